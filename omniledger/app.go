@@ -59,7 +59,7 @@ func create(c *cli.Context) error {
 
 	client := service.NewClient()
 	signer := darc.NewSignerEd25519(kp.Public, kp.Private)
-	msg, err := service.DefaultGenesisMsg(service.CurrentVersion, group.Roster, []string{"Spawn_dummy"}, signer.Identity())
+	msg, err := service.DefaultGenesisMsg(service.CurrentVersion, group.Roster, []string{"Spawn_value", "Invoke_update", "Delete"}, signer.Identity())
 	if err != nil {
 		return err
 	}
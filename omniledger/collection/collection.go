@@ -5,12 +5,19 @@
 // distributed and decentralized ledgers with minimal bootstrapping time.
 package collection
 
+import "crypto/sha256"
+
 // Collection represents the Merkle-tree based data structure.
 // The data is defined by a pointer to its root.
 type Collection struct {
 	root   *node
 	fields []Field
 	scope  scope
+	store  NodeStore
+	// stored is the label of the root this collection loaded from or last
+	// wrote to the store. It is shared by the copies of the collection, but
+	// not by its clones.
+	stored *[sha256.Size]byte
 
 	autoCollect flag
 	transaction struct {
@@ -67,6 +74,7 @@ func NewVerifier(fields ...Field) (verifier Collection) {
 
 // Clone returns a deep copy of the collection.
 // Note that the transaction id are restarted from 0 for the copy.
+// A clone of a collection with a store never releases nodes from the store.
 func (c *Collection) Clone() (collection Collection) {
 	if c.transaction.ongoing {
 		panic("Cannot clone a collection while a transaction is ongoing.")
@@ -79,6 +87,7 @@ func (c *Collection) Clone() (collection Collection) {
 
 	collection.scope = c.scope.clone()
 	collection.autoCollect = c.autoCollect
+	collection.store = c.store
 
 	collection.transaction.ongoing = false
 	collection.transaction.id = 0
@@ -107,8 +116,20 @@ func (c *Collection) Clone() (collection Collection) {
 	return
 }
 
+// SetAutoCollect defines whether End collects the nodes out of the scope.
+// For a collection with a store, disabling it keeps the nodes touched by
+// transactions in memory until the next call to Collect.
+func (c *Collection) SetAutoCollect(enabled bool) {
+	if enabled {
+		c.autoCollect.Enable()
+	} else {
+		c.autoCollect.Disable()
+	}
+}
+
 // GetRoot returns the root hash of the collection, which cryptographically
 // represents the whole set of key/value pairs in the collection.
 func (c *Collection) GetRoot() []byte {
-	return c.root.key
+	label := c.root.label
+	return label[:]
 }
@@ -35,6 +35,10 @@ func (g Getter) Record() (Record, error) {
 	cursor := g.collection.root
 
 	for {
+		err := g.collection.fetch(cursor)
+		if err != nil {
+			return Record{}, err
+		}
 		if !(cursor.known) {
 			return Record{}, errors.New("record lies in an unknown subtree")
 		}
@@ -67,6 +71,10 @@ func (g Getter) Proof() (Proof, error) {
 	proof.collection = g.collection
 	proof.Key = g.key
 
+	err := g.collection.fetch(g.collection.root)
+	if err != nil {
+		return proof, err
+	}
 	proof.Root = dumpNode(g.collection.root)
 
 	path := sha256.Sum256(g.key)
@@ -79,6 +87,10 @@ func (g Getter) Proof() (Proof, error) {
 	}
 
 	for {
+		err = g.collection.fetchChildren(cursor)
+		if err != nil {
+			return proof, err
+		}
 		if !(cursor.children.left.known) || !(cursor.children.right.known) {
 			return proof, errors.New("record lies in unknown subtree")
 		}
@@ -102,3 +114,73 @@ func (g Getter) Proof() (Proof, error) {
 
 	return proof, nil
 }
+
+// Keys returns all keys of the collection whose path, the hash of the key,
+// starts with the first bits of prefix. Going through all prefixes of a given
+// length allows to read the whole collection in chunks.
+func (c *Collection) Keys(prefix []byte, bits int) ([][]byte, error) {
+	if (bits < 0) || (bits > 8*len(prefix)) {
+		return nil, errors.New("prefix is shorter than the number of bits")
+	}
+
+	depth := 0
+	cursor := c.root
+
+	for depth < bits {
+		err := c.fetch(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if !(cursor.known) {
+			return nil, errors.New("keys lie in an unknown subtree")
+		}
+
+		if cursor.leaf() {
+			break
+		}
+		if bit(prefix, depth) {
+			cursor = cursor.children.right
+		} else {
+			cursor = cursor.children.left
+		}
+
+		depth++
+	}
+
+	var keys [][]byte
+
+	var explore func(*node) error
+	explore = func(node *node) error {
+		err := c.fetch(node)
+		if err != nil {
+			return err
+		}
+		if !(node.known) {
+			return errors.New("keys lie in an unknown subtree")
+		}
+
+		if node.leaf() {
+			if node.placeholder() {
+				return nil
+			}
+			path := sha256.Sum256(node.key)
+			if match(path[:], prefix, bits) {
+				keys = append(keys, append([]byte{}, node.key...))
+			}
+			return nil
+		}
+
+		err = explore(node.children.left)
+		if err != nil {
+			return err
+		}
+		return explore(node.children.right)
+	}
+
+	err := explore(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
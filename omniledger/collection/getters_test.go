@@ -164,3 +164,62 @@ func TestGettersProof(test *testing.T) {
 		test.Error("[getters.go]", "[proof]", "Proof() does not yield an error when querying a tree with unknown root.")
 	}
 }
+
+func TestGettersKeys(test *testing.T) {
+	collection := New()
+
+	if keys, _ := collection.Keys([]byte{}, 0); len(keys) != 0 {
+		test.Error("[getters.go]", "[keys]", "Keys() returns keys of an empty collection.")
+	}
+
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key)
+	}
+
+	for bits := 0; bits <= 10; bits += 5 {
+		found := make(map[uint64]bool)
+
+		for chunk := 0; chunk < (1 << uint(bits)); chunk++ {
+			prefix := make([]byte, 2)
+			binary.BigEndian.PutUint16(prefix, uint16(chunk<<uint(16-bits)))
+
+			keys, err := collection.Keys(prefix, bits)
+			if err != nil {
+				test.Fatal("[getters.go]", "[keys]", err)
+			}
+
+			for _, key := range keys {
+				path := sha256.Sum256(key)
+				if !match(path[:], prefix, bits) {
+					test.Error("[getters.go]", "[keys]", "Keys() returns a key with another prefix.")
+				}
+
+				index := binary.BigEndian.Uint64(key)
+				if found[index] {
+					test.Error("[getters.go]", "[keys]", "Keys() returns the same key twice.")
+				}
+				found[index] = true
+			}
+		}
+
+		if len(found) != 512 {
+			test.Error("[getters.go]", "[keys]", "Keys() doesn't return all keys of the collection.")
+		}
+	}
+
+	_, err := collection.Keys([]byte{0}, 9)
+	if err == nil {
+		test.Error("[getters.go]", "[keys]", "Keys() accepts a prefix shorter than the number of bits.")
+	}
+
+	collection.scope.None()
+	collection.Collect()
+
+	_, err = collection.Keys([]byte{}, 0)
+	if err == nil {
+		test.Error("[getters.go]", "[keys]", "Keys() doesn't yield an error on unknown subtree.")
+	}
+}
@@ -33,11 +33,19 @@ func (c *Collection) Add(key []byte, values ...interface{}) error {
 	depth := 0
 	cursor := c.root
 
+	err := c.fetch(cursor)
+	if err != nil {
+		return err
+	}
 	if !(cursor.known) {
 		return errors.New("applying update to unknown subtree. Proof needed")
 	}
 
 	for {
+		err = c.fetchChildren(cursor)
+		if err != nil {
+			return err
+		}
 		if !(cursor.children.left.known) || !(cursor.children.right.known) {
 			return errors.New("applying update to unknown subtree. Proof needed")
 		}
@@ -113,7 +121,7 @@ func (c *Collection) Add(key []byte, values ...interface{}) error {
 	}
 
 	if !(c.transaction.ongoing) {
-		c.Collect()
+		return c.Collect()
 	}
 
 	return nil
@@ -131,11 +139,19 @@ func (c *Collection) Set(key []byte, values ...interface{}) error {
 	depth := 0
 	cursor := c.root
 
+	err := c.fetch(cursor)
+	if err != nil {
+		return err
+	}
 	if !(cursor.known) {
 		return errors.New("applying update to unknown subtree. Proof needed")
 	}
 
 	for {
+		err = c.fetchChildren(cursor)
+		if err != nil {
+			return err
+		}
 		if !(cursor.children.left.known) || !(cursor.children.right.known) {
 			return errors.New("applying update to unknown subtree. Proof needed")
 		}
@@ -186,7 +202,7 @@ func (c *Collection) Set(key []byte, values ...interface{}) error {
 	}
 
 	if !(c.transaction.ongoing) {
-		c.Collect()
+		return c.Collect()
 	}
 
 	return nil
@@ -221,11 +237,19 @@ func (c *Collection) Remove(key []byte) error {
 	depth := 0
 	cursor := c.root
 
+	err := c.fetch(cursor)
+	if err != nil {
+		return err
+	}
 	if !(cursor.known) {
 		return errors.New("applying update to unknown subtree. Proof needed")
 	}
 
 	for {
+		err = c.fetchChildren(cursor)
+		if err != nil {
+			return err
+		}
 		if !(cursor.children.left.known) || !(cursor.children.right.known) {
 			return errors.New("applying update to unknown subtree. Proof needed")
 		}
@@ -288,7 +312,7 @@ func (c *Collection) Remove(key []byte) error {
 	}
 
 	if !(c.transaction.ongoing) {
-		c.Collect()
+		return c.Collect()
 	}
 
 	return nil
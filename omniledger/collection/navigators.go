@@ -29,6 +29,10 @@ func (n Navigator) Record() (Record, error) {
 	cursor := n.collection.root
 
 	for {
+		err := n.collection.fetch(cursor)
+		if err != nil {
+			return Record{}, err
+		}
 		if !(cursor.known) {
 			return Record{}, errors.New("record lies in an unknown subtree")
 		}
@@ -36,6 +40,10 @@ func (n Navigator) Record() (Record, error) {
 		if cursor.leaf() {
 			return recordQueryMatch(n.collection, n.field, n.query, cursor), nil
 		}
+		err = n.collection.fetchChildren(cursor)
+		if err != nil {
+			return Record{}, err
+		}
 		if !(cursor.children.left.known) || !(cursor.children.right.known) {
 			return Record{}, errors.New("record lies in an unknown subtree")
 		}
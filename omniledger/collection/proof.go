@@ -99,7 +99,7 @@ type Proof struct {
 
 // TreeRootHash returns the hash of the merkle tree root.
 func (p Proof) TreeRootHash() []byte {
-	return p.Root.Key
+	return p.Root.Label[:]
 }
 
 // Methods
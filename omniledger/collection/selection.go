@@ -0,0 +1,167 @@
+package collection
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// selectionMaxDraws bounds the number of draws per selected record. If the
+// stakes are so unbalanced that some records cannot be drawn in time, the
+// selection fails.
+const selectionMaxDraws = 32
+
+// Methods (collection) (selection)
+
+// Select draws k distinct records of the collection, each with a probability
+// proportional to its value of the Stake64 field field. The draws are
+// derived from seed, for example the collective signature of a block, so
+// that anybody knowing the seed and the root of the collection can verify
+// the selection with VerifySelection.
+// It returns the proofs of the records of all draws, in order. A record that
+// is drawn again is not selected again, so there can be more than k proofs.
+func (c *Collection) Select(field int, seed []byte, k int) ([]Proof, error) {
+	if (field < 0) || (field >= len(c.fields)) {
+		return nil, errors.New("field unknown")
+	}
+	if _, ok := c.fields[field].(Stake64); !ok {
+		return nil, errors.New("field is not a Stake64")
+	}
+	if k <= 0 {
+		return nil, errors.New("nothing to select")
+	}
+
+	err := c.fetch(c.root)
+	if err != nil {
+		return nil, err
+	}
+	total, err := Stake64{}.Decode(c.root.values[field])
+	if err != nil {
+		return nil, err
+	}
+	if total.(uint64) == 0 {
+		return nil, errors.New("collection holds no stake")
+	}
+
+	var proofs []Proof
+	selected := make(map[string]bool)
+
+	for draw := 0; len(selected) < k; draw++ {
+		if draw >= selectionMaxDraws*k {
+			return nil, errors.New("not enough stakeholders")
+		}
+
+		record, err := c.Navigate(field, drawQuery(seed, draw, total.(uint64))).Record()
+		if err != nil {
+			return nil, err
+		}
+		proof, err := c.Get(record.Key()).Proof()
+		if err != nil {
+			return nil, err
+		}
+
+		proofs = append(proofs, proof)
+		selected[string(record.Key())] = true
+	}
+
+	return proofs, nil
+}
+
+// VerifySelection verifies that proofs are the draws of Select for k records
+// from the collection with the given root, using the Stake64 field field and
+// the given seed. It returns the keys of the selected records, in the order
+// they have been drawn.
+func VerifySelection(root []byte, field int, seed []byte, k int, proofs []Proof) ([][]byte, error) {
+	if k <= 0 {
+		return nil, errors.New("nothing to select")
+	}
+	if len(proofs) > selectionMaxDraws*k {
+		return nil, errors.New("too many draws")
+	}
+
+	var keys [][]byte
+	selected := make(map[string]bool)
+
+	for draw, proof := range proofs {
+		if len(selected) == k {
+			return nil, errors.New("too many draws")
+		}
+		if !equal(proof.TreeRootHash(), root) {
+			return nil, errors.New("proof is for another root")
+		}
+		if !(proof.Consistent()) || !(proof.Match()) {
+			return nil, errors.New("invalid proof")
+		}
+		if field < 0 || field >= len(proof.Root.Values) {
+			return nil, errors.New("field unknown")
+		}
+		total, err := Stake64{}.Decode(proof.Root.Values[field])
+		if err != nil {
+			return nil, err
+		}
+		if total.(uint64) == 0 {
+			return nil, errors.New("collection holds no stake")
+		}
+
+		err = proof.navigates(field, Stake64{}.Encode(drawQuery(seed, draw, total.(uint64))))
+		if err != nil {
+			return nil, err
+		}
+
+		if !selected[string(proof.Key)] {
+			selected[string(proof.Key)] = true
+			keys = append(keys, proof.Key)
+		}
+	}
+
+	if len(selected) < k {
+		return nil, errors.New("not enough draws")
+	}
+
+	return keys, nil
+}
+
+// drawQuery returns the stake queried by the given draw: a number between 0
+// and total, derived from the seed. As total is much smaller than 2^64, the
+// bias of the modulo can be neglected.
+func drawQuery(seed []byte, draw int, total uint64) uint64 {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, uint64(draw))
+
+	hash := sha256.Sum256(append(append([]byte{}, seed...), buffer...))
+	return binary.BigEndian.Uint64(hash[:8]) % total
+}
+
+// Methods (proof) (selection)
+
+// navigates returns an error if navigating the collection with the query of
+// the Stake64 field field doesn't follow the steps of a consistent proof.
+func (p Proof) navigates(field int, query []byte) error {
+	var stake Stake64
+
+	cursor := &(p.Root)
+	path := sha256.Sum256(p.Key)
+
+	for depth := 0; depth < len(p.Steps); depth++ {
+		left, right := &(p.Steps[depth].Left), &(p.Steps[depth].Right)
+		if (field >= len(cursor.Values)) || (field >= len(left.Values)) || (field >= len(right.Values)) {
+			return errors.New("field unknown")
+		}
+
+		navigation, err := stake.Navigate(query, cursor.Values[field], left.Values[field], right.Values[field])
+		if err != nil {
+			return err
+		}
+		if navigation != bit(path[:], depth) {
+			return errors.New("draw doesn't lead to the record")
+		}
+
+		if navigation == Right {
+			cursor = right
+		} else {
+			cursor = left
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package collection
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestSelectionSelect(test *testing.T) {
+	stake64 := Stake64{}
+	data := Data{}
+	collection := New(data, stake64)
+
+	for index := 0; index < 64; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		// Every fourth record has no stake and must never be selected.
+		collection.Add(key, []byte{}, uint64((index%4)*index))
+	}
+
+	root := collection.GetRoot()
+	seed := []byte("seed")
+
+	proofs, err := collection.Select(1, seed, 10)
+	if err != nil {
+		test.Fatal("[selection.go]", "[select]", err)
+	}
+
+	keys, err := VerifySelection(root, 1, seed, 10, proofs)
+	if err != nil {
+		test.Fatal("[selection.go]", "[select]", "VerifySelection() rejects a valid selection:", err)
+	}
+
+	if len(keys) != 10 {
+		test.Error("[selection.go]", "[select]", "VerifySelection() returns the wrong number of keys.")
+	}
+
+	found := make(map[uint64]bool)
+	for _, key := range keys {
+		index := binary.BigEndian.Uint64(key)
+		if index%4 == 0 {
+			test.Error("[selection.go]", "[select]", "Select() selects a record without stake.")
+		}
+		if found[index] {
+			test.Error("[selection.go]", "[select]", "Select() selects the same record twice.")
+		}
+		found[index] = true
+	}
+
+	again, _ := collection.Select(1, seed, 10)
+	if len(again) != len(proofs) {
+		test.Error("[selection.go]", "[select]", "Select() is not deterministic.")
+	}
+	for index := range again {
+		if !equal(again[index].Key, proofs[index].Key) {
+			test.Error("[selection.go]", "[select]", "Select() is not deterministic.")
+		}
+	}
+
+	if _, err := collection.Select(0, seed, 1); err == nil {
+		test.Error("[selection.go]", "[select]", "Select() doesn't yield an error on a field that is not a Stake64.")
+	}
+
+	if _, err := collection.Select(1, seed, 49); err == nil {
+		test.Error("[selection.go]", "[select]", "Select() doesn't yield an error when selecting more records than there are stakeholders.")
+	}
+
+	empty := New(stake64)
+	if _, err := empty.Select(0, seed, 1); err == nil {
+		test.Error("[selection.go]", "[select]", "Select() doesn't yield an error on a collection without stake.")
+	}
+}
+
+func TestSelectionVerifySelection(test *testing.T) {
+	stake64 := Stake64{}
+	collection := New(stake64)
+
+	for index := 0; index < 64; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		collection.Add(key, uint64(index+1))
+	}
+
+	root := collection.GetRoot()
+	seed := []byte("seed")
+
+	proofs, err := collection.Select(0, seed, 5)
+	if err != nil {
+		test.Fatal("[selection.go]", "[verifyselection]", err)
+	}
+
+	if _, err := VerifySelection(root, 0, []byte("other seed"), 5, proofs); err == nil {
+		test.Error("[selection.go]", "[verifyselection]", "VerifySelection() accepts a selection with another seed.")
+	}
+
+	if _, err := VerifySelection(root, 0, seed, 5, proofs[1:]); err == nil {
+		test.Error("[selection.go]", "[verifyselection]", "VerifySelection() accepts a selection with a missing draw.")
+	}
+
+	if _, err := VerifySelection(root, 0, seed, 4, proofs); err == nil {
+		test.Error("[selection.go]", "[verifyselection]", "VerifySelection() accepts a selection with too many draws.")
+	}
+
+	// A record that exists but hasn't been drawn.
+	other, _ := collection.Get(proofs[1].Key).Proof()
+	forged := append([]Proof{other}, proofs[1:]...)
+	if !equal(other.Key, proofs[0].Key) {
+		if _, err := VerifySelection(root, 0, seed, 5, forged); err == nil {
+			test.Error("[selection.go]", "[verifyselection]", "VerifySelection() accepts a record that hasn't been drawn.")
+		}
+	}
+
+	collection.Add([]byte("new"), uint64(1000))
+	if _, err := VerifySelection(collection.GetRoot(), 0, seed, 5, proofs); err == nil {
+		test.Error("[selection.go]", "[verifyselection]", "VerifySelection() accepts proofs for another root.")
+	}
+}
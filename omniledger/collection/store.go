@@ -0,0 +1,349 @@
+package collection
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/protobuf"
+)
+
+// NodeStore persistently stores the nodes of a collection. Every node is
+// stored under its label, so a node loaded from the store can always be
+// verified against the label its parent holds.
+//
+// As nodes with the same label are stored once, a node can be part of several
+// trees. The store counts the references to every node, so the nodes of a
+// replaced tree can be released without removing the nodes still in use.
+type NodeStore interface {
+	// Get returns the serialized node stored under the given label.
+	Get(label [sha256.Size]byte) ([]byte, error)
+	// Put stores all the serialized nodes, indexed by their label. A node
+	// that wasn't stored yet adds a reference to each of its children.
+	Put(nodes map[[sha256.Size]byte][]byte) error
+	// Release removes the node stored under the given label if nothing
+	// refers to it, and then releases the children it referred to.
+	Release(label [sha256.Size]byte) error
+}
+
+// Constructors
+
+// NewFromStore creates a collection whose nodes are kept in the store and only
+// loaded when an operation needs them. Every time the collection is collected,
+// the nodes in memory are written to the store and dropped, so only the root
+// label is kept between two operations. The nodes of the root that is replaced
+// are released, so the root of a collection that is still read by another
+// collection must be pinned, see BoltStore.Pin.
+// If root is empty, a new, empty collection is written to the store. Otherwise
+// the root node with the given label is loaded and verified.
+func NewFromStore(store NodeStore, root []byte, fields ...Field) (collection Collection, err error) {
+	if len(root) == 0 {
+		collection = New(fields...)
+		collection.store = store
+		collection.stored = new([sha256.Size]byte)
+		collection.scope.None()
+		err = collection.Collect()
+		return
+	}
+	if len(root) != sha256.Size {
+		return Collection{}, errors.New("wrong length of root label")
+	}
+
+	collection.fields = fields
+	collection.store = store
+	collection.stored = new([sha256.Size]byte)
+	copy(collection.stored[:], root)
+
+	collection.scope.None()
+	collection.autoCollect.Enable()
+
+	collection.root = new(node)
+	collection.root.known = false
+	copy(collection.root.label[:], root)
+
+	err = collection.fetch(collection.root)
+	return
+}
+
+// Private methods (collection) (store methods)
+
+// fetch loads an unknown node from the store. The node is only accepted if
+// its content corresponds to its label. If the collection has no store or the
+// node is already known, fetch does nothing.
+func (c *Collection) fetch(node *node) error {
+	if node.known || c.store == nil {
+		return nil
+	}
+
+	buffer, err := c.store.Get(node.label)
+	if err != nil {
+		return err
+	}
+
+	var stored dump
+	err = protobuf.Decode(buffer, &stored)
+	if err != nil {
+		return err
+	}
+	if stored.Label != node.label || !(stored.consistent()) {
+		return errors.New("stored node doesn't correspond to its label")
+	}
+
+	stored.to(node)
+	return nil
+}
+
+// fetchChildren loads both children of an internal node from the store.
+func (c *Collection) fetchChildren(node *node) error {
+	if node.leaf() {
+		return nil
+	}
+
+	err := c.fetch(node.children.left)
+	if err != nil {
+		return err
+	}
+	return c.fetch(node.children.right)
+}
+
+// flush writes all known nodes of the given subtrees to the store. If the root
+// of the collection is written, the root it replaces is released.
+func (c *Collection) flush(roots []*node) error {
+	if c.store == nil || len(roots) == 0 {
+		return nil
+	}
+
+	nodes := make(map[[sha256.Size]byte][]byte)
+
+	var explore func(*node) error
+	explore = func(node *node) error {
+		if !(node.known) {
+			return nil
+		}
+
+		stored := dumpNode(node)
+		buffer, err := protobuf.Encode(&stored)
+		if err != nil {
+			return err
+		}
+		nodes[node.label] = buffer
+
+		if !(node.leaf()) {
+			err = explore(node.children.left)
+			if err != nil {
+				return err
+			}
+			return explore(node.children.right)
+		}
+		return nil
+	}
+
+	for _, root := range roots {
+		err := explore(root)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.store.Put(nodes)
+	if err != nil {
+		return err
+	}
+
+	if c.stored == nil || roots[0] != c.root || *c.stored == c.root.label {
+		return nil
+	}
+	replaced := *c.stored
+	*c.stored = c.root.label
+	var empty [sha256.Size]byte
+	if replaced == empty {
+		return nil
+	}
+	return c.store.Release(replaced)
+}
+
+// BoltStore
+
+// refsBucket is the bucket, nested in the bucket of the nodes, that holds the
+// number of references to every node.
+var refsBucket = []byte("refs")
+
+// BoltStore is a NodeStore keeping the nodes in a bucket of a bbolt database.
+// A node is referred to by the stored nodes whose child it is, and by the
+// pins of its label.
+type BoltStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+// NewBoltStore returns a BoltStore using the given bucket, which is created
+// if it doesn't exist yet.
+func NewBoltStore(db *bolt.DB, bucket []byte) (*BoltStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		_, err = b.CreateBucketIfNotExists(refsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db, bucket}, nil
+}
+
+// Get returns a copy of the node stored under the label.
+func (s *BoltStore) Get(label [sha256.Size]byte) (buffer []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(s.bucket).Get(label[:])
+		if value == nil {
+			return errors.New("node not found in store")
+		}
+		buffer = make([]byte, len(value))
+		copy(buffer, value)
+		return nil
+	})
+	return
+}
+
+// Put stores all nodes in one bbolt transaction.
+func (s *BoltStore) Put(nodes map[[sha256.Size]byte][]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		refs := bucket.Bucket(refsBucket)
+		for label, buffer := range nodes {
+			l := label
+			known := bucket.Get(l[:]) != nil
+			err := bucket.Put(l[:], buffer)
+			if err != nil {
+				return err
+			}
+			if known {
+				continue
+			}
+			children, err := storedChildren(buffer)
+			if err != nil {
+				return err
+			}
+			for _, child := range children {
+				err = addRefs(refs, child, 1)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Release removes the node and all its descendants that are not referred to
+// anymore, in one bbolt transaction.
+func (s *BoltStore) Release(label [sha256.Size]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return releaseNode(tx.Bucket(s.bucket), label)
+	})
+}
+
+// Pin adds a reference to the node stored under the label, so it is kept
+// until it is unpinned, even if the collections that wrote it move on.
+func (s *BoltStore) Pin(label []byte) error {
+	if len(label) != sha256.Size {
+		return errors.New("wrong length of label")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var l [sha256.Size]byte
+		copy(l[:], label)
+		return addRefs(tx.Bucket(s.bucket).Bucket(refsBucket), l, 1)
+	})
+}
+
+// Unpin removes a reference added by Pin and releases the node if nothing
+// refers to it anymore.
+func (s *BoltStore) Unpin(label []byte) error {
+	if len(label) != sha256.Size {
+		return errors.New("wrong length of label")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var l [sha256.Size]byte
+		copy(l[:], label)
+		bucket := tx.Bucket(s.bucket)
+		err := addRefs(bucket.Bucket(refsBucket), l, -1)
+		if err != nil {
+			return err
+		}
+		return releaseNode(bucket, l)
+	})
+}
+
+// releaseNode removes the node if it is not referred to, and removes the
+// references it holds to its children, releasing them in turn.
+func releaseNode(bucket *bolt.Bucket, label [sha256.Size]byte) error {
+	refs := bucket.Bucket(refsBucket)
+	if countRefs(refs, label) > 0 {
+		return nil
+	}
+	buffer := bucket.Get(label[:])
+	if buffer == nil {
+		return nil
+	}
+	children, err := storedChildren(buffer)
+	if err != nil {
+		return err
+	}
+	err = bucket.Delete(label[:])
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		err = addRefs(refs, child, -1)
+		if err != nil {
+			return err
+		}
+		err = releaseNode(bucket, child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedChildren returns the labels of the children of a serialized node.
+func storedChildren(buffer []byte) ([][sha256.Size]byte, error) {
+	var stored dump
+	err := protobuf.Decode(buffer, &stored)
+	if err != nil {
+		return nil, err
+	}
+	if stored.leaf() {
+		return nil, nil
+	}
+	return [][sha256.Size]byte{stored.Children.Left, stored.Children.Right}, nil
+}
+
+// countRefs returns the number of references to the node.
+func countRefs(refs *bolt.Bucket, label [sha256.Size]byte) uint64 {
+	value := refs.Get(label[:])
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
+
+// addRefs adds delta to the number of references to the node. The number
+// never drops below zero, and is only stored while it is positive.
+func addRefs(refs *bolt.Bucket, label [sha256.Size]byte, delta int) error {
+	count := countRefs(refs, label)
+	switch {
+	case delta >= 0:
+		count += uint64(delta)
+	case count > uint64(-delta):
+		count -= uint64(-delta)
+	default:
+		return refs.Delete(label[:])
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, count)
+	return refs.Put(label[:], value)
+}
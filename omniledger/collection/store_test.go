@@ -0,0 +1,293 @@
+package collection
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+func testBoltStore(test *testing.T) (*BoltStore, func()) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	if err != nil {
+		test.Fatal(err)
+	}
+	tmpDB.Close()
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	store, err := NewBoltStore(db, []byte("nodes"))
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	return store, func() {
+		db.Close()
+		os.Remove(tmpDB.Name())
+	}
+}
+
+func TestStoreNewFromStore(test *testing.T) {
+	store, cleanup := testBoltStore(test)
+	defer cleanup()
+
+	stake64 := Stake64{}
+	data := Data{}
+
+	collection, err := NewFromStore(store, nil, stake64, data)
+	if err != nil {
+		test.Fatal("[store.go]", "[new]", err)
+	}
+	reference := New(stake64, data)
+
+	if collection.root.known {
+		test.Error("[store.go]", "[new]", "Root of a new stored collection stays in memory.")
+	}
+
+	if !equal(collection.GetRoot(), reference.GetRoot()) {
+		test.Error("[store.go]", "[new]", "Empty stored collection has a different root.")
+	}
+
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		err = collection.Add(key, uint64(index), key)
+		if err != nil {
+			test.Fatal("[store.go]", "[add]", err)
+		}
+		reference.Add(key, uint64(index), key)
+
+		if collection.root.known {
+			test.Error("[store.go]", "[add]", "Add() doesn't write the nodes to the store.")
+		}
+	}
+
+	for index := 0; index < 512; index += 3 {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		err = collection.Set(key, uint64(2*index), key)
+		if err != nil {
+			test.Fatal("[store.go]", "[set]", err)
+		}
+		reference.Set(key, uint64(2*index), key)
+	}
+
+	for index := 1; index < 512; index += 3 {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		err = collection.Remove(key)
+		if err != nil {
+			test.Fatal("[store.go]", "[remove]", err)
+		}
+		reference.Remove(key)
+	}
+
+	if !equal(collection.GetRoot(), reference.GetRoot()) {
+		test.Error("[store.go]", "[root]", "Stored collection and in-memory collection have different roots.")
+	}
+
+	reloaded, err := NewFromStore(store, collection.GetRoot(), stake64, data)
+	if err != nil {
+		test.Fatal("[store.go]", "[reload]", err)
+	}
+
+	for index := 0; index < 512; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+
+		record, err := reloaded.Get(key).Record()
+		if err != nil {
+			test.Fatal("[store.go]", "[get]", err)
+		}
+
+		if (index % 3) == 1 {
+			if record.Match() {
+				test.Error("[store.go]", "[get]", "Removed key is still in the stored collection.")
+			}
+			continue
+		}
+
+		values, err := record.Values()
+		if err != nil {
+			test.Fatal("[store.go]", "[get]", err)
+		}
+
+		expected := uint64(index)
+		if (index % 3) == 0 {
+			expected = uint64(2 * index)
+		}
+		if values[0].(uint64) != expected {
+			test.Error("[store.go]", "[get]", "Wrong value loaded from the store.")
+		}
+
+		proof, err := reloaded.Get(key).Proof()
+		if err != nil {
+			test.Fatal("[store.go]", "[proof]", err)
+		}
+		if !(proof.Match()) || !(reference.Verify(proof)) {
+			test.Error("[store.go]", "[proof]", "Proof of a stored collection doesn't verify.")
+		}
+	}
+
+	navigated, err := reloaded.Navigate(0, uint64(100)).Record()
+	if err != nil {
+		test.Fatal("[store.go]", "[navigate]", err)
+	}
+	expected, _ := reference.Navigate(0, uint64(100)).Record()
+	if !equal(navigated.Key(), expected.Key()) {
+		test.Error("[store.go]", "[navigate]", "Navigate() on a stored collection finds another record.")
+	}
+
+	clone := reloaded.Clone()
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(1024))
+	err = clone.Add(key, uint64(1024), key)
+	if err != nil {
+		test.Fatal("[store.go]", "[clone]", err)
+	}
+
+	if equal(clone.GetRoot(), reloaded.GetRoot()) || !equal(reloaded.GetRoot(), reference.GetRoot()) {
+		test.Error("[store.go]", "[clone]", "Modifying a clone alters the stored collection.")
+	}
+}
+
+func TestStoreCorrupted(test *testing.T) {
+	store, cleanup := testBoltStore(test)
+	defer cleanup()
+
+	collection, err := NewFromStore(store, nil, Data{})
+	if err != nil {
+		test.Fatal("[store.go]", "[new]", err)
+	}
+
+	for index := 0; index < 64; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		collection.Add(key, key)
+	}
+
+	var unknown [sha256.Size]byte
+	_, err = NewFromStore(store, unknown[:], Data{})
+	if err == nil {
+		test.Error("[store.go]", "[missing]", "NewFromStore() accepts a missing root.")
+	}
+
+	var root [sha256.Size]byte
+	copy(root[:], collection.GetRoot())
+	err = store.Put(map[[sha256.Size]byte][]byte{root: []byte("corrupted")})
+	if err != nil {
+		test.Fatal("[store.go]", "[put]", err)
+	}
+
+	_, err = NewFromStore(store, root[:], Data{})
+	if err == nil {
+		test.Error("[store.go]", "[corrupted]", "NewFromStore() accepts a corrupted root.")
+	}
+
+	key := make([]byte, 8)
+	_, err = collection.Get(key).Record()
+	if err == nil {
+		test.Error("[store.go]", "[corrupted]", "Get() accepts a corrupted node.")
+	}
+}
+
+func TestStoreRelease(test *testing.T) {
+	store, cleanup := testBoltStore(test)
+	defer cleanup()
+
+	stored := func() (count int) {
+		store.db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(store.bucket).ForEach(func(k, v []byte) error {
+				if v != nil {
+					count++
+				}
+				return nil
+			})
+		})
+		return
+	}
+
+	collection, err := NewFromStore(store, nil, Data{})
+	if err != nil {
+		test.Fatal("[store.go]", "[new]", err)
+	}
+
+	for index := 0; index < 64; index++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(index))
+		err = collection.Add(key, key)
+		if err != nil {
+			test.Fatal("[store.go]", "[add]", err)
+		}
+	}
+	size := stored()
+
+	key := make([]byte, 8)
+	for index := 0; index < 256; index++ {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(index))
+		err = collection.Set(key, value)
+		if err != nil {
+			test.Fatal("[store.go]", "[set]", err)
+		}
+	}
+	if stored() > size+1 {
+		test.Error("[store.go]", "[release]", "Replaced nodes are kept in the store.")
+	}
+
+	// A pinned root is kept until it is unpinned.
+	pinned := collection.GetRoot()
+	err = store.Pin(pinned)
+	if err != nil {
+		test.Fatal("[store.go]", "[pin]", err)
+	}
+	err = collection.Set(key, key)
+	if err != nil {
+		test.Fatal("[store.go]", "[set]", err)
+	}
+	reloaded, err := NewFromStore(store, pinned, Data{})
+	if err != nil {
+		test.Fatal("[store.go]", "[pin]", err)
+	}
+	record, err := reloaded.Get(key).Record()
+	if err != nil || !(record.Match()) {
+		test.Error("[store.go]", "[pin]", "Nodes of a pinned root are released.")
+	}
+
+	err = store.Unpin(pinned)
+	if err != nil {
+		test.Fatal("[store.go]", "[unpin]", err)
+	}
+	_, err = NewFromStore(store, pinned, Data{})
+	if err == nil {
+		test.Error("[store.go]", "[unpin]", "Nodes of an unpinned root are kept.")
+	}
+	if stored() > size+1 {
+		test.Error("[store.go]", "[unpin]", "Unpinned nodes are kept in the store.")
+	}
+
+	// All other keys are still in the store.
+	reloaded, err = NewFromStore(store, collection.GetRoot(), Data{})
+	if err != nil {
+		test.Fatal("[store.go]", "[reload]", err)
+	}
+	for index := 0; index < 64; index++ {
+		binary.BigEndian.PutUint64(key, uint64(index))
+		record, err := reloaded.Get(key).Record()
+		if err != nil {
+			test.Fatal("[store.go]", "[get]", err)
+		}
+		if !(record.Match()) {
+			test.Error("[store.go]", "[get]", "Released nodes are still in use.")
+		}
+	}
+}
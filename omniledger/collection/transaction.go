@@ -50,6 +50,8 @@ func (c *Collection) End() {
 	c.fix()
 
 	if c.autoCollect.value {
+		// If the nodes cannot be written to the store, they are kept in
+		// memory until the next successful Collect.
 		c.Collect()
 	}
 
@@ -59,7 +61,18 @@ func (c *Collection) End() {
 
 // Collect performs the garbage collection of the nodes out of the scope.
 // It removes all nodes that are meant to be stored temporarily.
-func (c *Collection) Collect() {
+// If the scope covers the whole collection, there is nothing to collect and
+// the tree is not explored at all, so the cost of a transaction stays
+// proportional to the nodes it touches.
+// If the collection has a store, the removed nodes are written to the store
+// first. If that fails, no node is removed and the error is returned.
+func (c *Collection) Collect() error {
+	if c.scope.all && len(c.scope.masks) == 0 {
+		return nil
+	}
+
+	var collected []*node
+
 	var explore func(*node, [sha256.Size]byte, int)
 	explore = func(node *node, path [sha256.Size]byte, bit int) {
 		if !(node.known) {
@@ -67,11 +80,7 @@ func (c *Collection) Collect() {
 		}
 
 		if bit > 0 && !(c.scope.match(path, bit-1)) {
-			node.known = false
-			node.key = []byte{}
-			node.values = [][]byte{}
-
-			node.prune()
+			collected = append(collected, node)
 		} else if !(node.leaf()) {
 			setBit(path[:], bit+1, false)
 			explore(node.children.left, path, bit+1)
@@ -82,7 +91,7 @@ func (c *Collection) Collect() {
 	}
 
 	if !(c.root.known) {
-		return
+		return nil
 	}
 
 	var path [sha256.Size]byte
@@ -99,11 +108,7 @@ func (c *Collection) Collect() {
 	}
 
 	if none {
-		c.root.known = false
-		c.root.key = []byte{}
-		c.root.values = [][]byte{}
-
-		c.root.prune()
+		collected = []*node{c.root}
 	} else {
 		setBit(path[:], 0, false)
 		explore(c.root.children.left, path, 0)
@@ -111,6 +116,21 @@ func (c *Collection) Collect() {
 		setBit(path[:], 0, true)
 		explore(c.root.children.right, path, 0)
 	}
+
+	err := c.flush(collected)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range collected {
+		node.known = false
+		node.key = []byte{}
+		node.values = [][]byte{}
+
+		node.prune()
+	}
+
+	return nil
 }
 
 // Private methods (collection) (transaction methods)
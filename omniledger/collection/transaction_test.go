@@ -338,3 +338,67 @@ func TestTransactionFix(test *testing.T) {
 
 	ctx.verify.tree("[fix]", &collection)
 }
+
+// benchmarkKeys is the number of keys in the collection used by the
+// benchmarks below.
+const benchmarkKeys = 1000000
+
+var benchmarkCollection *Collection
+
+// millionCollection returns a collection holding benchmarkKeys keys. It is
+// only created once, as filling it takes a while.
+func millionCollection(b *testing.B) *Collection {
+	if benchmarkCollection == nil {
+		collection := New(Data{})
+		collection.Begin()
+		for index := 0; index < benchmarkKeys; index++ {
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(index))
+			collection.Add(key, key)
+		}
+		collection.End()
+		benchmarkCollection = &collection
+	}
+	b.ResetTimer()
+	return benchmarkCollection
+}
+
+func BenchmarkTransactionClone(b *testing.B) {
+	collection := millionCollection(b)
+
+	for i := 0; i < b.N; i++ {
+		clone := collection.Clone()
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(benchmarkKeys+i))
+		clone.Add(key, key)
+	}
+}
+
+func BenchmarkTransactionRollback(b *testing.B) {
+	collection := millionCollection(b)
+
+	for i := 0; i < b.N; i++ {
+		collection.Begin()
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(benchmarkKeys+i))
+		collection.Add(key, key)
+		binary.BigEndian.PutUint64(key, uint64(i%benchmarkKeys))
+		collection.Set(key, []byte("new value"))
+		collection.Rollback()
+	}
+}
+
+func BenchmarkTransactionEnd(b *testing.B) {
+	collection := millionCollection(b)
+
+	for i := 0; i < b.N; i++ {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(benchmarkKeys+i))
+		collection.Begin()
+		collection.Add(key, key)
+		collection.End()
+		collection.Begin()
+		collection.Remove(key)
+		collection.End()
+	}
+}
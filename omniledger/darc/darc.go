@@ -440,6 +440,23 @@ func (r *Request) Verify(d *Darc) error {
 	})
 }
 
+// VerifyIdentities checks whether the identities may do the action in the
+// darc. Unlike a request, no signatures are checked: the caller is
+// responsible for making sure that the identities agreed to the action.
+func (d *Darc) VerifyIdentities(a Action, ids []Identity, getDarc func(string) *Darc) error {
+	if len(ids) == 0 {
+		return errors.New("no identities - nothing to verify")
+	}
+	if !d.Rules.Contains(a) {
+		return fmt.Errorf("action '%v' does not exist", a)
+	}
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return evalExpr(d.Rules[a], getDarc, strs...)
+}
+
 // String returns a human-readable string representation of the darc.
 func (d Darc) String() string {
 	s := fmt.Sprintf("ID:\t%x\nBase:\t%x\nVer:\t%d\nRules:", d.GetID(), d.GetBaseID(), d.Version)
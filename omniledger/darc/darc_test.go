@@ -278,6 +278,20 @@ func TestDarc_Rules(t *testing.T) {
 	require.NotNil(t, r.Verify(d))
 }
 
+func TestDarc_VerifyIdentities(t *testing.T) {
+	d := createDarc(1, "testdarc").darc
+	user1 := NewSignerEd25519(nil, nil)
+	user2 := NewSignerEd25519(nil, nil)
+	err := d.Rules.AddRule("use", expression.InitAndExpr(user1.Identity().String(), user2.Identity().String()))
+	require.Nil(t, err)
+	noDarc := func(string) *Darc { return nil }
+
+	require.Nil(t, d.VerifyIdentities("use", []Identity{*user1.Identity(), *user2.Identity()}, noDarc))
+	require.NotNil(t, d.VerifyIdentities("use", []Identity{*user1.Identity()}, noDarc))
+	require.NotNil(t, d.VerifyIdentities("go", []Identity{*user1.Identity(), *user2.Identity()}, noDarc))
+	require.NotNil(t, d.VerifyIdentities("use", nil, noDarc))
+}
+
 func TestDarc_EvolveRequest(t *testing.T) {
 	td := createDarc(1, "testdarc")
 	require.Nil(t, td.darc.Verify())
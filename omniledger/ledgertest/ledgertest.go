@@ -0,0 +1,147 @@
+// Package ledgertest offers an in-memory ledger to test contracts. It
+// verifies and executes ClientTransactions like the omniledger service does,
+// but in a single process and without skipchain: every call to Apply executes
+// its transactions as one block, before returning.
+package ledgertest
+
+import (
+	"bytes"
+	"errors"
+
+	"gopkg.in/dedis/onet.v2"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+	"student_18_byzcoin/omniledger/service"
+)
+
+// Ledger is a single-process ledger. The methods of the embedded Executor
+// give access to the state.
+type Ledger struct {
+	*service.Executor
+	// Signer is an owner of the genesis darc and can sign for all its
+	// rules.
+	Signer *darc.Signer
+	// Darc is the genesis darc.
+	Darc darc.Darc
+	// Receipts holds the receipts of all ClientTransactions applied so
+	// far, in order.
+	Receipts []service.Receipt
+}
+
+// New creates a ledger whose genesis darc allows the given rules, like
+// "Spawn_value", to a new Signer.
+func New(rules ...string) (*Ledger, error) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesis, err := service.DefaultGenesisMsg(service.CurrentVersion, &onet.Roster{}, rules, signer.Identity())
+	if err != nil {
+		return nil, err
+	}
+	return NewFromGenesis(genesis, signer)
+}
+
+// NewFromGenesis creates a ledger from the genesis request, which allows to
+// set a reward account or limits. The signer should be allowed by the
+// genesis darc.
+func NewFromGenesis(genesis *service.CreateGenesisBlock, signer *darc.Signer) (*Ledger, error) {
+	e, err := service.NewExecutor(genesis)
+	if err != nil {
+		return nil, err
+	}
+	return &Ledger{Executor: e, Signer: signer, Darc: genesis.GenesisDarc}, nil
+}
+
+// NewObjectID returns a new ObjectID governed by the genesis darc.
+func (l *Ledger) NewObjectID() service.ObjectID {
+	return service.ObjectID{DarcID: l.Darc.GetBaseID(), InstanceID: service.GenNonce()}
+}
+
+// Sign puts the instructions in a ClientTransaction and signs them and their
+// coin inputs with the Signer.
+func (l *Ledger) Sign(instrs ...service.Instruction) (service.ClientTransaction, error) {
+	for i := range instrs {
+		instrs[i].Index, instrs[i].Length = i, len(instrs)
+		if err := instrs[i].SignBy(l.Signer); err != nil {
+			return service.ClientTransaction{}, err
+		}
+		for j := range instrs[i].Coins {
+			if err := instrs[i].SignCoinInput(j, l.Signer); err != nil {
+				return service.ClientTransaction{}, err
+			}
+		}
+	}
+	return service.ClientTransaction{Instructions: instrs}, nil
+}
+
+// Apply executes the ClientTransactions as the next block and returns their
+// receipts, in the same order. A refused ClientTransaction is not an error,
+// its receipt holds the reason.
+func (l *Ledger) Apply(cts ...service.ClientTransaction) ([]service.Receipt, error) {
+	receipts, err := l.Executor.Apply(cts...)
+	if err != nil {
+		return nil, err
+	}
+	l.Receipts = append(l.Receipts, receipts...)
+	return receipts, nil
+}
+
+// Run signs the instructions and applies them as a block holding a single
+// ClientTransaction. It returns an error if the ClientTransaction is refused.
+func (l *Ledger) Run(instrs ...service.Instruction) error {
+	ct, err := l.Sign(instrs...)
+	if err != nil {
+		return err
+	}
+	receipts, err := l.Apply(ct)
+	if err != nil {
+		return err
+	}
+	if receipts[0].Error != "" {
+		return errors.New(receipts[0].Error)
+	}
+	return nil
+}
+
+// Rejection returns why the ClientTransaction with the hash has been refused
+// the last time it was applied. It returns false if it has been accepted or
+// never applied.
+func (l *Ledger) Rejection(txHash []byte) (string, bool) {
+	for i := len(l.Receipts) - 1; i >= 0; i-- {
+		if bytes.Equal(l.Receipts[i].TxHash, txHash) {
+			return l.Receipts[i].Error, l.Receipts[i].Error != ""
+		}
+	}
+	return "", false
+}
+
+// Events returns the events of all accepted ClientTransactions with the
+// given topic, in the order they have been emitted.
+func (l *Ledger) Events(topic string) []service.Event {
+	var events []service.Event
+	for _, r := range l.Receipts {
+		for _, ev := range r.Events {
+			if ev.Topic == topic {
+				events = append(events, ev)
+			}
+		}
+	}
+	return events
+}
+
+// Value returns the value and the contract of the object. If the object
+// doesn't exist, value is nil and contractID is empty.
+func (l *Ledger) Value(oid service.ObjectID) (value []byte, contractID string, err error) {
+	return l.Get(oid.Slice())
+}
+
+// ObjectProof returns the proof of presence or absence of the object, checked
+// against the current merkle root.
+func (l *Ledger) ObjectProof(oid service.ObjectID) (collection.Proof, error) {
+	p, err := l.Proof(oid.Slice())
+	if err != nil {
+		return collection.Proof{}, err
+	}
+	if !p.Consistent() || !bytes.Equal(p.TreeRootHash(), l.Root()) {
+		return collection.Proof{}, errors.New("proof doesn't match the merkle root")
+	}
+	return p, nil
+}
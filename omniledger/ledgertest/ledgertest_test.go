@@ -0,0 +1,86 @@
+package ledgertest
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/service"
+)
+
+// counterKind is a contract storing the index of the block it has last been
+// called in.
+var counterKind = "counter"
+
+func contractCounter(ctx service.Context, cdb collection.Collection, tx service.Instruction, c []service.Coin) ([]service.StateChange, []service.Coin, error) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(ctx.Index))
+	action := service.Update
+	if tx.Spawn != nil {
+		action = service.Create
+	}
+	return []service.StateChange{service.NewStateChange(action, tx.ObjectID, counterKind, buf)}, c, nil
+}
+
+func TestLedger(t *testing.T) {
+	l, err := New("Spawn_value", "Spawn_"+counterKind, "Invoke_count")
+	require.Nil(t, err)
+	require.Nil(t, l.RegisterContractWithContext(counterKind, contractCounter))
+	require.Equal(t, 0, l.Index())
+
+	oid := l.NewObjectID()
+	require.Nil(t, l.Run(service.Instruction{
+		ObjectID: oid,
+		Spawn: &service.Spawn{
+			ContractID: service.ContractValueID,
+			Args:       service.Arguments{{Name: "value", Value: []byte("hello")}},
+		},
+	}))
+	require.Equal(t, 1, l.Index())
+	value, contractID, err := l.Value(oid)
+	require.Nil(t, err)
+	require.Equal(t, []byte("hello"), value)
+	require.Equal(t, service.ContractValueID, contractID)
+	p, err := l.ObjectProof(oid)
+	require.Nil(t, err)
+	require.True(t, p.Match())
+
+	// Both transactions end up in the same block, the unsigned one is
+	// refused.
+	counter := l.NewObjectID()
+	signed, err := l.Sign(service.Instruction{ObjectID: counter,
+		Spawn: &service.Spawn{ContractID: counterKind}})
+	require.Nil(t, err)
+	unsigned := service.ClientTransaction{Instructions: []service.Instruction{{
+		ObjectID: l.NewObjectID(),
+		Spawn:    &service.Spawn{ContractID: service.ContractValueID},
+	}}}
+	receipts, err := l.Apply(unsigned, signed)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(receipts))
+	require.Equal(t, signed.Hash(), receipts[1].TxHash)
+	require.Equal(t, "", receipts[1].Error)
+	reason, rejected := l.Rejection(unsigned.Hash())
+	require.True(t, rejected)
+	require.NotEqual(t, "", reason)
+	_, rejected = l.Rejection(signed.Hash())
+	require.False(t, rejected)
+	p, err = l.ObjectProof(unsigned.Instructions[0].ObjectID)
+	require.Nil(t, err)
+	require.False(t, p.Match())
+
+	// The contract sees the index of the block.
+	value, _, err = l.Value(counter)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), binary.LittleEndian.Uint64(value))
+	require.Nil(t, l.Run(service.Instruction{ObjectID: counter,
+		Invoke: &service.Invoke{Command: "count"}}))
+	value, _, err = l.Value(counter)
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), binary.LittleEndian.Uint64(value))
+
+	// Unknown contracts are refused.
+	require.NotNil(t, l.Run(service.Instruction{ObjectID: l.NewObjectID(),
+		Spawn: &service.Spawn{ContractID: "unknown"}}))
+}
@@ -15,7 +15,10 @@ import (
 
 	"gopkg.in/dedis/cothority.v2"
 	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/kyber.v2"
+	"gopkg.in/dedis/kyber.v2/sign/schnorr"
 	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/network"
 )
 
 // ServiceName is used for registration on the onet.
@@ -77,6 +80,233 @@ func (c *Client) GetProof(r *onet.Roster, id skipchain.SkipBlockID, key []byte)
 	return reply, nil
 }
 
+// SimulateTransaction executes the transaction without adding it to the
+// skipchain, and returns the StateChanges it would create, or the reason why
+// it would be refused.
+func (c *Client) SimulateTransaction(r *onet.Roster, id skipchain.SkipBlockID, tx ClientTransaction) (*SimulateTransactionResponse, error) {
+	reply := &SimulateTransactionResponse{}
+	err := c.SendProtobuf(r.List[0], &SimulateTransaction{
+		Version:     CurrentVersion,
+		SkipchainID: id,
+		Transaction: tx,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// GetReceipt returns the receipt of the transaction with the given hash, which
+// tells whether the transaction has been accepted and why it has been refused
+// otherwise. Its events can be checked with the Verify method of the proof in
+// the response.
+func (c *Client) GetReceipt(r *onet.Roster, id skipchain.SkipBlockID, txHash []byte) (*GetReceiptResponse, error) {
+	reply := &GetReceiptResponse{}
+	err := c.SendProtobuf(r.List[0], &GetReceipt{
+		Version: CurrentVersion,
+		ID:      id,
+		TxHash:  txHash,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// QueryTransactions returns a page of the transactions found by the query,
+// see QueryTransactions. The Version and ID of the query are set by the
+// method.
+func (c *Client) QueryTransactions(r *onet.Roster, id skipchain.SkipBlockID, query QueryTransactions) (*QueryTransactionsResponse, error) {
+	query.Version, query.ID = CurrentVersion, id
+	reply := &QueryTransactionsResponse{}
+	err := c.SendProtobuf(r.List[0], &query, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// RebuildIndex asks the node to rebuild its indexes of the skipchain. The
+// request is signed with conodePriv, the private key of the node, which the
+// administrator finds in its private.toml.
+func (c *Client) RebuildIndex(si *network.ServerIdentity, conodePriv kyber.Scalar, id skipchain.SkipBlockID) (*RebuildIndexResponse, error) {
+	sig, err := schnorr.Sign(cothority.Suite, conodePriv, rebuildIndexMessage(id))
+	if err != nil {
+		return nil, errors.New("couldn't sign request: " + err.Error())
+	}
+	reply := &RebuildIndexResponse{}
+	err = c.SendProtobuf(si, &RebuildIndex{
+		Version:   CurrentVersion,
+		ID:        id,
+		Signature: sig,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// ListContracts returns the contracts registered on the first node of the
+// roster, with the schemas of their arguments.
+func (c *Client) ListContracts(r *onet.Roster) (*ListContractsResponse, error) {
+	reply := &ListContractsResponse{}
+	err := c.SendProtobuf(r.List[0], &ListContracts{Version: CurrentVersion}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Subscribe follows the skipchain with the given ID, starting at block from,
+// or at the latest block if from is negative, and watching the objects.
+// Every response is verified before it is given to f. If the connection
+// breaks, or a block is missing, Subscribe connects to the next node of the
+// roster and resumes after the last block given to f. It returns once f
+// returns false, or with an error if it couldn't get a block after
+// subscribeRetries attempts in a row.
+func (c *Client) Subscribe(r *onet.Roster, id skipchain.SkipBlockID, from int, objects []ObjectID,
+	f func(*SubscribeResponse) bool) error {
+	return subscribeLoop(r, id, from, objects, f,
+		func(si *network.ServerIdentity, req *Subscribe) (func(*SubscribeResponse) error, func(), error) {
+			cl := onet.NewClient(cothority.Suite, ServiceName)
+			conn, err := cl.Stream(si, req)
+			if err != nil {
+				cl.Close()
+				return nil, nil, err
+			}
+			read := func(resp *SubscribeResponse) error {
+				return conn.ReadMessage(resp)
+			}
+			return read, func() { cl.Close() }, nil
+		})
+}
+
+// CallView runs a view method of a contract on the latest state of the
+// skipchain. The response must be verified with CallViewResponse.Verify.
+func (c *Client) CallView(r *onet.Roster, id skipchain.SkipBlockID, contractID, method string, args Arguments) (*CallViewResponse, error) {
+	reply := &CallViewResponse{}
+	err := c.SendProtobuf(r.List[0], &CallView{
+		Version:    CurrentVersion,
+		ID:         id,
+		ContractID: contractID,
+		Method:     method,
+		Args:       args,
+	}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// CreateShardedLedger sets up an identity chain and the skipchains of the
+// shards. The nodes of the roster are assigned to the shards.
+func (c *Client) CreateShardedLedger(r *onet.Roster, msg *CreateShardedLedger) (*CreateShardedLedgerResponse, error) {
+	reply := &CreateShardedLedgerResponse{}
+	if err := c.SendProtobuf(r.List[0], msg, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// ShardedClient sends the transactions and proof requests of a sharded
+// ledger to the shards storing the keys.
+type ShardedClient struct {
+	*Client
+	// Roster and ID are the roster and the ID of the identity chain.
+	Roster *onet.Roster
+	ID     skipchain.SkipBlockID
+	// Shards are the shards as recorded in the identity chain.
+	Shards *ShardConfig
+}
+
+// NewShardedClient returns a client for the sharded ledger with the given
+// identity chain, reading the shards from the identity chain.
+func NewShardedClient(r *onet.Roster, id skipchain.SkipBlockID) (*ShardedClient, error) {
+	c := &ShardedClient{Client: NewClient(), Roster: r, ID: id}
+	if err := c.UpdateShards(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// UpdateShards reads the shards from the config of the identity chain. It
+// must be called once the nodes are assigned anew to the shards.
+func (c *ShardedClient) UpdateShards() error {
+	reply, err := c.Client.GetProof(c.Roster, c.ID, GenesisReferenceID.Slice())
+	if err != nil {
+		return err
+	}
+	if err = reply.Proof.Verify(c.ID); err != nil {
+		return err
+	}
+	_, values, err := reply.Proof.KeyValue()
+	if err != nil {
+		return err
+	}
+	if len(values) < 2 || string(values[1]) != ContractConfigID {
+		return errors.New("identity chain has no config")
+	}
+	configID := ObjectID{DarcID: darc.ID(values[0]), InstanceID: OneNonce}
+	reply, err = c.Client.GetProof(c.Roster, c.ID, configID.Slice())
+	if err != nil {
+		return err
+	}
+	if err = reply.Proof.Verify(c.ID); err != nil {
+		return err
+	}
+	config, err := reply.Proof.Config()
+	if err != nil {
+		return err
+	}
+	if config.Shards == nil {
+		return errors.New("skipchain is not an identity chain")
+	}
+	c.Shards = config.Shards
+	return nil
+}
+
+// AddTransaction sends the transaction to the shard storing its objects. A
+// step of a cross-shard transaction is sent to the shard of its input or
+// output.
+func (c *ShardedClient) AddTransaction(tx ClientTransaction) (*AddTxResponse, error) {
+	var i int
+	var err error
+	if tx.Atomix != nil {
+		i, err = c.Shards.AtomixShard(tx.Atomix)
+	} else {
+		i, err = c.Shards.TransactionShard(tx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	shard := c.Shards.Shards[i]
+	return c.Client.AddTransaction(shard.Roster, shard.ID, tx)
+}
+
+// GetProof returns the proof for the key from the shard storing it. The proof
+// must be verified against the skipchain of that shard.
+func (c *ShardedClient) GetProof(key []byte) (*GetProofResponse, error) {
+	shard := c.Shards.Shards[c.Shards.ShardOf(key)]
+	return c.Client.GetProof(shard.Roster, shard.ID, key)
+}
+
+// GetAtomixProof returns the proof of the lock of the input index of the
+// cross-shard transaction or, if index is negative, the proof of its commit.
+func (c *ShardedClient) GetAtomixProof(at AtomixTransaction, index int) (*GetProofResponse, error) {
+	step := &AtomixStep{Phase: AtomixLock, Transaction: at, Index: index}
+	key := AtomixLockID(at.Hash(), index)
+	if index < 0 {
+		step.Phase = AtomixCommit
+		key = AtomixCommitID(at.Hash())
+	}
+	i, err := c.Shards.AtomixShard(step)
+	if err != nil {
+		return nil, err
+	}
+	shard := c.Shards.Shards[i]
+	return c.Client.GetProof(shard.Roster, shard.ID, key.Slice())
+}
+
 // DefaultGenesisMsg creates the message that is used to for creating the
 // genesis darc and block.
 func DefaultGenesisMsg(v Version, r *onet.Roster, rules []string, ids ...*darc.Identity) (*CreateGenesisBlock, error) {
@@ -0,0 +1,465 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/protobuf"
+	"student_18_byzcoin/omniledger/collection"
+)
+
+// A cross-shard transaction spends objects on several shards of a sharded
+// ledger, following the lock/unlock protocol of Atomix:
+//   1. the client sends every input to its shard in an AtomixLock step. The
+//   shard runs the input and stores a lock: if the input is accepted, the
+//   objects it changed are locked and its leftover coins are kept in the
+//   lock. Else the lock records the rejection.
+//   2. if all inputs are accepted, the client sends the output to its shard
+//   in an AtomixCommit step, with the proofs of all locks. The output shard
+//   runs the output with the coins of the locks and records the commit.
+//   3. the client sends an AtomixUnlock step to every input shard, with the
+//   proof of the commit, which releases the objects and the coins of the
+//   lock, or with the proof of a rejected input, which reverts the input.
+
+// AtomixPhase is the step of a cross-shard transaction.
+type AtomixPhase int
+
+const (
+	// AtomixLock runs an input and locks its objects.
+	AtomixLock AtomixPhase = iota
+	// AtomixCommit runs the output once all inputs are locked.
+	AtomixCommit
+	// AtomixUnlock releases the objects of an input once the output has
+	// been committed, or reverts the input if another input was rejected.
+	AtomixUnlock
+)
+
+// ContractAtomixLockID denotes the lock of an input of a cross-shard
+// transaction, which holds an AtomixLockRecord.
+var ContractAtomixLockID = "atomix_lock"
+
+// ContractAtomixCommitID denotes the commit of a cross-shard transaction,
+// which holds the hash of the transaction.
+var ContractAtomixCommitID = "atomix_commit"
+
+// contractAtomixLockedID denotes the mark of a locked object, which holds the
+// hash of the cross-shard transaction locking it.
+var contractAtomixLockedID = "atomix_locked"
+
+// AtomixTransaction is a transaction spanning several shards. Every input
+// and the output must only touch the objects of one shard.
+type AtomixTransaction struct {
+	Inputs []ClientTransaction
+	Output ClientTransaction
+}
+
+// Hash returns the hash identifying the cross-shard transaction.
+func (at AtomixTransaction) Hash() []byte {
+	h := sha256.New()
+	for _, in := range at.Inputs {
+		h.Write(in.Instructions.Hash())
+	}
+	h.Write(at.Output.Instructions.Hash())
+	return h.Sum(nil)
+}
+
+// AtomixStep is one step of a cross-shard transaction. The instructions of
+// the ClientTransaction of a lock step must be the input Index, and those of
+// a commit step the output.
+type AtomixStep struct {
+	Phase       AtomixPhase
+	Transaction AtomixTransaction
+	// Index is the input locked or unlocked.
+	Index int
+	// Proofs holds, for a commit, the proof of the lock of every input and,
+	// for an unlock, either the proof of the commit or the proof of the lock
+	// of a rejected input.
+	Proofs []Proof
+}
+
+// Hash returns the hash of the step.
+func (step AtomixStep) Hash() []byte {
+	h := sha256.New()
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(step.Phase))
+	h.Write(b)
+	binary.LittleEndian.PutUint64(b, uint64(step.Index))
+	h.Write(b)
+	h.Write(step.Transaction.Hash())
+	for _, p := range step.Proofs {
+		buf, err := protobuf.Encode(&p)
+		if err != nil {
+			// Proofs that can't be encoded can't be sent either.
+			continue
+		}
+		h.Write(buf)
+	}
+	return h.Sum(nil)
+}
+
+// AtomixLockRecord is stored by an input shard once it ran its input.
+type AtomixLockRecord struct {
+	// Accepted is false if the input has been refused.
+	Accepted bool
+	// Coins are the coins left over by the input, which go to the output.
+	Coins []Coin
+	// Undo holds the StateChanges reverting the input, in the order they
+	// have been applied.
+	Undo StateChanges
+	// Objects holds the objects locked by the input.
+	Objects [][]byte
+	// Unlocked is set once the objects are released.
+	Unlocked bool
+}
+
+// AtomixLockID returns the object holding the lock of the input index of the
+// cross-shard transaction with the given hash.
+func AtomixLockID(tx []byte, index int) ObjectID {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(index))
+	return ObjectID{DarcID: ZeroDarc, InstanceID: atomixNonce("lock", tx, b)}
+}
+
+// AtomixCommitID returns the object holding the commit of the cross-shard
+// transaction with the given hash.
+func AtomixCommitID(tx []byte) ObjectID {
+	return ObjectID{DarcID: ZeroDarc, InstanceID: atomixNonce("commit", tx)}
+}
+
+// atomixLockedID returns the object marking the object under key as locked.
+func atomixLockedID(key []byte) ObjectID {
+	return ObjectID{DarcID: ZeroDarc, InstanceID: atomixNonce("locked", key)}
+}
+
+func atomixNonce(kind string, data ...[]byte) Nonce {
+	h := sha256.New()
+	h.Write([]byte(kind))
+	for _, d := range data {
+		h.Write(d)
+	}
+	var n Nonce
+	copy(n[:], h.Sum(nil))
+	return n
+}
+
+func decodeAtomixLock(value, contract []byte) (*AtomixLockRecord, error) {
+	if string(contract) != ContractAtomixLockID {
+		return nil, errors.New("object is not a lock")
+	}
+	lock := &AtomixLockRecord{}
+	if err := protobuf.Decode(value, lock); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// AtomixShard returns the shard that the step must be sent to.
+func (sc ShardConfig) AtomixShard(step *AtomixStep) (int, error) {
+	if step.Phase == AtomixCommit {
+		return sc.TransactionShard(step.Transaction.Output)
+	}
+	if step.Index < 0 || step.Index >= len(step.Transaction.Inputs) {
+		return 0, errors.New("no such input")
+	}
+	return sc.TransactionShard(step.Transaction.Inputs[step.Index])
+}
+
+// hasAtomix returns whether one of the transactions is a step of a
+// cross-shard transaction.
+func hasAtomix(cts ClientTransactions) bool {
+	for _, ct := range cts {
+		if ct.Atomix != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAtomixLocked returns an error if the object under key is locked by
+// another transaction than the cross-shard transaction with the given hash.
+func checkAtomixLocked(coll collection.Collection, key, tx []byte) error {
+	rec, err := coll.Get(atomixLockedID(key).Slice()).Record()
+	if err != nil {
+		return err
+	}
+	if !rec.Match() {
+		return nil
+	}
+	vals, err := rec.Values()
+	if err != nil {
+		return err
+	}
+	if tx == nil || !bytes.Equal(vals[0].([]byte), tx) {
+		return fmt.Errorf("object %x is locked by a cross-shard transaction", key)
+	}
+	return nil
+}
+
+// atomixShards returns the shards of the ledger of the skipchain with the
+// given config, as of the block of the identity chain in ctx, and the index
+// of its shard.
+func (s *Service) atomixShards(config *Config, ctx Context) (*ShardConfig, int, error) {
+	if config.Identity.IsNull() {
+		return nil, 0, errors.New("skipchain is not a shard")
+	}
+	if ctx.identityBlock.IsNull() {
+		return nil, 0, errors.New("block uses no block of the identity chain")
+	}
+	identity, err := s.identityConfig(config.Identity, ctx.identityBlock)
+	if err != nil {
+		return nil, 0, err
+	}
+	if identity.Shards == nil || config.Shard >= len(identity.Shards.Shards) {
+		return nil, 0, errors.New("shard is not recorded in the identity chain")
+	}
+	return identity.Shards, config.Shard, nil
+}
+
+// checkAtomixStep makes sure that the instructions of ct are the given part
+// of the cross-shard transaction, and that this part belongs to the shard of
+// the skipchain, as given by the shards of the block in ctx.
+func checkAtomixStep(ctx Context, ct ClientTransaction, part ClientTransaction) error {
+	at := ct.Atomix.Transaction
+	for _, in := range append([]ClientTransaction{at.Output}, at.Inputs...) {
+		if in.Atomix != nil {
+			return errors.New("cross-shard transactions cannot be nested")
+		}
+	}
+	if !bytes.Equal(ct.Instructions.Hash(), part.Instructions.Hash()) {
+		return errors.New("instructions are not part of the cross-shard transaction")
+	}
+	if ctx.shards == nil {
+		return errors.New("shards of the block are not available")
+	}
+	i, err := ctx.shards.TransactionShard(part)
+	if err != nil {
+		return err
+	}
+	if i != ctx.shard {
+		return errors.New("instructions belong to another shard")
+	}
+	return nil
+}
+
+// checkAtomixLock makes sure that the input of the lock step belongs to the
+// skipchain and hasn't been locked yet.
+func checkAtomixLock(coll collection.Collection, ctx Context, ct ClientTransaction) error {
+	step := ct.Atomix
+	if step.Index < 0 || step.Index >= len(step.Transaction.Inputs) {
+		return errors.New("no such input")
+	}
+	if err := checkAtomixStep(ctx, ct, step.Transaction.Inputs[step.Index]); err != nil {
+		return err
+	}
+	rec, err := coll.Get(AtomixLockID(step.Transaction.Hash(), step.Index).Slice()).Record()
+	if err != nil {
+		return err
+	}
+	if rec.Match() {
+		return errors.New("input is already locked")
+	}
+	return nil
+}
+
+// lockAtomix returns the StateChanges storing the lock of an accepted input,
+// which changed the objects as reverted by undo, and marking the objects as
+// locked.
+func lockAtomix(step *AtomixStep, coins []Coin, undo StateChanges) (StateChanges, error) {
+	tx := step.Transaction.Hash()
+	lock := AtomixLockRecord{
+		Accepted: true,
+		Coins:    coins,
+		Undo:     append(StateChanges{}, undo...),
+	}
+	var scs StateChanges
+	seen := map[string]bool{}
+	for _, u := range undo {
+		if seen[string(u.ObjectID)] {
+			continue
+		}
+		seen[string(u.ObjectID)] = true
+		lock.Objects = append(lock.Objects, u.ObjectID)
+		scs = append(scs, NewStateChange(Create, atomixLockedID(u.ObjectID), contractAtomixLockedID, tx))
+	}
+	buf, err := protobuf.Encode(&lock)
+	if err != nil {
+		return nil, err
+	}
+	return append(scs, NewStateChange(Create, AtomixLockID(tx, step.Index), ContractAtomixLockID, buf)), nil
+}
+
+// rejectAtomixLock stores the lock of a refused input in coll and returns the
+// StateChanges and the StateChanges reverting them.
+func rejectAtomixLock(coll collection.Collection, ctx Context, ct ClientTransaction) (states, undo StateChanges, err error) {
+	if err = checkAtomixLock(coll, ctx, ct); err != nil {
+		return
+	}
+	buf, err := protobuf.Encode(&AtomixLockRecord{})
+	if err != nil {
+		return
+	}
+	sc := NewStateChange(Create, AtomixLockID(ct.Atomix.Transaction.Hash(), ct.Atomix.Index),
+		ContractAtomixLockID, buf)
+	u, err := undoStateChange(coll, &sc)
+	if err != nil {
+		return
+	}
+	if err = storeInColl(coll, &sc); err != nil {
+		return
+	}
+	return StateChanges{sc}, StateChanges{u}, nil
+}
+
+// checkAtomixCommit makes sure that the output of the commit step belongs to
+// the skipchain, hasn't been committed yet, and that all inputs are locked.
+// It returns the coins of the locks.
+func checkAtomixCommit(coll collection.Collection, ctx Context, ct ClientTransaction) ([]Coin, error) {
+	step := ct.Atomix
+	tx := step.Transaction.Hash()
+	if err := checkAtomixStep(ctx, ct, step.Transaction.Output); err != nil {
+		return nil, err
+	}
+	shards := ctx.shards
+	rec, err := coll.Get(AtomixCommitID(tx).Slice()).Record()
+	if err != nil {
+		return nil, err
+	}
+	if rec.Match() {
+		return nil, errors.New("transaction is already committed")
+	}
+	if len(step.Proofs) != len(step.Transaction.Inputs) {
+		return nil, errors.New("every input needs a proof of its lock")
+	}
+
+	var coins []Coin
+	for i, in := range step.Transaction.Inputs {
+		shard, err := shards.TransactionShard(in)
+		if err != nil {
+			return nil, err
+		}
+		value, contract, err := verifyAtomixProof(shards, shard, AtomixLockID(tx, i), step.Proofs[i])
+		if err != nil {
+			return nil, fmt.Errorf("proof of input %d: %s", i, err)
+		}
+		lock, err := decodeAtomixLock(value, contract)
+		if err != nil {
+			return nil, err
+		}
+		if !lock.Accepted || lock.Unlocked {
+			return nil, fmt.Errorf("input %d is not locked", i)
+		}
+		for _, c := range lock.Coins {
+			if coins, err = addCoin(coins, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return coins, nil
+}
+
+// unlockAtomix returns the StateChanges releasing the objects of a locked
+// input. If the proof of the step shows the commit, the coins of the lock
+// are returned as they have gone to the output shard. If it shows a rejected
+// input, the input is reverted.
+func unlockAtomix(coll collection.Collection, ctx Context, step *AtomixStep) (StateChanges, []Coin, error) {
+	tx := step.Transaction.Hash()
+	lockID := AtomixLockID(tx, step.Index)
+	value, contract, err := getValueContract(coll, lockID.Slice())
+	if err != nil {
+		return nil, nil, errors.New("input is not locked")
+	}
+	lock, err := decodeAtomixLock(value, contract)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !lock.Accepted || lock.Unlocked {
+		return nil, nil, errors.New("input is not locked")
+	}
+	if len(step.Proofs) != 1 {
+		return nil, nil, errors.New("unlocking needs one proof")
+	}
+	if ctx.shards == nil {
+		return nil, nil, errors.New("shards of the block are not available")
+	}
+
+	committed, err := atomixCommitted(ctx.shards, step)
+	if err != nil {
+		return nil, nil, err
+	}
+	var scs StateChanges
+	var outgoing []Coin
+	if committed {
+		outgoing = lock.Coins
+	} else {
+		for i := len(lock.Undo) - 1; i >= 0; i-- {
+			scs = append(scs, lock.Undo[i])
+		}
+	}
+	for _, key := range lock.Objects {
+		scs = append(scs, NewStateChange(Remove, atomixLockedID(key), contractAtomixLockedID, nil))
+	}
+	lock.Coins, lock.Undo, lock.Objects, lock.Unlocked = nil, nil, nil, true
+	buf, err := protobuf.Encode(lock)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(scs, NewStateChange(Update, lockID, ContractAtomixLockID, buf)), outgoing, nil
+}
+
+// atomixCommitted returns true if the proof of the unlock step shows the
+// commit of the transaction and false if it shows a rejected input.
+func atomixCommitted(shards *ShardConfig, step *AtomixStep) (bool, error) {
+	tx := step.Transaction.Hash()
+	proof := step.Proofs[0]
+	output, err := shards.TransactionShard(step.Transaction.Output)
+	if err != nil {
+		return false, err
+	}
+	value, contract, err := verifyAtomixProof(shards, output, AtomixCommitID(tx), proof)
+	if err == nil && string(contract) == ContractAtomixCommitID && bytes.Equal(value, tx) {
+		return true, nil
+	}
+	for i, in := range step.Transaction.Inputs {
+		if i == step.Index {
+			continue
+		}
+		shard, err := shards.TransactionShard(in)
+		if err != nil {
+			return false, err
+		}
+		value, contract, err := verifyAtomixProof(shards, shard, AtomixLockID(tx, i), proof)
+		if err != nil {
+			continue
+		}
+		if lock, err := decodeAtomixLock(value, contract); err == nil && !lock.Accepted {
+			return false, nil
+		}
+	}
+	return false, errors.New("proof shows neither the commit nor a rejected input")
+}
+
+// verifyAtomixProof verifies that the proof comes from the skipchain of the
+// shard and holds the object oid. It returns the value and the contract of
+// the object.
+func verifyAtomixProof(shards *ShardConfig, shard int, oid ObjectID, p Proof) (value, contract []byte, err error) {
+	if shard < 0 || shard >= len(shards.Shards) {
+		return nil, nil, errors.New("no such shard")
+	}
+	if err = p.Verify(shards.Shards[shard].ID); err != nil {
+		return nil, nil, err
+	}
+	if !p.InclusionProof.Match() || !bytes.Equal(p.InclusionProof.Key, oid.Slice()) {
+		return nil, nil, errors.New("object is not in the proof")
+	}
+	_, values, err := p.KeyValue()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(values) < 2 {
+		return nil, nil, errors.New("proof holds no value")
+	}
+	return values[0], values[1], nil
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+func TestService_Atomix(t *testing.T) {
+	// The reward account receives the coins arriving at the output shard.
+	reward := ObjectID{DarcID: darc.ID(ZeroNonce[:]), InstanceID: GenNonce()}
+	sl := newShardedLedger(t, &reward, EpochConfig{},
+		"Spawn_coin", "Invoke_mint", "Invoke_fetch", "Spawn_value")
+	defer sl.local.CloseAll()
+	defer closeQueues(sl.local)
+
+	// The coins are minted on shard 0.
+	genesisCoin, account := sl.newOID(0), sl.newOID(0)
+	valueBuf := func(value uint64) []byte {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, value)
+		return buf
+	}
+	sign := func(instrs ...Instruction) ClientTransaction {
+		for i := range instrs {
+			instrs[i].Index, instrs[i].Length = i, len(instrs)
+			require.Nil(t, instrs[i].SignBy(sl.signer))
+			for j := range instrs[i].Coins {
+				require.Nil(t, instrs[i].SignCoinInput(j, sl.signer))
+			}
+		}
+		return ClientTransaction{Instructions: instrs}
+	}
+	balance := func(shard int, oid ObjectID) uint64 {
+		p := sl.proof(t, shard, oid)
+		if !p.InclusionProof.Match() {
+			return 0
+		}
+		ca, err := p.CoinAccount()
+		require.Nil(t, err)
+		return ca.Balance(genesisCoin)
+	}
+	lock := func(shard int, oid ObjectID) *AtomixLockRecord {
+		p := sl.proof(t, shard, oid)
+		require.True(t, p.InclusionProof.Match())
+		_, values, err := p.KeyValue()
+		require.Nil(t, err)
+		l, err := decodeAtomixLock(values[0], values[1])
+		require.Nil(t, err)
+		return l
+	}
+	// fetch takes coins from the account into a new value.
+	fetch := func(shard int, account ObjectID, value uint64) Instruction {
+		return Instruction{
+			ObjectID: sl.newOID(shard),
+			Spawn:    &Spawn{ContractID: ContractValueID},
+			Coins:    []CoinInput{{Account: account, Coin: Coin{Name: genesisCoin, Value: value}}},
+		}
+	}
+
+	sl.send(t, 0, sign(
+		Instruction{ObjectID: genesisCoin, Spawn: &Spawn{
+			ContractID: ContractCoinID,
+			Args:       Arguments{{Name: "genesis", Value: []byte{1}}},
+		}},
+		Instruction{ObjectID: account, Spawn: &Spawn{ContractID: ContractCoinID}},
+		Instruction{ObjectID: genesisCoin, Invoke: &Invoke{
+			Command: CmdCoinMint,
+			Args: Arguments{
+				{Name: "value", Value: valueBuf(100)},
+				{Name: "destination", Value: account.Slice()},
+			},
+		}}))
+	require.Equal(t, uint64(100), balance(0, account))
+
+	// 30 coins go from shard 0 to shard 1.
+	at := AtomixTransaction{
+		Inputs: []ClientTransaction{sign(fetch(0, account, 30))},
+		Output: sign(Instruction{ObjectID: sl.newOID(1), Spawn: &Spawn{ContractID: ContractValueID}}),
+	}
+	tx := at.Hash()
+	sl.send(t, 0, ClientTransaction{
+		Instructions: at.Inputs[0].Instructions,
+		Atomix:       &AtomixStep{Phase: AtomixLock, Transaction: at, Index: 0},
+	})
+	l := lock(0, AtomixLockID(tx, 0))
+	require.True(t, l.Accepted)
+	require.Equal(t, uint64(30), CoinAccount{l.Coins}.Balance(genesisCoin))
+	require.Equal(t, uint64(70), balance(0, account))
+
+	// The account is locked until the transaction is done.
+	sl.send(t, 0, sign(fetch(0, account, 10)))
+	require.Equal(t, uint64(70), balance(0, account))
+
+	commit := ClientTransaction{
+		Instructions: at.Output.Instructions,
+		Atomix: &AtomixStep{Phase: AtomixCommit, Transaction: at,
+			Proofs: []Proof{sl.proof(t, 0, AtomixLockID(tx, 0))}},
+	}
+	sl.send(t, 1, commit)
+	require.True(t, sl.proof(t, 1, AtomixCommitID(tx)).InclusionProof.Match())
+	require.Equal(t, uint64(30), balance(1, reward))
+	require.True(t, sl.proof(t, 1, at.Output.Instructions[0].ObjectID).InclusionProof.Match())
+
+	// The same transaction cannot be committed twice.
+	sl.send(t, 1, commit)
+	require.Equal(t, uint64(30), balance(1, reward))
+
+	sl.send(t, 0, ClientTransaction{Atomix: &AtomixStep{Phase: AtomixUnlock, Transaction: at,
+		Proofs: []Proof{sl.proof(t, 1, AtomixCommitID(tx))}}})
+	l = lock(0, AtomixLockID(tx, 0))
+	require.True(t, l.Unlocked)
+	require.Equal(t, 0, len(l.Coins))
+	require.Equal(t, uint64(70), balance(0, account))
+	sl.send(t, 0, sign(fetch(0, account, 10)))
+	require.Equal(t, uint64(60), balance(0, account))
+
+	// The second input takes coins from an account that doesn't exist on
+	// shard 1, so it is rejected and the first input is reverted.
+	at = AtomixTransaction{
+		Inputs: []ClientTransaction{
+			sign(fetch(0, account, 20)),
+			sign(fetch(1, sl.newOID(1), 20)),
+		},
+		Output: sign(Instruction{ObjectID: sl.newOID(1), Spawn: &Spawn{ContractID: ContractValueID}}),
+	}
+	tx = at.Hash()
+	for i, shard := range []int{0, 1} {
+		sl.send(t, shard, ClientTransaction{
+			Instructions: at.Inputs[i].Instructions,
+			Atomix:       &AtomixStep{Phase: AtomixLock, Transaction: at, Index: i},
+		})
+	}
+	require.True(t, lock(0, AtomixLockID(tx, 0)).Accepted)
+	require.False(t, lock(1, AtomixLockID(tx, 1)).Accepted)
+	require.Equal(t, uint64(40), balance(0, account))
+
+	// Without every acceptance, the output is not committed.
+	sl.send(t, 1, ClientTransaction{
+		Instructions: at.Output.Instructions,
+		Atomix: &AtomixStep{Phase: AtomixCommit, Transaction: at,
+			Proofs: []Proof{sl.proof(t, 0, AtomixLockID(tx, 0)), sl.proof(t, 1, AtomixLockID(tx, 1))}},
+	})
+	require.False(t, sl.proof(t, 1, AtomixCommitID(tx)).InclusionProof.Match())
+
+	sl.send(t, 0, ClientTransaction{Atomix: &AtomixStep{Phase: AtomixUnlock, Transaction: at,
+		Proofs: []Proof{sl.proof(t, 1, AtomixLockID(tx, 1))}}})
+	require.True(t, lock(0, AtomixLockID(tx, 0)).Unlocked)
+	require.Equal(t, uint64(60), balance(0, account))
+	require.False(t, sl.proof(t, 0, at.Inputs[0].Instructions[0].ObjectID).InclusionProof.Match())
+}
+
+func TestService_AtomixShards(t *testing.T) {
+	shards := ShardConfig{Shards: []Shard{{ID: []byte("shard0")}, {ID: []byte("shard1")}}}
+	in := ClientTransaction{Instructions: Instructions{{
+		ObjectID: ObjectID{DarcID: darc.ID(ZeroNonce[:]), InstanceID: GenNonce()},
+		Spawn:    &Spawn{ContractID: ContractValueID},
+	}}}
+	shard, err := shards.TransactionShard(in)
+	require.Nil(t, err)
+	ct := ClientTransaction{
+		Instructions: in.Instructions,
+		Atomix: &AtomixStep{
+			Phase:       AtomixLock,
+			Transaction: AtomixTransaction{Inputs: []ClientTransaction{in}},
+		},
+	}
+	coll := collection.New(&collection.Data{}, &collection.Data{})
+
+	// The input is checked against the shards of the block only.
+	require.Nil(t, checkAtomixLock(coll, Context{shards: &shards, shard: shard}, ct))
+	require.NotNil(t, checkAtomixLock(coll, Context{shards: &shards, shard: 1 - shard}, ct))
+	require.NotNil(t, checkAtomixLock(coll, Context{}, ct))
+
+	// Without skipchain, the shards cannot be loaded.
+	_, _, err = (&Service{}).atomixShards(&Config{Identity: []byte("identity")},
+		Context{identityBlock: []byte("block")})
+	require.NotNil(t, err)
+}
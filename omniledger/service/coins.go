@@ -0,0 +1,259 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/dedis/protobuf"
+	"student_18_byzcoin/omniledger/collection"
+)
+
+// CoinAccount is the value of an account object. It holds the balance of the
+// account for every type of coin.
+type CoinAccount struct {
+	Coins []Coin
+}
+
+// Balance returns the number of coins of the given type in the account.
+func (ca CoinAccount) Balance(name ObjectID) uint64 {
+	for _, c := range ca.Coins {
+		if c.Name.Equal(name) {
+			return c.Value
+		}
+	}
+	return 0
+}
+
+// addCoin returns the coins with c added to them. It fails if the number of
+// coins of that type would overflow.
+func addCoin(coins []Coin, c Coin) ([]Coin, error) {
+	if c.Value == 0 {
+		return coins, nil
+	}
+	out := make([]Coin, len(coins), len(coins)+1)
+	copy(out, coins)
+	for i := range out {
+		if out[i].Name.Equal(c.Name) {
+			if out[i].Value > math.MaxUint64-c.Value {
+				return nil, errors.New("coin overflow")
+			}
+			out[i].Value += c.Value
+			return out, nil
+		}
+	}
+	return append(out, c), nil
+}
+
+// subCoin returns the coins with c taken from them. It fails if there are not
+// enough coins of that type.
+func subCoin(coins []Coin, c Coin) ([]Coin, error) {
+	if c.Value == 0 {
+		return coins, nil
+	}
+	for i := range coins {
+		if coins[i].Name.Equal(c.Name) {
+			if coins[i].Value < c.Value {
+				break
+			}
+			out := make([]Coin, 0, len(coins))
+			out = append(out, coins[:i]...)
+			if coins[i].Value > c.Value {
+				out = append(out, Coin{Name: coins[i].Name, Value: coins[i].Value - c.Value})
+			}
+			return append(out, coins[i+1:]...), nil
+		}
+	}
+	return nil, errors.New("not enough coins")
+}
+
+// loadCoinAccount returns the account stored under key, or nil if there is
+// nothing stored under key. It fails if the object is not an account.
+func loadCoinAccount(coll collection.Collection, key []byte) (*CoinAccount, error) {
+	rec, err := coll.Get(key).Record()
+	if err != nil {
+		return nil, err
+	}
+	if !rec.Match() {
+		return nil, nil
+	}
+	vals, err := rec.Values()
+	if err != nil {
+		return nil, err
+	}
+	return decodeCoinAccount(vals[0].([]byte), vals[1].([]byte))
+}
+
+func decodeCoinAccount(value, contract []byte) (*CoinAccount, error) {
+	if string(contract) != ContractCoinID {
+		return nil, errors.New("object is not a coin account")
+	}
+	ca := &CoinAccount{}
+	if err := protobuf.Decode(value, ca); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// fetchCoin returns the StateChange taking the coins of in from its account.
+func fetchCoin(coll collection.Collection, in CoinInput) (StateChange, error) {
+	ca, err := loadCoinAccount(coll, in.Account.Slice())
+	if err != nil {
+		return StateChange{}, err
+	}
+	if ca == nil {
+		return StateChange{}, errors.New("coin account doesn't exist")
+	}
+	if ca.Coins, err = subCoin(ca.Coins, in.Coin); err != nil {
+		return StateChange{}, err
+	}
+	buf, err := protobuf.Encode(ca)
+	if err != nil {
+		return StateChange{}, err
+	}
+	return NewStateChange(Update, in.Account, ContractCoinID, buf), nil
+}
+
+// creditCoins returns the StateChange adding the coins to the account. The
+// account is created if it doesn't exist yet.
+func creditCoins(coll collection.Collection, account ObjectID, coins []Coin) (StateChange, error) {
+	ca, err := loadCoinAccount(coll, account.Slice())
+	if err != nil {
+		return StateChange{}, err
+	}
+	action := Update
+	if ca == nil {
+		ca = &CoinAccount{}
+		action = Create
+	}
+	for _, c := range coins {
+		if ca.Coins, err = addCoin(ca.Coins, c); err != nil {
+			return StateChange{}, err
+		}
+	}
+	buf, err := protobuf.Encode(ca)
+	if err != nil {
+		return StateChange{}, err
+	}
+	return NewStateChange(action, account, ContractCoinID, buf), nil
+}
+
+// heldCoins returns the coins held by an object: the balance of an account,
+// the coins locked by a stake or the coins of a multisig wallet.
+func heldCoins(value, contract []byte) ([]Coin, error) {
+	switch string(contract) {
+	case ContractCoinID:
+		ca, err := decodeCoinAccount(value, contract)
+		if err != nil {
+			return nil, err
+		}
+		return ca.Coins, nil
+	case ContractStakeID:
+		stake, err := decodeStake(value, contract)
+		if err != nil {
+			return nil, err
+		}
+		return []Coin{stake.Coin}, nil
+	case ContractAtomixLockID:
+		lock, err := decodeAtomixLock(value, contract)
+		if err != nil {
+			return nil, err
+		}
+		return lock.Coins, nil
+	case ContractMultisigID:
+		w, err := decodeMultisigWallet(value, contract)
+		if err != nil {
+			return nil, err
+		}
+		return w.Coins, nil
+	}
+	return nil, nil
+}
+
+// checkCoins makes sure that a ClientTransaction neither created nor
+// destroyed coins: for every type of coin, the sum of the coins held by all
+// the objects it changed must be the same before and after. The coins before
+// are taken from undo, the StateChanges reverting the ClientTransaction, the
+// coins after from coll. A genesis coin object that is created by the
+// ClientTransaction, as told by states, the StateChanges it applied, counts as
+// if it already held all coins of its type, whatever it holds afterwards. The
+// incoming coins come from other shards and the outgoing coins have gone to
+// other shards.
+func checkCoins(coll collection.Collection, states, undo StateChanges, incoming, outgoing []Coin) error {
+	diff := map[string]*big.Int{}
+	add := func(coins []Coin, sign int64) {
+		for _, c := range coins {
+			key := string(c.Name.Slice())
+			if diff[key] == nil {
+				diff[key] = new(big.Int)
+			}
+			v := new(big.Int).SetUint64(c.Value)
+			diff[key].Add(diff[key], v.Mul(v, big.NewInt(sign)))
+		}
+	}
+
+	add(incoming, -1)
+	add(outgoing, 1)
+	seen := map[string]bool{}
+	for _, u := range undo {
+		// The first StateChange reverting an object holds its value before
+		// the ClientTransaction.
+		if seen[string(u.ObjectID)] {
+			continue
+		}
+		seen[string(u.ObjectID)] = true
+		if u.StateAction != Remove {
+			before, err := heldCoins(u.Value, u.ContractID)
+			if err != nil {
+				return err
+			}
+			add(before, -1)
+		} else if oid, ok := spawnedGenesis(states, u.ObjectID); ok {
+			add([]Coin{{Name: oid, Value: math.MaxUint64}}, -1)
+		}
+		rec, err := coll.Get(u.ObjectID).Record()
+		if err != nil {
+			return err
+		}
+		if !rec.Match() {
+			continue
+		}
+		vals, err := rec.Values()
+		if err != nil {
+			return err
+		}
+		after, err := heldCoins(vals[0].([]byte), vals[1].([]byte))
+		if err != nil {
+			return err
+		}
+		add(after, 1)
+	}
+	for key, d := range diff {
+		if d.Sign() != 0 {
+			return fmt.Errorf("transaction changes the coins %x by %s", []byte(key), d)
+		}
+	}
+	return nil
+}
+
+// spawnedGenesis returns whether the first of the StateChanges of the object
+// created a genesis coin object, which holds all coins named after it.
+func spawnedGenesis(states StateChanges, key []byte) (ObjectID, bool) {
+	oid, err := NewObjectIDFromSlice(key)
+	if err != nil {
+		return oid, false
+	}
+	for _, sc := range states {
+		if !bytes.Equal(sc.ObjectID, key) {
+			continue
+		}
+		if sc.StateAction != Create || string(sc.ContractID) != ContractCoinID {
+			return oid, false
+		}
+		coins, err := heldCoins(sc.Value, sc.ContractID)
+		return oid, err == nil && (CoinAccount{coins}).Balance(oid) == math.MaxUint64
+	}
+	return oid, false
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+func TestCoins_AddSub(t *testing.T) {
+	a := ObjectID{DarcID: darc.ID(ZeroNonce[:]), InstanceID: GenNonce()}
+	b := ObjectID{DarcID: darc.ID(ZeroNonce[:]), InstanceID: GenNonce()}
+
+	coins, err := addCoin(nil, Coin{Name: a, Value: 10})
+	require.Nil(t, err)
+	coins, err = addCoin(coins, Coin{Name: b, Value: 5})
+	require.Nil(t, err)
+	coins, err = addCoin(coins, Coin{Name: a, Value: 10})
+	require.Nil(t, err)
+	require.Equal(t, uint64(20), CoinAccount{coins}.Balance(a))
+	require.Equal(t, uint64(5), CoinAccount{coins}.Balance(b))
+
+	_, err = addCoin(coins, Coin{Name: a, Value: math.MaxUint64})
+	require.NotNil(t, err)
+
+	_, err = subCoin(coins, Coin{Name: b, Value: 6})
+	require.NotNil(t, err)
+	left, err := subCoin(coins, Coin{Name: b, Value: 5})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(left))
+	require.Equal(t, uint64(5), CoinAccount{coins}.Balance(b))
+}
+
+func TestService_CoinPipeline(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	// burn keeps all the coins it gets, mint returns more than it gets.
+	RegisterContract(s.hosts[0], "burn", func(cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		return nil, nil, nil
+	})
+	RegisterContract(s.hosts[0], "mint", func(cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		return nil, append(c, c...), nil
+	})
+
+	coinType := ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}
+	account := ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}
+	reward := ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}
+	newColl := func(reward *ObjectID) collection.Collection {
+		coll := newConfigColl(t, s, reward)
+		ca := CoinAccount{Coins: []Coin{{Name: coinType, Value: 100}}}
+		buf, err := protobuf.Encode(&ca)
+		require.Nil(t, err)
+		require.Nil(t, coll.Add(account.Slice(), buf, []byte(ContractCoinID)))
+		return coll
+	}
+	tx := func(contractID string, value uint64) ClientTransaction {
+		instr, err := createInstr(s.darc.GetBaseID(), contractID, []byte("a"), s.signer)
+		require.Nil(t, err)
+		instr.Coins = []CoinInput{{
+			Account: account,
+			Coin:    Coin{Name: coinType, Value: value},
+		}}
+		return ClientTransaction{Instructions: []Instruction{instr}}
+	}
+	balance := func(coll collection.Collection, oid ObjectID) uint64 {
+		ca, err := loadCoinAccount(coll, oid.Slice())
+		require.Nil(t, err)
+		if ca == nil {
+			return 0
+		}
+		return ca.Balance(coinType)
+	}
+
+	coll := newColl(&reward)
+	_, ctsOK, scs, _, err := s.service().createStateChanges(coll, Context{}, ClientTransactions{
+		tx(ContractValueID, 30),
+		tx("burn", 10),
+		tx("mint", 10),
+		tx(ContractValueID, 1000),
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ctsOK))
+	for i := range scs {
+		require.Nil(t, storeInColl(coll, &scs[i]))
+	}
+	require.Equal(t, uint64(70), balance(coll, account))
+	require.Equal(t, uint64(30), balance(coll, reward))
+
+	// Without a reward account, the leftover coins would be lost.
+	coll = newColl(nil)
+	_, ctsOK, _, _, err = s.service().createStateChanges(coll, Context{}, ClientTransactions{
+		tx(ContractValueID, 30),
+	})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ctsOK))
+}
+
+// newConfigColl returns a collection holding the configuration of the
+// skipchain of s, with the given reward account and other arguments.
+func newConfigColl(t *testing.T, s *ser, reward *ObjectID, extra ...Argument) collection.Collection {
+	coll := collection.New(collection.Data{}, collection.Data{})
+	darcBuf, err := s.darc.ToProto()
+	require.Nil(t, err)
+	intervalBuf := make([]byte, 8)
+	binary.PutVarint(intervalBuf, int64(testInterval))
+	args := Arguments{
+		{Name: "darc", Value: darcBuf},
+		{Name: "block_interval", Value: intervalBuf},
+	}
+	if reward != nil {
+		args = append(args, Argument{Name: "reward_account", Value: reward.Slice()})
+	}
+	args = append(args, extra...)
+	scs, _, err := s.service().ContractConfig(coll, Instruction{
+		ObjectID: ObjectID{DarcID: s.darc.GetBaseID()},
+		Spawn:    &Spawn{ContractID: ContractConfigID, Args: args},
+	}, nil)
+	require.Nil(t, err)
+	for i := range scs {
+		require.Nil(t, storeInColl(coll, &scs[i]))
+	}
+	return coll
+}
+
+func TestService_CoinInputSignature(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, s.roster,
+		[]string{"Spawn_dummy", "Invoke_" + CmdCoinFetch}, s.signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = s.interval
+	resp, err := s.service().CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	id := resp.Skipblock.SkipChainID()
+	darcID := genesisMsg.GenesisDarc.GetBaseID()
+
+	instr := Instruction{
+		ObjectID: ObjectID{DarcID: darcID, InstanceID: GenNonce()},
+		Spawn:    &Spawn{ContractID: dummyKind},
+		Coins: []CoinInput{{
+			Account: ObjectID{DarcID: darcID, InstanceID: GenNonce()},
+			Coin:    Coin{Name: ObjectID{DarcID: darcID, InstanceID: GenNonce()}, Value: 10},
+		}},
+	}
+	require.Nil(t, instr.SignBy(s.signer))
+	require.NotNil(t, s.service().verifyInstruction(id, instr))
+
+	require.Nil(t, instr.SignCoinInput(0, darc.NewSignerEd25519(nil, nil)))
+	require.NotNil(t, s.service().verifyInstruction(id, instr))
+
+	require.Nil(t, instr.SignCoinInput(0, s.signer))
+	require.Nil(t, s.service().verifyInstruction(id, instr))
+
+	// The signatures cover the coins that are taken.
+	instr.Coins[0].Coin.Value = 20
+	require.NotNil(t, s.service().verifyInstruction(id, instr))
+}
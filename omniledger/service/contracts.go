@@ -1,8 +1,12 @@
 package service
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
+	"sort"
 	"time"
 
 	"github.com/dedis/protobuf"
@@ -10,7 +14,11 @@ import (
 	"student_18_byzcoin/omniledger/collection"
 	// "github.com/dedis/student_18_omniledger/omniledger/collection"
 	// "github.com/dedis/student_18_omniledger/omniledger/darc"
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2"
 	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
 )
 
 // Here we give a definition of pre-defined contracts.
@@ -41,16 +49,208 @@ var ContractDarcID = "darc"
 // CmdDarcEvolve is needed to evolve a darc.
 var CmdDarcEvolve = "Evolve"
 
+// ContractValueID denotes a value-contract
+var ContractValueID = "value"
+
+// CmdValueUpdate is needed to update a value.
+var CmdValueUpdate = "update"
+
+// ContractCoinID denotes a coin-contract. Its objects are coin accounts and
+// their value is a CoinAccount.
+var ContractCoinID = "coin"
+
+// CmdCoinMint is needed to create new coins.
+var CmdCoinMint = "mint"
+
+// CmdCoinTransfer is needed to send coins to another account.
+var CmdCoinTransfer = "transfer"
+
+// CmdCoinFetch is needed to take coins from an account.
+var CmdCoinFetch = "fetch"
+
+// CmdConfigEpoch is used by the leader to start a new epoch.
+var CmdConfigEpoch = "epoch"
+
+// CmdConfigShards is the command recording the shards in the config of an
+// identity chain.
+var CmdConfigShards = "shards"
+
+// CmdConfigContracts is the command replacing the contracts enabled on a
+// skipchain.
+var CmdConfigContracts = "contracts"
+
+// CmdConfigUpgrade is the command scheduling a new version of a contract.
+var CmdConfigUpgrade = "upgrade"
+
+// ContractStakeID denotes a stake-contract. Its value is a Stake.
+var ContractStakeID = "stake"
+
+// CmdStakeUnlock is needed to unlock a stake.
+var CmdStakeUnlock = "unlock"
+
+// CmdStakeWithdraw is needed to get the coins of an unlocked stake back.
+var CmdStakeWithdraw = "withdraw"
+
 // Config stores all the configuration information for one skipchain. It will
 // be stored under the key "GenesisDarcID || OneNonce", in the collections. The
 // GenesisDarcID is the value of GenesisReferenceID.
 type Config struct {
 	BlockInterval time.Duration
+	// RewardAccount receives the coins left over by the transactions. If
+	// it is nil, transactions with leftover coins are refused.
+	RewardAccount *ObjectID
+	// Epochs defines how the roster is chosen from the stakes.
+	Epochs EpochConfig
+	// Epoch is the number of the current epoch.
+	Epoch uint64
+	// EpochIndex is the index of the block that started the current
+	// epoch.
+	EpochIndex int
+	// Roster is the roster chosen for the current epoch. It is only set if
+	// the roster is chosen from the stakes.
+	Roster *onet.Roster
+	// Shards holds the shards of a sharded ledger, if the skipchain is its
+	// identity chain.
+	Shards *ShardConfig
+	// Identity is the identity chain, if the skipchain is a shard, and
+	// Shard the index of the shard in it.
+	Identity skipchain.SkipBlockID
+	Shard    int
+	// Limits bounds the resources of the transactions, if it is set.
+	Limits *Limits
+	// Contracts holds the contracts that can be used on the skipchain. If
+	// it is nil, all contracts registered by the nodes can be used.
+	Contracts *ContractWhitelist
+	// Upgrades holds the versions of contracts that are active from a
+	// given block on, see versions.go.
+	Upgrades []ContractUpgrade
+	// Stakes holds the stakes that are locked, so that an epoch doesn't
+	// need to go through the whole collection to find them.
+	Stakes []ObjectID
+}
+
+// DefaultContractVersion is the version of contracts registered without a
+// version.
+const DefaultContractVersion = 1
+
+// EnabledContract is a contract that can be used on a skipchain.
+type EnabledContract struct {
+	// ID is the ID the contract is registered with.
+	ID string
+	// Version is the version of the contract the nodes must run, until
+	// an upgrade is activated.
+	Version int
+}
+
+// ContractWhitelist is the set of contracts enabled on a skipchain. The
+// config contract is always enabled, so that the set can be changed.
+//
+// As every node checks the instructions of a block against the set, a leader
+// cannot use a contract the other nodes don't have, and a node refuses to sign
+// a block using a contract it doesn't have.
+type ContractWhitelist struct {
+	Contracts []EnabledContract
+}
+
+// verify checks that every contract is enabled only once, with a valid
+// version.
+func (cw ContractWhitelist) verify() error {
+	seen := make(map[string]bool)
+	for _, c := range cw.Contracts {
+		if c.ID == "" || c.Version <= 0 {
+			return fmt.Errorf("invalid contract %q version %d", c.ID, c.Version)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("contract %q is enabled twice", c.ID)
+		}
+		seen[c.ID] = true
+	}
+	return nil
+}
+
+// version returns the enabled version of the contract, or 0 if it is not
+// enabled.
+func (cw *ContractWhitelist) version(contractID string) int {
+	if cw == nil || contractID == ContractConfigID {
+		return DefaultContractVersion
+	}
+	for _, c := range cw.Contracts {
+		if c.ID == contractID {
+			return c.Version
+		}
+	}
+	return 0
+}
+
+// usedContracts returns the sorted IDs of the contracts called by the
+// transactions of the receipts.
+func usedContracts(receipts []Receipt) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, r := range receipts {
+		for _, c := range r.Contracts {
+			if !seen[c] {
+				seen[c] = true
+				ids = append(ids, c)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// sameContracts returns whether both lists hold the same IDs in the same
+// order.
+func sameContracts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyBlockContracts checks that the node has all contracts used by the
+// block, in the versions enabled on its skipchain as of the previous block.
+func (s *Service) verifyBlockContracts(sb *skipchain.SkipBlock, header *DataHeader) error {
+	// The config is only known once the genesis block is applied.
+	var config *Config
+	if sb.Index > 0 {
+		coll, err := s.previousState(sb)
+		if err != nil {
+			return err
+		}
+		if config, err = loadConfig(coll); err != nil {
+			return err
+		}
+	}
+	// The versions are those the block was executed with, so an upgrade
+	// stored after the previous block doesn't change them.
+	for _, id := range header.Contracts {
+		version := DefaultContractVersion
+		if config != nil {
+			version = config.contractVersion(id, sb.Index)
+		}
+		if !s.hasContract(id, version) {
+			return fmt.Errorf("block uses contract %s in version %d, which this node doesn't have", id, version)
+		}
+	}
+	return nil
 }
 
 // ContractConfig can only be instantiated once per skipchain, and only for
-// the genesis block.
+// the genesis block. Afterwards, the leader invokes "epoch" on it at the
+// beginning of every epoch, which needs the Context, see contractConfig.
 func (s *Service) ContractConfig(cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	if tx.Invoke != nil {
+		switch tx.Invoke.Command {
+		case CmdConfigShards:
+			return s.contractConfigShards(cdb, tx, coins)
+		}
+	}
 	if tx.Spawn == nil {
 		return nil, nil, errors.New("Config can only be spawned")
 	}
@@ -68,9 +268,14 @@ func (s *Service) ContractConfig(cdb collection.Collection, tx Instruction, coin
 		return
 	}
 
-	// sanity check the block interval
-	intervalBuf := tx.Spawn.Args.Search("block_interval")
-	interval, _ := binary.Varint(intervalBuf)
+	// sanity check the block interval. The genesis transactions of the
+	// existing skipchains wrote it in 8 bytes, so trailing bytes are
+	// accepted.
+	interval, n := binary.Varint(tx.Spawn.Args.Search("block_interval"))
+	if n <= 0 {
+		err = errors.New("invalid block interval")
+		return
+	}
 	if interval == 0 {
 		err = errors.New("block interval is zero")
 		return
@@ -80,6 +285,57 @@ func (s *Service) ContractConfig(cdb collection.Collection, tx Instruction, coin
 	config := Config{
 		BlockInterval: time.Duration(interval),
 	}
+	if buf := tx.Spawn.Args.Search("reward_account"); buf != nil {
+		var reward ObjectID
+		reward, err = NewObjectIDFromSlice(buf)
+		if err != nil {
+			return
+		}
+		config.RewardAccount = &reward
+	}
+	if buf := tx.Spawn.Args.Search("epochs"); buf != nil {
+		if err = protobuf.Decode(buf, &config.Epochs); err != nil {
+			return
+		}
+		config.Roster = &onet.Roster{}
+		err = protobuf.DecodeWithConstructors(tx.Spawn.Args.Search("roster"), config.Roster,
+			network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return
+		}
+		if len(config.Roster.List) == 0 || config.Epochs.Length <= 0 || config.Epochs.RosterSize <= 0 {
+			err = errors.New("invalid epoch configuration")
+			return
+		}
+	}
+	if buf := tx.Spawn.Args.Search("limits"); buf != nil {
+		config.Limits = &Limits{}
+		if err = protobuf.Decode(buf, config.Limits); err != nil {
+			return
+		}
+	}
+	// An empty whitelist is encoded as an empty value.
+	if buf, ok := tx.Spawn.Args.Lookup("contracts"); ok {
+		config.Contracts = &ContractWhitelist{}
+		if err = protobuf.Decode(buf, config.Contracts); err != nil {
+			return
+		}
+		if err = config.Contracts.verify(); err != nil {
+			return
+		}
+	}
+	if buf := tx.Spawn.Args.Search("identity"); buf != nil {
+		config.Identity = skipchain.SkipBlockID(buf)
+		var shard int64
+		if shard, err = tx.Spawn.Args.Varint("shard"); err != nil {
+			return
+		}
+		if shard < 0 {
+			err = errors.New("invalid shard")
+			return
+		}
+		config.Shard = int(shard)
+	}
 	configBuf, err := protobuf.Encode(&config)
 	if err != nil {
 		return
@@ -93,7 +349,119 @@ func (s *Service) ContractConfig(cdb collection.Collection, tx Instruction, coin
 				DarcID:     tx.ObjectID.DarcID,
 				InstanceID: OneNonce,
 			}, ContractConfigID, configBuf),
-	}, nil, nil
+	}, coins, nil
+}
+
+// contractConfigEpoch starts a new epoch: the roster is chosen from the
+// stakes, using the "seed" argument for a random choice. As the leader
+// doesn't sign the instruction, the seed must be the one of the Context,
+// which every node derives from the previous block, and the block must be
+// the first of an epoch that has not been started yet.
+func (s *Service) contractConfigEpoch(ctx Context, cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	if tx.ObjectID.InstanceID != OneNonce {
+		return nil, nil, errors.New("epochs are started on the config")
+	}
+	config, err := loadConfig(cdb)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.Epochs.Length <= 0 || config.Roster == nil {
+		return nil, nil, errors.New("skipchain has no epochs")
+	}
+	if ctx.Index%config.Epochs.Length != 0 {
+		return nil, nil, fmt.Errorf("block %d doesn't start an epoch", ctx.Index)
+	}
+	if config.Epoch > 0 && config.EpochIndex >= ctx.Index {
+		return nil, nil, fmt.Errorf("epoch of block %d is already started", ctx.Index)
+	}
+	seed := tx.Invoke.Args.Search("seed")
+	if len(ctx.epochSeed) == 0 || !bytes.Equal(seed, ctx.epochSeed) {
+		return nil, nil, errors.New("wrong seed for the epoch")
+	}
+	stakes, err := loadStakes(cdb, config, config.Epochs.Coin)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Roster, err = selectRoster(config.Roster, config.Epochs, stakes, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Epoch++
+	config.EpochIndex = ctx.Index
+	if config.Shards != nil {
+		if err = config.Shards.reassign(config.Epoch, seed); err != nil {
+			return nil, nil, err
+		}
+	}
+	configBuf, err := protobuf.Encode(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []StateChange{
+		NewStateChange(Update, tx.ObjectID, ContractConfigID, configBuf),
+	}, coins, nil
+}
+
+// contractConfigShards records the shards of the "shards" argument in the
+// config of an identity chain. The shards can only be recorded once, and
+// their rosters must be the assignment of the seed.
+func (s *Service) contractConfigShards(cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	if tx.ObjectID.InstanceID != OneNonce {
+		return nil, nil, errors.New("shards are recorded in the config")
+	}
+	config, err := loadConfig(cdb)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.Shards != nil {
+		return nil, nil, errors.New("shards are already recorded")
+	}
+	shards := &ShardConfig{}
+	err = protobuf.DecodeWithConstructors(tx.Invoke.Args.Search("shards"), shards,
+		network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = shards.verify(); err != nil {
+		return nil, nil, err
+	}
+	config.Shards = shards
+	configBuf, err := protobuf.Encode(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []StateChange{
+		NewStateChange(Update, tx.ObjectID, ContractConfigID, configBuf),
+	}, coins, nil
+}
+
+// contractConfigContracts replaces the contracts enabled on the skipchain with
+// the ContractWhitelist of the "contracts" argument. Who may do so is defined
+// by the rule "Invoke_contracts" of the genesis darc. The versions of the new
+// whitelist replace the upgrades activated so far.
+func (s *Service) contractConfigContracts(ctx Context, cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	if tx.ObjectID.InstanceID != OneNonce {
+		return nil, nil, errors.New("contracts are enabled in the config")
+	}
+	config, err := loadConfig(cdb)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.Contracts = &ContractWhitelist{}
+	if err = protobuf.Decode(tx.Invoke.Args.Search("contracts"), config.Contracts); err != nil {
+		return nil, nil, err
+	}
+	if err = config.Contracts.verify(); err != nil {
+		return nil, nil, err
+	}
+	config.Upgrades = pendingUpgrades(config.Upgrades, ctx.Index)
+	configBuf, err := protobuf.Encode(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []StateChange{
+		NewStateChange(Update, tx.ObjectID, ContractConfigID, configBuf),
+	}, coins, nil
 }
 
 // ContractDarc accepts the following instructions:
@@ -102,3 +470,301 @@ func (s *Service) ContractConfig(cdb collection.Collection, tx Instruction, coin
 func (s *Service) ContractDarc(cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
 	return nil, nil, errors.New("Not yet implemented")
 }
+
+// ContractValue stores an arbitrary value given in the "value" argument. It
+// accepts the following instructions:
+//   - Spawn - creates a new value
+//   - Invoke.update - replaces the value
+//   - Delete - removes the value
+// Who may do what is defined by the rules "Spawn_value", "Invoke_update" and
+// "Delete" of the darc of the object.
+func (s *Service) ContractValue(cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	switch {
+	case tx.Spawn != nil:
+		rec, err := cdb.Get(tx.ObjectID.Slice()).Record()
+		if err != nil {
+			return nil, nil, err
+		}
+		if rec.Match() {
+			return nil, nil, errors.New("object already exists")
+		}
+		return []StateChange{
+			NewStateChange(Create, tx.ObjectID, ContractValueID, tx.Spawn.Args.Search("value")),
+		}, coins, nil
+	case tx.Invoke != nil:
+		if tx.Invoke.Command != CmdValueUpdate {
+			return nil, nil, errors.New("Value contract can only update")
+		}
+		return []StateChange{
+			NewStateChange(Update, tx.ObjectID, ContractValueID, tx.Invoke.Args.Search("value")),
+		}, coins, nil
+	case tx.Delete != nil:
+		return []StateChange{
+			NewStateChange(Remove, tx.ObjectID, ContractValueID, nil),
+		}, coins, nil
+	}
+	return nil, nil, errors.New("instruction without action")
+}
+
+// ContractCoin handles coin accounts. Spawning an object creates an empty
+// account that can hold all types of coins. Spawning an object with the
+// argument "genesis" creates a new type of coin instead, named after the
+// object. This genesis coin object holds all the coins of its type that have
+// not been minted yet, and its darc defines who may mint them. It accepts the
+// following instructions:
+//   - Spawn - creates a new account or a new type of coin
+//   - Invoke.mint - moves "value" coins from the genesis coin object to the
+//     account "destination"
+//   - Invoke.transfer - moves "value" coins of the type "coin" to the account
+//     "destination"
+//   - Invoke.fetch - takes "value" coins of the type "coin" from the account
+//     and hands them to the next contracts
+//   - Delete - removes an empty account
+//
+// Objects are given as ObjectID.Slice and values as 8 bytes in little endian.
+// The coins received from the previous contracts are handed on unchanged,
+// except for fetch, which adds to them.
+func (s *Service) ContractCoin(cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	if tx.Spawn != nil {
+		rec, err := cdb.Get(tx.ObjectID.Slice()).Record()
+		if err != nil {
+			return nil, nil, err
+		}
+		if rec.Match() {
+			return nil, nil, errors.New("object already exists")
+		}
+		ca := CoinAccount{}
+		if tx.Spawn.Args.Search("genesis") != nil {
+			ca.Coins = []Coin{{Name: tx.ObjectID, Value: math.MaxUint64}}
+		}
+		buf, err := protobuf.Encode(&ca)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []StateChange{
+			NewStateChange(Create, tx.ObjectID, ContractCoinID, buf),
+		}, coins, nil
+	}
+
+	ca, err := loadCoinAccount(cdb, tx.ObjectID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	if ca == nil {
+		return nil, nil, errors.New("coin account doesn't exist")
+	}
+	if tx.Delete != nil {
+		for _, coin := range ca.Coins {
+			if coin.Value > 0 {
+				return nil, nil, errors.New("only empty accounts can be deleted")
+			}
+		}
+		return []StateChange{
+			NewStateChange(Remove, tx.ObjectID, ContractCoinID, nil),
+		}, coins, nil
+	}
+	if tx.Invoke == nil {
+		return nil, nil, errors.New("instruction without action")
+	}
+
+	value, err := coinValueArg(tx.Invoke.Args)
+	if err != nil {
+		return nil, nil, err
+	}
+	coin := Coin{Name: tx.ObjectID, Value: value}
+	if tx.Invoke.Command != CmdCoinMint {
+		if coin.Name, err = NewObjectIDFromSlice(tx.Invoke.Args.Search("coin")); err != nil {
+			return nil, nil, err
+		}
+		// The coins of a genesis coin object can only be minted.
+		if coin.Name.Equal(tx.ObjectID) {
+			return nil, nil, errors.New("coins of a genesis coin object must be minted")
+		}
+	}
+	// All commands take coins from the account.
+	if ca.Coins, err = subCoin(ca.Coins, coin); err != nil {
+		return nil, nil, err
+	}
+	buf, err := protobuf.Encode(ca)
+	if err != nil {
+		return nil, nil, err
+	}
+	sc = []StateChange{NewStateChange(Update, tx.ObjectID, ContractCoinID, buf)}
+
+	switch tx.Invoke.Command {
+	case CmdCoinMint, CmdCoinTransfer:
+		dest, err := NewObjectIDFromSlice(tx.Invoke.Args.Search("destination"))
+		if err != nil {
+			return nil, nil, err
+		}
+		if dest.Equal(tx.ObjectID) {
+			return nil, nil, errors.New("cannot send coins to the same account")
+		}
+		destAccount, err := loadCoinAccount(cdb, dest.Slice())
+		if err != nil {
+			return nil, nil, err
+		}
+		if destAccount == nil {
+			return nil, nil, errors.New("destination account doesn't exist")
+		}
+		credit, err := creditCoins(cdb, dest, []Coin{coin})
+		if err != nil {
+			return nil, nil, err
+		}
+		return append(sc, credit), coins, nil
+	case CmdCoinFetch:
+		if c, err = addCoin(coins, coin); err != nil {
+			return nil, nil, err
+		}
+		return sc, c, nil
+	}
+	return nil, nil, errors.New("Coin contract can only mint, transfer and fetch")
+}
+
+// coinValueArg returns the number of coins given in the argument "value".
+func coinValueArg(args Arguments) (uint64, error) {
+	value, err := args.Uint64("value")
+	if err != nil {
+		return 0, err
+	}
+	if value == 0 {
+		return 0, errors.New("value is zero")
+	}
+	return value, nil
+}
+
+// Stake is the value of a stake object.
+type Stake struct {
+	// Conode is the node that the coins are staked for.
+	Conode *network.ServerIdentity
+	// Coin is the type and the number of coins that are locked.
+	Coin Coin
+	// Unlocked is set once the holder asks for the coins back. Unlocked
+	// stakes are not taken into account anymore.
+	Unlocked bool
+	// UnlockEpoch is the first epoch in which the coins of an unlocked
+	// stake can be withdrawn.
+	UnlockEpoch uint64
+}
+
+// ContractStake locks coins for a conode, so that the conode can be chosen
+// for the roster of the next epochs. It accepts the following instructions:
+//   - Spawn - locks "value" coins for the conode "conode", a protobuf-encoded
+//     network.ServerIdentity. The coins are taken from the coins handed over
+//     by the previous contracts and must be of the type used for staking.
+//   - Invoke.unlock - unlocks the stake, which can be withdrawn once the delay
+//     of the configuration has passed
+//   - Invoke.withdraw - sends the coins of an unlocked stake to the account
+//     "destination" and removes the stake
+//
+// The locked stakes are listed in the config, so Spawn and unlock update it.
+func (s *Service) ContractStake(cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	config, err := loadConfig(cdb)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.Epochs.Length <= 0 {
+		return nil, nil, errors.New("skipchain has no epochs")
+	}
+
+	if tx.Spawn != nil {
+		rec, err := cdb.Get(tx.ObjectID.Slice()).Record()
+		if err != nil {
+			return nil, nil, err
+		}
+		if rec.Match() {
+			return nil, nil, errors.New("object already exists")
+		}
+		stake := Stake{Conode: &network.ServerIdentity{}}
+		err = protobuf.DecodeWithConstructors(tx.Spawn.Args.Search("conode"), stake.Conode,
+			network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return nil, nil, err
+		}
+		if stake.Conode.Public == nil {
+			return nil, nil, errors.New("conode has no public key")
+		}
+		value, err := coinValueArg(tx.Spawn.Args)
+		if err != nil {
+			return nil, nil, err
+		}
+		stake.Coin = Coin{Name: config.Epochs.Coin, Value: value}
+		if c, err = subCoin(coins, stake.Coin); err != nil {
+			return nil, nil, err
+		}
+		buf, err := protobuf.Encode(&stake)
+		if err != nil {
+			return nil, nil, err
+		}
+		configSC, err := updateStakes(cdb, config, func(stakes []ObjectID) []ObjectID {
+			return append(stakes, tx.ObjectID)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return []StateChange{
+			NewStateChange(Create, tx.ObjectID, ContractStakeID, buf),
+			configSC,
+		}, c, nil
+	}
+
+	stake, err := loadStake(cdb, tx.ObjectID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	if tx.Invoke == nil {
+		return nil, nil, errors.New("Stake contract can only be spawned and invoked")
+	}
+	switch tx.Invoke.Command {
+	case CmdStakeUnlock:
+		if stake.Unlocked {
+			return nil, nil, errors.New("stake is already unlocked")
+		}
+		stake.Unlocked = true
+		stake.UnlockEpoch = config.Epoch + config.Epochs.UnlockDelay
+		buf, err := protobuf.Encode(stake)
+		if err != nil {
+			return nil, nil, err
+		}
+		configSC, err := updateStakes(cdb, config, func(stakes []ObjectID) []ObjectID {
+			var locked []ObjectID
+			for _, oid := range stakes {
+				if !oid.Equal(tx.ObjectID) {
+					locked = append(locked, oid)
+				}
+			}
+			return locked
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return []StateChange{
+			NewStateChange(Update, tx.ObjectID, ContractStakeID, buf),
+			configSC,
+		}, coins, nil
+	case CmdStakeWithdraw:
+		if !stake.Unlocked || config.Epoch < stake.UnlockEpoch {
+			return nil, nil, errors.New("stake is still locked")
+		}
+		dest, err := NewObjectIDFromSlice(tx.Invoke.Args.Search("destination"))
+		if err != nil {
+			return nil, nil, err
+		}
+		destAccount, err := loadCoinAccount(cdb, dest.Slice())
+		if err != nil {
+			return nil, nil, err
+		}
+		if destAccount == nil {
+			return nil, nil, errors.New("destination account doesn't exist")
+		}
+		credit, err := creditCoins(cdb, dest, []Coin{stake.Coin})
+		if err != nil {
+			return nil, nil, err
+		}
+		return []StateChange{
+			NewStateChange(Remove, tx.ObjectID, ContractStakeID, nil),
+			credit,
+		}, coins, nil
+	}
+	return nil, nil, errors.New("Stake contract can only unlock and withdraw")
+}
@@ -0,0 +1,541 @@
+package service
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/network"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+func TestContractValue(t *testing.T) {
+	s := &Service{}
+	coll := collection.New(collection.Data{}, collection.Data{})
+	oid := ObjectID{DarcID: darc.ID(ZeroNonce[:]), InstanceID: GenNonce()}
+
+	scs, _, err := s.ContractValue(coll, Instruction{
+		ObjectID: oid,
+		Spawn: &Spawn{
+			ContractID: ContractValueID,
+			Args:       Arguments{{Name: "value", Value: []byte("first")}},
+		},
+	}, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(scs))
+	require.Equal(t, Create, scs[0].StateAction)
+	require.Equal(t, []byte("first"), scs[0].Value)
+	require.Nil(t, storeInColl(coll, &scs[0]))
+
+	// The value cannot be spawned twice.
+	_, _, err = s.ContractValue(coll, Instruction{
+		ObjectID: oid,
+		Spawn:    &Spawn{ContractID: ContractValueID},
+	}, nil)
+	require.NotNil(t, err)
+
+	scs, _, err = s.ContractValue(coll, Instruction{
+		ObjectID: oid,
+		Invoke: &Invoke{
+			Command: CmdValueUpdate,
+			Args:    Arguments{{Name: "value", Value: []byte("second")}},
+		},
+	}, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(scs))
+	require.Equal(t, Update, scs[0].StateAction)
+	require.Equal(t, []byte("second"), scs[0].Value)
+
+	_, _, err = s.ContractValue(coll, Instruction{
+		ObjectID: oid,
+		Invoke:   &Invoke{Command: "other"},
+	}, nil)
+	require.NotNil(t, err)
+
+	scs, _, err = s.ContractValue(coll, Instruction{
+		ObjectID: oid,
+		Delete:   &Delete{},
+	}, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(scs))
+	require.Equal(t, Remove, scs[0].StateAction)
+}
+
+func TestService_ContractValue(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	defer closeQueues(local)
+	hosts, roster, _ := local.GenTree(2, true)
+	service := local.GetServices(hosts, omniledgerID)[0].(*Service)
+
+	// The same rules as the ones of the CLI.
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, roster,
+		[]string{"Spawn_value", "Invoke_update", "Delete"}, signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = testInterval
+	resp, err := service.CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	id := resp.Skipblock.SkipChainID()
+
+	oid := ObjectID{DarcID: genesisMsg.GenesisDarc.GetBaseID(), InstanceID: GenNonce()}
+	send := func(instr Instruction, signer *darc.Signer) {
+		instr.ObjectID = oid
+		require.Nil(t, instr.SignBy(signer))
+		_, err := service.AddTransaction(&AddTxRequest{
+			Version:     CurrentVersion,
+			SkipchainID: id,
+			Transaction: ClientTransaction{Instructions: []Instruction{instr}},
+		})
+		require.Nil(t, err)
+	}
+	waitValue := func(value []byte) {
+		for i := 0; i < 20; i++ {
+			time.Sleep(2 * testInterval)
+			rep, err := service.GetProof(&GetProof{
+				Version: CurrentVersion,
+				ID:      id,
+				Key:     oid.Slice(),
+			})
+			require.Nil(t, err)
+			require.Nil(t, rep.Proof.Verify(id))
+			_, values, err := rep.Proof.KeyValue()
+			if value == nil && err != nil {
+				return
+			}
+			if err == nil && string(values[0]) == string(value) {
+				require.Equal(t, ContractValueID, string(values[1]))
+				return
+			}
+		}
+		require.Fail(t, "value didn't get stored")
+	}
+
+	send(Instruction{Spawn: &Spawn{
+		ContractID: ContractValueID,
+		Args:       Arguments{{Name: "value", Value: []byte("first")}},
+	}}, signer)
+	waitValue([]byte("first"))
+
+	// Only the signers allowed by the darc may update the value.
+	send(Instruction{Invoke: &Invoke{
+		Command: CmdValueUpdate,
+		Args:    Arguments{{Name: "value", Value: []byte("other")}},
+	}}, darc.NewSignerEd25519(nil, nil))
+	time.Sleep(4 * testInterval)
+	waitValue([]byte("first"))
+	send(Instruction{Invoke: &Invoke{
+		Command: CmdValueUpdate,
+		Args:    Arguments{{Name: "value", Value: []byte("second")}},
+	}}, signer)
+	waitValue([]byte("second"))
+
+	send(Instruction{Delete: &Delete{}}, signer)
+	waitValue(nil)
+}
+
+func TestService_ContractCoinInstructions(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	newOID := func() ObjectID {
+		return ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}
+	}
+	genesis, a, b := newOID(), newOID(), newOID()
+	coll := newConfigColl(t, s, &b)
+	// run applies the instructions in their own transaction and returns
+	// whether it has been accepted.
+	run := func(instrs ...Instruction) bool {
+		_, ctsOK, scs, _, err := s.service().createStateChanges(coll, Context{},
+			ClientTransactions{{Instructions: instrs}})
+		require.Nil(t, err)
+		for i := range scs {
+			require.Nil(t, storeInColl(coll, &scs[i]))
+		}
+		return len(ctsOK) == 1
+	}
+	invoke := func(oid ObjectID, cmd string, value uint64, dest ObjectID) Instruction {
+		valueBuf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(valueBuf, value)
+		return Instruction{ObjectID: oid, Invoke: &Invoke{
+			Command: cmd,
+			Args: Arguments{
+				{Name: "coin", Value: genesis.Slice()},
+				{Name: "value", Value: valueBuf},
+				{Name: "destination", Value: dest.Slice()},
+			},
+		}}
+	}
+	balance := func(oid ObjectID) uint64 {
+		ca, err := loadCoinAccount(coll, oid.Slice())
+		require.Nil(t, err)
+		return ca.Balance(genesis)
+	}
+
+	require.True(t, run(Instruction{ObjectID: genesis, Spawn: &Spawn{
+		ContractID: ContractCoinID,
+		Args:       Arguments{{Name: "genesis", Value: []byte{1}}},
+	}}))
+	require.Equal(t, uint64(math.MaxUint64), balance(genesis))
+	require.True(t, run(Instruction{ObjectID: a, Spawn: &Spawn{ContractID: ContractCoinID}}))
+	require.True(t, run(Instruction{ObjectID: b, Spawn: &Spawn{ContractID: ContractCoinID}}))
+	require.False(t, run(Instruction{ObjectID: b, Spawn: &Spawn{ContractID: ContractCoinID}}))
+
+	// Only the genesis coin object can mint, and only by minting.
+	require.True(t, run(invoke(genesis, CmdCoinMint, 100, a)))
+	require.False(t, run(invoke(a, CmdCoinMint, 100, b)))
+	require.False(t, run(invoke(genesis, CmdCoinTransfer, 100, a)))
+	require.Equal(t, uint64(100), balance(a))
+	require.Equal(t, uint64(math.MaxUint64-100), balance(genesis))
+
+	require.True(t, run(invoke(a, CmdCoinTransfer, 30, b)))
+	require.False(t, run(invoke(a, CmdCoinTransfer, 71, b)))
+	require.False(t, run(invoke(a, CmdCoinTransfer, 10, newOID())))
+	require.Equal(t, uint64(70), balance(a))
+	require.Equal(t, uint64(30), balance(b))
+
+	// The fetched coins are left over and go to the reward account b.
+	require.True(t, run(invoke(a, CmdCoinFetch, 20, b)))
+	require.Equal(t, uint64(50), balance(a))
+	require.Equal(t, uint64(50), balance(b))
+
+	require.False(t, run(Instruction{ObjectID: a, Delete: &Delete{}}))
+	require.True(t, run(invoke(a, CmdCoinTransfer, 50, b)))
+	require.True(t, run(Instruction{ObjectID: a, Delete: &Delete{}}))
+
+	// A new type of coin can be minted completely when it is created.
+	full, c := newOID(), newOID()
+	require.True(t, run(
+		Instruction{ObjectID: c, Spawn: &Spawn{ContractID: ContractCoinID}},
+		Instruction{ObjectID: full, Spawn: &Spawn{
+			ContractID: ContractCoinID,
+			Args:       Arguments{{Name: "genesis", Value: []byte{1}}},
+		}},
+		invoke(full, CmdCoinMint, math.MaxUint64, c),
+	))
+	ca, err := loadCoinAccount(coll, c.Slice())
+	require.Nil(t, err)
+	require.Equal(t, uint64(math.MaxUint64), ca.Balance(full))
+}
+
+func TestService_ContractCoin(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	defer closeQueues(local)
+	hosts, roster, _ := local.GenTree(2, true)
+	service := local.GetServices(hosts, omniledgerID)[0].(*Service)
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, roster,
+		[]string{"Spawn_coin", "Invoke_mint", "Invoke_transfer"}, signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = testInterval
+	resp, err := service.CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	id := resp.Skipblock.SkipChainID()
+
+	darcID := genesisMsg.GenesisDarc.GetBaseID()
+	genesis := ObjectID{DarcID: darcID, InstanceID: GenNonce()}
+	a := ObjectID{DarcID: darcID, InstanceID: GenNonce()}
+	b := ObjectID{DarcID: darcID, InstanceID: GenNonce()}
+	send := func(signer *darc.Signer, instrs ...Instruction) {
+		for i := range instrs {
+			instrs[i].Index, instrs[i].Length = i, len(instrs)
+			require.Nil(t, instrs[i].SignBy(signer))
+		}
+		_, err := service.AddTransaction(&AddTxRequest{
+			Version:     CurrentVersion,
+			SkipchainID: id,
+			Transaction: ClientTransaction{Instructions: instrs},
+		})
+		require.Nil(t, err)
+	}
+	invoke := func(oid ObjectID, cmd string, value uint64, dest ObjectID) Instruction {
+		valueBuf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(valueBuf, value)
+		return Instruction{ObjectID: oid, Invoke: &Invoke{
+			Command: cmd,
+			Args: Arguments{
+				{Name: "coin", Value: genesis.Slice()},
+				{Name: "value", Value: valueBuf},
+				{Name: "destination", Value: dest.Slice()},
+			},
+		}}
+	}
+	waitBalance := func(oid ObjectID, value uint64) {
+		for i := 0; i < 20; i++ {
+			time.Sleep(2 * testInterval)
+			rep, err := service.GetProof(&GetProof{
+				Version: CurrentVersion,
+				ID:      id,
+				Key:     oid.Slice(),
+			})
+			require.Nil(t, err)
+			require.Nil(t, rep.Proof.Verify(id))
+			ca, err := rep.Proof.CoinAccount()
+			if err == nil && ca.Balance(genesis) == value {
+				return
+			}
+		}
+		require.Fail(t, "balance didn't get stored")
+	}
+
+	spawn := func(oid ObjectID, args Arguments) Instruction {
+		return Instruction{ObjectID: oid, Spawn: &Spawn{ContractID: ContractCoinID, Args: args}}
+	}
+	send(signer,
+		spawn(genesis, Arguments{{Name: "genesis", Value: []byte{1}}}),
+		spawn(a, nil),
+		spawn(b, nil),
+		invoke(genesis, CmdCoinMint, 100, a))
+	waitBalance(a, 100)
+
+	// A transfer needs the signature of the darc of the sender.
+	send(darc.NewSignerEd25519(nil, nil), invoke(a, CmdCoinTransfer, 40, b))
+	time.Sleep(4 * testInterval)
+	waitBalance(b, 0)
+	send(signer, invoke(a, CmdCoinTransfer, 40, b))
+	waitBalance(b, 40)
+	waitBalance(a, 60)
+}
+
+func TestService_ContractStakeInstructions(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	newOID := func() ObjectID {
+		return ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}
+	}
+	genesis, account, stakeID := newOID(), newOID(), newOID()
+	epochs := EpochConfig{Length: 10, RosterSize: 2, Coin: genesis, UnlockDelay: 1}
+	epochsBuf, err := protobuf.Encode(&epochs)
+	require.Nil(t, err)
+	roster := onet.NewRoster(s.roster.List[:1])
+	rosterBuf, err := protobuf.Encode(roster)
+	require.Nil(t, err)
+	coll := newConfigColl(t, s, &account,
+		Argument{Name: "epochs", Value: epochsBuf},
+		Argument{Name: "roster", Value: rosterBuf})
+	configID, err := loadConfigID(coll)
+	require.Nil(t, err)
+
+	runAt := func(ctx Context, instrs ...Instruction) bool {
+		_, ctsOK, scs, _, err := s.service().createStateChanges(coll, ctx,
+			ClientTransactions{{Instructions: instrs}})
+		require.Nil(t, err)
+		for i := range scs {
+			require.Nil(t, storeInColl(coll, &scs[i]))
+		}
+		return len(ctsOK) == 1
+	}
+	run := func(instrs ...Instruction) bool {
+		return runAt(Context{}, instrs...)
+	}
+	valueBuf := func(value uint64) []byte {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, value)
+		return buf
+	}
+	balance := func() uint64 {
+		ca, err := loadCoinAccount(coll, account.Slice())
+		require.Nil(t, err)
+		return ca.Balance(genesis)
+	}
+	// startEpoch invokes epoch in the block with the index and the seed.
+	startEpoch := func(index int, seed string) bool {
+		return runAt(Context{Index: index, epochSeed: []byte("seed")},
+			Instruction{ObjectID: configID, Invoke: &Invoke{
+				Command: CmdConfigEpoch,
+				Args:    Arguments{{Name: "seed", Value: []byte(seed)}},
+			}})
+	}
+	index := 0
+	epoch := func() *Config {
+		index += epochs.Length
+		require.True(t, startEpoch(index, "seed"))
+		config, err := loadConfig(coll)
+		require.Nil(t, err)
+		require.Equal(t, index, config.EpochIndex)
+		return config
+	}
+
+	require.True(t, run(
+		Instruction{ObjectID: genesis, Spawn: &Spawn{
+			ContractID: ContractCoinID,
+			Args:       Arguments{{Name: "genesis", Value: []byte{1}}},
+		}},
+		Instruction{ObjectID: account, Spawn: &Spawn{ContractID: ContractCoinID}},
+		Instruction{ObjectID: genesis, Invoke: &Invoke{
+			Command: CmdCoinMint,
+			Args: Arguments{
+				{Name: "value", Value: valueBuf(100)},
+				{Name: "destination", Value: account.Slice()},
+			},
+		}}))
+
+	// The seed must be the one derived by the node, and the block must
+	// start an epoch.
+	require.False(t, startEpoch(epochs.Length, "other"))
+	require.False(t, startEpoch(epochs.Length+1, "seed"))
+
+	// Without a stake, the roster stays the same.
+	config := epoch()
+	require.Equal(t, uint64(1), config.Epoch)
+	require.Equal(t, roster.ID, config.Roster.ID)
+	require.False(t, startEpoch(index, "seed"))
+
+	// The stake takes 50 of the 60 coins taken from the account, the rest
+	// goes back to it as the reward account.
+	conodeBuf, err := protobuf.Encode(s.roster.List[1])
+	require.Nil(t, err)
+	stake := Instruction{ObjectID: stakeID, Spawn: &Spawn{
+		ContractID: ContractStakeID,
+		Args: Arguments{
+			{Name: "conode", Value: conodeBuf},
+			{Name: "value", Value: valueBuf(50)},
+		},
+	}}
+	require.False(t, run(stake))
+	stake.Coins = []CoinInput{{Account: account, Coin: Coin{Name: genesis, Value: 60}}}
+	require.True(t, run(stake))
+	require.Equal(t, uint64(50), balance())
+
+	config = epoch()
+	require.Equal(t, []ObjectID{stakeID}, config.Stakes)
+	require.Equal(t, uint64(2), config.Epoch)
+	require.Equal(t, 2, len(config.Roster.List))
+	require.True(t, config.Roster.List[0].Equal(roster.List[0]))
+	require.True(t, config.Roster.List[1].Equal(s.roster.List[1]))
+
+	withdraw := Instruction{ObjectID: stakeID, Invoke: &Invoke{
+		Command: CmdStakeWithdraw,
+		Args:    Arguments{{Name: "destination", Value: account.Slice()}},
+	}}
+	require.False(t, run(withdraw))
+	require.True(t, run(Instruction{ObjectID: stakeID, Invoke: &Invoke{Command: CmdStakeUnlock}}))
+	require.False(t, run(withdraw))
+
+	// Unlocked stakes can be withdrawn after the delay.
+	config = epoch()
+	require.Equal(t, 0, len(config.Stakes))
+	require.Equal(t, uint64(3), config.Epoch)
+	require.True(t, run(withdraw))
+	require.Equal(t, uint64(100), balance())
+}
+
+func TestService_ContractWhitelist(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, &onet.Roster{},
+		[]string{"Spawn_value", "Spawn_coin", "Invoke_" + CmdConfigContracts}, signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.Contracts = &ContractWhitelist{Contracts: []EnabledContract{
+		{ID: ContractValueID, Version: DefaultContractVersion},
+	}}
+	e, err := NewExecutor(genesisMsg)
+	require.Nil(t, err)
+	dID := genesisMsg.GenesisDarc.GetBaseID()
+
+	apply := func(instr Instruction) string {
+		require.Nil(t, instr.SignBy(signer))
+		receipts, err := e.Apply(ClientTransaction{Instructions: []Instruction{instr}})
+		require.Nil(t, err)
+		return receipts[0].Error
+	}
+	spawn := func(contractID string) string {
+		return apply(Instruction{
+			ObjectID: ObjectID{DarcID: dID, InstanceID: GenNonce()},
+			Spawn: &Spawn{
+				ContractID: contractID,
+				Args:       Arguments{{Name: "value", Value: []byte("value")}},
+			},
+		})
+	}
+	enable := func(contracts ...EnabledContract) string {
+		buf, err := protobuf.Encode(&ContractWhitelist{Contracts: contracts})
+		require.Nil(t, err)
+		return apply(Instruction{
+			ObjectID: ObjectID{DarcID: dID, InstanceID: OneNonce},
+			Nonce:    GenNonce(),
+			Invoke: &Invoke{
+				Command: CmdConfigContracts,
+				Args:    Arguments{{Name: "contracts", Value: buf}},
+			},
+		})
+	}
+
+	require.Equal(t, "", spawn(ContractValueID))
+	require.Contains(t, spawn(ContractCoinID), "not enabled")
+
+	// The genesis darc allows to enable more contracts.
+	require.Equal(t, "", enable(
+		EnabledContract{ID: ContractValueID, Version: DefaultContractVersion},
+		EnabledContract{ID: ContractCoinID, Version: DefaultContractVersion}))
+	require.Equal(t, "", spawn(ContractCoinID))
+
+	// A version this node doesn't have cannot be used.
+	require.Equal(t, "", enable(EnabledContract{ID: ContractValueID, Version: 2}))
+	require.Contains(t, spawn(ContractValueID), "has no version 2")
+	require.Contains(t, spawn(ContractCoinID), "not enabled")
+
+	require.NotEqual(t, "", enable(
+		EnabledContract{ID: ContractValueID, Version: DefaultContractVersion},
+		EnabledContract{ID: ContractValueID, Version: DefaultContractVersion}))
+	require.NotEqual(t, "", enable(EnabledContract{ID: ContractValueID}))
+}
+
+func TestService_VerifyBlockContracts(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	// The genesis block used the config contract only.
+	header, err := decodeHeader(s.sb)
+	require.Nil(t, err)
+	require.Equal(t, []string{ContractConfigID}, header.Contracts)
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	sb, _ := s.propose(t, s.sb, ClientTransactions{tx})
+	require.True(t, s.service().verifySkipBlock(nil, sb))
+	header, err = decodeHeader(sb)
+	require.Nil(t, err)
+	require.Equal(t, []string{dummyKind}, header.Contracts)
+	header.Contracts = []string{"unknown"}
+	sb.Data, err = network.Marshal(header)
+	require.Nil(t, err)
+	require.False(t, s.service().verifySkipBlock(nil, sb))
+	require.NotNil(t, s.service().verifyBlockContracts(sb, header))
+
+	// The contracts are checked against the state of the previous block,
+	// so they cannot be checked without it.
+	header.Contracts = []string{dummyKind}
+	require.Nil(t, s.service().verifyBlockContracts(sb, header))
+	sb.BackLinkIDs = []skipchain.SkipBlockID{skipchain.SkipBlockID("unknown")}
+	require.NotNil(t, s.service().verifyBlockContracts(sb, header))
+	sb.BackLinkIDs = []skipchain.SkipBlockID{s.sb.Hash}
+
+	// An upgrade that is only in the latest state doesn't change the
+	// versions of the block.
+	cdb := s.service().getCollection(s.sb.SkipChainID())
+	config, err := loadConfig(cdb.coll)
+	require.Nil(t, err)
+	config.Upgrades = []ContractUpgrade{{ContractID: dummyKind, Version: 2, Index: sb.Index}}
+	configBuf, err := protobuf.Encode(config)
+	require.Nil(t, err)
+	configID, err := loadConfigID(cdb.coll)
+	require.Nil(t, err)
+	sc := NewStateChange(Update, configID, ContractConfigID, configBuf)
+	require.Nil(t, cdb.Store(&sc))
+	config, err = loadConfig(cdb.coll)
+	require.Nil(t, err)
+	require.Equal(t, 2, config.contractVersion(dummyKind, sb.Index))
+	require.Nil(t, s.service().verifyBlockContracts(sb, header))
+}
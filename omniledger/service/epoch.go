@@ -0,0 +1,232 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/dedis/protobuf"
+	"student_18_byzcoin/omniledger/collection"
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+// EpochConfig defines how the roster of a skipchain is chosen from the
+// stakes. At the first block of every epoch, the leader invokes "epoch" on
+// the config, which chooses the roster of the epoch. The following block is
+// then created with that roster.
+//
+// As there is no view-change yet, the leader stays the same: only the other
+// nodes of the roster are chosen from the stakes.
+type EpochConfig struct {
+	// Length is the number of blocks of an epoch. If it is zero, the roster
+	// never changes.
+	Length int
+	// RosterSize is the number of nodes of the roster, including the
+	// leader.
+	RosterSize int
+	// Random chooses the nodes at random, with a probability proportional
+	// to their stake. Otherwise the nodes with the biggest stakes are
+	// chosen.
+	Random bool
+	// Coin is the type of the coins that can be staked.
+	Coin ObjectID
+	// UnlockDelay is the number of epochs between unlocking a stake and
+	// withdrawing its coins.
+	UnlockDelay uint64
+}
+
+// stakeholder is a conode and the sum of all the coins staked for it.
+type stakeholder struct {
+	conode *network.ServerIdentity
+	key    []byte
+	value  uint64
+}
+
+// loadStake returns the stake stored under key.
+func loadStake(coll collection.Collection, key []byte) (*Stake, error) {
+	value, contract, err := getValueContract(coll, key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStake(value, contract)
+}
+
+func decodeStake(value, contract []byte) (*Stake, error) {
+	if string(contract) != ContractStakeID {
+		return nil, errors.New("object is not a stake")
+	}
+	stake := &Stake{}
+	err := protobuf.DecodeWithConstructors(value, stake, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, err
+	}
+	if stake.Conode == nil || stake.Conode.Public == nil {
+		return nil, errors.New("stake has no conode")
+	}
+	return stake, nil
+}
+
+// loadStakes goes through the locked stakes listed in the config and
+// returns, for every conode, the sum of the coins of the given type that are
+// locked for it. The stakeholders are sorted by their public key.
+func loadStakes(coll collection.Collection, config *Config, coin ObjectID) ([]stakeholder, error) {
+	byKey := map[string]*stakeholder{}
+	for _, oid := range config.Stakes {
+		stake, err := loadStake(coll, oid.Slice())
+		if err != nil {
+			return nil, err
+		}
+		if stake.Unlocked || !stake.Coin.Name.Equal(coin) {
+			continue
+		}
+		pub, err := stake.Conode.Public.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		sh := byKey[string(pub)]
+		if sh == nil {
+			sh = &stakeholder{conode: stake.Conode, key: pub}
+			byKey[string(pub)] = sh
+		}
+		if sh.value > math.MaxUint64-stake.Coin.Value {
+			return nil, errors.New("stake overflow")
+		}
+		sh.value += stake.Coin.Value
+	}
+
+	stakes := make([]stakeholder, 0, len(byKey))
+	for _, sh := range byKey {
+		stakes = append(stakes, *sh)
+	}
+	sort.Slice(stakes, func(i, j int) bool {
+		return bytes.Compare(stakes[i].key, stakes[j].key) < 0
+	})
+	return stakes, nil
+}
+
+// selectRoster returns the roster of the next epoch: the leader of the
+// current roster, followed by the nodes chosen from the stakes. If nobody
+// staked for another node, the current roster is kept.
+func selectRoster(current *onet.Roster, epochs EpochConfig, stakes []stakeholder, seed []byte) (*onet.Roster, error) {
+	if len(current.List) == 0 {
+		return nil, errors.New("empty roster")
+	}
+	leader := current.List[0]
+	var candidates []stakeholder
+	for _, sh := range stakes {
+		if !sh.conode.Equal(leader) {
+			candidates = append(candidates, sh)
+		}
+	}
+	if len(candidates) == 0 {
+		return current, nil
+	}
+	n := epochs.RosterSize - 1
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+
+	list := []*network.ServerIdentity{leader}
+	if epochs.Random && n > 0 {
+		chosen, err := selectRandom(candidates, n, seed)
+		if err == nil {
+			return onet.NewRoster(append(list, chosen...)), nil
+		}
+		// The stakes are so unbalanced that some of them are never
+		// drawn, so the biggest ones are taken instead.
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].value > candidates[j].value
+	})
+	for _, sh := range candidates[:n] {
+		list = append(list, sh.conode)
+	}
+	return onet.NewRoster(list), nil
+}
+
+// selectRandom draws n distinct stakeholders with a probability proportional
+// to their stake, using collection.Select.
+func selectRandom(candidates []stakeholder, n int, seed []byte) ([]*network.ServerIdentity, error) {
+	coll := collection.New(collection.Stake64{})
+	byKey := map[string]*network.ServerIdentity{}
+	for _, sh := range candidates {
+		if err := coll.Add(sh.key, sh.value); err != nil {
+			return nil, err
+		}
+		byKey[string(sh.key)] = sh.conode
+	}
+	proofs, err := coll.Select(0, seed, n)
+	if err != nil {
+		return nil, err
+	}
+	var chosen []*network.ServerIdentity
+	selected := map[string]bool{}
+	for _, p := range proofs {
+		if !selected[string(p.Key)] {
+			selected[string(p.Key)] = true
+			chosen = append(chosen, byKey[string(p.Key)])
+		}
+	}
+	return chosen, nil
+}
+
+// updateStakes returns the StateChange storing the config, after f changed
+// the list of its locked stakes.
+func updateStakes(coll collection.Collection, config *Config, f func([]ObjectID) []ObjectID) (StateChange, error) {
+	configID, err := loadConfigID(coll)
+	if err != nil {
+		return StateChange{}, err
+	}
+	config.Stakes = f(config.Stakes)
+	buf, err := protobuf.Encode(config)
+	if err != nil {
+		return StateChange{}, err
+	}
+	return NewStateChange(Update, configID, ContractConfigID, buf), nil
+}
+
+// epochTransaction returns the transaction starting a new epoch if the block
+// following latest is the first block of an epoch, else nil.
+func (s *Service) epochTransaction(latest *skipchain.SkipBlock) *ClientTransaction {
+	coll, _, _, err := s.getCollection(latest.SkipChainID()).view()
+	if err != nil {
+		return nil
+	}
+	config, err := loadConfig(coll)
+	if err != nil || config.Epochs.Length <= 0 || (latest.Index+1)%config.Epochs.Length != 0 {
+		return nil
+	}
+	configID, err := loadConfigID(coll)
+	if err != nil {
+		return nil
+	}
+	return &ClientTransaction{Instructions: []Instruction{{
+		ObjectID: configID,
+		Index:    0,
+		Length:   1,
+		Invoke: &Invoke{
+			Command: CmdConfigEpoch,
+			Args:    Arguments{{Name: "seed", Value: s.epochSeed(latest)}},
+		},
+	}}}
+}
+
+// epochSeed returns the collective signature of the forward link to latest,
+// which nobody could know in advance. The genesis block has no such link and
+// its hash is used instead.
+func (s *Service) epochSeed(latest *skipchain.SkipBlock) []byte {
+	if latest.Index > 0 && len(latest.BackLinkIDs) > 0 {
+		if prev := s.db().GetByID(latest.BackLinkIDs[0]); prev != nil {
+			for _, fl := range prev.ForwardLink {
+				if fl.To.Equal(latest.Hash) && len(fl.Signature.Sig) > 0 {
+					return fl.Signature.Sig
+				}
+			}
+		}
+	}
+	return latest.Hash
+}
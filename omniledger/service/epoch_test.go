@@ -0,0 +1,162 @@
+package service
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/network"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+func TestSelectRoster(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, roster, _ := local.GenTree(5, false)
+	current := onet.NewRoster(roster.List[:2])
+
+	var stakes []stakeholder
+	for i, si := range roster.List {
+		pub, err := si.Public.MarshalBinary()
+		require.Nil(t, err)
+		stakes = append(stakes, stakeholder{conode: si, key: pub, value: uint64(10 * (i + 1))})
+	}
+
+	// Without stakes, the roster doesn't change.
+	r, err := selectRoster(current, EpochConfig{RosterSize: 3}, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, current.ID, r.ID)
+
+	// The leader stays and the biggest stakes are chosen.
+	r, err = selectRoster(current, EpochConfig{RosterSize: 3}, stakes, nil)
+	require.Nil(t, err)
+	require.Equal(t, []*network.ServerIdentity{roster.List[0], roster.List[4], roster.List[3]}, r.List)
+
+	// Random choices depend on the seed only.
+	r, err = selectRoster(current, EpochConfig{RosterSize: 3, Random: true}, stakes, []byte("seed"))
+	require.Nil(t, err)
+	require.Equal(t, 3, len(r.List))
+	require.True(t, r.List[0].Equal(roster.List[0]))
+	require.False(t, r.List[1].Equal(r.List[2]))
+	again, err := selectRoster(current, EpochConfig{RosterSize: 3, Random: true}, stakes, []byte("seed"))
+	require.Nil(t, err)
+	require.Equal(t, r.ID, again.ID)
+
+	// There are not enough stakes to fill the roster.
+	r, err = selectRoster(current, EpochConfig{RosterSize: 10, Random: true}, stakes, []byte("seed"))
+	require.Nil(t, err)
+	require.Equal(t, 5, len(r.List))
+}
+
+func TestService_Epochs(t *testing.T) {
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	defer closeQueues(local)
+	hosts, roster, _ := local.GenTree(3, true)
+	service := local.GetServices(hosts, omniledgerID)[0].(*Service)
+
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, onet.NewRoster(roster.List[:2]),
+		[]string{"Spawn_coin", "Invoke_mint", "Invoke_fetch", "Spawn_stake", "Spawn_value"},
+		signer.Identity())
+	require.Nil(t, err)
+	darcID := genesisMsg.GenesisDarc.GetBaseID()
+	newOID := func() ObjectID {
+		return ObjectID{DarcID: darcID, InstanceID: GenNonce()}
+	}
+	genesis, account := newOID(), newOID()
+	genesisMsg.BlockInterval = testInterval
+	genesisMsg.RewardAccount = &account
+	genesisMsg.Epochs = EpochConfig{Length: 3, RosterSize: 2, Coin: genesis}
+	resp, err := service.CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	id := resp.Skipblock.SkipChainID()
+
+	valueBuf := func(value uint64) []byte {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, value)
+		return buf
+	}
+	// send adds a transaction and waits until its block is applied.
+	send := func(instrs ...Instruction) {
+		_, index := service.getCollection(id).latestBlock()
+		for i := range instrs {
+			instrs[i].Index, instrs[i].Length = i, len(instrs)
+			require.Nil(t, instrs[i].SignBy(signer))
+			for j := range instrs[i].Coins {
+				require.Nil(t, instrs[i].SignCoinInput(j, signer))
+			}
+		}
+		_, err := service.AddTransaction(&AddTxRequest{
+			Version:     CurrentVersion,
+			SkipchainID: id,
+			Transaction: ClientTransaction{Instructions: instrs},
+		})
+		require.Nil(t, err)
+		for i := 0; i < 20; i++ {
+			time.Sleep(2 * testInterval)
+			if _, latest := service.getCollection(id).latestBlock(); latest > index {
+				return
+			}
+		}
+		require.Fail(t, "no new block")
+	}
+	value := func() Instruction {
+		return Instruction{ObjectID: newOID(), Spawn: &Spawn{ContractID: ContractValueID}}
+	}
+
+	// Block 1
+	send(Instruction{ObjectID: genesis, Spawn: &Spawn{
+		ContractID: ContractCoinID,
+		Args:       Arguments{{Name: "genesis", Value: []byte{1}}},
+	}},
+		Instruction{ObjectID: account, Spawn: &Spawn{ContractID: ContractCoinID}},
+		Instruction{ObjectID: genesis, Invoke: &Invoke{
+			Command: CmdCoinMint,
+			Args: Arguments{
+				{Name: "value", Value: valueBuf(100)},
+				{Name: "destination", Value: account.Slice()},
+			},
+		}})
+
+	// Block 2: the third node gets a stake.
+	conodeBuf, err := protobuf.Encode(roster.List[2])
+	require.Nil(t, err)
+	send(Instruction{
+		ObjectID: newOID(),
+		Spawn: &Spawn{
+			ContractID: ContractStakeID,
+			Args: Arguments{
+				{Name: "conode", Value: conodeBuf},
+				{Name: "value", Value: valueBuf(50)},
+			},
+		},
+		Coins: []CoinInput{{Account: account, Coin: Coin{Name: genesis, Value: 50}}},
+	})
+
+	// Block 3 starts a new epoch and block 4 has the new roster.
+	send(value())
+	config, err := service.loadConfig(id)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), config.Epoch)
+	require.Equal(t, 2, len(config.Roster.List))
+	require.True(t, config.Roster.List[0].Equal(roster.List[0]))
+	require.True(t, config.Roster.List[1].Equal(roster.List[2]))
+
+	send(value())
+	latestID, index := service.getCollection(id).latestBlock()
+	require.Equal(t, 4, index)
+	latest := service.db().GetByID(latestID)
+	require.Equal(t, config.Roster.ID, latest.Roster.ID)
+
+	// The new node synchronises with the others.
+	newcomer := local.GetServices(hosts, omniledgerID)[2].(*Service)
+	root := service.getCollection(id).RootHash()
+	for i := 0; i < 20 && string(newcomer.getCollection(id).RootHash()) != string(root); i++ {
+		time.Sleep(testInterval)
+	}
+	require.Equal(t, root, newcomer.getCollection(id).RootHash())
+}
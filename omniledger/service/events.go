@@ -0,0 +1,224 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+// Contracts can emit events with Context.Emit, to tell clients what happened
+// without making them compare the state before and after a block:
+//   1. the events of an accepted ClientTransaction are kept in its Receipt,
+//   in the order they have been emitted. The events of a refused
+//   ClientTransaction, or of a failed call, are dropped
+//   2. the receipts are stored in the body of the block, and the root of a
+//   merkle tree over them is stored in its DataHeader
+//   3. a ReceiptProof holds a receipt, its path in the merkle tree and the
+//   links from the genesis block to the block, so a client can verify that
+//   the events have been emitted in this block
+
+// Event is emitted by a contract while it executes an instruction.
+type Event struct {
+	// Topic is the type of the event, e.g. "transfer". It tells how Data
+	// is encoded.
+	Topic string
+	// ContractID is the contract that emitted the event.
+	ContractID string
+	// ObjectID is the object of the instruction the contract executed.
+	ObjectID ObjectID
+	// Data is defined by the contract for every topic.
+	Data []byte
+}
+
+// Hash returns the sha256 hash of the receipt, including its events and
+// contracts. It is the leaf of the receipt in the merkle tree of the block.
+func (r Receipt) Hash() []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(r.TxHash)
+	h.Write([]byte(r.Error))
+	b := make([]byte, 8)
+	for _, i := range []int{r.Used.StateChanges, r.Used.Bytes, r.Used.Steps, len(r.Events),
+		len(r.Contracts)} {
+		binary.LittleEndian.PutUint64(b, uint64(i))
+		h.Write(b)
+	}
+	for _, ev := range r.Events {
+		for _, buf := range [][]byte{[]byte(ev.Topic), []byte(ev.ContractID),
+			ev.ObjectID.Slice(), ev.Data} {
+			binary.LittleEndian.PutUint64(b, uint64(len(buf)))
+			h.Write(b)
+			h.Write(buf)
+		}
+	}
+	for _, c := range r.Contracts {
+		binary.LittleEndian.PutUint64(b, uint64(len(c)))
+		h.Write(b)
+		h.Write([]byte(c))
+	}
+	return h.Sum(nil)
+}
+
+// MerkleStep is a node on the path from a leaf of a merkle tree to its root.
+type MerkleStep struct {
+	// Hash is the sibling of the node on the path.
+	Hash []byte
+	// Left is set if the sibling is on the left.
+	Left bool
+}
+
+// hashNode returns the hash of an inner node of a merkle tree.
+func hashNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleTree returns the root of the merkle tree over the leaves and the path
+// from leaf i to the root. If i is negative, no path is returned. A node
+// without sibling is moved up to the next level as is.
+func merkleTree(leaves [][]byte, i int) (root []byte, path []MerkleStep) {
+	if len(leaves) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:], nil
+	}
+	level := leaves
+	for len(level) > 1 {
+		var next [][]byte
+		for j := 0; j < len(level); j += 2 {
+			if j+1 == len(level) {
+				next = append(next, level[j])
+				continue
+			}
+			switch i {
+			case j:
+				path = append(path, MerkleStep{Hash: level[j+1]})
+			case j + 1:
+				path = append(path, MerkleStep{Hash: level[j], Left: true})
+			}
+			next = append(next, hashNode(level[j], level[j+1]))
+		}
+		if i >= 0 {
+			i /= 2
+		}
+		level = next
+	}
+	return level[0], path
+}
+
+// receiptsRoot returns the root of the merkle tree over the receipts, as
+// stored in the DataHeader.
+func receiptsRoot(receipts []Receipt) []byte {
+	root, _ := merkleTree(receiptLeaves(receipts), -1)
+	return root
+}
+
+func receiptLeaves(receipts []Receipt) [][]byte {
+	leaves := make([][]byte, len(receipts))
+	for i, r := range receipts {
+		leaves[i] = r.Hash()
+	}
+	return leaves
+}
+
+// ReceiptProof proves that a receipt, together with its events, is stored in
+// a block of a skipchain.
+type ReceiptProof struct {
+	// Receipt is the proven receipt.
+	Receipt Receipt
+	// Path leads from the receipt to the receipts root of the block.
+	Path []MerkleStep
+	// Block holds the receipt.
+	Block skipchain.SkipBlock
+	// Links proves that the block is part of the skipchain, like in Proof.
+	Links []skipchain.ForwardLink
+}
+
+// ErrorVerifyReceiptsRoot is returned if the path of the receipt doesn't lead
+// to the receipts root of the block.
+var ErrorVerifyReceiptsRoot = errors.New("receipt is not in the receipts root of the skipblock")
+
+// newReceiptProof returns the proof of the i-th receipt of the block.
+func newReceiptProof(s *skipchain.SkipBlockDB, sb *skipchain.SkipBlock, receipts []Receipt, i int) (*ReceiptProof, error) {
+	_, path := merkleTree(receiptLeaves(receipts), i)
+	links, block, err := chainLinks(s, sb.SkipChainID(), sb.Index)
+	if err != nil {
+		return nil, err
+	}
+	if !block.Hash.Equal(sb.Hash) {
+		return nil, errors.New("couldn't find the links to the block")
+	}
+	return &ReceiptProof{Receipt: receipts[i], Path: path, Block: *block, Links: links}, nil
+}
+
+// Verify checks that the receipt is in the block and that the block is part
+// of the skipchain with the given ID.
+func (p ReceiptProof) Verify(scID skipchain.SkipBlockID) error {
+	_, d, err := network.Unmarshal(p.Block.Data, cothority.Suite)
+	if err != nil {
+		return err
+	}
+	header, ok := d.(*DataHeader)
+	if !ok {
+		return errors.New("block holds no header")
+	}
+	root := p.Receipt.Hash()
+	for _, step := range p.Path {
+		if step.Left {
+			root = hashNode(step.Hash, root)
+		} else {
+			root = hashNode(root, step.Hash)
+		}
+	}
+	if !bytes.Equal(root, header.ReceiptsRoot) {
+		return ErrorVerifyReceiptsRoot
+	}
+	return verifyLinks(scID, p.Links, p.Block)
+}
+
+// verifyReceipts checks the receipts of a body against the receipts of its
+// transactions, as computed by the node. The accepted receipts must be these
+// receipts, one for every transaction, in the order of the body. The refused
+// receipts can only be for transactions that are not in the body, and hold
+// neither resources, events nor contracts.
+func verifyReceipts(body *DataBody, receipts []Receipt) error {
+	if len(receipts) != len(body.Transactions) {
+		return errors.New("wrong number of receipts")
+	}
+	inBlock := make(map[string]bool)
+	for _, ct := range body.Transactions {
+		inBlock[string(ct.Hash())] = true
+	}
+	i := 0
+	for _, r := range body.Receipts {
+		if r.Error != "" {
+			if inBlock[string(r.TxHash)] {
+				return fmt.Errorf("refused receipt of accepted transaction %x", r.TxHash)
+			}
+			if r.Used != (Resources{}) || len(r.Events) > 0 || len(r.Contracts) > 0 {
+				return fmt.Errorf("refused receipt of transaction %x holds results", r.TxHash)
+			}
+			continue
+		}
+		if i == len(receipts) {
+			return fmt.Errorf("receipt of transaction %x is not in the block", r.TxHash)
+		}
+		if !bytes.Equal(r.TxHash, body.Transactions[i].Hash()) ||
+			!bytes.Equal(r.Hash(), receipts[i].Hash()) {
+			return fmt.Errorf("receipt of transaction %x doesn't verify", r.TxHash)
+		}
+		i++
+	}
+	if i != len(receipts) {
+		return errors.New("receipts of accepted transactions are missing")
+	}
+	return nil
+}
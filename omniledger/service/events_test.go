@@ -0,0 +1,226 @@
+package service
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/network"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+func TestMerkleTree(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		var leaves [][]byte
+		for i := 0; i < n; i++ {
+			h := sha256.Sum256([]byte{byte(i)})
+			leaves = append(leaves, h[:])
+		}
+		root, path := merkleTree(leaves, -1)
+		require.Nil(t, path)
+		for i := range leaves {
+			_, path := merkleTree(leaves, i)
+			r := leaves[i]
+			for _, step := range path {
+				if step.Left {
+					r = hashNode(step.Hash, r)
+				} else {
+					r = hashNode(r, step.Hash)
+				}
+			}
+			require.Equal(t, root, r, "leaf %d of %d", i, n)
+		}
+	}
+}
+
+// emitKind is a contract emitting an event with its "data" argument. If the
+// "fail" argument is set, it fails after emitting. If the "call" argument is
+// set, it calls itself on another object to fail, and goes on.
+var emitKind = "emit"
+
+func contractEmit(ctx Context, cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+	if err := ctx.Emit("data", tx.Spawn.Args.Search("data")); err != nil {
+		return nil, nil, err
+	}
+	if tx.Spawn.Args.Search("fail") != nil {
+		return nil, nil, errors.New("failing")
+	}
+	if tx.Spawn.Args.Search("call") != nil {
+		oid := tx.ObjectID
+		oid.InstanceID = Nonce(sha256.Sum256(oid.InstanceID[:]))
+		_, _, err := ctx.Call(Instruction{ObjectID: oid, Spawn: &Spawn{
+			ContractID: emitKind,
+			Args: Arguments{
+				{Name: "data", Value: []byte("dropped")},
+				{Name: "fail", Value: []byte{1}},
+			},
+		}}, c)
+		if err == nil {
+			return nil, nil, errors.New("call should fail")
+		}
+	}
+	return []StateChange{NewStateChange(Create, tx.ObjectID, emitKind, []byte{})}, c, nil
+}
+
+func TestContext_Emit(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, &onet.Roster{}, []string{"Spawn_" + emitKind}, signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.Limits = &Limits{Instruction: Resources{Bytes: 100}}
+	e, err := NewExecutor(genesisMsg)
+	require.Nil(t, err)
+	require.Nil(t, e.RegisterContractWithContext(emitKind, contractEmit))
+
+	emit := func(data string, args ...Argument) Receipt {
+		instr := Instruction{
+			ObjectID: ObjectID{DarcID: genesisMsg.GenesisDarc.GetBaseID(), InstanceID: GenNonce()},
+			Spawn: &Spawn{
+				ContractID: emitKind,
+				Args:       append(Arguments{{Name: "data", Value: []byte(data)}}, args...),
+			},
+		}
+		require.Nil(t, instr.SignBy(signer))
+		receipts, err := e.Apply(ClientTransaction{Instructions: []Instruction{instr}})
+		require.Nil(t, err)
+		return receipts[0]
+	}
+
+	r := emit("hello")
+	require.Equal(t, "", r.Error)
+	require.Equal(t, 1, len(r.Events))
+	require.Equal(t, "data", r.Events[0].Topic)
+	require.Equal(t, emitKind, r.Events[0].ContractID)
+	require.Equal(t, []byte("hello"), r.Events[0].Data)
+	require.Equal(t, []string{emitKind}, r.Contracts)
+
+	// The events of the failed call are dropped.
+	r = emit("caller", Argument{Name: "call", Value: []byte{1}})
+	require.Equal(t, "", r.Error)
+	require.Equal(t, 1, len(r.Events))
+	require.Equal(t, []byte("caller"), r.Events[0].Data)
+
+	// A refused transaction has no events.
+	r = emit("refused", Argument{Name: "fail", Value: []byte{1}})
+	require.NotEqual(t, "", r.Error)
+	require.Equal(t, 0, len(r.Events))
+
+	// The events count against the limits.
+	r = emit(strings.Repeat("x", 100))
+	require.True(t, strings.Contains(r.Error, "instruction over its budget"), r.Error)
+
+	require.NotNil(t, Context{}.Emit("data", nil))
+}
+
+func TestService_ApplyBlockReceipts(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	id := s.sb.SkipChainID()
+	srv := s.services[1]
+
+	genesis := srv.db().GetByID(id)
+	latest, err := srv.db().GetLatest(genesis)
+	require.Nil(t, err)
+	require.Equal(t, 1, latest.Index)
+	cdb := srv.getCollection(id)
+	genesisBody, err := cdb.getBody(genesis.Hash)
+	require.Nil(t, err)
+	body, err := cdb.getBody(latest.Hash)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(body.Receipts))
+	require.Nil(t, cdb.reset())
+	require.Nil(t, srv.applyBlock(cdb, genesis, genesisBody))
+
+	// apply applies the block with the receipts, and a header holding
+	// their root.
+	apply := func(receipts []Receipt) error {
+		header, err := decodeHeader(latest)
+		require.Nil(t, err)
+		header.ReceiptsRoot = receiptsRoot(receipts)
+		sb := latest.Copy()
+		sb.Data, err = network.Marshal(header)
+		require.Nil(t, err)
+		b := *body
+		b.Receipts = receipts
+		return srv.applyBlock(cdb, sb, &b)
+	}
+	accepted := body.Receipts[0]
+	forged := accepted
+	forged.Events = []Event{{Topic: "forged"}}
+	events := []Event{{Topic: "forged"}}
+	for _, receipts := range [][]Receipt{
+		nil,
+		{accepted, accepted},
+		{forged},
+		{accepted, {TxHash: []byte("forged"), Events: events}},
+		{accepted, {TxHash: accepted.TxHash, Error: "refused"}},
+		{accepted, {TxHash: []byte("forged"), Error: "refused", Events: events}},
+		{accepted, {TxHash: []byte("forged"), Error: "refused", Contracts: []string{dummyKind}}},
+		{accepted, {TxHash: []byte("forged"), Error: "refused", Used: Resources{Steps: 1}}},
+	} {
+		require.NotNil(t, apply(receipts))
+	}
+	require.Nil(t, apply([]Receipt{{TxHash: []byte("refused"), Error: "refused"}, accepted}))
+}
+
+func TestService_ReceiptProof(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	for _, h := range s.hosts {
+		require.Nil(t, RegisterContractWithContext(h, emitKind, contractEmit))
+	}
+
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, s.roster, []string{"Spawn_" + emitKind}, s.signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = s.interval
+	resp, err := s.service().CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	id := resp.Skipblock.SkipChainID()
+
+	var hashes [][]byte
+	for _, data := range []string{"one", "two", "three"} {
+		instr := Instruction{
+			ObjectID: ObjectID{DarcID: genesisMsg.GenesisDarc.GetBaseID(), InstanceID: GenNonce()},
+			Spawn: &Spawn{
+				ContractID: emitKind,
+				Args:       Arguments{{Name: "data", Value: []byte(data)}},
+			},
+		}
+		require.Nil(t, instr.SignBy(s.signer))
+		ct := ClientTransaction{Instructions: []Instruction{instr}}
+		_, err := s.service().AddTransaction(&AddTxRequest{
+			Version:     CurrentVersion,
+			SkipchainID: id,
+			Transaction: ct,
+		})
+		require.Nil(t, err)
+		hashes = append(hashes, ct.Hash())
+	}
+	time.Sleep(4 * s.interval)
+
+	// The other node checked the receipts and applied the block.
+	_, index := s.services[0].getCollection(id).latestBlock()
+	require.True(t, index >= 1)
+	_, followerIndex := s.services[1].getCollection(id).latestBlock()
+	require.Equal(t, index, followerIndex)
+
+	for i, h := range hashes {
+		receipt, err := s.service().GetReceipt(&GetReceipt{Version: CurrentVersion, ID: id, TxHash: h})
+		require.Nil(t, err)
+		p := receipt.Proof
+		require.Nil(t, p.Verify(id))
+		require.Equal(t, receipt.Index, p.Block.Index)
+		require.Equal(t, 1, len(p.Receipt.Events))
+		require.Equal(t, []string{"one", "two", "three"}[i], string(p.Receipt.Events[0].Data))
+
+		// A changed event doesn't verify.
+		p.Receipt.Events = []Event{{Topic: "data", ContractID: emitKind, Data: []byte("forged")}}
+		require.Equal(t, ErrorVerifyReceiptsRoot, p.Verify(id))
+	}
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+// Executor holds the state of a ledger in memory and applies
+// ClientTransactions to it without skipchain, network or consensus. The
+// transactions go through the same verification and the same
+// createStateChanges as on the leader of a skipchain, so the Executor can be
+// used to test contracts, see the ledgertest package.
+//
+// There is no identity chain without skipchain, so the cross-shard
+// transactions of a shard are refused.
+type Executor struct {
+	s     *Service
+	coll  collection.Collection
+	id    skipchain.SkipBlockID
+	index int
+	// Timestamp is given to the contracts in the Context of the next block.
+	Timestamp int64
+	// Leader executes the transactions like the leader of a skipchain,
+	// which also leaves out the ones running longer than Limits.Duration.
+	// The other nodes cannot check the time, so it is off by default.
+	Leader bool
+}
+
+// NewExecutor creates the genesis state from the request and returns an
+// Executor knowing the built-in contracts. The hash of the genesis
+// transaction stands for the skipchain ID in the Context.
+func NewExecutor(genesis *CreateGenesisBlock) (*Executor, error) {
+	e := &Executor{
+		s: &Service{
+			contracts: make(map[string]map[int]ContractWithContext),
+			schemas:   make(map[string]map[int]ContractSchema),
+			views:     make(map[string]map[string]ContractView),
+		},
+		coll:  collection.New(&collection.Data{}, &collection.Data{}),
+		index: -1,
+	}
+	e.s.registerBuiltins()
+	ct, err := genesisTransaction(genesis)
+	if err != nil {
+		return nil, err
+	}
+	// Like on the leader, the genesis transaction is not verified.
+	receipts, err := e.execute(ClientTransactions{ct})
+	if err != nil {
+		return nil, err
+	}
+	if receipts[0].Error != "" {
+		return nil, errors.New("couldn't create genesis state: " + receipts[0].Error)
+	}
+	e.id = skipchain.SkipBlockID(ct.Hash())
+	return e, nil
+}
+
+// RegisterContract stores the contract, so it is called for the instructions
+// of its kind.
+func (e *Executor) RegisterContract(contractID string, c OmniLedgerContract) error {
+	return e.s.registerContract(contractID, c)
+}
+
+// RegisterContractWithContext stores a contract that receives the Context of
+// its instructions.
+func (e *Executor) RegisterContractWithContext(contractID string, c ContractWithContext) error {
+	return e.s.registerContractWithContext(contractID, c)
+}
+
+// RegisterContractVersion stores a version of a contract, see versions.go.
+func (e *Executor) RegisterContractVersion(contractID string, version int, c ContractWithContext) error {
+	return e.s.registerContractVersion(contractID, version, c)
+}
+
+// RegisterSchema stores the argument schema of a version of a contract, see
+// schema.go.
+func (e *Executor) RegisterSchema(contractID string, version int, commands ...CommandSchema) error {
+	return e.s.registerSchema(contractID, version, commands...)
+}
+
+// RegisterView stores the view method of a contract, so it can be called with
+// CallView.
+func (e *Executor) RegisterView(contractID, method string, f ContractView) error {
+	return e.s.registerView(contractID, method, f)
+}
+
+// Apply verifies the ClientTransactions against the darcs of the current
+// state and executes the valid ones as the next block. It returns a receipt
+// for every ClientTransaction, in the order they have been given. The
+// receipt of a refused ClientTransaction holds the reason.
+func (e *Executor) Apply(cts ...ClientTransaction) ([]Receipt, error) {
+	getDarc := func(id darc.ID) (*darc.Darc, error) {
+		return loadDarc(e.coll, id)
+	}
+	receipts := make([]Receipt, len(cts))
+	done := make([]bool, len(cts))
+	var valid ClientTransactions
+	for i, ct := range cts {
+		receipts[i].TxHash = ct.Hash()
+		if err := verifyClientTx(ct, getDarc); err != nil {
+			receipts[i].Error = err.Error()
+			done[i] = true
+			continue
+		}
+		valid = append(valid, ct)
+	}
+	executed, err := e.execute(valid)
+	if err != nil {
+		return nil, err
+	}
+	// The transactions have been sorted, so their receipts are put back
+	// in the order of cts.
+	for _, r := range executed {
+		for i := range cts {
+			if !done[i] && bytes.Equal(receipts[i].TxHash, r.TxHash) {
+				receipts[i], done[i] = r, true
+				break
+			}
+		}
+	}
+	return receipts, nil
+}
+
+// execute runs createStateChanges on the ClientTransactions and stores the
+// resulting StateChanges.
+func (e *Executor) execute(cts ClientTransactions) ([]Receipt, error) {
+	if err := sortTransactions(cts); err != nil {
+		return nil, err
+	}
+	ctx := Context{SkipchainID: e.id, Index: e.index + 1, Timestamp: e.Timestamp, leader: e.Leader}
+	_, _, scs, receipts, err := e.s.createStateChanges(e.coll, ctx, cts)
+	if err != nil {
+		return nil, err
+	}
+	e.coll.Begin()
+	for i := range scs {
+		if err := storeInColl(e.coll, &scs[i]); err != nil {
+			e.coll.Rollback()
+			return nil, fmt.Errorf("couldn't store state change %d: %v", i, err)
+		}
+	}
+	e.coll.End()
+	e.index++
+	return receipts, nil
+}
+
+// Index returns the index of the latest block.
+func (e *Executor) Index() int {
+	return e.index
+}
+
+// Root returns the merkle root of the current state.
+func (e *Executor) Root() []byte {
+	return e.coll.GetRoot()
+}
+
+// Get returns the value and the contract stored under the key. If nothing is
+// stored under the key, value is nil and contractID is empty.
+func (e *Executor) Get(key []byte) (value []byte, contractID string, err error) {
+	return newCollectionReader(e.coll).Get(key)
+}
+
+// Proof returns the proof of presence or absence of the key in the current
+// state. It can be checked against Root.
+func (e *Executor) Proof(key []byte) (collection.Proof, error) {
+	return e.coll.Get(key).Proof()
+}
+
+// CallView runs a view method of a contract on the current state.
+func (e *Executor) CallView(contractID, method string, args Arguments) ([]byte, error) {
+	f, ok := e.s.views[contractID][method]
+	if !ok {
+		return nil, fmt.Errorf("contract %s has no view %s", contractID, method)
+	}
+	return f(newCollectionReader(e.coll), args)
+}
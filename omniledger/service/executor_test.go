@@ -0,0 +1,73 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v2"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+func TestExecutor_Leader(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, &onet.Roster{},
+		[]string{"Spawn_slow"}, signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.Limits = &Limits{Duration: time.Millisecond}
+	e, err := NewExecutor(genesisMsg)
+	require.Nil(t, err)
+	require.Nil(t, e.RegisterContractWithContext("slow",
+		func(ctx Context, cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+			time.Sleep(10 * time.Millisecond)
+			return []StateChange{NewStateChange(Create, tx.ObjectID, "slow", nil)}, c, nil
+		}))
+
+	spawn := func() string {
+		instr := Instruction{
+			ObjectID: ObjectID{DarcID: genesisMsg.GenesisDarc.GetBaseID(), InstanceID: GenNonce()},
+			Spawn:    &Spawn{ContractID: "slow"},
+		}
+		require.Nil(t, instr.SignBy(signer))
+		receipts, err := e.Apply(ClientTransaction{Instructions: []Instruction{instr}})
+		require.Nil(t, err)
+		return receipts[0].Error
+	}
+	// Only the leader checks the time.
+	require.Equal(t, "", spawn())
+	e.Leader = true
+	require.True(t, strings.HasPrefix(spawn(), "transaction took longer"))
+}
+
+func TestExecutor_Shard(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, &onet.Roster{},
+		[]string{"Spawn_value"}, signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.Identity = []byte("identity")
+	e, err := NewExecutor(genesisMsg)
+	require.Nil(t, err)
+
+	in := Instruction{
+		ObjectID: ObjectID{DarcID: genesisMsg.GenesisDarc.GetBaseID(), InstanceID: GenNonce()},
+		Spawn:    &Spawn{ContractID: ContractValueID},
+	}
+	require.Nil(t, in.SignBy(signer))
+	input := ClientTransaction{Instructions: []Instruction{in}}
+	ct := ClientTransaction{
+		Instructions: input.Instructions,
+		Atomix: &AtomixStep{
+			Phase:       AtomixLock,
+			Transaction: AtomixTransaction{Inputs: []ClientTransaction{input}},
+		},
+	}
+	// Without identity chain, the cross-shard transaction is refused.
+	receipts, err := e.Apply(ct)
+	require.Nil(t, err)
+	require.NotEqual(t, "", receipts[0].Error)
+	_, contractID, err := e.Get(in.ObjectID.Slice())
+	require.Nil(t, err)
+	require.Equal(t, "", contractID)
+}
@@ -0,0 +1,337 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/protobuf"
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/kyber.v2/sign/schnorr"
+	"gopkg.in/dedis/onet.v2/log"
+)
+
+// Every node keeps secondary indexes of the accepted ClientTransactions of
+// its skipchains, next to their collections. They map
+//   - the identities that signed an instruction
+//   - the darcs of the objects of the instructions
+//   - the contracts called, as listed in the receipts
+// to the transactions and the blocks holding them, and are read with
+// QueryTransactions. The indexes are local to the node and not part of the
+// consensus: they are derived from the bodies of the applied blocks, and can
+// be rebuilt from them at any time. A node that installed a snapshot of the
+// collection only indexes the blocks whose bodies it has.
+//
+// The entries are stored in bucketName_index under the key
+//   uvarint(len(term)) || term || index of the block || position in the body
+// where term is the category of the index followed by the value, so that all
+// transactions of a value are sorted by block.
+
+// The categories of the indexes.
+const (
+	indexSigner byte = iota + 1
+	indexDarc
+	indexContract
+)
+
+// queryDefaultLimit is the number of transactions returned by
+// QueryTransactions if no limit is given, queryMaxLimit is the largest limit.
+const (
+	queryDefaultLimit = 100
+	queryMaxLimit     = 1000
+)
+
+// IndexedTransaction is an entry of the indexes.
+type IndexedTransaction struct {
+	// TxHash is the hash of the ClientTransaction.
+	TxHash []byte
+	// Index is the index of the block holding the ClientTransaction.
+	Index int
+	// Timestamp is the timestamp of the block.
+	Timestamp int64
+}
+
+// indexTerm returns the prefix of the keys of the value in the category.
+func indexTerm(category byte, value []byte) []byte {
+	term := append([]byte{category}, value...)
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(len(term)))
+	return append(prefix[:n], term...)
+}
+
+// indexKey returns the key of the transaction at position pos in the body of
+// the block.
+func indexKey(term []byte, index, pos int) []byte {
+	key := make([]byte, len(term)+12)
+	copy(key, term)
+	binary.BigEndian.PutUint64(key[len(term):], uint64(index))
+	binary.BigEndian.PutUint32(key[len(term)+8:], uint32(pos))
+	return key
+}
+
+// keyIndex returns the index of the block of the key with the term.
+func keyIndex(term, key []byte) int {
+	return int(binary.BigEndian.Uint64(key[len(term):]))
+}
+
+// bodyTerms returns the terms of every accepted ClientTransaction of the body.
+func bodyTerms(body *DataBody) [][][]byte {
+	terms := make([][][]byte, len(body.Transactions))
+	for i, ct := range body.Transactions {
+		hash := ct.Hash()
+		for _, instr := range ct.Instructions {
+			for _, id := range instr.VerifiedSigners() {
+				terms[i] = append(terms[i], indexTerm(indexSigner, []byte(id.String())))
+			}
+			terms[i] = append(terms[i], indexTerm(indexDarc, instr.ObjectID.DarcID))
+		}
+		for _, r := range body.Receipts {
+			if r.Error == "" && bytes.Equal(r.TxHash, hash) {
+				for _, c := range r.Contracts {
+					terms[i] = append(terms[i], indexTerm(indexContract, []byte(c)))
+				}
+				break
+			}
+		}
+	}
+	return terms
+}
+
+func (c *collectionDB) indexBucket() []byte {
+	return append(append([]byte{}, c.bucketName...), []byte("_index")...)
+}
+
+// indexedBlock returns the index of the latest indexed block, or -1 if no
+// block has been indexed.
+func (c *collectionDB) indexedBlock() int {
+	index := -1
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(c.metaBucket()).Get(metaIndexed); b != nil {
+			i, _ := binary.Varint(b)
+			index = int(i)
+		}
+		return nil
+	})
+	return index
+}
+
+// indexBlock adds the accepted ClientTransactions of the body of the block
+// with the given index to the indexes. As the keys only depend on the block,
+// indexing a block again doesn't change the indexes.
+func (c *collectionDB) indexBlock(index int, timestamp int64, body *DataBody) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.indexBucket())
+		for pos, terms := range bodyTerms(body) {
+			buf, err := protobuf.Encode(&IndexedTransaction{
+				TxHash:    body.Transactions[pos].Hash(),
+				Index:     index,
+				Timestamp: timestamp,
+			})
+			if err != nil {
+				return err
+			}
+			for _, term := range terms {
+				if err = b.Put(indexKey(term, index, pos), buf); err != nil {
+					return err
+				}
+			}
+		}
+		// A block that is indexed again doesn't move the latest
+		// indexed block back.
+		meta := tx.Bucket(c.metaBucket())
+		if b := meta.Get(metaIndexed); b != nil {
+			if i, _ := binary.Varint(b); int(i) >= index {
+				return nil
+			}
+		}
+		indexed := make([]byte, 8)
+		binary.PutVarint(indexed, int64(index))
+		return meta.Put(metaIndexed, indexed)
+	})
+}
+
+// resetIndex removes all entries of the indexes.
+func (c *collectionDB) resetIndex() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(c.indexBucket()); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(c.indexBucket()); err != nil {
+			return err
+		}
+		return tx.Bucket(c.metaBucket()).Delete(metaIndexed)
+	})
+}
+
+// queryIndex returns up to limit transactions of the term in the blocks from
+// index from to index to, or up to the latest block if to is negative. If
+// cursor is set, the transactions start after it. The returned cursor is nil
+// if there are no more transactions.
+func (c *collectionDB) queryIndex(term []byte, from, to int, cursor []byte, limit int) ([]IndexedTransaction, []byte, error) {
+	if cursor != nil && (!bytes.HasPrefix(cursor, term) || len(cursor) != len(term)+12) {
+		return nil, nil, errors.New("cursor doesn't belong to the query")
+	}
+	if from < 0 {
+		from = 0
+	}
+	inRange := func(k []byte) bool {
+		return k != nil && bytes.HasPrefix(k, term) && len(k) == len(term)+12 &&
+			(to < 0 || keyIndex(term, k) <= to)
+	}
+	var txs []IndexedTransaction
+	var next []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(c.indexBucket()).Cursor()
+		start := indexKey(term, from, 0)
+		if cursor != nil && bytes.Compare(cursor, start) >= 0 {
+			start = cursor
+		}
+		k, v := cur.Seek(start)
+		if cursor != nil && bytes.Equal(k, cursor) {
+			k, v = cur.Next()
+		}
+		var last []byte
+		for ; inRange(k); k, v = cur.Next() {
+			if len(txs) == limit {
+				// There are more transactions, they start
+				// after the last one returned.
+				next = last
+				return nil
+			}
+			var it IndexedTransaction
+			if err := protobuf.Decode(v, &it); err != nil {
+				return err
+			}
+			txs = append(txs, it)
+			last = append([]byte{}, k...)
+		}
+		return nil
+	})
+	return txs, next, err
+}
+
+// updateIndex indexes the applied blocks that are newer than the latest
+// indexed block. Blocks whose bodies are missing are left out.
+func (s *Service) updateIndex(cdb *collectionDB) error {
+	latest, index := cdb.latestBlock()
+	indexed := cdb.indexedBlock()
+	if index <= indexed {
+		return nil
+	}
+	var blocks []*skipchain.SkipBlock
+	for sb := s.db().GetByID(latest); sb != nil && sb.Index > indexed; {
+		blocks = append(blocks, sb)
+		if sb.Index == 0 || len(sb.BackLinkIDs) == 0 {
+			break
+		}
+		sb = s.db().GetByID(sb.BackLinkIDs[0])
+	}
+	for i := len(blocks) - 1; i >= 0; i-- {
+		body, err := cdb.getBody(blocks[i].Hash)
+		if err != nil {
+			return err
+		}
+		if body == nil {
+			continue
+		}
+		header, err := decodeHeader(blocks[i])
+		if err != nil {
+			return err
+		}
+		if err = cdb.indexBlock(blocks[i].Index, header.Timestamp, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildIndex removes the indexes of the skipchain and recreates them from
+// the bodies of its blocks.
+func (s *Service) rebuildIndex(id skipchain.SkipBlockID) error {
+	cs := s.getChain(id)
+	cs.writeMu.Lock()
+	defer cs.writeMu.Unlock()
+	if err := cs.cdb.resetIndex(); err != nil {
+		return err
+	}
+	log.Lvlf2("%s: Rebuilding the indexes of %x", s.ServerIdentity(), id)
+	return s.updateIndex(cs.cdb)
+}
+
+// rebuildIndexMessage returns the message signed by the administrator of a
+// node to rebuild the indexes of the skipchain.
+func rebuildIndexMessage(id skipchain.SkipBlockID) []byte {
+	return append([]byte("reindex:"), id...)
+}
+
+// RebuildIndex rebuilds the indexes of a skipchain, if the request is signed
+// with the private key of the node. Like in skipchain.CreateLinkPrivate, the
+// administrator of a node is whoever has its private.toml.
+func (s *Service) RebuildIndex(req *RebuildIndex) (*RebuildIndexResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	err := schnorr.Verify(cothority.Suite, s.ServerIdentity().Public,
+		rebuildIndexMessage(req.ID), req.Signature)
+	if err != nil {
+		return nil, errors.New("wrong signature: " + err.Error())
+	}
+	sb := s.db().GetByID(req.ID)
+	if sb == nil {
+		return nil, errors.New("unknown skipchain")
+	}
+	id := sb.SkipChainID()
+	if err = s.rebuildIndex(id); err != nil {
+		return nil, err
+	}
+	return &RebuildIndexResponse{
+		Version: CurrentVersion,
+		Index:   s.getCollection(id).indexedBlock(),
+	}, nil
+}
+
+// QueryTransactions returns the accepted ClientTransactions of a signer, a
+// darc or a contract, in the order of the blocks. If there are more than the
+// limit, the response holds a cursor to get the next ones.
+func (s *Service) QueryTransactions(req *QueryTransactions) (*QueryTransactionsResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	sb := s.db().GetByID(req.ID)
+	if sb == nil {
+		return nil, errors.New("unknown skipchain")
+	}
+	var terms [][]byte
+	if req.Signer != "" {
+		terms = append(terms, indexTerm(indexSigner, []byte(req.Signer)))
+	}
+	if len(req.DarcID) > 0 {
+		terms = append(terms, indexTerm(indexDarc, req.DarcID))
+	}
+	if req.ContractID != "" {
+		terms = append(terms, indexTerm(indexContract, []byte(req.ContractID)))
+	}
+	if len(terms) != 1 {
+		return nil, errors.New("exactly one of signer, darc and contract must be given")
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = queryDefaultLimit
+	}
+	if limit > queryMaxLimit {
+		return nil, fmt.Errorf("limit is larger than %d", queryMaxLimit)
+	}
+	txs, cursor, err := s.getCollection(sb.SkipChainID()).queryIndex(terms[0],
+		req.FromIndex, req.ToIndex, req.Cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryTransactionsResponse{
+		Version:      CurrentVersion,
+		Transactions: txs,
+		Cursor:       cursor,
+	}, nil
+}
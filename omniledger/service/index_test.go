@@ -0,0 +1,90 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/kyber.v2/sign/schnorr"
+)
+
+func TestService_QueryTransactions(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	id := s.sb.SkipChainID()
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	_, err = s.service().AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: id,
+		Transaction: tx,
+	})
+	require.Nil(t, err)
+	time.Sleep(4 * s.interval)
+	hashes := [][]byte{s.tx.Hash(), tx.Hash()}
+
+	query := func(srv *Service, q QueryTransactions) ([][]byte, *QueryTransactionsResponse) {
+		q.Version, q.ID = CurrentVersion, id
+		resp, err := srv.QueryTransactions(&q)
+		require.Nil(t, err)
+		var found [][]byte
+		for _, it := range resp.Transactions {
+			require.True(t, it.Index > 0)
+			require.NotEqual(t, int64(0), it.Timestamp)
+			found = append(found, it.TxHash)
+		}
+		return found, resp
+	}
+
+	// Both nodes index the blocks they apply.
+	for _, srv := range s.services {
+		found, _ := query(srv, QueryTransactions{Signer: s.signer.Identity().String(), FromIndex: 1, ToIndex: -1})
+		require.Equal(t, hashes, found)
+		found, _ = query(srv, QueryTransactions{ContractID: dummyKind, ToIndex: -1})
+		require.Equal(t, hashes, found)
+	}
+	found, _ := query(s.service(), QueryTransactions{DarcID: s.darc.GetBaseID(), FromIndex: 1, ToIndex: -1})
+	require.Equal(t, hashes, found)
+	found, _ = query(s.service(), QueryTransactions{ContractID: "unknown", ToIndex: -1})
+	require.Equal(t, 0, len(found))
+
+	// The transactions of the first block only.
+	_, index := s.service().getCollection(id).latestBlock()
+	found, _ = query(s.service(), QueryTransactions{ContractID: dummyKind, ToIndex: index - 1})
+	require.Equal(t, hashes[:1], found)
+
+	// One page at a time.
+	found, resp := query(s.service(), QueryTransactions{ContractID: dummyKind, ToIndex: -1, Limit: 1})
+	require.Equal(t, hashes[:1], found)
+	require.NotNil(t, resp.Cursor)
+	found, resp = query(s.service(), QueryTransactions{ContractID: dummyKind, ToIndex: -1, Limit: 1, Cursor: resp.Cursor})
+	require.Equal(t, hashes[1:], found)
+	require.Nil(t, resp.Cursor)
+
+	// The indexes are rebuilt from the bodies of the blocks, if the
+	// administrator of the node asks for it.
+	sig, err := schnorr.Sign(cothority.Suite, s.local.GetPrivate(s.hosts[0]), rebuildIndexMessage(id))
+	require.Nil(t, err)
+	rebuilt, err := s.service().RebuildIndex(&RebuildIndex{Version: CurrentVersion, ID: id, Signature: sig})
+	require.Nil(t, err)
+	require.Equal(t, index, rebuilt.Index)
+	require.Equal(t, index, s.service().getCollection(id).indexedBlock())
+	_, err = s.services[1].RebuildIndex(&RebuildIndex{Version: CurrentVersion, ID: id, Signature: sig})
+	require.NotNil(t, err)
+	found, _ = query(s.service(), QueryTransactions{ContractID: dummyKind, ToIndex: -1})
+	require.Equal(t, hashes, found)
+
+	for _, q := range []QueryTransactions{
+		{},
+		{ContractID: dummyKind, Signer: s.signer.Identity().String()},
+		{ContractID: dummyKind, Limit: queryMaxLimit + 1},
+		{ContractID: dummyKind, Cursor: []byte("cursor")},
+	} {
+		q.Version, q.ID = CurrentVersion, id
+		_, err = s.service().QueryTransactions(&q)
+		require.NotNil(t, err)
+	}
+}
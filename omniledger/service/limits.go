@@ -0,0 +1,182 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// The ClientTransactions are metered while their contracts are executed, and
+// the Limits in the config bound what they may use:
+//   1. every instruction, together with the contracts it calls, may only
+//   return a limited number of StateChanges, write a limited number of bytes
+//   and call a limited number of contracts
+//   2. every ClientTransaction has a budget, which grows with the fee it
+//   leaves to the reward account
+//   3. all ClientTransactions of a block share a budget
+// A ClientTransaction over a budget is refused on its own, and the reason is
+// kept in its Receipt. All nodes count the same way: the leader sends the body
+// of a new block to the nodes signing it, which execute it and refuse to sign
+// a block holding a transaction over its budget. Only the time a transaction
+// takes is checked by the leader alone, as the other nodes cannot measure it
+// the same way.
+
+// Resources counts what the execution of instructions uses, or bounds it.
+type Resources struct {
+	// StateChanges is the number of StateChanges returned by the contracts.
+	StateChanges int
+	// Bytes is the size of the keys, contract IDs and values of these
+	// StateChanges.
+	Bytes int
+	// Steps is the number of contracts called.
+	Steps int
+}
+
+// add adds the resources of o to r.
+func (r *Resources) add(o Resources) {
+	r.StateChanges += o.StateChanges
+	r.Bytes += o.Bytes
+	r.Steps += o.Steps
+}
+
+// count adds the StateChanges and their bytes to r.
+func (r *Resources) count(scs []StateChange) {
+	for _, sc := range scs {
+		r.StateChanges++
+		r.Bytes += len(sc.ObjectID) + len(sc.ContractID) + len(sc.Value)
+	}
+}
+
+// exceeds returns an error if r uses more than the limit. The fields of the
+// limit that are zero are unlimited.
+func (r Resources) exceeds(limit Resources) error {
+	check := func(name string, used, max int) error {
+		if max > 0 && used > max {
+			return fmt.Errorf("%d %s used, but only %d allowed", used, name, max)
+		}
+		return nil
+	}
+	if err := check("StateChanges", r.StateChanges, limit.StateChanges); err != nil {
+		return err
+	}
+	if err := check("bytes", r.Bytes, limit.Bytes); err != nil {
+		return err
+	}
+	return check("steps", r.Steps, limit.Steps)
+}
+
+// Limits bounds the resources of the ClientTransactions. All fields are
+// optional, a zero value is unlimited.
+type Limits struct {
+	// Instruction bounds every instruction, including the contracts it
+	// calls.
+	Instruction Resources
+	// Transaction bounds every ClientTransaction that pays no fee.
+	Transaction Resources
+	// Block bounds all ClientTransactions of a block.
+	Block Resources
+	// FeeCoin is the type of coin the fees are paid with. The fee of a
+	// ClientTransaction is the number of these coins it leaves to the
+	// reward account.
+	FeeCoin ObjectID
+	// PerFee is added to the limits of a ClientTransaction for every coin
+	// of its fee. The limits that are unlimited stay so.
+	PerFee Resources
+	// Duration is the time the leader lets a ClientTransaction run.
+	Duration time.Duration
+}
+
+// transactionLimit returns the limit of a ClientTransaction paying the fee.
+func (l Limits) transactionLimit(fee uint64) Resources {
+	raise := func(max, per int) int {
+		if max <= 0 || per <= 0 || fee == 0 {
+			return max
+		}
+		if fee > uint64(math.MaxInt32-max)/uint64(per) {
+			return math.MaxInt32
+		}
+		return max + int(fee)*per
+	}
+	return Resources{
+		StateChanges: raise(l.Transaction.StateChanges, l.PerFee.StateChanges),
+		Bytes:        raise(l.Transaction.Bytes, l.PerFee.Bytes),
+		Steps:        raise(l.Transaction.Steps, l.PerFee.Steps),
+	}
+}
+
+// Receipt holds the outcome of a ClientTransaction the leader tried to add to
+// a block.
+type Receipt struct {
+	// TxHash is the hash of the ClientTransaction.
+	TxHash []byte
+	// Error is why the ClientTransaction has been refused. It is empty if
+	// the ClientTransaction has been accepted.
+	Error string
+	// Used holds the resources of an accepted ClientTransaction.
+	Used Resources
+	// Events holds the events emitted by the contracts of an accepted
+	// ClientTransaction, see events.go.
+	Events []Event
+	// Contracts holds the IDs of the contracts called by an accepted
+	// ClientTransaction, including the cross-contract calls, in the order
+	// they have been called first.
+	Contracts []string
+}
+
+// addContract adds the contract to r.Contracts if it's not in yet.
+func (r *Receipt) addContract(contractID string) {
+	for _, c := range r.Contracts {
+		if c == contractID {
+			return
+		}
+	}
+	r.Contracts = append(r.Contracts, contractID)
+}
+
+// receiptSearchDepth is the number of blocks GetReceipt goes back to find the
+// receipt of a ClientTransaction.
+const receiptSearchDepth = 100
+
+// GetReceipt returns the receipt of a ClientTransaction, searched in the
+// bodies of the latest blocks, together with the proof that it is in the
+// block.
+func (s *Service) GetReceipt(req *GetReceipt) (*GetReceiptResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	sb := s.db().GetByID(req.ID)
+	if sb == nil {
+		return nil, errors.New("unknown skipchain")
+	}
+	cdb := s.getCollection(sb.SkipChainID())
+	id, _ := cdb.latestBlock()
+	for i := 0; i < receiptSearchDepth && !id.IsNull(); i++ {
+		sb = s.db().GetByID(id)
+		if sb == nil {
+			break
+		}
+		if body, err := cdb.getBody(sb.Hash); err == nil {
+			for i, r := range body.Receipts {
+				if bytes.Equal(r.TxHash, req.TxHash) {
+					p, err := newReceiptProof(s.db(), sb, body.Receipts, i)
+					if err != nil {
+						return nil, err
+					}
+					return &GetReceiptResponse{
+						Version: CurrentVersion,
+						Index:   sb.Index,
+						Receipt: r,
+						Proof:   *p,
+					}, nil
+				}
+			}
+		}
+		if len(sb.BackLinkIDs) == 0 || sb.Index == 0 {
+			break
+		}
+		id = sb.BackLinkIDs[0]
+	}
+	return nil, errors.New("no receipt found")
+}
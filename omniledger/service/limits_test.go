@@ -0,0 +1,182 @@
+package service
+
+import (
+	"crypto/sha256"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+	"student_18_byzcoin/omniledger/collection"
+)
+
+func TestResources_Exceeds(t *testing.T) {
+	used := Resources{StateChanges: 3, Bytes: 100, Steps: 2}
+	require.Nil(t, used.exceeds(Resources{}))
+	require.Nil(t, used.exceeds(used))
+	require.NotNil(t, used.exceeds(Resources{StateChanges: 2}))
+	require.NotNil(t, used.exceeds(Resources{Bytes: 99}))
+	require.NotNil(t, used.exceeds(Resources{Steps: 1}))
+
+	// The fees only raise the limited resources.
+	l := Limits{
+		Transaction: Resources{StateChanges: 2},
+		PerFee:      Resources{StateChanges: 3, Bytes: 10},
+	}
+	require.Equal(t, Resources{StateChanges: 2}, l.transactionLimit(0))
+	require.Equal(t, Resources{StateChanges: 8}, l.transactionLimit(2))
+	require.Equal(t, math.MaxInt32, l.transactionLimit(math.MaxUint64).StateChanges)
+}
+
+// spamKind is a contract that creates as many objects as given in its "n"
+// argument.
+var spamKind = "spam"
+
+func contractSpam(cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+	var scs []StateChange
+	for i := 0; i < int(tx.Spawn.Args.Search("n")[0]); i++ {
+		oid := tx.ObjectID
+		oid.InstanceID = Nonce(sha256.Sum256(append(oid.InstanceID[:], byte(i))))
+		scs = append(scs, NewStateChange(Create, oid, spamKind, []byte("spam")))
+	}
+	return scs, c, nil
+}
+
+func TestService_Limits(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	RegisterContract(s.hosts[0], spamKind, contractSpam)
+
+	coinType := ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}
+	account := ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}
+	reward := ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}
+	limits := Limits{
+		Instruction: Resources{StateChanges: 4},
+		Transaction: Resources{StateChanges: 3, Steps: 2},
+		Block:       Resources{StateChanges: 10},
+		FeeCoin:     coinType,
+		PerFee:      Resources{StateChanges: 1},
+	}
+	limitsBuf, err := protobuf.Encode(&limits)
+	require.Nil(t, err)
+	coll := newConfigColl(t, s, &reward, Argument{Name: "limits", Value: limitsBuf})
+	ca := CoinAccount{Coins: []Coin{{Name: coinType, Value: 100}}}
+	buf, err := protobuf.Encode(&ca)
+	require.Nil(t, err)
+	require.Nil(t, coll.Add(account.Slice(), buf, []byte(ContractCoinID)))
+
+	spam := func(n int, fee uint64) Instruction {
+		instr := Instruction{
+			ObjectID: ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()},
+			Spawn: &Spawn{
+				ContractID: spamKind,
+				Args:       Arguments{{Name: "n", Value: []byte{byte(n)}}},
+			},
+		}
+		if fee > 0 {
+			instr.Coins = []CoinInput{{Account: account, Coin: Coin{Name: coinType, Value: fee}}}
+		}
+		return instr
+	}
+	run := func(cts ...ClientTransaction) []Receipt {
+		_, ctsOK, scs, receipts, err := s.service().createStateChanges(coll, Context{}, cts)
+		require.Nil(t, err)
+		require.Equal(t, len(cts), len(receipts))
+		for i := range scs {
+			require.Nil(t, storeInColl(coll, &scs[i]))
+		}
+		accepted := 0
+		for i, r := range receipts {
+			require.Equal(t, cts[i].Hash(), r.TxHash)
+			if r.Error == "" {
+				accepted++
+			}
+		}
+		require.Equal(t, len(ctsOK), accepted)
+		return receipts
+	}
+	tx := func(instrs ...Instruction) ClientTransaction {
+		return ClientTransaction{Instructions: instrs}
+	}
+
+	r := run(tx(spam(3, 0)))[0]
+	require.Equal(t, "", r.Error)
+	require.Equal(t, Resources{StateChanges: 3, Bytes: 3 * (64 + len(spamKind) + 4), Steps: 1}, r.Used)
+
+	r = run(tx(spam(4, 0)))[0]
+	require.True(t, strings.HasPrefix(r.Error, "transaction over its budget"), r.Error)
+	// The fee raises the budget of the transaction, but not the one of the
+	// instruction.
+	r = run(tx(spam(4, 1)))[0]
+	require.Equal(t, "", r.Error)
+	r = run(tx(spam(5, 5)))[0]
+	require.True(t, strings.HasPrefix(r.Error, "instruction over its budget"), r.Error)
+	r = run(tx(spam(0, 0), spam(0, 0), spam(0, 0)))[0]
+	require.True(t, strings.Contains(r.Error, "steps"), r.Error)
+
+	// The fourth transaction doesn't fit in the block anymore.
+	receipts := run(tx(spam(3, 0)), tx(spam(3, 0)), tx(spam(3, 0)), tx(spam(3, 0)))
+	for _, r := range receipts[:3] {
+		require.Equal(t, "", r.Error)
+	}
+	require.True(t, strings.HasPrefix(receipts[3].Error, "block over its budget"), receipts[3].Error)
+}
+
+func TestService_GetReceipt(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	for _, h := range s.hosts {
+		RegisterContract(h, spamKind, contractSpam)
+	}
+
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, s.roster, []string{"Spawn_" + spamKind}, s.signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = s.interval
+	genesisMsg.Limits = &Limits{Transaction: Resources{StateChanges: 2}}
+	resp, err := s.service().CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	id := resp.Skipblock.SkipChainID()
+	darcID := genesisMsg.GenesisDarc.GetBaseID()
+
+	send := func(n int) []byte {
+		instr := Instruction{
+			ObjectID: ObjectID{DarcID: darcID, InstanceID: GenNonce()},
+			Spawn: &Spawn{
+				ContractID: spamKind,
+				Args:       Arguments{{Name: "n", Value: []byte{byte(n)}}},
+			},
+		}
+		require.Nil(t, instr.SignBy(s.signer))
+		ct := ClientTransaction{Instructions: []Instruction{instr}}
+		_, err := s.service().AddTransaction(&AddTxRequest{
+			Version:     CurrentVersion,
+			SkipchainID: id,
+			Transaction: ct,
+		})
+		require.Nil(t, err)
+		return ct.Hash()
+	}
+	ok, tooBig := send(2), send(3)
+	time.Sleep(4 * s.interval)
+
+	// The other node accepted the block, as it enforces the same limits.
+	_, index := s.services[0].getCollection(id).latestBlock()
+	require.True(t, index >= 1)
+	_, followerIndex := s.services[1].getCollection(id).latestBlock()
+	require.Equal(t, index, followerIndex)
+	receipt, err := s.service().GetReceipt(&GetReceipt{Version: CurrentVersion, ID: id, TxHash: ok})
+	require.Nil(t, err)
+	require.True(t, receipt.Index >= 1)
+	require.Equal(t, "", receipt.Receipt.Error)
+	require.Equal(t, 2, receipt.Receipt.Used.StateChanges)
+	receipt, err = s.service().GetReceipt(&GetReceipt{Version: CurrentVersion, ID: id, TxHash: tooBig})
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(receipt.Receipt.Error, "transaction over its budget"))
+
+	_, err = s.service().GetReceipt(&GetReceipt{Version: CurrentVersion, ID: id, TxHash: []byte("unknown")})
+	require.NotNil(t, err)
+}
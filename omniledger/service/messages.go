@@ -20,6 +20,14 @@ func init() {
 	network.RegisterMessages(
 		&CreateGenesisBlock{}, &CreateGenesisBlockResponse{},
 		&AddTxRequest{}, &AddTxResponse{},
+		&CreateShardedLedger{}, &CreateShardedLedgerResponse{},
+		&GetReceipt{}, &GetReceiptResponse{},
+		&CallView{}, &CallViewResponse{},
+		&SimulateTransaction{}, &SimulateTransactionResponse{},
+		&Subscribe{}, &SubscribeResponse{},
+		&QueryTransactions{}, &QueryTransactionsResponse{},
+		&ListContracts{}, &ListContractsResponse{},
+		&RebuildIndex{}, &RebuildIndexResponse{},
 	)
 }
 
@@ -52,6 +60,22 @@ type CreateGenesisBlock struct {
 	GenesisDarc darc.Darc
 	// BlockInterval in int64.
 	BlockInterval time.Duration
+	// RewardAccount is the coin account receiving the coins left over by
+	// the transactions. It is optional.
+	RewardAccount *ObjectID
+	// Epochs defines how the roster is chosen from the stakes. If its
+	// Length is zero, the roster never changes.
+	Epochs EpochConfig
+	// Identity is the identity chain of a sharded ledger, if the new
+	// skipchain is one of its shards. It is optional.
+	Identity skipchain.SkipBlockID
+	// Shard is the index of the shard in the identity chain.
+	Shard int
+	// Limits bounds the resources of the transactions. It is optional.
+	Limits *Limits
+	// Contracts are the contracts enabled on the skipchain. If it is nil,
+	// all contracts registered by the nodes can be used.
+	Contracts *ContractWhitelist
 }
 
 // CreateGenesisBlockResponse holds the genesis-block of the new skipchain.
@@ -78,6 +102,29 @@ type AddTxResponse struct {
 	Version Version
 }
 
+// SimulateTransaction asks to execute a transaction without adding it to the
+// skipchain.
+type SimulateTransaction struct {
+	// Version of the protocol
+	Version Version
+	// SkipchainID is the hash of the first skipblock
+	SkipchainID skipchain.SkipBlockID
+	// Transaction to be executed
+	Transaction ClientTransaction
+}
+
+// SimulateTransactionResponse holds the outcome of the simulated transaction.
+type SimulateTransactionResponse struct {
+	// Version of the protocol
+	Version Version
+	// StateChanges holds what the transaction would change, if it is
+	// accepted.
+	StateChanges StateChanges
+	// Receipt tells whether the transaction would be accepted, and why it
+	// would be refused otherwise.
+	Receipt Receipt
+}
+
 // GetProof returns the proof that the given key is in the collection.
 type GetProof struct {
 	// Version of the protocol
@@ -98,3 +145,195 @@ type GetProofResponse struct {
 	// of the included key/value pair given a genesis skipblock.
 	Proof Proof
 }
+
+// GetReceipt asks for the receipt of a transaction that has been sent to the
+// leader of the skipchain.
+type GetReceipt struct {
+	// Version of the protocol
+	Version Version
+	// ID is any block of the skipchain.
+	ID skipchain.SkipBlockID
+	// TxHash is the hash of the ClientTransaction.
+	TxHash []byte
+}
+
+// GetReceiptResponse holds the receipt of a transaction and the index of the
+// block it has been tried in.
+type GetReceiptResponse struct {
+	// Version of the protocol
+	Version Version
+	// Index is the index of the block.
+	Index int
+	// Receipt tells whether the transaction has been accepted.
+	Receipt Receipt
+	// Proof proves that the receipt, with its events, is in the block.
+	Proof ReceiptProof
+}
+
+// CallView asks for the result of a view method of a contract.
+type CallView struct {
+	// Version of the protocol
+	Version Version
+	// ID is the skipchain whose state is read.
+	ID skipchain.SkipBlockID
+	// ContractID is the contract the view belongs to.
+	ContractID string
+	// Method is the name of the view.
+	Method string
+	// Args are given to the view.
+	Args Arguments
+}
+
+// CallViewResponse holds the result of a view and the proofs of all keys it
+// read, see CallViewResponse.Verify.
+type CallViewResponse struct {
+	// Version of the protocol
+	Version Version
+	// Result is what the view returned.
+	Result []byte
+	// Proofs holds a proof for every key read by the view.
+	Proofs []Proof
+}
+
+// CreateShardedLedger asks the service to set up an identity chain and the
+// skipchains of the shards, whose rosters are chosen from the nodes of the
+// roster.
+type CreateShardedLedger struct {
+	// Version of the protocol
+	Version Version
+	// Roster holds all nodes, which form the roster of the identity chain
+	// and are assigned to the shards.
+	Roster onet.Roster
+	// GenesisDarc defines who is allowed to write to the skipchains.
+	GenesisDarc darc.Darc
+	// BlockInterval in int64.
+	BlockInterval time.Duration
+	// RewardAccount is the coin account receiving the coins left over by
+	// the transactions on every skipchain. It is optional.
+	RewardAccount *ObjectID
+	// Shards is the number of shards.
+	Shards int
+	// Epochs defines the epochs of the identity chain. At every epoch, the
+	// nodes are assigned to the shards anew. If its Length is zero, they
+	// are never assigned anew.
+	Epochs EpochConfig
+	// Limits bounds the resources of the transactions on every skipchain.
+	// It is optional.
+	Limits *Limits
+}
+
+// CreateShardedLedgerResponse holds the genesis-block of the identity chain
+// and the shards recorded in it.
+type CreateShardedLedgerResponse struct {
+	// Version of the protocol
+	Version Version
+	// Identity is the genesis-block of the identity chain.
+	Identity *skipchain.SkipBlock
+	// Shards holds the skipchains of the shards and their rosters.
+	Shards ShardConfig
+}
+
+// Subscribe asks for a stream of the blocks of a skipchain, see subscribe.go.
+type Subscribe struct {
+	// Version of the protocol
+	Version Version
+	// ID is any block of the skipchain.
+	ID skipchain.SkipBlockID
+	// From is the index of the first block to send. If it is negative, or
+	// after the latest block, the latest block is sent first, with the
+	// proofs of all watched objects.
+	From int
+	// ObjectIDs are the objects whose changes are proven.
+	ObjectIDs []ObjectID
+}
+
+// SubscribeResponse is sent for every block of a subscription. It must be
+// verified with Verify.
+type SubscribeResponse struct {
+	// Version of the protocol
+	Version Version
+	// Block is the skipblock, its data is a DataHeader.
+	Block skipchain.SkipBlock
+	// Links proves that the block is part of the skipchain, like in Proof.
+	Links []skipchain.ForwardLink
+	// Receipts holds the receipts of the body of the block, their merkle
+	// root is in the header.
+	Receipts []Receipt
+	// Objects holds the proofs of the watched objects that changed in the
+	// block.
+	Objects []Proof
+}
+
+// QueryTransactions asks for the accepted ClientTransactions of a signer, a
+// darc or a contract, see index.go. Exactly one of them must be set.
+type QueryTransactions struct {
+	// Version of the protocol
+	Version Version
+	// ID is any block of the skipchain.
+	ID skipchain.SkipBlockID
+	// Signer is the string of the identity of a signer of an instruction.
+	Signer string
+	// DarcID is the darc of an object of an instruction.
+	DarcID darc.ID
+	// ContractID is a contract called by the transaction.
+	ContractID string
+	// FromIndex is the index of the first block searched.
+	FromIndex int
+	// ToIndex is the index of the last block searched. If it is negative,
+	// the blocks up to the latest one are searched.
+	ToIndex int
+	// Limit is the maximum number of transactions returned. If it is zero,
+	// up to 100 transactions are returned.
+	Limit int
+	// Cursor is the cursor of the previous response, to get the next
+	// transactions.
+	Cursor []byte
+}
+
+// QueryTransactionsResponse holds the transactions in the order of the
+// blocks.
+type QueryTransactionsResponse struct {
+	// Version of the protocol
+	Version Version
+	// Transactions holds the transactions found.
+	Transactions []IndexedTransaction
+	// Cursor is set if there are more transactions. It must be sent with
+	// the same query to get them.
+	Cursor []byte
+}
+
+// RebuildIndex asks a node to rebuild its indexes of a skipchain from the
+// bodies of the blocks. Only the administrator of the node may do so.
+type RebuildIndex struct {
+	// Version of the protocol
+	Version Version
+	// ID is any block of the skipchain.
+	ID skipchain.SkipBlockID
+	// Signature is the schnorr signature of "reindex:" followed by ID,
+	// made with the private key of the node.
+	Signature []byte
+}
+
+// RebuildIndexResponse tells up to which block the indexes have been
+// rebuilt.
+type RebuildIndexResponse struct {
+	// Version of the protocol
+	Version Version
+	// Index is the latest indexed block.
+	Index int
+}
+
+// ListContracts asks for the contracts registered on a node, see schema.go.
+type ListContracts struct {
+	// Version of the protocol
+	Version Version
+}
+
+// ListContractsResponse holds every version of the registered contracts with
+// its argument schema.
+type ListContractsResponse struct {
+	// Version of the protocol
+	Version Version
+	// Contracts are sorted by ID and version.
+	Contracts []ContractSchema
+}
@@ -0,0 +1,371 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/protobuf"
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/onet.v2/network"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+// A multisig wallet holds coins and spends them, or runs any other
+// instruction, once enough identities approved it. The approvals don't need
+// to be given in one instruction: a proposal is stored in the wallet and
+// collects them over several blocks, until it is executed or its deadline
+// passes. Who may approve is defined by the rule Invoke_approve of the darc
+// of the wallet, every signer that satisfies the rule on its own counts as
+// one approval.
+//
+// Instructions proposed to the wallet are executed with Context.Call, with
+// the approvers as signers, so the darc of their object has to allow the
+// approvers. The coins of the wallet can only be spent by proposals, as they
+// are held by the wallet itself.
+
+// ContractMultisigID denotes a multisig-contract. Its objects are wallets
+// and their value is a MultisigWallet.
+var ContractMultisigID = "multisig"
+
+// CmdMultisigDeposit is needed to put coins into a wallet.
+var CmdMultisigDeposit = "deposit"
+
+// CmdMultisigPropose is needed to create a proposal.
+var CmdMultisigPropose = "propose"
+
+// CmdMultisigApprove is needed to approve a proposal.
+var CmdMultisigApprove = "approve"
+
+// MultisigWallet is the value of a multisig wallet.
+type MultisigWallet struct {
+	// Threshold is the number of approvals a proposal needs.
+	Threshold int
+	// Coins are the coins held by the wallet.
+	Coins []Coin
+	// Proposals are the proposals that are neither executed nor expired.
+	Proposals []MultisigProposal
+	// NextProposal is the ID of the next proposal.
+	NextProposal uint64
+}
+
+// MultisigProposal is a proposal of a wallet. It either sends coins of the
+// wallet or holds an instruction.
+type MultisigProposal struct {
+	// ID identifies the proposal in its wallet.
+	ID uint64
+	// Transfer is set if the proposal sends coins.
+	Transfer *MultisigTransfer
+	// Instruction is set if the proposal runs an instruction.
+	Instruction *Instruction
+	// Deadline is the last timestamp of a block in which the proposal can
+	// be approved, in seconds since the epoch.
+	Deadline int64
+	// Approvals holds the identities that approved the proposal.
+	Approvals []darc.Identity
+}
+
+// MultisigTransfer sends coins of the wallet to an account.
+type MultisigTransfer struct {
+	// Coin is the type and the number of coins sent.
+	Coin Coin
+	// Destination is the coin account receiving the coins.
+	Destination ObjectID
+}
+
+func loadMultisigWallet(coll collection.Collection, key []byte) (*MultisigWallet, error) {
+	value, contract, err := getValueContract(coll, key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMultisigWallet(value, contract)
+}
+
+func decodeMultisigWallet(value, contract []byte) (*MultisigWallet, error) {
+	if string(contract) != ContractMultisigID {
+		return nil, errors.New("object is not a multisig wallet")
+	}
+	w := &MultisigWallet{}
+	err := protobuf.DecodeWithConstructors(value, w, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// approve adds the identities that didn't approve the proposal yet. It
+// returns the number of new approvals.
+func (p *MultisigProposal) approve(ids []darc.Identity) int {
+	added := 0
+	for _, id := range ids {
+		known := false
+		for _, a := range p.Approvals {
+			if a.String() == id.String() {
+				known = true
+				break
+			}
+		}
+		if !known {
+			p.Approvals = append(p.Approvals, id)
+			added++
+		}
+	}
+	return added
+}
+
+// multisigApprovers returns the signers that satisfy the approve rule of the
+// darc on their own.
+func multisigApprovers(cdb collection.Collection, darcID darc.ID, signers []darc.Identity) ([]darc.Identity, error) {
+	d, err := loadDarc(cdb, darcID)
+	if err != nil {
+		return nil, err
+	}
+	getDarc := func(id string) *darc.Darc {
+		return getDarcFromColl(cdb, id)
+	}
+	action := darc.Action("Invoke_" + CmdMultisigApprove)
+	var ids []darc.Identity
+	for _, id := range signers {
+		if d.VerifyIdentities(action, []darc.Identity{id}, getDarc) == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// multisigProposalArgs returns the proposal described by the arguments of a
+// propose instruction.
+func multisigProposalArgs(tx Instruction) (*MultisigProposal, error) {
+	args := tx.Invoke.Args
+	deadline, err := args.Varint("deadline")
+	if err != nil {
+		return nil, err
+	}
+	p := &MultisigProposal{Deadline: deadline}
+	if buf, ok := args.Lookup("instruction"); ok {
+		instr := &Instruction{}
+		err := protobuf.DecodeWithConstructors(buf, instr, network.DefaultConstructors(cothority.Suite))
+		if err != nil {
+			return nil, err
+		}
+		if instr.Action() == "invalid" {
+			return nil, errors.New("proposed instruction has no action")
+		}
+		if instr.ObjectID.Equal(tx.ObjectID) {
+			return nil, errors.New("proposed instruction cannot change the wallet")
+		}
+		p.Instruction = instr
+		return p, nil
+	}
+	value, err := coinValueArg(args)
+	if err != nil {
+		return nil, err
+	}
+	coin, err := NewObjectIDFromSlice(args.Search("coin"))
+	if err != nil {
+		return nil, err
+	}
+	dest, err := NewObjectIDFromSlice(args.Search("destination"))
+	if err != nil {
+		return nil, err
+	}
+	p.Transfer = &MultisigTransfer{
+		Coin:        Coin{Name: coin, Value: value},
+		Destination: dest,
+	}
+	return p, nil
+}
+
+// proposalIDData is the data of the events of a proposal.
+func proposalIDData(id uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, id)
+	return buf
+}
+
+// ContractMultisig handles multisig wallets. It accepts the following
+// instructions:
+//   - Spawn - creates a wallet whose proposals need "threshold" approvals,
+//     the coins handed over by the previous contracts are put in the wallet
+//   - Invoke.deposit - puts the coins handed over by the previous contracts
+//     in the wallet
+//   - Invoke.propose - creates a proposal that can be approved until the
+//     block timestamp "deadline". It sends "value" coins of the type "coin" of
+//     the wallet to the account "destination", or runs the protobuf-encoded
+//     "instruction". The signers allowed to approve approve it at once.
+//   - Invoke.approve - approves the proposal "proposal" for every signer
+//     allowed to approve
+//   - Delete - removes a wallet without coins
+//
+// A proposal is executed, and removed, by the instruction giving it enough
+// approvals. If the execution fails, the instruction fails and the proposal
+// keeps its approvals. Coins handed back by a proposed instruction are put in
+// the wallet. Expired proposals are removed by the next instruction of the
+// wallet. The events "proposed", "executed" and "expired" hold the ID of the
+// proposal as 8 bytes in little endian.
+func (s *Service) ContractMultisig(ctx Context, cdb collection.Collection, tx Instruction, coins []Coin) (sc []StateChange, c []Coin, err error) {
+	if tx.Spawn != nil {
+		rec, err := cdb.Get(tx.ObjectID.Slice()).Record()
+		if err != nil {
+			return nil, nil, err
+		}
+		if rec.Match() {
+			return nil, nil, errors.New("object already exists")
+		}
+		threshold, err := tx.Spawn.Args.Varint("threshold")
+		if err != nil {
+			return nil, nil, err
+		}
+		if threshold <= 0 {
+			return nil, nil, errors.New("threshold must be positive")
+		}
+		buf, err := protobuf.Encode(&MultisigWallet{
+			Threshold: int(threshold),
+			Coins:     coins,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return []StateChange{
+			NewStateChange(Create, tx.ObjectID, ContractMultisigID, buf),
+		}, nil, nil
+	}
+
+	w, err := loadMultisigWallet(cdb, tx.ObjectID.Slice())
+	if err != nil {
+		return nil, nil, err
+	}
+	if tx.Delete != nil {
+		for _, coin := range w.Coins {
+			if coin.Value > 0 {
+				return nil, nil, errors.New("only empty wallets can be deleted")
+			}
+		}
+		return []StateChange{
+			NewStateChange(Remove, tx.ObjectID, ContractMultisigID, nil),
+		}, coins, nil
+	}
+	if tx.Invoke == nil {
+		return nil, nil, errors.New("instruction without action")
+	}
+
+	var pending []MultisigProposal
+	for _, p := range w.Proposals {
+		if p.Deadline < ctx.Timestamp {
+			if err = ctx.Emit("expired", proposalIDData(p.ID)); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		pending = append(pending, p)
+	}
+	w.Proposals = pending
+
+	var p *MultisigProposal
+	switch tx.Invoke.Command {
+	case CmdMultisigDeposit:
+		for _, coin := range coins {
+			if w.Coins, err = addCoin(w.Coins, coin); err != nil {
+				return nil, nil, err
+			}
+		}
+		coins = nil
+	case CmdMultisigPropose:
+		if p, err = multisigProposalArgs(tx); err != nil {
+			return nil, nil, err
+		}
+		if p.Deadline < ctx.Timestamp {
+			return nil, nil, errors.New("deadline has passed")
+		}
+		p.ID = w.NextProposal
+		w.NextProposal++
+		w.Proposals = append(w.Proposals, *p)
+		p = &w.Proposals[len(w.Proposals)-1]
+		if err = ctx.Emit("proposed", proposalIDData(p.ID)); err != nil {
+			return nil, nil, err
+		}
+	case CmdMultisigApprove:
+		id, err := tx.Invoke.Args.Uint64("proposal")
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range w.Proposals {
+			if w.Proposals[i].ID == id {
+				p = &w.Proposals[i]
+			}
+		}
+		if p == nil {
+			return nil, nil, fmt.Errorf("proposal %d doesn't exist or has expired", id)
+		}
+	default:
+		return nil, nil, errors.New("Multisig contract can only deposit, propose and approve")
+	}
+
+	if p != nil {
+		approvers, err := multisigApprovers(cdb, tx.ObjectID.DarcID, ctx.Signers)
+		if err != nil {
+			return nil, nil, err
+		}
+		if p.approve(approvers) == 0 && tx.Invoke.Command == CmdMultisigApprove {
+			return nil, nil, errors.New("no new approval")
+		}
+		if len(p.Approvals) >= w.Threshold {
+			if sc, err = s.executeProposal(ctx, cdb, w, *p); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	buf, err := protobuf.Encode(w)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append([]StateChange{
+		NewStateChange(Update, tx.ObjectID, ContractMultisigID, buf),
+	}, sc...), coins, nil
+}
+
+// executeProposal executes the approved proposal and removes it from the
+// wallet. It returns the StateChanges of a transfer, the StateChanges of a
+// proposed instruction are applied by Context.Call.
+func (s *Service) executeProposal(ctx Context, cdb collection.Collection, w *MultisigWallet, p MultisigProposal) (sc []StateChange, err error) {
+	for i := range w.Proposals {
+		if w.Proposals[i].ID == p.ID {
+			w.Proposals = append(w.Proposals[:i], w.Proposals[i+1:]...)
+			break
+		}
+	}
+	switch {
+	case p.Transfer != nil:
+		if w.Coins, err = subCoin(w.Coins, p.Transfer.Coin); err != nil {
+			return nil, err
+		}
+		dest, err := loadCoinAccount(cdb, p.Transfer.Destination.Slice())
+		if err != nil {
+			return nil, err
+		}
+		if dest == nil {
+			return nil, errors.New("destination account doesn't exist")
+		}
+		credit, err := creditCoins(cdb, p.Transfer.Destination, []Coin{p.Transfer.Coin})
+		if err != nil {
+			return nil, err
+		}
+		sc = append(sc, credit)
+	case p.Instruction != nil:
+		ctx.Signers = p.Approvals
+		_, left, err := ctx.Call(*p.Instruction, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, coin := range left {
+			if w.Coins, err = addCoin(w.Coins, coin); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("proposal has no action")
+	}
+	return sc, ctx.Emit("executed", proposalIDData(p.ID))
+}
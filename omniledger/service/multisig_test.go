@@ -0,0 +1,166 @@
+package service
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v2"
+	"student_18_byzcoin/omniledger/darc"
+	"student_18_byzcoin/omniledger/darc/expression"
+)
+
+func TestService_ContractMultisig(t *testing.T) {
+	owner := darc.NewSignerEd25519(nil, nil)
+	a := darc.NewSignerEd25519(nil, nil)
+	b := darc.NewSignerEd25519(nil, nil)
+	c := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, &onet.Roster{},
+		[]string{"Spawn_" + ContractCoinID, "Invoke_" + CmdCoinMint, "Invoke_" + CmdCoinFetch,
+			"Spawn_" + ContractMultisigID, "Invoke_" + CmdMultisigDeposit, "Delete",
+			"Spawn_" + ContractValueID}, owner.Identity())
+	require.Nil(t, err)
+	rules := genesisMsg.GenesisDarc.Rules
+	approvers := expression.InitOrExpr(a.Identity().String(), b.Identity().String(), c.Identity().String())
+	require.Nil(t, rules.AddRule(darc.Action("Invoke_"+CmdMultisigPropose), approvers))
+	require.Nil(t, rules.AddRule(darc.Action("Invoke_"+CmdMultisigApprove), approvers))
+	require.Nil(t, rules.AddRule(darc.Action("Invoke_"+CmdValueUpdate),
+		expression.InitAndExpr(a.Identity().String(), b.Identity().String())))
+	e, err := NewExecutor(genesisMsg)
+	require.Nil(t, err)
+	e.Timestamp = 1000
+
+	newOID := func() ObjectID {
+		return ObjectID{DarcID: genesisMsg.GenesisDarc.GetBaseID(), InstanceID: GenNonce()}
+	}
+	genesis, account, dest, wallet, value := newOID(), newOID(), newOID(), newOID(), newOID()
+	uint64Arg := func(name string, i uint64) Argument {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, i)
+		return Argument{Name: name, Value: buf}
+	}
+	varintArg := func(name string, i int64) Argument {
+		buf := make([]byte, binary.MaxVarintLen64)
+		return Argument{Name: name, Value: buf[:binary.PutVarint(buf, i)]}
+	}
+	// apply runs the instructions, each signed by the signers, in one
+	// transaction and returns its receipt.
+	apply := func(signers []*darc.Signer, instrs ...Instruction) Receipt {
+		for i := range instrs {
+			instrs[i].Nonce = GenNonce()
+			require.Nil(t, instrs[i].SignBy(signers...))
+		}
+		receipts, err := e.Apply(ClientTransaction{Instructions: instrs})
+		require.Nil(t, err)
+		return receipts[0]
+	}
+	invoke := func(oid ObjectID, cmd string, args ...Argument) Instruction {
+		return Instruction{ObjectID: oid, Invoke: &Invoke{Command: cmd, Args: args}}
+	}
+	approve := func(id uint64, signers ...*darc.Signer) Receipt {
+		return apply(signers, invoke(wallet, CmdMultisigApprove, uint64Arg("proposal", id)))
+	}
+	balance := func(oid ObjectID) uint64 {
+		buf, contractID, err := e.Get(oid.Slice())
+		require.Nil(t, err)
+		coins, err := heldCoins(buf, []byte(contractID))
+		require.Nil(t, err)
+		return CoinAccount{coins}.Balance(genesis)
+	}
+	topics := func(r Receipt) []string {
+		var ts []string
+		for _, ev := range r.Events {
+			ts = append(ts, ev.Topic)
+		}
+		return ts
+	}
+	ownerOnly := []*darc.Signer{owner}
+
+	require.Equal(t, "", apply(ownerOnly,
+		Instruction{ObjectID: genesis, Spawn: &Spawn{ContractID: ContractCoinID,
+			Args: Arguments{{Name: "genesis", Value: []byte{1}}}}},
+		Instruction{ObjectID: account, Spawn: &Spawn{ContractID: ContractCoinID}},
+		Instruction{ObjectID: dest, Spawn: &Spawn{ContractID: ContractCoinID}},
+		invoke(genesis, CmdCoinMint, uint64Arg("value", 100), Argument{Name: "destination", Value: account.Slice()}),
+		Instruction{ObjectID: value, Spawn: &Spawn{ContractID: ContractValueID,
+			Args: Arguments{{Name: "value", Value: []byte("old")}}}},
+	).Error)
+	require.NotEqual(t, "", apply(ownerOnly, Instruction{ObjectID: wallet, Spawn: &Spawn{
+		ContractID: ContractMultisigID, Args: Arguments{varintArg("threshold", 0)}}}).Error)
+	require.Equal(t, "", apply(ownerOnly, Instruction{ObjectID: wallet, Spawn: &Spawn{
+		ContractID: ContractMultisigID, Args: Arguments{varintArg("threshold", 2)}}}).Error)
+
+	// The fetched coins are put in the wallet.
+	require.Equal(t, "", apply(ownerOnly,
+		invoke(account, CmdCoinFetch, uint64Arg("value", 60), Argument{Name: "coin", Value: genesis.Slice()}),
+		invoke(wallet, CmdMultisigDeposit),
+	).Error)
+	require.Equal(t, uint64(60), balance(wallet))
+	require.Equal(t, uint64(40), balance(account))
+
+	// The proposer approves the transfer, it is executed with the second
+	// approval.
+	transfer := func(v uint64, deadline int64) Instruction {
+		return invoke(wallet, CmdMultisigPropose, varintArg("deadline", deadline), uint64Arg("value", v),
+			Argument{Name: "coin", Value: genesis.Slice()}, Argument{Name: "destination", Value: dest.Slice()})
+	}
+	r := apply([]*darc.Signer{a}, transfer(50, 2000))
+	require.Equal(t, "", r.Error)
+	require.Equal(t, []string{"proposed"}, topics(r))
+	require.Equal(t, uint64(60), balance(wallet))
+	require.Contains(t, approve(0, a).Error, "no new approval")
+	require.NotEqual(t, "", approve(0, owner).Error)
+	r = approve(0, b)
+	require.Equal(t, "", r.Error)
+	require.Equal(t, []string{"executed"}, topics(r))
+	require.Equal(t, uint64(10), balance(wallet))
+	require.Equal(t, uint64(50), balance(dest))
+	require.Contains(t, approve(0, c).Error, "doesn't exist")
+
+	// A transfer the wallet cannot pay keeps its approvals.
+	require.Equal(t, "", apply([]*darc.Signer{a}, transfer(20, 2000)).Error)
+	require.Contains(t, approve(1, b).Error, "not enough coins")
+	require.Equal(t, "", apply(ownerOnly,
+		invoke(account, CmdCoinFetch, uint64Arg("value", 10), Argument{Name: "coin", Value: genesis.Slice()}),
+		invoke(wallet, CmdMultisigDeposit),
+	).Error)
+	require.Equal(t, "", approve(1, c).Error)
+	require.Equal(t, uint64(0), balance(wallet))
+	require.Equal(t, uint64(70), balance(dest))
+
+	// Proposals cannot be approved after their deadline.
+	require.NotEqual(t, "", apply([]*darc.Signer{a}, transfer(1, e.Timestamp-1)).Error)
+	require.Equal(t, "", apply([]*darc.Signer{a}, transfer(1, e.Timestamp)).Error)
+	e.Timestamp++
+	require.Contains(t, approve(2, b).Error, "has expired")
+
+	// The instruction runs with the approvers as signers, which a single
+	// approver cannot do.
+	update := Instruction{ObjectID: value, Invoke: &Invoke{Command: CmdValueUpdate,
+		Args: Arguments{{Name: "value", Value: []byte("new")}}}}
+	require.NotEqual(t, "", apply([]*darc.Signer{a}, update).Error)
+	buf, err := protobuf.Encode(&update)
+	require.Nil(t, err)
+	r = apply([]*darc.Signer{b}, invoke(wallet, CmdMultisigPropose, varintArg("deadline", 2000),
+		Argument{Name: "instruction", Value: buf}))
+	require.Equal(t, "", r.Error)
+	require.Equal(t, []string{"expired", "proposed"}, topics(r))
+	require.Equal(t, "", approve(3, a).Error)
+	stored, _, err := e.Get(value.Slice())
+	require.Nil(t, err)
+	require.Equal(t, []byte("new"), stored)
+
+	// Only the pending proposal is kept in the wallet.
+	require.Equal(t, "", apply([]*darc.Signer{a}, transfer(1, 2000)).Error)
+	w, err := loadMultisigWallet(e.coll, wallet.Slice())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(w.Proposals))
+	require.Equal(t, uint64(5), w.NextProposal)
+
+	buf, err = protobuf.Encode(&Instruction{ObjectID: wallet, Delete: &Delete{}})
+	require.Nil(t, err)
+	require.Contains(t, apply([]*darc.Signer{a}, invoke(wallet, CmdMultisigPropose, varintArg("deadline", 2000),
+		Argument{Name: "instruction", Value: buf})).Error, "cannot change the wallet")
+	require.Equal(t, "", apply(ownerOnly, Instruction{ObjectID: wallet, Delete: &Delete{}}).Error)
+}
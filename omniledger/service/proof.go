@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 
+	"github.com/dedis/protobuf"
 	// "github.com/dedis/student_18_omniledger/omniledger/collection"
 	"student_18_byzcoin/omniledger/collection"
 	"gopkg.in/dedis/cothority.v2"
@@ -35,33 +36,69 @@ type Proof struct {
 // NewProof creates a proof for key in the skipchain with the given id. It uses
 // the collectionDB to look up the key and the skipblockdb to create the correct
 // proof for the forward links.
+// The key is looked up in the latest stored state of the collection, so the
+// proof ends at the latest block applied to the collection, even if newer
+// blocks are already stored. If the collection doesn't know which block it
+// corresponds to, the proof ends at the latest block.
 func NewProof(c *collectionDB, s *skipchain.SkipBlockDB, id skipchain.SkipBlockID,
+	key []byte) (p *Proof, err error) {
+	coll, _, index, err := c.view()
+	if err != nil {
+		return
+	}
+	return newProof(coll, index, s, id, key)
+}
+
+// newProof returns the proof of the key in coll, which must be the state
+// after the block with the given index.
+func newProof(coll collection.Collection, index int, s *skipchain.SkipBlockDB, id skipchain.SkipBlockID,
 	key []byte) (p *Proof, err error) {
 	p = &Proof{}
-	p.InclusionProof, err = c.coll.Get(key).Proof()
+	p.InclusionProof, err = coll.Get(key).Proof()
 	if err != nil {
 		return
 	}
+	links, sb, err := chainLinks(s, id, index)
+	if err != nil {
+		return nil, err
+	}
+	p.Links = links
+	p.Latest = *sb
+	// p.ProofBytes = p.proof.Consistent()
+	return
+}
+
+// chainLinks returns the forward links from the genesis block of the
+// skipchain to the block with the given index, and that block. If index is
+// negative, the links go to the latest block.
+func chainLinks(s *skipchain.SkipBlockDB, id skipchain.SkipBlockID, index int) ([]skipchain.ForwardLink, *skipchain.SkipBlock, error) {
 	sb := s.GetByID(id)
 	if sb == nil {
-		return nil, errors.New("didn't find skipchain")
+		return nil, nil, errors.New("didn't find skipchain")
 	}
-	p.Links = []skipchain.ForwardLink{{
+	links := []skipchain.ForwardLink{{
 		From:      []byte{},
 		To:        id,
 		NewRoster: sb.Roster,
 	}}
-	for len(sb.ForwardLink) > 0 {
-		link := sb.ForwardLink[len(sb.ForwardLink)-1]
-		p.Links = append(p.Links, *link)
-		sb = s.GetByID(link.To)
-		if sb == nil {
-			return nil, errors.New("missing block in chain")
+	for len(sb.ForwardLink) > 0 && (index < 0 || sb.Index < index) {
+		// Take the highest link that doesn't go beyond the block.
+		var link *skipchain.ForwardLink
+		var next *skipchain.SkipBlock
+		for i := len(sb.ForwardLink) - 1; i >= 0; i-- {
+			link = sb.ForwardLink[i]
+			next = s.GetByID(link.To)
+			if next == nil || index < 0 || next.Index <= index {
+				break
+			}
+		}
+		if next == nil {
+			return nil, nil, errors.New("missing block in chain")
 		}
+		links = append(links, *link)
+		sb = next
 	}
-	p.Latest = *sb
-	// p.ProofBytes = p.proof.Consistent()
-	return
+	return links, sb, nil
 }
 
 // ErrorVerifyCollection is returned if the collection-proof itself
@@ -91,9 +128,15 @@ func (p Proof) Verify(scID skipchain.SkipBlockID) error {
 	if !bytes.Equal(p.InclusionProof.TreeRootHash(), d.(*DataHeader).CollectionRoot) {
 		return ErrorVerifyCollectionRoot
 	}
+	return verifyLinks(scID, p.Links, p.Latest)
+}
+
+// verifyLinks checks that the links lead from the genesis block of the
+// skipchain to the block.
+func verifyLinks(scID skipchain.SkipBlockID, links []skipchain.ForwardLink, latest skipchain.SkipBlock) error {
 	var sbID skipchain.SkipBlockID
 	var publics []kyber.Point
-	for i, l := range p.Links {
+	for i, l := range links {
 		if i == 0 {
 			// The first forward link is a pointer from []byte{} to the genesis
 			// block and holds the roster of the genesis block.
@@ -101,7 +144,7 @@ func (p Proof) Verify(scID skipchain.SkipBlockID) error {
 			publics = l.NewRoster.Publics()
 			continue
 		}
-		if err = l.Verify(cothority.Suite, publics); err != nil {
+		if err := l.Verify(cothority.Suite, publics); err != nil {
 			return ErrorVerifySkipchain
 		}
 		if !l.From.Equal(sbID) {
@@ -112,6 +155,11 @@ func (p Proof) Verify(scID skipchain.SkipBlockID) error {
 			publics = l.NewRoster.Publics()
 		}
 	}
+	// The links must end at the latest skipblock, which must correspond to
+	// its hash.
+	if !sbID.Equal(latest.Hash) || !latest.CalculateHash().Equal(latest.Hash) {
+		return ErrorVerifySkipchain
+	}
 	return nil
 }
 
@@ -121,3 +169,34 @@ func (p Proof) KeyValue() (key []byte, values [][]byte, err error) {
 	values, err = p.InclusionProof.RawValues()
 	return
 }
+
+// CoinAccount returns the coin account stored in the proof. The proof must
+// be verified with Verify first.
+func (p Proof) CoinAccount() (*CoinAccount, error) {
+	_, values, err := p.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < 2 {
+		return nil, errors.New("proof holds no value")
+	}
+	return decodeCoinAccount(values[0], values[1])
+}
+
+// Config returns the configuration stored in the proof. The proof must be
+// verified with Verify first.
+func (p Proof) Config() (*Config, error) {
+	_, values, err := p.KeyValue()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < 2 || string(values[1]) != ContractConfigID {
+		return nil, errors.New("proof holds no config")
+	}
+	config := Config{}
+	err = protobuf.DecodeWithConstructors(values[0], &config, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
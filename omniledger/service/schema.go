@@ -0,0 +1,322 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/dedis/protobuf"
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/onet.v2/network"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+// A contract can declare, for every command, which arguments it takes, of
+// which type and whether they are required. Before an instruction is given to
+// a contract with a schema, the service checks that
+//   - the contract has a schema for the action of the instruction
+//   - every declared argument is given at most once, and can be decoded as
+//   its type
+//   - every required argument is given
+// Other arguments are left to the contract, and contracts without schema get
+// all instructions unchecked. ListContracts
+// returns the schemas, so that clients can build instructions generically.
+
+// ArgumentType is the type of the value of an argument.
+type ArgumentType string
+
+// The types of arguments.
+const (
+	// ArgBytes is any value.
+	ArgBytes ArgumentType = "bytes"
+	// ArgString is an UTF-8 string.
+	ArgString ArgumentType = "string"
+	// ArgUint64 is an uint64 in 8 bytes, little endian.
+	ArgUint64 ArgumentType = "uint64"
+	// ArgVarint is an int64 written with binary.PutVarint, without
+	// trailing bytes.
+	ArgVarint ArgumentType = "varint"
+	// ArgObjectID is an ObjectID as returned by ObjectID.Slice.
+	ArgObjectID ArgumentType = "objectid"
+	// ArgDarc is a darc as returned by Darc.ToProto.
+	ArgDarc ArgumentType = "darc"
+	// ArgIdentity is a protobuf-encoded darc.Identity.
+	ArgIdentity ArgumentType = "identity"
+)
+
+// ArgumentSchema declares an argument of a command.
+type ArgumentSchema struct {
+	// Name is the name of the argument.
+	Name string
+	// Type tells how the value is encoded.
+	Type ArgumentType
+	// Required is set if instructions without the argument are refused.
+	Required bool
+}
+
+// CommandSchema declares the arguments of a command. The command is named
+// after the action of its instructions, like "Spawn_value", "Invoke_update"
+// or "Delete".
+type CommandSchema struct {
+	// Action is the action of the instructions of the command.
+	Action string
+	// Args are the arguments the command takes.
+	Args []ArgumentSchema
+}
+
+// ContractSchema holds the commands of a version of a contract. A contract
+// without schema has no commands.
+type ContractSchema struct {
+	// ContractID is the ID the contract is registered with.
+	ContractID string
+	// Version is the version of the contract.
+	Version int
+	// Commands are the commands the version accepts.
+	Commands []CommandSchema
+}
+
+func (t ArgumentType) known() bool {
+	switch t {
+	case ArgBytes, ArgString, ArgUint64, ArgVarint, ArgObjectID, ArgDarc, ArgIdentity:
+		return true
+	}
+	return false
+}
+
+// verify checks that the value can be decoded as the type.
+func (t ArgumentType) verify(value []byte) error {
+	switch t {
+	case ArgBytes:
+		return nil
+	case ArgString:
+		if !utf8.Valid(value) {
+			return errors.New("not an UTF-8 string")
+		}
+	case ArgUint64:
+		if len(value) != 8 {
+			return errors.New("uint64 must be 8 bytes")
+		}
+	case ArgVarint:
+		if _, n := binary.Varint(value); n <= 0 || n != len(value) {
+			return errors.New("invalid varint")
+		}
+	case ArgObjectID:
+		_, err := NewObjectIDFromSlice(value)
+		return err
+	case ArgDarc:
+		d, err := darc.NewDarcFromProto(value)
+		if err != nil {
+			return err
+		}
+		return d.Verify()
+	case ArgIdentity:
+		var id darc.Identity
+		return protobuf.DecodeWithConstructors(value, &id, network.DefaultConstructors(cothority.Suite))
+	default:
+		return fmt.Errorf("unknown type %q", t)
+	}
+	return nil
+}
+
+// verify checks the arguments against the schema of the command.
+func (cs CommandSchema) verify(args Arguments) error {
+	given := make(map[string]bool)
+	for _, arg := range args {
+		as, ok := cs.arg(arg.Name)
+		if !ok {
+			continue
+		}
+		if given[arg.Name] {
+			return fmt.Errorf("argument %q is given twice", arg.Name)
+		}
+		given[arg.Name] = true
+		if err := as.Type.verify(arg.Value); err != nil {
+			return fmt.Errorf("argument %q: %s", arg.Name, err)
+		}
+	}
+	for _, as := range cs.Args {
+		if as.Required && !given[as.Name] {
+			return fmt.Errorf("missing argument %q", as.Name)
+		}
+	}
+	return nil
+}
+
+func (cs CommandSchema) arg(name string) (ArgumentSchema, bool) {
+	for _, as := range cs.Args {
+		if as.Name == name {
+			return as, true
+		}
+	}
+	return ArgumentSchema{}, false
+}
+
+// verifyInstruction checks the arguments of the instruction against the
+// schema of its command.
+func (cs ContractSchema) verifyInstruction(instr Instruction) error {
+	action := instr.Action()
+	for _, cmd := range cs.Commands {
+		if cmd.Action == action {
+			var args Arguments
+			switch {
+			case instr.Spawn != nil:
+				args = instr.Spawn.Args
+			case instr.Invoke != nil:
+				args = instr.Invoke.Args
+			}
+			if err := cmd.verify(args); err != nil {
+				return fmt.Errorf("invalid instruction for %s: %s", cs.ContractID, err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("contract %s has no command %s", cs.ContractID, action)
+}
+
+// registerSchema stores the schema of a version of a contract. The schema
+// of the version can be registered before the contract itself.
+func (s *Service) registerSchema(contractID string, version int, commands ...CommandSchema) error {
+	seen := make(map[string]bool)
+	for _, cmd := range commands {
+		if seen[cmd.Action] {
+			return fmt.Errorf("command %s is declared twice", cmd.Action)
+		}
+		seen[cmd.Action] = true
+		for _, as := range cmd.Args {
+			if !as.Type.known() {
+				return fmt.Errorf("argument %q of %s has unknown type %q", as.Name, cmd.Action, as.Type)
+			}
+		}
+	}
+	if s.schemas[contractID] == nil {
+		s.schemas[contractID] = make(map[int]ContractSchema)
+	}
+	s.schemas[contractID][version] = ContractSchema{
+		ContractID: contractID,
+		Version:    version,
+		Commands:   commands,
+	}
+	return nil
+}
+
+// verifySchema checks the instruction against the schema of the version of
+// the contract, if it has one.
+func (s *Service) verifySchema(contractID string, version int, instr Instruction) error {
+	schema, ok := s.schemas[contractID][version]
+	if !ok {
+		return nil
+	}
+	return schema.verifyInstruction(instr)
+}
+
+// ListContracts returns every version of the contracts registered on this
+// node, with their schemas, sorted by ID and version.
+func (s *Service) ListContracts(req *ListContracts) (*ListContractsResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	resp := &ListContractsResponse{Version: CurrentVersion}
+	for id, versions := range s.contracts {
+		for version := range versions {
+			schema, ok := s.schemas[id][version]
+			if !ok {
+				schema = ContractSchema{ContractID: id, Version: version}
+			}
+			resp.Contracts = append(resp.Contracts, schema)
+		}
+	}
+	sort.Slice(resp.Contracts, func(i, j int) bool {
+		a, b := resp.Contracts[i], resp.Contracts[j]
+		return a.ContractID < b.ContractID ||
+			a.ContractID == b.ContractID && a.Version < b.Version
+	})
+	return resp, nil
+}
+
+// builtinSchemas are the schemas of the built-in contracts.
+var builtinSchemas = []ContractSchema{
+	{ContractID: ContractConfigID, Commands: []CommandSchema{
+		{Action: "Spawn_" + ContractConfigID, Args: []ArgumentSchema{
+			{Name: "darc", Type: ArgDarc, Required: true},
+			{Name: "block_interval", Type: ArgVarint, Required: true},
+			{Name: "reward_account", Type: ArgObjectID},
+			{Name: "epochs", Type: ArgBytes},
+			{Name: "roster", Type: ArgBytes},
+			{Name: "limits", Type: ArgBytes},
+			{Name: "contracts", Type: ArgBytes},
+			{Name: "identity", Type: ArgBytes},
+			{Name: "shard", Type: ArgVarint},
+		}},
+		{Action: "Invoke_" + CmdConfigEpoch, Args: []ArgumentSchema{
+			{Name: "seed", Type: ArgBytes, Required: true},
+		}},
+		{Action: "Invoke_" + CmdConfigShards, Args: []ArgumentSchema{
+			{Name: "shards", Type: ArgBytes, Required: true},
+		}},
+		{Action: "Invoke_" + CmdConfigContracts, Args: []ArgumentSchema{
+			{Name: "contracts", Type: ArgBytes, Required: true},
+		}},
+		{Action: "Invoke_" + CmdConfigUpgrade, Args: []ArgumentSchema{
+			{Name: "contract", Type: ArgString, Required: true},
+			{Name: "version", Type: ArgVarint, Required: true},
+			{Name: "index", Type: ArgVarint, Required: true},
+		}},
+	}},
+	{ContractID: ContractValueID, Commands: []CommandSchema{
+		{Action: "Spawn_" + ContractValueID, Args: []ArgumentSchema{
+			{Name: "value", Type: ArgBytes},
+		}},
+		{Action: "Invoke_" + CmdValueUpdate, Args: []ArgumentSchema{
+			{Name: "value", Type: ArgBytes},
+		}},
+		{Action: "Delete"},
+	}},
+	{ContractID: ContractCoinID, Commands: []CommandSchema{
+		{Action: "Spawn_" + ContractCoinID, Args: []ArgumentSchema{
+			{Name: "genesis", Type: ArgBytes},
+		}},
+		{Action: "Invoke_" + CmdCoinMint, Args: []ArgumentSchema{
+			{Name: "value", Type: ArgUint64, Required: true},
+			{Name: "destination", Type: ArgObjectID, Required: true},
+		}},
+		{Action: "Invoke_" + CmdCoinTransfer, Args: []ArgumentSchema{
+			{Name: "value", Type: ArgUint64, Required: true},
+			{Name: "coin", Type: ArgObjectID, Required: true},
+			{Name: "destination", Type: ArgObjectID, Required: true},
+		}},
+		{Action: "Invoke_" + CmdCoinFetch, Args: []ArgumentSchema{
+			{Name: "value", Type: ArgUint64, Required: true},
+			{Name: "coin", Type: ArgObjectID, Required: true},
+		}},
+		{Action: "Delete"},
+	}},
+	{ContractID: ContractStakeID, Commands: []CommandSchema{
+		{Action: "Spawn_" + ContractStakeID, Args: []ArgumentSchema{
+			{Name: "conode", Type: ArgBytes, Required: true},
+			{Name: "value", Type: ArgUint64, Required: true},
+		}},
+		{Action: "Invoke_" + CmdStakeUnlock},
+		{Action: "Invoke_" + CmdStakeWithdraw, Args: []ArgumentSchema{
+			{Name: "destination", Type: ArgObjectID, Required: true},
+		}},
+	}},
+	{ContractID: ContractMultisigID, Commands: []CommandSchema{
+		{Action: "Spawn_" + ContractMultisigID, Args: []ArgumentSchema{
+			{Name: "threshold", Type: ArgVarint, Required: true},
+		}},
+		{Action: "Invoke_" + CmdMultisigDeposit},
+		{Action: "Invoke_" + CmdMultisigPropose, Args: []ArgumentSchema{
+			{Name: "deadline", Type: ArgVarint, Required: true},
+			{Name: "value", Type: ArgUint64},
+			{Name: "coin", Type: ArgObjectID},
+			{Name: "destination", Type: ArgObjectID},
+			{Name: "instruction", Type: ArgBytes},
+		}},
+		{Action: "Invoke_" + CmdMultisigApprove, Args: []ArgumentSchema{
+			{Name: "proposal", Type: ArgUint64, Required: true},
+		}},
+		{Action: "Delete"},
+	}},
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v2"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+func TestArguments(t *testing.T) {
+	u := make([]byte, 8)
+	binary.LittleEndian.PutUint64(u, 42)
+	v := make([]byte, binary.MaxVarintLen64)
+	v = v[:binary.PutVarint(v, -42)]
+	args := Arguments{
+		{Name: "empty", Value: []byte{}},
+		{Name: "uint64", Value: u},
+		{Name: "varint", Value: v},
+		{Name: "padded", Value: append(v, 0)},
+	}
+
+	value, ok := args.Lookup("empty")
+	require.True(t, ok)
+	require.Equal(t, 0, len(value))
+	_, ok = args.Lookup("missing")
+	require.False(t, ok)
+
+	i, err := args.Uint64("uint64")
+	require.Nil(t, err)
+	require.Equal(t, uint64(42), i)
+	j, err := args.Varint("varint")
+	require.Nil(t, err)
+	require.Equal(t, int64(-42), j)
+	_, err = args.Uint64("empty")
+	require.NotNil(t, err)
+	_, err = args.Varint("missing")
+	require.NotNil(t, err)
+	_, err = args.Varint("padded")
+	require.NotNil(t, err)
+}
+
+// typedKind is a contract with a schema, it stores the "name" argument.
+var typedKind = "typed"
+
+func TestService_Schema(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, &onet.Roster{},
+		[]string{"Spawn_" + typedKind, "Invoke_rename"}, signer.Identity())
+	require.Nil(t, err)
+	e, err := NewExecutor(genesisMsg)
+	require.Nil(t, err)
+	require.Nil(t, e.RegisterContract(typedKind, func(cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		return []StateChange{NewStateChange(Create, tx.ObjectID, typedKind, tx.Spawn.Args.Search("name"))}, c, nil
+	}))
+	require.Nil(t, e.RegisterSchema(typedKind, DefaultContractVersion, CommandSchema{
+		Action: "Spawn_" + typedKind,
+		Args: []ArgumentSchema{
+			{Name: "amount", Type: ArgUint64, Required: true},
+			{Name: "name", Type: ArgString},
+			{Name: "owner", Type: ArgIdentity},
+		},
+	}))
+	require.NotNil(t, e.RegisterSchema(typedKind, 2, CommandSchema{
+		Action: "Spawn_" + typedKind,
+		Args:   []ArgumentSchema{{Name: "amount", Type: "float"}},
+	}))
+
+	amount := make([]byte, 8)
+	owner, err := protobuf.Encode(signer.Identity())
+	require.Nil(t, err)
+	run := func(instr Instruction) string {
+		instr.ObjectID = ObjectID{DarcID: genesisMsg.GenesisDarc.GetBaseID(), InstanceID: GenNonce()}
+		require.Nil(t, instr.SignBy(signer))
+		receipts, err := e.Apply(ClientTransaction{Instructions: []Instruction{instr}})
+		require.Nil(t, err)
+		return receipts[0].Error
+	}
+	spawn := func(args ...Argument) string {
+		return run(Instruction{Spawn: &Spawn{ContractID: typedKind, Args: args}})
+	}
+
+	require.Equal(t, "", spawn(Argument{Name: "amount", Value: amount}))
+	require.Equal(t, "", spawn(Argument{Name: "amount", Value: amount},
+		Argument{Name: "name", Value: []byte("name")},
+		Argument{Name: "owner", Value: owner},
+		Argument{Name: "other", Value: []byte{1}}))
+	require.Contains(t, spawn(), `missing argument "amount"`)
+	require.Contains(t, spawn(Argument{Name: "amount", Value: []byte{1}}), "8 bytes")
+	require.Contains(t, spawn(Argument{Name: "amount", Value: amount},
+		Argument{Name: "name", Value: []byte{0xff}}), "UTF-8")
+	require.Contains(t, spawn(Argument{Name: "amount", Value: amount},
+		Argument{Name: "owner", Value: []byte{0xff}}), `argument "owner"`)
+	require.Contains(t, spawn(Argument{Name: "amount", Value: amount},
+		Argument{Name: "amount", Value: amount}), "twice")
+	err = e.s.verifySchema(typedKind, DefaultContractVersion, Instruction{Invoke: &Invoke{Command: "rename"}})
+	require.Contains(t, err.Error(), "has no command Invoke_rename")
+	// Versions without schema are not checked.
+	require.Nil(t, e.s.verifySchema(typedKind, 2, Instruction{Spawn: &Spawn{ContractID: typedKind}}))
+}
+
+func TestService_ListContracts(t *testing.T) {
+	s := &Service{
+		contracts: make(map[string]map[int]ContractWithContext),
+		schemas:   make(map[string]map[int]ContractSchema),
+		views:     make(map[string]map[string]ContractView),
+	}
+	s.registerBuiltins()
+	require.Nil(t, s.registerContractVersion(ContractValueID, 2, nil))
+
+	resp, err := s.ListContracts(&ListContracts{Version: CurrentVersion})
+	require.Nil(t, err)
+	var ids []string
+	for _, c := range resp.Contracts {
+		ids = append(ids, c.ContractID)
+	}
+	require.Equal(t, []string{ContractCoinID, ContractConfigID, ContractDarcID,
+		ContractMultisigID, ContractStakeID, ContractValueID, ContractValueID}, ids)
+	value := resp.Contracts[5]
+	require.Equal(t, DefaultContractVersion, value.Version)
+	require.Equal(t, "Spawn_"+ContractValueID, value.Commands[0].Action)
+	require.Equal(t, ArgBytes, value.Commands[0].Args[0].Type)
+	// Version 2 of value and the darc contract have no schema.
+	require.Equal(t, 2, resp.Contracts[6].Version)
+	require.Equal(t, 0, len(resp.Contracts[6].Commands))
+	require.Equal(t, 0, len(resp.Contracts[2].Commands))
+
+	_, err = s.ListContracts(&ListContracts{})
+	require.NotNil(t, err)
+}
@@ -2,10 +2,13 @@
 package service
 
 import (
-	// "bytes"
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,7 +39,8 @@ func init() {
 	var err error
 	omniledgerID, err = onet.RegisterNewService(ServiceName, newService)
 	log.ErrFatal(err)
-	network.RegisterMessages(&storage{}, &DataHeader{}, &updateCollection{})
+	network.RegisterMessages(&storage{}, &DataHeader{}, &updateCollection{},
+		&proposeBlock{})
 }
 
 // GenNonce returns a random nonce.
@@ -50,27 +54,50 @@ type Service struct {
 	// We need to embed the ServiceProcessor, so that incoming messages
 	// are correctly handled.
 	*onet.ServiceProcessor
-	// collections cannot be stored, so they will be re-created whenever the
-	// service reloads.
-	collectionDB map[string]*collectionDB
-
-	// wokersMu protects access to queueWorkers
-	workersMu sync.Mutex
-	// queueWorkers is a map that points to channels that handle queueing and
-	// starting of new blocks.
-	queueWorkers map[string]chan ClientTransaction
+	// chainsMu protects chains
+	chainsMu sync.Mutex
+	// chains holds the collection, the queue and the configuration of
+	// every skipchain, indexed by the skipchain ID. The collections are
+	// loaded from disk whenever the service reloads and rebuilt from the
+	// blocks if they don't correspond to the skipchain.
+	chains map[string]*chainState
 
 	// CloseQueues is closed when the queues should stop - this is mostly for
 	// testing and there should be a better way to clean up services for testing...
 	CloseQueues chan bool
-	// contracts map kinds to kind specific verification functions
-	contracts map[string]OmniLedgerContract
+	// contracts map kinds to kind specific verification functions, for
+	// every registered version
+	contracts map[string]map[int]ContractWithContext
+	// schemas holds the argument schemas of the versions of contracts
+	schemas map[string]map[int]ContractSchema
+	// views holds the view methods of the contracts, by contract and
+	// method.
+	views map[string]map[string]ContractView
 	// propagate the new transactions
 	propagateTransactions messaging.PropagationFunc
+	// propagate the body of a block before it is signed
+	propagateProposal messaging.PropagationFunc
 
 	storage *storage
 
 	createSkipChainMut sync.Mutex
+
+	// syncMu protects syncReplies and syncing
+	syncMu sync.Mutex
+	// syncReplies holds a channel for every request sent to synchronise
+	// a skipchain, indexed by the nonce of the request.
+	syncReplies map[Nonce]chan network.Message
+	// syncing holds the skipchains which are being synchronised.
+	syncing map[string]bool
+	// snapshots holds the states that are pinned while other nodes
+	// download them, indexed by the block ID.
+	snapshots map[string]*snapshotPin
+
+	// subscribeMu protects subscribers
+	subscribeMu sync.Mutex
+	// subscribers holds the streams of the clients following a
+	// skipchain, indexed by the skipchain ID.
+	subscribers map[string][]*subscriber
 }
 
 // storageID reflects the data we're storing - we could store more
@@ -89,8 +116,20 @@ type storage struct {
 	PropTimeout time.Duration
 }
 
+// updateCollection is sent by the leader to all nodes once a new block has
+// been stored. As the skipblocks cannot hold the body, it is sent alongside.
 type updateCollection struct {
-	ID skipchain.SkipBlockID
+	ID   skipchain.SkipBlockID
+	Body DataBody
+}
+
+// proposeBlock is sent by the leader to all nodes before a new block is
+// signed, so that they can execute its body and check it against the header.
+type proposeBlock struct {
+	SkipChainID skipchain.SkipBlockID
+	// DataHash is the hash of the Data of the proposed skipblock.
+	DataHash []byte
+	Body     DataBody
 }
 
 // CreateGenesisBlock asks the service to create a new skipchain ready to
@@ -110,20 +149,42 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 		return nil, fmt.Errorf("version mismatch - got %d but need %d", req.Version, CurrentVersion)
 	}
 
-	darcBuf, err := req.GenesisDarc.ToProto()
+	transaction, err := genesisTransaction(req)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := s.createNewBlock(nil, &req.Roster, ClientTransactions{transaction})
 	if err != nil {
 		return nil, err
 	}
+	s.save()
+
+	s.getChain(sb.SkipChainID()).setQueue(s.createQueueWorker(sb.SkipChainID(), req.BlockInterval))
+
+	return &CreateGenesisBlockResponse{
+		Version:   CurrentVersion,
+		Skipblock: sb,
+	}, nil
+}
+
+// genesisTransaction returns the transaction of the genesis block, which
+// spawns the config of the skipchain. If the request has no block interval,
+// it is set to the default.
+func genesisTransaction(req *CreateGenesisBlock) (ClientTransaction, error) {
+	darcBuf, err := req.GenesisDarc.ToProto()
+	if err != nil {
+		return ClientTransaction{}, err
+	}
 	if req.GenesisDarc.Verify() != nil ||
 		len(req.GenesisDarc.Rules) == 0 {
-		return nil, errors.New("invalid genesis darc")
+		return ClientTransaction{}, errors.New("invalid genesis darc")
 	}
 
 	if req.BlockInterval == 0 {
 		req.BlockInterval = defaultInterval
 	}
-	intervalBuf := make([]byte, 8)
-	binary.PutVarint(intervalBuf, int64(req.BlockInterval))
+	intervalBuf := make([]byte, binary.MaxVarintLen64)
+	intervalBuf = intervalBuf[:binary.PutVarint(intervalBuf, int64(req.BlockInterval))]
 
 	spawn := &Spawn{
 		ContractID: ContractConfigID,
@@ -132,10 +193,45 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 			{Name: "block_interval", Value: intervalBuf},
 		},
 	}
+	if req.RewardAccount != nil {
+		spawn.Args = append(spawn.Args, Argument{Name: "reward_account", Value: req.RewardAccount.Slice()})
+	}
+	if req.Epochs.Length > 0 {
+		epochsBuf, err := protobuf.Encode(&req.Epochs)
+		if err != nil {
+			return ClientTransaction{}, err
+		}
+		rosterBuf, err := protobuf.Encode(&req.Roster)
+		if err != nil {
+			return ClientTransaction{}, err
+		}
+		spawn.Args = append(spawn.Args, Argument{Name: "epochs", Value: epochsBuf},
+			Argument{Name: "roster", Value: rosterBuf})
+	}
+	if req.Limits != nil {
+		limitsBuf, err := protobuf.Encode(req.Limits)
+		if err != nil {
+			return ClientTransaction{}, err
+		}
+		spawn.Args = append(spawn.Args, Argument{Name: "limits", Value: limitsBuf})
+	}
+	if req.Contracts != nil {
+		contractsBuf, err := protobuf.Encode(req.Contracts)
+		if err != nil {
+			return ClientTransaction{}, err
+		}
+		spawn.Args = append(spawn.Args, Argument{Name: "contracts", Value: contractsBuf})
+	}
+	if !req.Identity.IsNull() {
+		shardBuf := make([]byte, binary.MaxVarintLen64)
+		shardBuf = shardBuf[:binary.PutVarint(shardBuf, int64(req.Shard))]
+		spawn.Args = append(spawn.Args, Argument{Name: "identity", Value: req.Identity},
+			Argument{Name: "shard", Value: shardBuf})
+	}
 
 	// Create the genesis-transaction with a special key, it acts as a
 	// reference to the actual genesis transaction.
-	transaction := []ClientTransaction{{
+	return ClientTransaction{
 		Instructions: []Instruction{{
 			ObjectID: ObjectID{DarcID: req.GenesisDarc.GetID()},
 			Nonce:    ZeroNonce,
@@ -143,21 +239,6 @@ func (s *Service) CreateGenesisBlock(req *CreateGenesisBlock) (
 			Length:   1,
 			Spawn:    spawn,
 		}},
-	}}
-
-	sb, err := s.createNewBlock(nil, &req.Roster, transaction)
-	if err != nil {
-		return nil, err
-	}
-	s.save()
-
-	s.workersMu.Lock()
-	s.queueWorkers[string(sb.SkipChainID())] = s.createQueueWorker(sb.SkipChainID(), req.BlockInterval)
-	s.workersMu.Unlock()
-
-	return &CreateGenesisBlockResponse{
-		Version:   CurrentVersion,
-		Skipblock: sb,
 	}, nil
 }
 
@@ -167,14 +248,22 @@ func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 		return nil, errors.New("version mismatch")
 	}
 
-	s.workersMu.Lock()
-	c, ok := s.queueWorkers[string(req.SkipchainID)]
-	s.workersMu.Unlock()
-	if !ok {
+	// Only skipchains that are already loaded have a queue, so there is no
+	// need to load the collection of unknown skipchains.
+	s.chainsMu.Lock()
+	cs := s.chains[string(req.SkipchainID)]
+	s.chainsMu.Unlock()
+	var c chan ClientTransaction
+	if cs != nil {
+		c = cs.getQueue()
+	}
+	if c == nil {
 		return nil, fmt.Errorf("we don't know skipchain ID %x", req.SkipchainID)
 	}
 
-	if len(req.Transaction.Instructions) == 0 {
+	// Only unlocking a cross-shard transaction needs no instructions.
+	if len(req.Transaction.Instructions) == 0 &&
+		(req.Transaction.Atomix == nil || req.Transaction.Atomix.Phase != AtomixUnlock) {
 		return nil, errors.New("no transactions to add")
 	}
 
@@ -185,6 +274,46 @@ func (s *Service) AddTransaction(req *AddTxRequest) (*AddTxResponse, error) {
 	}, nil
 }
 
+// SimulateTransaction verifies and executes the transaction as the leader
+// would, but on a view of the collection that is thrown away afterwards.
+// Nothing is queued or stored. If the transaction would be refused, the reason
+// is in the receipt of the response.
+func (s *Service) SimulateTransaction(req *SimulateTransaction) (*SimulateTransactionResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if s.db().GetByID(req.SkipchainID) == nil {
+		return nil, errors.New("unknown skipchain")
+	}
+	resp := &SimulateTransactionResponse{
+		Version: CurrentVersion,
+		Receipt: Receipt{TxHash: req.Transaction.Hash()},
+	}
+	if err := s.verifyClientTx(req.SkipchainID, req.Transaction); err != nil {
+		resp.Receipt.Error = err.Error()
+		return resp, nil
+	}
+
+	coll, _, index, err := s.getCollection(req.SkipchainID).view()
+	if err != nil {
+		return nil, err
+	}
+	ctx := Context{
+		SkipchainID: req.SkipchainID,
+		Index:       index + 1,
+		Timestamp:   time.Now().Unix(),
+	}
+	_, _, scs, receipts, err := s.createStateChanges(coll, ctx, ClientTransactions{req.Transaction})
+	if err != nil {
+		return nil, err
+	}
+	resp.Receipt = receipts[0]
+	if resp.Receipt.Error == "" {
+		resp.StateChanges = scs
+	}
+	return resp, nil
+}
+
 // GetProof searches for a key and returns a proof of the
 // presence or the absence of this key.
 func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
@@ -192,11 +321,12 @@ func (s *Service) GetProof(req *GetProof) (resp *GetProofResponse, err error) {
 		return nil, errors.New("version mismatch")
 	}
 	log.Lvlf2("%s: Getting proof for key %x on sc %x", s.ServerIdentity(), req.Key, req.ID)
-	latest, err := s.db().GetLatest(s.db().GetByID(req.ID))
-	if err != nil {
-		return
+	if s.db().GetByID(req.ID) == nil {
+		return nil, errors.New("unknown skipchain")
 	}
-	proof, err := NewProof(s.getCollection(req.ID), s.db(), latest.Hash, req.Key)
+	// The proof is created from a view of the collection, so it isn't
+	// affected by blocks that are being created or applied.
+	proof, err := NewProof(s.getCollection(req.ID), s.db(), req.ID, req.Key)
 	if err != nil {
 		return
 	}
@@ -222,29 +352,50 @@ func toObjectID(dID darc.ID) ObjectID {
 	}
 }
 
-func (s *Service) verifyAndFilterTxs(scID skipchain.SkipBlockID, ts []ClientTransaction) []ClientTransaction {
+// verifyAndFilterTxs returns the transactions whose signatures are valid, and
+// the receipts of the others.
+func (s *Service) verifyAndFilterTxs(scID skipchain.SkipBlockID, ts []ClientTransaction) ([]ClientTransaction, []Receipt) {
 	var validTxs []ClientTransaction
+	var refused []Receipt
 	for _, t := range ts {
 		if err := s.verifyClientTx(scID, t); err != nil {
 			log.Error(err)
+			refused = append(refused, Receipt{TxHash: t.Hash(), Error: err.Error()})
 			continue
 		}
 		validTxs = append(validTxs, t)
 	}
-	return validTxs
+	return validTxs, refused
 }
 
 func (s *Service) verifyClientTx(scID skipchain.SkipBlockID, tx ClientTransaction) error {
+	return verifyClientTx(tx, s.latestDarcs(scID))
+}
+
+func (s *Service) verifyInstruction(scID skipchain.SkipBlockID, instr Instruction) error {
+	return verifyInstruction(instr, s.latestDarcs(scID))
+}
+
+// latestDarcs returns a function loading the latest darcs of the skipchain.
+func (s *Service) latestDarcs(scID skipchain.SkipBlockID) func(darc.ID) (*darc.Darc, error) {
+	return func(id darc.ID) (*darc.Darc, error) {
+		return s.loadLatestDarc(scID, id)
+	}
+}
+
+// verifyClientTx checks the signatures of all instructions of tx against the
+// darcs returned by getDarc.
+func verifyClientTx(tx ClientTransaction, getDarc func(darc.ID) (*darc.Darc, error)) error {
 	for _, instr := range tx.Instructions {
-		if err := s.verifyInstruction(scID, instr); err != nil {
+		if err := verifyInstruction(instr, getDarc); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (s *Service) verifyInstruction(scID skipchain.SkipBlockID, instr Instruction) error {
-	d, err := s.loadLatestDarc(scID, instr.ObjectID.DarcID)
+func verifyInstruction(instr Instruction, getDarc func(darc.ID) (*darc.Darc, error)) error {
+	d, err := getDarc(instr.ObjectID.DarcID)
 	if err != nil {
 		return err
 	}
@@ -253,17 +404,44 @@ func (s *Service) verifyInstruction(scID skipchain.SkipBlockID, instr Instructio
 		return err
 	}
 	// TODO we need to use req.VerifyWithCB to search for missing darcs
-	return req.Verify(d)
+	if err = req.Verify(d); err != nil {
+		return err
+	}
+	// Every account that coins are taken from must allow it.
+	for i, in := range instr.Coins {
+		d, err := getDarc(in.Account.DarcID)
+		if err != nil {
+			return err
+		}
+		req, err := instr.CoinInputRequest(i)
+		if err != nil {
+			return err
+		}
+		if err = req.Verify(d); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // createNewBlock creates a new block and proposes it to the
 // skipchain-service. Once the block has been created, we
 // inform all nodes to update their internal collections
-// to include the new transactions.
-func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts ClientTransactions) (*skipchain.SkipBlock, error) {
+// to include the new transactions. The internal transactions are created by
+// the leader itself and are not verified against the darcs.
+func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts ClientTransactions,
+	internal ...ClientTransaction) (*skipchain.SkipBlock, error) {
 	var sb *skipchain.SkipBlock
 	var mr []byte
 	var coll collection.Collection
+	// cs is only set if the block is added to an existing skipchain.
+	var cs *chainState
+	// signers is the roster of the previous block, which signs the new one.
+	var signers *onet.Roster
+	// The timestamp is fixed before the transactions are executed, so the
+	// contracts see the one stored in the header.
+	ctx := Context{SkipchainID: scID, Timestamp: time.Now().Unix(), leader: true}
+	var refused []Receipt
 
 	if scID.IsNull() {
 		// For a genesis block, we create a throwaway collection.
@@ -287,14 +465,32 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts
 				"Could not get latest block from the skipchain: " + err.Error())
 		}
 		sb = sbLatest.Copy()
+		signers = sbLatest.Roster
+		ctx.Index = sbLatest.Index + 1
+		ctx.epochSeed = s.epochSeed(sbLatest)
 		if r != nil {
 			sb.Roster = r
 		}
-		cts = s.verifyAndFilterTxs(sb.SkipChainID(), cts)
-		if len(cts) == 0 {
+		cts, refused = s.verifyAndFilterTxs(sb.SkipChainID(), cts)
+		if len(cts) == 0 && len(internal) == 0 {
 			return nil, errors.New("no valid transaction")
 		}
-		coll = s.getCollection(scID).coll
+		// The leader starts the epochs, so the transaction is not
+		// signed.
+		if epoch := s.epochTransaction(sbLatest); epoch != nil {
+			internal = append(internal, *epoch)
+		}
+		cts = append(cts, internal...)
+		cs = s.getChain(scID)
+		// A shard uses the shards as of the latest block of the
+		// identity chain this node applied.
+		if config, err := cs.getConfig(); err == nil && !config.Identity.IsNull() {
+			id, index := s.getCollection(config.Identity).latestBlock()
+			if index < 0 {
+				return nil, errors.New("identity chain has not been applied yet")
+			}
+			ctx.identityBlock = id
+		}
 	}
 
 	// Note that the transactions are sorted in-place.
@@ -306,27 +502,55 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts
 	var scs StateChanges
 	var err error
 	var ctsOK ClientTransactions
-	mr, ctsOK, scs, err = s.createStateChanges(coll, cts)
+	var receipts []Receipt
+	// The StateChanges are tried on the collection, so nobody else may
+	// change it in the meantime. The lock is released before the block is
+	// propagated, as this node will apply the block, too.
+	if cs != nil {
+		cs.writeMu.Lock()
+		coll = cs.cdb.coll
+	}
+	mr, ctsOK, scs, receipts, err = s.createStateChanges(coll, ctx, cts)
+	if cs != nil {
+		cs.writeMu.Unlock()
+	}
 	if err != nil {
 		return nil, err
 	}
+	// The skipblock has no place for the body, so the body is sent to all
+	// nodes together with the request to update their collection.
+	body := DataBody{Transactions: ctsOK, Receipts: append(refused, receipts...)}
 	header := &DataHeader{
 		CollectionRoot:        mr,
 		ClientTransactionHash: ctsOK.Hash(),
 		StateChangesHash:      scs.Hash(),
-		Timestamp:             time.Now().Unix(),
+		Timestamp:             ctx.Timestamp,
+		ReceiptsRoot:          receiptsRoot(body.Receipts),
+		Contracts:             usedContracts(receipts),
+		IdentityBlock:         ctx.identityBlock,
 	}
 	sb.Data, err = network.Marshal(header)
 	if err != nil {
 		return nil, errors.New("Couldn't marshal data: " + err.Error())
 	}
 
-	// Store transactions in the body
-	// body := &DataBody{Transactions: ctsOK}
-	// sb.Payload, err = network.Marshal(body)
-	// if err != nil {
-	// 	return nil, errors.New("Couldn't marshal data: " + err.Error())
-	// }
+	s.storage.Lock()
+	pto := s.storage.PropTimeout
+	s.storage.Unlock()
+	if cs != nil {
+		// The nodes of the previous block sign the new one. They
+		// execute its body before, so they need it first.
+		h := sha256.Sum256(sb.Data)
+		proposal := &proposeBlock{SkipChainID: scID, DataHash: h[:], Body: body}
+		cs.setProposal(proposal)
+		replies, err := s.propagateProposal(signers, proposal, pto)
+		if err != nil {
+			log.Lvl1("Propagation-error:", err.Error())
+		}
+		if replies != len(signers.List) {
+			log.Lvl1(s.ServerIdentity(), "Only", replies, "out of", len(signers.List), "got the proposal")
+		}
+	}
 
 	var ssb = skipchain.StoreSkipBlock{
 		NewBlock:          sb,
@@ -338,11 +562,12 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts
 		return nil, err
 	}
 
-	s.storage.Lock()
-	pto := s.storage.PropTimeout
-	s.storage.Unlock()
 	// TODO: replace this with some kind of callback from the skipchain-service
-	replies, err := s.propagateTransactions(sb.Roster, &updateCollection{sb.Hash}, pto)
+	latest := ssbReply.Latest
+	if err = s.getCollection(latest.SkipChainID()).storeBody(latest.Hash, &body); err != nil {
+		return nil, errors.New("couldn't store body: " + err.Error())
+	}
+	replies, err := s.propagateTransactions(sb.Roster, &updateCollection{latest.Hash, body}, pto)
 	if err != nil {
 		log.Lvl1("Propagation-error:", err.Error())
 	}
@@ -357,101 +582,353 @@ func (s *Service) createNewBlock(scID skipchain.SkipBlockID, r *onet.Roster, cts
 // It is called by the leader, and every node will add the
 // transactions in the block to its collection.
 func (s *Service) updateCollection(msg network.Message) {
-	_, ok := msg.(*updateCollection)
-	// uc, ok := msg.(*updateCollection)
+	uc, ok := msg.(*updateCollection)
 	if !ok {
 		return
 	}
 
-	// sb, err := s.db().GetLatestByID(uc.ID)
-	// if err != nil {
-	// 	log.Errorf("didn't find latest block for %x", uc.ID)
-	// 	return
-	// }
-	// _, dataI, err := network.Unmarshal(sb.Data, cothority.Suite)
-	// data, ok := dataI.(*DataHeader)
-	// if err != nil || !ok {
-	// 	log.Error("couldn't unmarshal header")
-	// 	return
-	// }
-	// _, bodyI, err := network.Unmarshal(sb.Payload, cothority.Suite)
-	// body, ok := bodyI.(*DataBody)
-	// if err != nil || !ok {
-	// 	log.Error("couldn't unmarshal body", err, ok)
-	// 	return
-	// }
-
-// 	log.Lvlf2("%s: Updating transactions for %x", s.ServerIdentity(), sb.SkipChainID())
-// 	cdb := s.getCollection(sb.SkipChainID())
-// 	_, _, scs, err := s.createStateChanges(cdb.coll, body.Transactions)
-// 	if err != nil {
-// 		log.Error("Couldn't recreate state changes:", err.Error())
-// 		return
-// 	}
-// 	for _, sc := range scs {
-// 		log.Lvl2("Storing statechange", sc)
-// 		err = cdb.Store(&sc)
-// 		if err != nil {
-// 			log.Error("error while storing in collection: " + err.Error())
-// 		}
-// 	}
-// 	if !bytes.Equal(cdb.RootHash(), data.CollectionRoot) {
-// 		log.Error("hash of collection doesn't correspond to root hash")
-// 	}
+	sb := s.db().GetByID(uc.ID)
+	if sb == nil {
+		log.Errorf("didn't find block %x", uc.ID)
+		return
+	}
+	log.Lvlf2("%s: Updating transactions for %x", s.ServerIdentity(), sb.SkipChainID())
+	cs := s.getChain(sb.SkipChainID())
+	if err := cs.cdb.storeBody(sb.Hash, &uc.Body); err != nil {
+		log.Error("couldn't store body:", err)
+		return
+	}
+	cs.writeMu.Lock()
+	err := s.catchUp(cs.cdb, sb, nil)
+	cs.writeMu.Unlock()
+	if err != nil {
+		// Blocks or bodies are missing, so get them and the state from
+		// the other nodes.
+		log.Lvl2(s.ServerIdentity(), "couldn't update collection, synchronising it:", err)
+		if err = s.syncState(sb.Roster, sb.SkipChainID()); err != nil {
+			log.Error(s.ServerIdentity(), "couldn't update collection:", err)
+		}
+	}
 }
 
-func (s *Service) getCollection(id skipchain.SkipBlockID) *collectionDB {
-	idStr := fmt.Sprintf("%x", id)
-	col := s.collectionDB[idStr]
-	if col == nil {
-		db, name := s.GetAdditionalBucket([]byte(idStr))
-		s.collectionDB[idStr] = newCollectionDB(db, name)
-		return s.collectionDB[idStr]
+// storeProposal is called when the leader proposes the body of a new block,
+// which is kept until the block is verified.
+func (s *Service) storeProposal(msg network.Message) {
+	pb, ok := msg.(*proposeBlock)
+	if !ok {
+		return
+	}
+	if s.db().GetByID(pb.SkipChainID) == nil {
+		log.Errorf("%s: body proposed for unknown skipchain %x", s.ServerIdentity(), pb.SkipChainID)
+		return
 	}
-	return col
+	s.getChain(pb.SkipChainID).setProposal(pb)
 }
 
-// interface to skipchain.Service
-func (s *Service) skService() *skipchain.Service {
-	return s.Service(skipchain.ServiceName).(*skipchain.Service)
+// verifyProposal executes the body proposed for sb on the state of the
+// previous block, the same way applyBlock will. So a block is only signed if
+// all its transactions are within the limits and lead to the state of its
+// header.
+func (s *Service) verifyProposal(sb *skipchain.SkipBlock) error {
+	if len(sb.BackLinkIDs) == 0 {
+		return errors.New("block has no backlink")
+	}
+	prev := s.db().GetByID(sb.BackLinkIDs[0])
+	if prev == nil {
+		return fmt.Errorf("missing block %d", sb.Index-1)
+	}
+	cs := s.getChain(sb.SkipChainID())
+	h := sha256.Sum256(sb.Data)
+	pb := cs.getProposal(h[:])
+	if pb == nil {
+		return fmt.Errorf("no body proposed for block %d", sb.Index)
+	}
+
+	if err := s.verifyIdentityBlock(sb, prev); err != nil {
+		return err
+	}
+
+	cs.writeMu.Lock()
+	defer cs.writeMu.Unlock()
+	if err := s.catchUp(cs.cdb, prev, nil); err != nil {
+		return fmt.Errorf("couldn't apply block %d: %s", prev.Index, err)
+	}
+	if id, _ := cs.cdb.latestBlock(); !prev.Hash.Equal(id) {
+		return fmt.Errorf("state doesn't correspond to block %d", prev.Index)
+	}
+	_, _, err := s.executeBlock(cs.cdb, sb, &pb.Body)
+	return err
 }
 
-// gives us access to the skipchain's database, so we can get blocks by ID
-func (s *Service) db() *skipchain.SkipBlockDB {
-	return s.skService().GetDB()
+// verifyIdentityBlock makes sure that the block of the identity chain used by
+// sb is known to this node, and not older than the one used by prev.
+func (s *Service) verifyIdentityBlock(sb, prev *skipchain.SkipBlock) error {
+	header, err := decodeHeader(sb)
+	if err != nil {
+		return err
+	}
+	prevHeader, err := decodeHeader(prev)
+	if err != nil {
+		return err
+	}
+	if header.IdentityBlock.IsNull() {
+		if !prevHeader.IdentityBlock.IsNull() {
+			return errors.New("block of the identity chain is missing")
+		}
+		return nil
+	}
+	identity := s.db().GetByID(header.IdentityBlock)
+	if identity == nil {
+		return errors.New("unknown block of the identity chain")
+	}
+	if !prevHeader.IdentityBlock.IsNull() {
+		previous := s.db().GetByID(prevHeader.IdentityBlock)
+		if previous == nil || !previous.SkipChainID().Equal(identity.SkipChainID()) ||
+			previous.Index > identity.Index {
+			return errors.New("block of the identity chain is older than the previous one")
+		}
+	}
+	return nil
 }
 
-func (s *Service) loadConfig(scID skipchain.SkipBlockID) (*Config, error) {
-	coll := s.getCollection(scID)
-	// Find the genesis-darc ID.
-	val, contract, err := coll.GetValueContract(GenesisReferenceID.Slice())
+// previousState returns the collection as of the block preceding sb. It is
+// only available if this node applied that block, and at most keptRoots
+// blocks after it.
+func (s *Service) previousState(sb *skipchain.SkipBlock) (collection.Collection, error) {
+	if len(sb.BackLinkIDs) == 0 {
+		return collection.Collection{}, errors.New("block has no backlink")
+	}
+	prev := s.db().GetByID(sb.BackLinkIDs[0])
+	if prev == nil {
+		return collection.Collection{}, fmt.Errorf("missing block %d", sb.Index-1)
+	}
+	header, err := decodeHeader(prev)
 	if err != nil {
-		return nil, err
+		return collection.Collection{}, err
+	}
+	coll, err := s.getCollection(sb.SkipChainID()).snapshot(header.CollectionRoot)
+	if err != nil {
+		return collection.Collection{}, fmt.Errorf("state of block %d is not available: %s", prev.Index, err)
 	}
-	if string(contract) != ContractConfigID {
-		return nil, errors.New("did not get " + ContractConfigID)
+	return coll, nil
+}
+
+// applyBlock executes the transactions in the body of the block and stores
+// the resulting StateChanges in the collection, see executeBlock.
+func (s *Service) applyBlock(cdb *collectionDB, sb *skipchain.SkipBlock, body *DataBody) error {
+	header, scs, err := s.executeBlock(cdb, sb, body)
+	if err != nil {
+		return err
 	}
-	if len(val) != 32 {
-		return nil, errors.New("value has a invalid length")
+	if err = cdb.StoreAll(scs, sb); err != nil {
+		return err
 	}
-	// Use the genesis-darc ID to create the config key and read the config.
-	configID := ObjectID{
-		DarcID:     darc.ID(val),
-		InstanceID: OneNonce,
+	// The indexes can be rebuilt, so they don't stop the block.
+	if err = cdb.indexBlock(sb.Index, header.Timestamp, body); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't index block:", err)
 	}
-	val, contract, err = coll.GetValueContract(configID.Slice())
+	s.notifySubscribers(cdb, sb, body, scs)
+	return nil
+}
+
+// executeBlock executes the transactions in the body of the block on the
+// collection, which must hold the state of the previous block, and returns
+// the resulting StateChanges without storing them. The body must correspond
+// to the header of the block, and the resulting collection root must be the
+// one in the header. The receipts of the transactions, with their events,
+// must be the accepted receipts of the body, see verifyReceipts. The reasons
+// of the refused receipts cannot be checked, only that they are in the
+// receipts root.
+func (s *Service) executeBlock(cdb *collectionDB, sb *skipchain.SkipBlock, body *DataBody) (*DataHeader, StateChanges, error) {
+	header, err := decodeHeader(sb)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if !bytes.Equal(header.ClientTransactionHash, body.Transactions.Hash()) {
+		return nil, nil, fmt.Errorf("body of block %d doesn't correspond to its header", sb.Index)
+	}
+	ctx := Context{Index: sb.Index, Timestamp: header.Timestamp,
+		identityBlock: header.IdentityBlock}
+	if sb.Index > 0 {
+		ctx.SkipchainID = sb.SkipChainID()
+		if len(sb.BackLinkIDs) > 0 {
+			if prev := s.db().GetByID(sb.BackLinkIDs[0]); prev != nil {
+				ctx.epochSeed = s.epochSeed(prev)
+			}
+		}
+	}
+	if !bytes.Equal(header.ReceiptsRoot, receiptsRoot(body.Receipts)) {
+		return nil, nil, fmt.Errorf("receipts of block %d don't correspond to its header", sb.Index)
+	}
+	mr, ctsOK, scs, receipts, err := s.createStateChanges(cdb.coll, ctx, body.Transactions)
+	if err != nil {
+		return nil, nil, err
 	}
-	if string(contract) != ContractConfigID {
-		return nil, errors.New("did not get " + ContractConfigID)
+	if len(ctsOK) != len(body.Transactions) {
+		return nil, nil, fmt.Errorf("block %d holds invalid transactions", sb.Index)
 	}
-	config := Config{}
-	err = protobuf.Decode(val, &config)
+	if !bytes.Equal(mr, header.CollectionRoot) {
+		return nil, nil, fmt.Errorf("collection root of block %d doesn't verify", sb.Index)
+	}
+	if err = verifyReceipts(body, receipts); err != nil {
+		return nil, nil, fmt.Errorf("receipts of block %d: %s", sb.Index, err)
+	}
+	if !sameContracts(usedContracts(receipts), header.Contracts) {
+		return nil, nil, fmt.Errorf("contracts of block %d don't correspond to its header", sb.Index)
+	}
+	return header, scs, nil
+}
+
+// catchUp applies all blocks up to and including target that have not been
+// applied to the collection yet. If progress is not nil, it is called after
+// every applied block with the index of the block.
+func (s *Service) catchUp(cdb *collectionDB, target *skipchain.SkipBlock, progress func(int)) error {
+	_, index := cdb.latestBlock()
+	if index >= target.Index {
+		return nil
+	}
+
+	// Follow the backlinks to find all missing blocks, the first backlink
+	// always points to the previous block.
+	missing := make([]*skipchain.SkipBlock, target.Index-index)
+	sb := target
+	for i := len(missing) - 1; i >= 0; i-- {
+		if sb == nil {
+			return fmt.Errorf("missing block %d", index+1+i)
+		}
+		missing[i] = sb
+		if i > 0 {
+			sb = s.db().GetByID(sb.BackLinkIDs[0])
+		}
+	}
+
+	for _, sb := range missing {
+		body, err := cdb.getBody(sb.Hash)
+		if err != nil {
+			return err
+		}
+		if body == nil {
+			return fmt.Errorf("missing body of block %d", sb.Index)
+		}
+		if err = s.applyBlock(cdb, sb, body); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(sb.Index)
+		}
+	}
+	return nil
+}
+
+// replayChain removes the state of the skipchain and recreates it by applying
+// the body of every block since the genesis block. The progress is logged
+// while the blocks are replayed.
+func (s *Service) replayChain(id skipchain.SkipBlockID, cdb *collectionDB) error {
+	latest, err := s.db().GetLatest(s.db().GetByID(id))
+	if err != nil {
+		return err
+	}
+	if err = cdb.reset(); err != nil {
+		return err
+	}
+	total := latest.Index + 1
+	step := total / 10
+	if step == 0 {
+		step = 1
+	}
+	log.Lvlf1("%s: Replaying %d blocks of %x", s.ServerIdentity(), total, id)
+	return s.catchUp(cdb, latest, func(index int) {
+		if (index+1)%step == 0 || index == latest.Index {
+			log.Lvlf1("%s: Replayed %d/%d blocks of %x (%d%%)", s.ServerIdentity(),
+				index+1, total, id, 100*(index+1)/total)
+		}
+	})
+}
+
+// getChain returns the state of the skipchain. The first time a skipchain is
+// used, its collection is loaded from disk, and rebuilt if it doesn't
+// correspond to the latest block applied to it. Concurrent callers wait until
+// this is done.
+func (s *Service) getChain(id skipchain.SkipBlockID) *chainState {
+	s.chainsMu.Lock()
+	cs, ok := s.chains[string(id)]
+	if !ok {
+		cs = newChainState(id)
+		s.chains[string(id)] = cs
+	}
+	s.chainsMu.Unlock()
+
+	if ok {
+		<-cs.ready
+		return cs
+	}
+	idStr := fmt.Sprintf("%x", id)
+	db, name := s.GetAdditionalBucket([]byte(idStr))
+	cs.cdb = newCollectionDB(db, name)
+	if err := s.verifyCollectionRoot(cs.cdb); err != nil {
+		log.Error(s.ServerIdentity(), err, "- rebuilding it")
+		if err = s.replayChain(id, cs.cdb); err != nil {
+			log.Error(s.ServerIdentity(), "couldn't rebuild collection:", err)
+		}
+	}
+	if err := s.updateIndex(cs.cdb); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't update indexes:", err)
+	}
+	close(cs.ready)
+	return cs
+}
+
+func (s *Service) getCollection(id skipchain.SkipBlockID) *collectionDB {
+	return s.getChain(id).cdb
+}
+
+// verifyCollectionRoot checks that the root of the collection corresponds to
+// the CollectionRoot stored in the latest block applied to it.
+func (s *Service) verifyCollectionRoot(col *collectionDB) error {
+	id, index := col.latestBlock()
+	if index < 0 {
+		// No block has been applied yet, so the collection is empty.
+		return nil
+	}
+	sb := s.db().GetByID(id)
+	if sb == nil {
+		return fmt.Errorf("didn't find block %x of collection", id)
+	}
+	header, err := decodeHeader(sb)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(col.RootHash(), header.CollectionRoot) {
+		return fmt.Errorf("root of collection doesn't correspond to block %d", sb.Index)
+	}
+	return nil
+}
+
+// decodeHeader returns the DataHeader stored in the block.
+func decodeHeader(sb *skipchain.SkipBlock) (*DataHeader, error) {
+	_, headerI, err := network.Unmarshal(sb.Data, cothority.Suite)
 	if err != nil {
 		return nil, err
 	}
-	return &config, nil
+	header, ok := headerI.(*DataHeader)
+	if !ok {
+		return nil, errors.New("couldn't unmarshal header")
+	}
+	return header, nil
+}
+
+// interface to skipchain.Service
+func (s *Service) skService() *skipchain.Service {
+	return s.Service(skipchain.ServiceName).(*skipchain.Service)
+}
+
+// gives us access to the skipchain's database, so we can get blocks by ID
+func (s *Service) db() *skipchain.SkipBlockDB {
+	return s.skService().GetDB()
+}
+
+func (s *Service) loadConfig(scID skipchain.SkipBlockID) (*Config, error) {
+	return s.getChain(scID).getConfig()
 }
 
 func (s *Service) loadBlockInterval(scID skipchain.SkipBlockID) (time.Duration, error) {
@@ -462,6 +939,32 @@ func (s *Service) loadBlockInterval(scID skipchain.SkipBlockID) (time.Duration,
 	return config.BlockInterval, nil
 }
 
+// loadDarc returns the darc with the given base ID from the collection.
+func loadDarc(coll collection.Collection, dID darc.ID) (*darc.Darc, error) {
+	value, contract, err := getValueContract(coll, toObjectID(dID).Slice())
+	if err != nil {
+		return nil, err
+	}
+	if string(contract) != ContractDarcID {
+		return nil, fmt.Errorf("for darc %x, expected Kind to be 'darc' but got '%v'", dID, string(contract))
+	}
+	return darc.NewDarcFromProto(value)
+}
+
+// getDarcFromColl looks up the darc of a delegation, given as "darc:<id>". If
+// it cannot be found, an empty darc is returned, which never verifies.
+func getDarcFromColl(coll collection.Collection, id string) *darc.Darc {
+	dID, err := hex.DecodeString(strings.TrimPrefix(id, "darc:"))
+	if err != nil {
+		return &darc.Darc{}
+	}
+	d, err := loadDarc(coll, dID)
+	if err != nil {
+		return &darc.Darc{}
+	}
+	return d
+}
+
 func (s *Service) loadLatestDarc(sid skipchain.SkipBlockID, dID darc.ID) (*darc.Darc, error) {
 	colldb := s.getCollection(sid)
 	if colldb == nil {
@@ -496,7 +999,7 @@ func (s *Service) createQueueWorker(scID skipchain.SkipBlockID, interval time.Du
 					if err != nil {
 						panic("DB is in bad state and cannot find skipchain anymore: " + err.Error())
 					}
-					_, err = s.createNewBlock(scID, sb.Roster, ts)
+					_, err = s.createNewBlock(scID, s.nextRoster(scID, sb), ts)
 					// We empty ts because createNewBlock only returns an error only if it's a critical failure.
 					ts = []ClientTransaction{}
 					if err != nil {
@@ -515,98 +1018,451 @@ func (s *Service) createQueueWorker(scID skipchain.SkipBlockID, interval time.Du
 	return c
 }
 
+// nextRoster returns the roster of the block following latest. Once an epoch
+// has chosen a new roster, the next block changes to it. The roster of a
+// shard is the one assigned by its identity chain, as of the block of the
+// identity chain used by latest.
+func (s *Service) nextRoster(scID skipchain.SkipBlockID, latest *skipchain.SkipBlock) *onet.Roster {
+	config, err := s.loadConfig(scID)
+	if err != nil {
+		return latest.Roster
+	}
+	roster := config.Roster
+	if !config.Identity.IsNull() {
+		roster = nil
+		header, err := decodeHeader(latest)
+		if err == nil && !header.IdentityBlock.IsNull() {
+			identity, err := s.identityConfig(config.Identity, header.IdentityBlock)
+			if err == nil && identity.Shards != nil && config.Shard < len(identity.Shards.Shards) {
+				roster = identity.Shards.Shards[config.Shard].Roster
+			}
+		}
+	}
+	if roster != nil && roster.ID != latest.Roster.ID {
+		return roster
+	}
+	return latest.Roster
+}
+
+// identityConfig returns the config of the identity chain as of its block
+// with the given ID. Only the states of the last keptRoots applied blocks can
+// be loaded.
+func (s *Service) identityConfig(identity, block skipchain.SkipBlockID) (*Config, error) {
+	if s.ServiceProcessor == nil {
+		return nil, errors.New("there is no identity chain without skipchain")
+	}
+	sb := s.db().GetByID(block)
+	if sb == nil || !sb.SkipChainID().Equal(identity) {
+		return nil, errors.New("unknown block of the identity chain")
+	}
+	header, err := decodeHeader(sb)
+	if err != nil {
+		return nil, err
+	}
+	coll, err := s.getCollection(identity).snapshot(header.CollectionRoot)
+	if err != nil {
+		return nil, fmt.Errorf("state of block %d of the identity chain is not available: %s",
+			sb.Index, err)
+	}
+	return loadConfig(coll)
+}
+
 // We use the omniledger as a receiver (as is done in the identity service),
 // so we can access e.g. the collectionDBs of the service.
 func (s *Service) verifySkipBlock(newID []byte, newSB *skipchain.SkipBlock) bool {
 	_, headerI, err := network.Unmarshal(newSB.Data, cothority.Suite)
-	_, ok := headerI.(*DataHeader)
-	// header, ok := headerI.(*DataHeader)
+	header, ok := headerI.(*DataHeader)
 	if err != nil || !ok {
 		log.Errorf("couldn't unmarshal header")
 		return false
 	}
-	// _, bodyI, err := network.Unmarshal(newSB.Payload, cothority.Suite)
-	// body, ok := bodyI.(*DataBody)
-	// if err != nil || !ok {
-	// 	log.Error("couldn't unmarshal body", err, ok)
-	// 	return false
-	// }
-
-	// if bytes.Compare(header.ClientTransactionHash, body.Transactions.Hash()) != 0 {
-	// 	log.Lvl2(s.ServerIdentity(), "Client Transaction Hash doesn't verify")
-	// 	return false
-	// }
-	// ctx := body.Transactions
-	// cdb := s.getCollection(newSB.Hash)
-	// mtr, _, scs, err := s.createStateChanges(cdb.coll, ctx)
-	// if err != nil {
-	// 	log.Error("Couldn't create state changes:", err)
-	// 	return false
-	// }
-	// if bytes.Compare(header.CollectionRoot, mtr) != 0 {
-	// 	log.Lvl2(s.ServerIdentity(), "Collection root doesn't verify")
-	// 	return false
-	// }
-	// if bytes.Compare(header.StateChangesHash, scs.Hash()) != 0 {
-	// 	log.Lvl2(s.ServerIdentity(), "State Changes hash doesn't verify")
-	// 	return false
-	// }
+	// Verifying the body applies the previous block if needed, so the
+	// contracts can then be checked against its state.
+	if newSB.Index > 0 {
+		if err = s.verifyProposal(newSB); err != nil {
+			log.Lvl2(s.ServerIdentity(), err)
+			return false
+		}
+	}
+	if err = s.verifyBlockContracts(newSB, header); err != nil {
+		log.Lvl2(s.ServerIdentity(), err)
+		return false
+	}
 	return true
 }
 
 // createStateChanges goes through all ClientTransactions and creates
-// the appropriate StateChanges. If any of the transactions are invalid,
-// it returns an error.
-func (s *Service) createStateChanges(coll collection.Collection, cts ClientTransactions) (merkleRoot []byte, ctsOK ClientTransactions, states StateChanges, err error) {
+// the appropriate StateChanges. Invalid transactions are dropped and only the
+// valid ones are returned in ctsOK. The contracts are called with ctx, which
+// describes the block the transactions are executed in. For every transaction,
+// a receipt tells whether it has been accepted and what it used.
+//
+// Instead of cloning the collection, every ClientTransaction is run inside a
+// collection transaction, which only backs up the nodes it touches and is
+// rolled back if one of its instructions fails. Once all transactions went
+// through, the merkle root is read and the accepted StateChanges are reverted,
+// so the collection is left unchanged. The caller must make sure that nobody
+// else accesses coll during the call.
+func (s *Service) createStateChanges(coll collection.Collection, ctx Context, cts ClientTransactions) (merkleRoot []byte, ctsOK ClientTransactions, states StateChanges, receipts []Receipt, err error) {
+	// Don't write the tentative nodes to the store, they are collected once
+	// the block is applied.
+	coll.SetAutoCollect(false)
+	// Before the genesis block is applied, there is no configuration.
+	config, _ := loadConfig(coll)
+	var limits *Limits
+	if config != nil {
+		limits = config.Limits
+		// The cross-shard transactions of a shard are checked against
+		// the shards of the block of the identity chain in ctx, which
+		// are loaded once for the block.
+		if !config.Identity.IsNull() && ctx.shards == nil && hasAtomix(cts) {
+			var shardsErr error
+			ctx.shards, ctx.shard, shardsErr = s.atomixShards(config, ctx)
+			if shardsErr != nil {
+				log.Lvl2("couldn't load the shards of the block:", shardsErr)
+			}
+		}
+	}
+	var undo StateChanges
+	var block Resources
+	for _, ct := range cts {
+		coll.Begin()
+		start := time.Now()
+		scs, ctUndo, r, err := s.executeClientTx(coll, ctx, ct, config)
+		if err == nil && limits != nil {
+			total := block
+			total.add(r.Used)
+			if e := total.exceeds(limits.Block); e != nil {
+				err = errors.New("block over its budget: " + e.Error())
+			}
+		}
+		if err == nil && ctx.leader && limits != nil && limits.Duration > 0 &&
+			time.Since(start) > limits.Duration {
+			// The other nodes cannot check the time, so the
+			// transaction is left out of the block, even if it is a
+			// step of a cross-shard transaction.
+			err = fmt.Errorf("transaction took longer than %s", limits.Duration)
+			log.Lvl1(err)
+			coll.Rollback()
+			receipts = append(receipts, Receipt{TxHash: ct.Hash(), Error: err.Error()})
+			continue
+		}
+		if err != nil && ct.Atomix != nil && ct.Atomix.Phase == AtomixLock {
+			// A refused input of a cross-shard transaction is
+			// recorded, so that its rejection can be proven.
+			log.Lvl2(err)
+			coll.Rollback()
+			coll.Begin()
+			scs, ctUndo, err = rejectAtomixLock(coll, ctx, ct)
+			r = Receipt{}
+		}
+		if err != nil {
+			log.Lvl1(err)
+			coll.Rollback()
+			receipts = append(receipts, Receipt{TxHash: ct.Hash(), Error: err.Error()})
+			continue
+		}
+		coll.End()
+		block.add(r.Used)
+		r.TxHash = ct.Hash()
+		receipts = append(receipts, r)
+		undo = append(undo, ctUndo...)
+		states = append(states, scs...)
+		ctsOK = append(ctsOK, ct)
+	}
+	merkleRoot = coll.GetRoot()
 
-	// TODO: Because we depend on making at least one clone per transaction
-	// we need to find out if this is as expensive as it looks, and if so if
-	// we could use some kind of copy-on-write technique.
+	coll.Begin()
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err = storeInColl(coll, &undo[i]); err != nil {
+			coll.Rollback()
+			return nil, nil, nil, nil, errors.New("couldn't revert state changes: " + err.Error())
+		}
+	}
+	coll.End()
+	return
+}
 
-	cdbTemp := coll.Clone()
-clientTransactions:
-	for _, ct := range cts {
-		cdbI := cdbTemp.Clone()
-		for _, instr := range ct.Instructions {
-			kind, _, err := instr.GetContractState(cdbI)
+// executeClientTx calls the contracts of all instructions in ct and applies
+// the resulting StateChanges to coll. Besides the StateChanges, it returns the
+// StateChanges needed to revert them, in the order they have been applied.
+// If any instruction fails, an error is returned and coll is left in an
+// intermediate state that must be rolled back by the caller.
+//
+// The coins of a ClientTransaction are passed from one contract to the next:
+// every contract receives the coins left over by the previous one, plus the
+// coins its instruction takes from accounts. What is left after the last
+// instruction is credited to the reward account. Finally, a ClientTransaction
+// that would create or destroy coins is refused.
+//
+// The objects locked by a cross-shard transaction can only be changed by the
+// steps of that transaction, see atomix.go.
+//
+// Only the contracts enabled by config can be called, see Config.Contracts,
+// and the version that is active for the block is run, see versions.go. The
+// instructions must match the schema of that version, see schema.go.
+// If config sets limits, the resources used by the instructions are bounded,
+// see limits.go. The returned Receipt holds the resources used by the whole
+// transaction, its events and the contracts it called, but no TxHash.
+func (s *Service) executeClientTx(coll collection.Collection, ctx Context, ct ClientTransaction, config *Config) (states, undo StateChanges, r Receipt, err error) {
+	// Before the genesis block is applied, there is no configuration and
+	// leftover coins are refused.
+	var reward *ObjectID
+	var limits *Limits
+	if config != nil {
+		reward, limits = config.RewardAccount, config.Limits
+	}
+	var atomixHash []byte
+	if ct.Atomix != nil {
+		atomixHash = ct.Atomix.Transaction.Hash()
+	}
+	apply := func(scs ...StateChange) error {
+		for i := range scs {
+			if err := checkAtomixLocked(coll, scs[i].ObjectID, atomixHash); err != nil {
+				return err
+			}
+			u, err := undoStateChange(coll, &scs[i])
 			if err != nil {
-				log.Lvl1("Couldn't get kind of instruction")
-				continue clientTransactions
+				return err
+			}
+			if err := storeInColl(coll, &scs[i]); err != nil {
+				return errors.New("failed to add to collections with error: " + err.Error())
 			}
+			undo = append(undo, u)
+		}
+		states = append(states, scs...)
+		return nil
+	}
+
+	// instrUsed counts the resources of the current instruction, including
+	// the contracts it calls.
+	var instrUsed Resources
+	meter := func(scs []StateChange, steps int) error {
+		instrUsed.count(scs)
+		instrUsed.Steps += steps
+		if limits == nil {
+			return nil
+		}
+		if err := instrUsed.exceeds(limits.Instruction); err != nil {
+			return errors.New("instruction over its budget: " + err.Error())
+		}
+		return nil
+	}
 
-			f, exists := s.contracts[kind]
-			// If the leader does not have a verifier for this kind, it drops the
-			// transaction.
-			if !exists {
-				log.Lvl1("Leader is dropping instruction of unknown kind:", kind)
-				continue clientTransactions
+	// emitter returns the function recording the events of a contract
+	// executing instr. Their bytes are metered like those of StateChanges.
+	emitter := func(kind string, instr Instruction) func(Event) error {
+		return func(ev Event) error {
+			ev.ContractID, ev.ObjectID = kind, instr.ObjectID
+			instrUsed.Bytes += len(ev.Topic) + len(ev.Data)
+			if err := meter(nil, 0); err != nil {
+				return err
 			}
-			// Now we call the contract function with the data of the key:
-			log.Lvlf3("%s: Calling contract %s", s.ServerIdentity(), kind)
-			scs, _, err := f(cdbI, instr, nil)
+			r.Events = append(r.Events, ev)
+			return nil
+		}
+	}
+
+	// call executes the instructions of cross-contract calls, see
+	// Context.Call.
+	var call func(ctx Context, instr Instruction, coins []Coin) ([]StateChange, []Coin, error)
+	call = func(ctx Context, instr Instruction, coins []Coin) (scs []StateChange, left []Coin, err error) {
+		// The StateChanges, events and contracts of a failed call, and
+		// of the calls it made, are dropped, as the caller may go on
+		// without it.
+		n, m := len(r.Events), len(r.Contracts)
+		nUndo, nStates := len(undo), len(states)
+		defer func() {
 			if err != nil {
-				log.Lvl1("Call to contract returned error:", err)
-				continue clientTransactions
-			}
-			for _, sc := range scs {
-				if err := storeInColl(cdbI, &sc); err != nil {
-					log.Lvl1("failed to add to collections with error: " + err.Error())
-					continue clientTransactions
+				r.Events, r.Contracts = r.Events[:n], r.Contracts[:m]
+				for i := len(undo) - 1; i >= nUndo; i-- {
+					if errUndo := storeInColl(coll, &undo[i]); errUndo != nil {
+						err = errors.New("couldn't revert call: " + errUndo.Error())
+						return
+					}
 				}
+				undo, states = undo[:nUndo], states[:nStates]
 			}
-			states = append(states, scs...)
+		}()
+		d, err := loadDarc(coll, instr.ObjectID.DarcID)
+		if err != nil {
+			return nil, nil, err
 		}
-		cdbTemp = cdbI
-		ctsOK = append(ctsOK, ct)
+		getDarc := func(id string) *darc.Darc {
+			return getDarcFromColl(coll, id)
+		}
+		if err = d.VerifyIdentities(darc.Action(instr.Action()), ctx.Signers, getDarc); err != nil {
+			return nil, nil, errors.New("call refused: " + err.Error())
+		}
+		kind, _, err := instr.GetContractState(coll)
+		if err != nil {
+			return nil, nil, errors.New("Couldn't get kind of instruction")
+		}
+		if _, exists := s.contracts[kind]; !exists {
+			return nil, nil, errors.New("call to unknown contract: " + kind)
+		}
+		f, version, err := s.activeContract(config, kind, ctx.Index)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = s.verifySchema(kind, version, instr); err != nil {
+			return nil, nil, err
+		}
+		if err = meter(nil, 1); err != nil {
+			return nil, nil, err
+		}
+		ctx.depth++
+		ctx.call = call
+		ctx.emit = emitter(kind, instr)
+		scs, coins, err = f(ctx, coll, instr, coins)
+		if err != nil {
+			return nil, nil, errors.New("Call to contract returned error: " + err.Error())
+		}
+		if err = meter(scs, 0); err != nil {
+			return nil, nil, err
+		}
+		if err = apply(scs...); err != nil {
+			return nil, nil, err
+		}
+		r.addContract(kind)
+		return scs, coins, nil
 	}
-	return cdbTemp.GetRoot(), ctsOK, states, nil
+
+	// Coins can come from or go to other shards.
+	var coins, incoming, outgoing []Coin
+	if ct.Atomix != nil {
+		var scs StateChanges
+		switch ct.Atomix.Phase {
+		case AtomixLock:
+			err = checkAtomixLock(coll, ctx, ct)
+		case AtomixCommit:
+			incoming, err = checkAtomixCommit(coll, ctx, ct)
+			coins = incoming
+		case AtomixUnlock:
+			scs, outgoing, err = unlockAtomix(coll, ctx, ct.Atomix)
+		default:
+			err = errors.New("unknown phase of cross-shard transaction")
+		}
+		if err != nil {
+			return nil, nil, Receipt{}, err
+		}
+		if err = apply(scs...); err != nil {
+			return nil, nil, Receipt{}, err
+		}
+	}
+
+	for _, instr := range ct.Instructions {
+		kind, _, err := instr.GetContractState(coll)
+		if err != nil {
+			return nil, nil, Receipt{}, errors.New("Couldn't get kind of instruction")
+		}
+
+		// If the leader does not have a verifier for this kind, it drops the
+		// transaction.
+		if _, exists := s.contracts[kind]; !exists {
+			return nil, nil, Receipt{}, errors.New("Leader is dropping instruction of unknown kind: " + kind)
+		}
+		f, version, err := s.activeContract(config, kind, ctx.Index)
+		if err != nil {
+			return nil, nil, Receipt{}, err
+		}
+		if err = s.verifySchema(kind, version, instr); err != nil {
+			return nil, nil, Receipt{}, err
+		}
+
+		for _, in := range instr.Coins {
+			sc, err := fetchCoin(coll, in)
+			if err != nil {
+				return nil, nil, Receipt{}, errors.New("Couldn't fetch coins: " + err.Error())
+			}
+			if err = apply(sc); err != nil {
+				return nil, nil, Receipt{}, err
+			}
+			if coins, err = addCoin(coins, in.Coin); err != nil {
+				return nil, nil, Receipt{}, err
+			}
+		}
+
+		// Now we call the contract function with the data of the key:
+		log.Lvlf3("Calling contract %s", kind)
+		instrUsed = Resources{}
+		if err = meter(nil, 1); err != nil {
+			return nil, nil, Receipt{}, err
+		}
+		var scs []StateChange
+		instrCtx := ctx
+		instrCtx.Signers = instr.VerifiedSigners()
+		instrCtx.call = call
+		instrCtx.emit = emitter(kind, instr)
+		scs, coins, err = f(instrCtx, coll, instr, coins)
+		if err != nil {
+			return nil, nil, Receipt{}, errors.New("Call to contract returned error: " + err.Error())
+		}
+		if err = meter(scs, 0); err != nil {
+			return nil, nil, Receipt{}, err
+		}
+		if err = apply(scs...); err != nil {
+			return nil, nil, Receipt{}, err
+		}
+		r.Used.add(instrUsed)
+		r.addContract(kind)
+	}
+
+	if ct.Atomix != nil {
+		var scs StateChanges
+		switch ct.Atomix.Phase {
+		case AtomixLock:
+			// The leftover coins are locked until the output is
+			// committed or the input unlocked.
+			scs, err = lockAtomix(ct.Atomix, coins, undo)
+			coins = nil
+		case AtomixCommit:
+			scs = StateChanges{NewStateChange(Create, AtomixCommitID(atomixHash),
+				ContractAtomixCommitID, atomixHash)}
+		}
+		if err != nil {
+			return nil, nil, Receipt{}, err
+		}
+		if err = apply(scs...); err != nil {
+			return nil, nil, Receipt{}, err
+		}
+	}
+
+	if limits != nil {
+		fee := CoinAccount{Coins: coins}.Balance(limits.FeeCoin)
+		if err = r.Used.exceeds(limits.transactionLimit(fee)); err != nil {
+			return nil, nil, Receipt{}, errors.New("transaction over its budget: " + err.Error())
+		}
+	}
+
+	if len(coins) > 0 {
+		if reward == nil {
+			return nil, nil, Receipt{}, errors.New("leftover coins but no reward account")
+		}
+		sc, err := creditCoins(coll, *reward, coins)
+		if err != nil {
+			return nil, nil, Receipt{}, errors.New("Couldn't credit reward: " + err.Error())
+		}
+		if err = apply(sc); err != nil {
+			return nil, nil, Receipt{}, err
+		}
+	}
+	if err = checkCoins(coll, states, undo, incoming, outgoing); err != nil {
+		return nil, nil, Receipt{}, err
+	}
+	return
 }
 
 // registerContract stores the contract in a map and will
 // call it whenever a contract needs to be done.
 func (s *Service) registerContract(contractID string, c OmniLedgerContract) error {
-	s.contracts[contractID] = c
-	return nil
+	return s.registerContractWithContext(contractID, c.WithContext())
+}
+
+// registerContractWithContext stores a contract that receives the Context of
+// its instructions, as DefaultContractVersion.
+func (s *Service) registerContractWithContext(contractID string, c ContractWithContext) error {
+	return s.registerContractVersion(contractID, DefaultContractVersion, c)
 }
 
 // Tries to load the configuration and updates the data in the service
@@ -629,8 +1485,7 @@ func (s *Service) tryLoad() error {
 	if s.storage == nil {
 		s.storage = &storage{}
 	}
-	s.collectionDB = map[string]*collectionDB{}
-	s.queueWorkers = map[string]chan ClientTransaction{}
+	s.chains = map[string]*chainState{}
 
 	gas := &skipchain.GetAllSkipchains{}
 	gasr, err := s.skService().GetAllSkipchains(gas)
@@ -643,9 +1498,7 @@ func (s *Service) tryLoad() error {
 		if err != nil {
 			return err
 		}
-		// At this point the service is not yet up, so no need to
-		// protect access to queueWorkers with a mutex.
-		s.queueWorkers[string(sb.Hash)] = s.createQueueWorker(sb.Hash, interval)
+		s.getChain(sb.Hash).setQueue(s.createQueueWorker(sb.Hash, interval))
 	}
 
 	return nil
@@ -661,6 +1514,22 @@ func (s *Service) save() {
 	}
 }
 
+// registerBuiltins registers the contracts, schemas and views every skipchain
+// knows.
+func (s *Service) registerBuiltins() {
+	s.registerContractWithContext(ContractConfigID, s.contractConfig)
+	s.registerContract(ContractDarcID, s.ContractDarc)
+	s.registerContract(ContractValueID, s.ContractValue)
+	s.registerContract(ContractCoinID, s.ContractCoin)
+	s.registerContract(ContractStakeID, s.ContractStake)
+	s.registerContractWithContext(ContractMultisigID, s.ContractMultisig)
+	for _, schema := range builtinSchemas {
+		s.registerSchema(schema.ContractID, DefaultContractVersion, schema.Commands...)
+	}
+	s.registerView(ContractCoinID, ViewCoinBalance, viewCoinBalance)
+	s.registerView(ContractDarcID, ViewDarcRules, viewDarcRules)
+}
+
 // newService receives the context that holds information about the node it's
 // running on. Saving and loading can be done using the context. The data will
 // be stored in memory for tests and simulations, and on disk for real
@@ -669,12 +1538,25 @@ func newService(c *onet.Context) (onet.Service, error) {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		CloseQueues:      make(chan bool),
-		contracts:        make(map[string]OmniLedgerContract),
+		contracts:        make(map[string]map[int]ContractWithContext),
+		schemas:          make(map[string]map[int]ContractSchema),
+		views:            make(map[string]map[string]ContractView),
+		syncReplies:      make(map[Nonce]chan network.Message),
+		syncing:          make(map[string]bool),
+		snapshots:        make(map[string]*snapshotPin),
+		subscribers:      make(map[string][]*subscriber),
 	}
 	if err := s.RegisterHandlers(s.CreateGenesisBlock, s.AddTransaction,
-		s.GetProof); err != nil {
+		s.GetProof, s.CreateShardedLedger, s.GetReceipt, s.CallView,
+		s.SimulateTransaction, s.QueryTransactions, s.ListContracts,
+		s.RebuildIndex); err != nil {
 		log.ErrFatal(err, "Couldn't register messages")
 	}
+	if err := s.RegisterStreamingHandlers(s.Subscribe); err != nil {
+		log.ErrFatal(err, "Couldn't register streaming messages")
+	}
+	s.registerSync()
+	s.registerShards()
 	if err := s.tryLoad(); err != nil {
 		log.Error(err)
 		return nil, err
@@ -685,9 +1567,12 @@ func newService(c *onet.Context) (onet.Service, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.propagateProposal, err = messaging.NewPropagationFunc(c, "OmniLedgerPropose", s.storeProposal, -1)
+	if err != nil {
+		return nil, err
+	}
 
-	s.registerContract(ContractConfigID, s.ContractConfig)
-	s.registerContract(ContractDarcID, s.ContractDarc)
+	s.registerBuiltins()
 	skipchain.RegisterVerification(c, verifyOmniLedger, s.verifySkipBlock)
 	return s, nil
 }
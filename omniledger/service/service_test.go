@@ -2,6 +2,7 @@ package service
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"reflect"
@@ -12,12 +13,15 @@ import (
 	"student_18_byzcoin/omniledger/darc"
 	// "github.com/dedis/student_18_omniledger/omniledger/collection"
 	// "github.com/dedis/student_18_omniledger/omniledger/darc"
+	"github.com/dedis/protobuf"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/cothority.v2"
 	"gopkg.in/dedis/cothority.v2/skipchain"
 	"gopkg.in/dedis/kyber.v2/suites"
 	"gopkg.in/dedis/onet.v2"
 	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
 )
 
 var tSuite = suites.MustFind("Ed25519")
@@ -249,6 +253,41 @@ func TestService_InvalidVerification(t *testing.T) {
 	require.True(t, match)
 }
 
+func TestService_VerifyProposal(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	for i := range s.hosts {
+		RegisterContract(s.hosts[i], "invalid", verifyInvalidKind)
+	}
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	sb, body := s.propose(t, s.sb, ClientTransactions{tx})
+	for _, service := range s.services {
+		require.True(t, service.verifySkipBlock(nil, sb))
+	}
+
+	// Without the body, the block cannot be verified.
+	cs := s.services[1].getChain(s.sb.SkipChainID())
+	cs.setProposal(nil)
+	require.False(t, s.services[1].verifySkipBlock(nil, sb))
+
+	// A leader adding a transaction that the other nodes refuse, like one
+	// over its budget, doesn't get its block signed.
+	invalid, err := createOneClientTx(s.darc.GetBaseID(), "invalid", s.value, s.signer)
+	require.Nil(t, err)
+	body.Transactions = append(body.Transactions, invalid)
+	header, err := decodeHeader(sb)
+	require.Nil(t, err)
+	header.ClientTransactionHash = body.Transactions.Hash()
+	sb.Data, err = network.Marshal(header)
+	require.Nil(t, err)
+	h := sha256.Sum256(sb.Data)
+	cs.setProposal(&proposeBlock{SkipChainID: s.sb.SkipChainID(), DataHash: h[:], Body: *body})
+	require.False(t, s.services[1].verifySkipBlock(nil, sb))
+}
+
 func TestService_LoadBlockInterval(t *testing.T) {
 	interval := 200 * time.Millisecond
 	s := newSer(t, 1, interval)
@@ -260,6 +299,36 @@ func TestService_LoadBlockInterval(t *testing.T) {
 	require.Equal(t, dur, interval)
 }
 
+func TestService_ReplayChain(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	key := s.tx.Instructions[0].ObjectID.Slice()
+	cdb := s.service().getCollection(s.sb.SkipChainID())
+	_, index := cdb.latestBlock()
+	require.Equal(t, 1, index)
+	root := cdb.RootHash()
+
+	// Corrupt the stored state so that it doesn't correspond to the latest
+	// block anymore.
+	require.Nil(t, cdb.StoreAll(StateChanges{{
+		StateAction: Remove,
+		ObjectID:    key,
+	}}, nil))
+	require.NotEqual(t, root, cdb.RootHash())
+
+	// Loading the collection again must rebuild it from the blocks.
+	s.service().chains = map[string]*chainState{}
+	cdb = s.service().getCollection(s.sb.SkipChainID())
+	require.Equal(t, root, cdb.RootHash())
+	v, _, err := cdb.GetValueContract(key)
+	require.Nil(t, err)
+	require.Equal(t, s.value, v)
+	_, index = cdb.latestBlock()
+	require.Equal(t, 1, index)
+}
+
 func TestService_StateChange(t *testing.T) {
 	s := newSer(t, 1, testInterval)
 	defer s.local.CloseAll()
@@ -355,13 +424,295 @@ func TestService_StateChange(t *testing.T) {
 		},
 	}
 
-	_, ctsOK, scs, err := s.service().createStateChanges(cdb.coll, cts)
+	_, ctsOK, scs, _, err := s.service().createStateChanges(cdb.coll, Context{}, cts)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(ctsOK))
 	require.Equal(t, n, len(scs))
 	require.Equal(t, latest, int64(n-1))
 }
 
+func TestService_Context(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	// The contract stores the context it has been called with.
+	f := func(ctx Context, cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		buf, err := protobuf.Encode(&ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []StateChange{NewStateChange(Create, tx.ObjectID, dummyKind, buf)}, c, nil
+	}
+	for _, h := range s.hosts {
+		require.Nil(t, RegisterContractWithContext(h, dummyKind, f))
+	}
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	_, err = s.service().AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: s.sb.SkipChainID(),
+		Transaction: tx,
+	})
+	require.Nil(t, err)
+	time.Sleep(4 * s.interval)
+
+	latest, err := s.service().db().GetLatest(s.service().db().GetByID(s.sb.Hash))
+	require.Nil(t, err)
+	header, err := decodeHeader(latest)
+	require.Nil(t, err)
+	// Every node executes the contract with the same context.
+	for _, service := range s.services {
+		resp, err := service.GetProof(&GetProof{
+			Version: CurrentVersion,
+			ID:      s.sb.SkipChainID(),
+			Key:     tx.Instructions[0].ObjectID.Slice(),
+		})
+		require.Nil(t, err)
+		_, values, err := resp.Proof.KeyValue()
+		require.Nil(t, err)
+		var ctx Context
+		require.Nil(t, protobuf.DecodeWithConstructors(values[0], &ctx,
+			network.DefaultConstructors(cothority.Suite)))
+		require.True(t, ctx.SkipchainID.Equal(s.sb.SkipChainID()))
+		require.Equal(t, latest.Index, ctx.Index)
+		require.Equal(t, header.Timestamp, ctx.Timestamp)
+		require.Equal(t, 1, len(ctx.Signers))
+		require.True(t, ctx.Signers[0].Equal(s.signer.Identity()))
+	}
+}
+
+func TestService_ContractCall(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	callKind := "call"
+	require.Nil(t, s.darc.Rules.AddRule("Spawn_"+darc.Action(callKind), s.darc.Rules.GetSignExpr()))
+	// The contract calls the contract given in its arguments "depth" times,
+	// one object after the other.
+	next := func(oid ObjectID) ObjectID {
+		return ObjectID{DarcID: oid.DarcID, InstanceID: Nonce(sha256.Sum256(oid.InstanceID[:]))}
+	}
+	f := func(ctx Context, cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		depth := tx.Spawn.Args.Search("depth")[0]
+		if depth > 0 {
+			contract := tx.Spawn.Args.Search("contract")
+			_, _, err := ctx.Call(Instruction{ObjectID: next(tx.ObjectID), Spawn: &Spawn{
+				ContractID: string(contract),
+				Args: Arguments{
+					{Name: "depth", Value: []byte{depth - 1}},
+					{Name: "contract", Value: contract},
+				},
+			}}, c)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return []StateChange{NewStateChange(Create, tx.ObjectID, callKind, []byte{depth})}, c, nil
+	}
+	require.Nil(t, RegisterContractWithContext(s.hosts[0], callKind, f))
+
+	coll := newConfigColl(t, s, nil)
+	call := func(depth int, contract string, signers ...*darc.Signer) (ObjectID, bool) {
+		instr := Instruction{
+			ObjectID: ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()},
+			Spawn: &Spawn{
+				ContractID: callKind,
+				Args: Arguments{
+					{Name: "depth", Value: []byte{byte(depth)}},
+					{Name: "contract", Value: []byte(contract)},
+				},
+			},
+		}
+		require.Nil(t, instr.SignBy(signers...))
+		_, ctsOK, scs, _, err := s.service().createStateChanges(coll, Context{},
+			ClientTransactions{{Instructions: []Instruction{instr}}})
+		require.Nil(t, err)
+		for i := range scs {
+			require.Nil(t, storeInColl(coll, &scs[i]))
+		}
+		return instr.ObjectID, len(ctsOK) == 1
+	}
+	exists := func(oid ObjectID) bool {
+		_, _, err := getValueContract(coll, oid.Slice())
+		return err == nil
+	}
+
+	// All objects of the calls are created by the same transaction.
+	oid, ok := call(MaxCallDepth, callKind, s.signer)
+	require.True(t, ok)
+	for i := 0; i <= MaxCallDepth; i++ {
+		require.True(t, exists(oid))
+		oid = next(oid)
+	}
+	require.False(t, exists(oid))
+
+	// If any call fails, nothing is stored.
+	oid, ok = call(MaxCallDepth+1, callKind, s.signer)
+	require.False(t, ok)
+	require.False(t, exists(oid))
+
+	// The darc of the callee must allow the call to the signers.
+	oid, ok = call(1, ContractValueID, s.signer)
+	require.False(t, ok)
+	require.False(t, exists(oid))
+	oid, ok = call(1, callKind, darc.NewSignerEd25519(nil, nil))
+	require.False(t, ok)
+	require.False(t, exists(oid))
+
+	_, _, err := Context{}.Call(Instruction{}, nil)
+	require.NotNil(t, err)
+}
+
+func TestService_ContractCallRevert(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	revertKind := "revert"
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, &onet.Roster{},
+		[]string{"Spawn_" + revertKind, "Spawn_" + ContractValueID, "Invoke_" + CmdValueUpdate}, signer.Identity())
+	require.Nil(t, err)
+	e, err := NewExecutor(genesisMsg)
+	require.Nil(t, err)
+	newOID := func() ObjectID {
+		return ObjectID{DarcID: genesisMsg.GenesisDarc.GetBaseID(), InstanceID: GenNonce()}
+	}
+	value, callee := newOID(), newOID()
+
+	// The caller calls the callee and ignores its error. The callee
+	// updates the value object, spawns a value under its own object and
+	// fails.
+	f := func(ctx Context, cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		if tx.Spawn.Args.Search("callee") == nil {
+			_, _, err := ctx.Call(Instruction{ObjectID: callee, Spawn: &Spawn{
+				ContractID: revertKind,
+				Args:       Arguments{{Name: "callee", Value: []byte{1}}},
+			}}, c)
+			if err == nil {
+				return nil, nil, errors.New("call should fail")
+			}
+			return []StateChange{NewStateChange(Create, tx.ObjectID, revertKind, []byte{})}, c, nil
+		}
+		_, _, err := ctx.Call(Instruction{ObjectID: value, Invoke: &Invoke{
+			Command: CmdValueUpdate,
+			Args:    Arguments{{Name: "value", Value: []byte("changed")}},
+		}}, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, _, err = ctx.Call(Instruction{ObjectID: tx.ObjectID, Spawn: &Spawn{
+			ContractID: ContractValueID,
+		}}, c); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errors.New("failing")
+	}
+	require.Nil(t, e.RegisterContractWithContext(revertKind, f))
+
+	apply := func(instr Instruction) string {
+		require.Nil(t, instr.SignBy(signer))
+		receipts, err := e.Apply(ClientTransaction{Instructions: []Instruction{instr}})
+		require.Nil(t, err)
+		return receipts[0].Error
+	}
+	require.Equal(t, "", apply(Instruction{ObjectID: value, Spawn: &Spawn{
+		ContractID: ContractValueID,
+		Args:       Arguments{{Name: "value", Value: []byte("old")}},
+	}}))
+	caller := newOID()
+	require.Equal(t, "", apply(Instruction{ObjectID: caller, Spawn: &Spawn{ContractID: revertKind}}))
+
+	// Only the object of the caller has been added.
+	stored, _, err := e.Get(value.Slice())
+	require.Nil(t, err)
+	require.Equal(t, []byte("old"), stored)
+	_, contractID, err := e.Get(callee.Slice())
+	require.Nil(t, err)
+	require.Equal(t, "", contractID)
+	_, contractID, err = e.Get(caller.Slice())
+	require.Nil(t, err)
+	require.Equal(t, revertKind, contractID)
+}
+
+func TestService_SimulateTransaction(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	id := s.sb.SkipChainID()
+	cdb := s.service().getCollection(id)
+	root := cdb.RootHash()
+	_, index := cdb.latestBlock()
+
+	simulate := func(tx ClientTransaction) *SimulateTransactionResponse {
+		resp, err := s.service().SimulateTransaction(&SimulateTransaction{
+			Version:     CurrentVersion,
+			SkipchainID: id,
+			Transaction: tx,
+		})
+		require.Nil(t, err)
+		require.Equal(t, tx.Hash(), resp.Receipt.TxHash)
+		return resp
+	}
+
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, []byte("simulated"), s.signer)
+	require.Nil(t, err)
+	resp := simulate(tx)
+	require.Equal(t, "", resp.Receipt.Error)
+	require.Equal(t, 1, len(resp.StateChanges))
+	require.Equal(t, tx.Instructions[0].ObjectID.Slice(), resp.StateChanges[0].ObjectID)
+
+	// A wrong signature and a failing contract are reported.
+	tx, err = createOneClientTx(s.darc.GetBaseID(), dummyKind, []byte("simulated"), darc.NewSignerEd25519(nil, nil))
+	require.Nil(t, err)
+	resp = simulate(tx)
+	require.NotEqual(t, "", resp.Receipt.Error)
+	require.Equal(t, 0, len(resp.StateChanges))
+	tx, err = createOneClientTx(s.darc.GetBaseID(), "invalid", []byte("simulated"), s.signer)
+	require.Nil(t, err)
+	resp = simulate(tx)
+	require.Contains(t, resp.Receipt.Error, "unknown kind")
+
+	// Nothing has been stored or queued.
+	time.Sleep(2 * s.interval)
+	require.Equal(t, root, cdb.RootHash())
+	_, latest := cdb.latestBlock()
+	require.Equal(t, index, latest)
+}
+
+func TestService_StateChangeRollback(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	RegisterContract(s.hosts[0], "invalid", verifyInvalidKind)
+
+	coll := collection.New(collection.Data{}, collection.Data{})
+	for i := 0; i < 100; i++ {
+		key := GenNonce()
+		require.Nil(t, coll.Add(key[:], []byte{byte(i)}, []byte(dummyKind)))
+	}
+	root := coll.GetRoot()
+
+	// The second transaction fails in its second instruction, so its first
+	// instruction must not be applied either.
+	tx1, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, []byte("a"), s.signer)
+	require.Nil(t, err)
+	tx2, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, []byte("b"), s.signer)
+	require.Nil(t, err)
+	instr, err := createInstr(s.darc.GetBaseID(), "invalid", []byte("c"), s.signer)
+	require.Nil(t, err)
+	tx2.Instructions = append(tx2.Instructions, instr)
+
+	mr, ctsOK, scs, _, err := s.service().createStateChanges(coll, Context{}, ClientTransactions{tx1, tx2})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ctsOK))
+	require.Equal(t, 1, len(scs))
+	require.Equal(t, root, coll.GetRoot())
+
+	clone := coll.Clone()
+	require.Nil(t, storeInColl(clone, &scs[0]))
+	require.Equal(t, clone.GetRoot(), mr)
+}
+
 type ser struct {
 	local    *onet.LocalTest
 	hosts    []*onet.Server
@@ -424,6 +775,38 @@ func newSer(t *testing.T, step int, interval time.Duration) *ser {
 	return s
 }
 
+// propose returns the block following latest, whose body holds cts, as the
+// leader creates it. The body is given to all services, without proposing the
+// block to the skipchain.
+func (s *ser) propose(t *testing.T, latest *skipchain.SkipBlock, cts ClientTransactions) (*skipchain.SkipBlock, *DataBody) {
+	sb := latest.Copy()
+	sb.Index, sb.GenesisID = latest.Index+1, latest.SkipChainID()
+	sb.BackLinkIDs = []skipchain.SkipBlockID{latest.Hash}
+	ctx := Context{Index: sb.Index, SkipchainID: sb.SkipChainID(),
+		Timestamp: time.Now().Unix(), epochSeed: s.service().epochSeed(latest)}
+	cs := s.service().getChain(sb.SkipChainID())
+	cs.writeMu.Lock()
+	mr, ctsOK, scs, receipts, err := s.service().createStateChanges(cs.cdb.coll, ctx, cts)
+	cs.writeMu.Unlock()
+	require.Nil(t, err)
+	body := &DataBody{Transactions: ctsOK, Receipts: receipts}
+	sb.Data, err = network.Marshal(&DataHeader{
+		CollectionRoot:        mr,
+		ClientTransactionHash: ctsOK.Hash(),
+		StateChangesHash:      scs.Hash(),
+		Timestamp:             ctx.Timestamp,
+		ReceiptsRoot:          receiptsRoot(body.Receipts),
+		Contracts:             usedContracts(receipts),
+	})
+	require.Nil(t, err)
+	h := sha256.Sum256(sb.Data)
+	for _, service := range s.services {
+		service.getChain(sb.SkipChainID()).setProposal(&proposeBlock{
+			SkipChainID: sb.SkipChainID(), DataHash: h[:], Body: *body})
+	}
+	return sb, body
+}
+
 func closeQueues(local *onet.LocalTest) {
 	for _, server := range local.Servers {
 		services := local.GetServices([]*onet.Server{server}, omniledgerID)
@@ -0,0 +1,418 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dedis/protobuf"
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/kyber.v2/sign/schnorr"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+// A sharded ledger consists of an identity chain and the skipchains of the
+// shards:
+//   1. the identity chain is an omniledger skipchain with all nodes, whose
+//   config records the shards in a ShardConfig
+//   2. the nodes are assigned to the shards using the seed of the current
+//   epoch of the identity chain, and every shard runs its own skipchain and
+//   collection
+//   3. every key belongs to the shard given by ShardIndex, so a client sends
+//   its transactions and proof requests to the leader of that shard
+
+// ShardConfig is stored in the config of an identity chain and holds the
+// shards of the ledger.
+type ShardConfig struct {
+	// Epoch is the epoch of the identity chain in which the nodes have been
+	// assigned to the shards.
+	Epoch uint64
+	// Seed is the randomness the nodes have been assigned with.
+	Seed []byte
+	// Roster holds all nodes that are assigned to the shards.
+	Roster *onet.Roster
+	// Shards holds the skipchain and the roster of every shard.
+	Shards []Shard
+}
+
+// Shard is one skipchain of a sharded ledger.
+type Shard struct {
+	// ID is the ID of the skipchain of the shard.
+	ID skipchain.SkipBlockID
+	// Roster holds the nodes assigned to the shard. Its first node is the
+	// leader.
+	Roster *onet.Roster
+}
+
+// ShardIndex returns the shard that stores the key, if there are n shards.
+func ShardIndex(key []byte, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	hash := sha256.Sum256(key)
+	return int(binary.BigEndian.Uint64(hash[:8]) % uint64(n))
+}
+
+// ShardOf returns the shard storing the key.
+func (sc ShardConfig) ShardOf(key []byte) int {
+	return ShardIndex(key, len(sc.Shards))
+}
+
+// TransactionShard returns the shard that the transaction must be sent to.
+// All objects of the transaction, including the coin accounts, must be
+// stored on the same shard.
+func (sc ShardConfig) TransactionShard(tx ClientTransaction) (int, error) {
+	if len(sc.Shards) == 0 {
+		return 0, errors.New("no shards")
+	}
+	shard := -1
+	check := func(oid ObjectID) error {
+		i := sc.ShardOf(oid.Slice())
+		if shard >= 0 && i != shard {
+			return errors.New("transaction spans several shards")
+		}
+		shard = i
+		return nil
+	}
+	for _, instr := range tx.Instructions {
+		if err := check(instr.ObjectID); err != nil {
+			return 0, err
+		}
+		for _, in := range instr.Coins {
+			if err := check(in.Account); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if shard < 0 {
+		return 0, errors.New("no instructions")
+	}
+	return shard, nil
+}
+
+// verify makes sure that the shards have been assigned from the seed.
+func (sc ShardConfig) verify() error {
+	rosters, err := assignShards(sc.Roster, nil, sc.Seed, len(sc.Shards))
+	if err != nil {
+		return err
+	}
+	for i, shard := range sc.Shards {
+		if shard.ID.IsNull() {
+			return fmt.Errorf("shard %d has no skipchain", i)
+		}
+		if shard.Roster == nil || !rosterEqual(shard.Roster, rosters[i]) {
+			return fmt.Errorf("shard %d has the wrong roster", i)
+		}
+	}
+	return nil
+}
+
+// reassign assigns the nodes to the shards anew for the given epoch. As there
+// is no view-change yet, the leaders of the shards stay the same.
+func (sc *ShardConfig) reassign(epoch uint64, seed []byte) error {
+	leaders := make([]*network.ServerIdentity, len(sc.Shards))
+	for i, shard := range sc.Shards {
+		if shard.Roster == nil || len(shard.Roster.List) == 0 {
+			return fmt.Errorf("shard %d has no roster", i)
+		}
+		leaders[i] = shard.Roster.List[0]
+	}
+	rosters, err := assignShards(sc.Roster, leaders, seed, len(sc.Shards))
+	if err != nil {
+		return err
+	}
+	for i := range sc.Shards {
+		sc.Shards[i].Roster = rosters[i]
+	}
+	sc.Epoch, sc.Seed = epoch, seed
+	return nil
+}
+
+// assignShards assigns the nodes of the roster to n shards. The nodes are
+// ordered by the hash of the seed and their public key, and dealt to the
+// shards one after the other. If leaders is given, the leaders start the
+// rosters of their shards and only the other nodes are dealt.
+func assignShards(roster *onet.Roster, leaders []*network.ServerIdentity, seed []byte, n int) ([]*onet.Roster, error) {
+	if roster == nil || n <= 0 || len(roster.List) < n {
+		return nil, errors.New("not enough nodes for the shards")
+	}
+	if leaders != nil && len(leaders) != n {
+		return nil, errors.New("every shard needs a leader")
+	}
+	isLeader := func(si *network.ServerIdentity) bool {
+		for _, l := range leaders {
+			if l.Equal(si) {
+				return true
+			}
+		}
+		return false
+	}
+
+	type node struct {
+		si   *network.ServerIdentity
+		hash []byte
+	}
+	var nodes []node
+	for _, si := range roster.List {
+		if isLeader(si) {
+			continue
+		}
+		pub, err := si.Public.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(append(append([]byte{}, seed...), pub...))
+		nodes = append(nodes, node{si, hash[:]})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(nodes[i].hash, nodes[j].hash) < 0
+	})
+
+	lists := make([][]*network.ServerIdentity, n)
+	for i, l := range leaders {
+		lists[i] = []*network.ServerIdentity{l}
+	}
+	for i, nd := range nodes {
+		lists[i%n] = append(lists[i%n], nd.si)
+	}
+	rosters := make([]*onet.Roster, n)
+	for i, list := range lists {
+		rosters[i] = onet.NewRoster(list)
+	}
+	return rosters, nil
+}
+
+func rosterEqual(a, b *onet.Roster) bool {
+	if len(a.List) != len(b.List) {
+		return false
+	}
+	for i := range a.List {
+		if !a.List[i].Equal(b.List[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	shardGenesisRequestID = network.RegisterMessage(&shardGenesisRequest{})
+	shardGenesisReplyID   = network.RegisterMessage(&shardGenesisReply{})
+)
+
+// shardGenesisRequest asks the leader of a shard to create its skipchain.
+// It is signed by the leader of the identity chain, see shardGenesisDigest.
+type shardGenesisRequest struct {
+	Nonce     Nonce
+	Genesis   CreateGenesisBlock
+	Shards    int
+	Signature []byte
+}
+
+// shardGenesisReply holds the genesis block of the skipchain of the shard.
+type shardGenesisReply struct {
+	Nonce     Nonce
+	Skipblock *skipchain.SkipBlock
+	Error     string
+}
+
+// registerShards registers the handlers of the messages used to create the
+// shards.
+func (s *Service) registerShards() {
+	s.RegisterProcessorFunc(shardGenesisRequestID, s.handleShardGenesisRequest)
+	s.RegisterProcessorFunc(shardGenesisReplyID, s.handleSyncReply)
+}
+
+// CreateShardedLedger sets up an identity chain with all nodes of the roster.
+// The nodes are assigned to the shards using the hash of its genesis block,
+// then the leader of every shard creates the skipchain of the shard, and the
+// shards are recorded in the config of the identity chain. It must be sent to
+// the first node of the roster, which leads the identity chain.
+func (s *Service) CreateShardedLedger(req *CreateShardedLedger) (*CreateShardedLedgerResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, fmt.Errorf("version mismatch - got %d but need %d", req.Version, CurrentVersion)
+	}
+	if req.Shards <= 0 || len(req.Roster.List) < req.Shards {
+		return nil, errors.New("not enough nodes for the shards")
+	}
+	if !req.Roster.List[0].Equal(s.ServerIdentity()) {
+		return nil, errors.New("only the first node of the roster can create a sharded ledger")
+	}
+	epochs := req.Epochs
+	if epochs.Length > 0 && epochs.RosterSize == 0 {
+		epochs.RosterSize = len(req.Roster.List)
+	}
+	identity, err := s.CreateGenesisBlock(&CreateGenesisBlock{
+		Version:       CurrentVersion,
+		Roster:        req.Roster,
+		GenesisDarc:   req.GenesisDarc,
+		BlockInterval: req.BlockInterval,
+		RewardAccount: req.RewardAccount,
+		Epochs:        epochs,
+		Limits:        req.Limits,
+	})
+	if err != nil {
+		return nil, err
+	}
+	id := identity.Skipblock.SkipChainID()
+
+	shards := ShardConfig{
+		Seed:   s.epochSeed(identity.Skipblock),
+		Roster: &req.Roster,
+	}
+	rosters, err := assignShards(shards.Roster, nil, shards.Seed, req.Shards)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range rosters {
+		sb, err := s.requestShardGenesis(r.List[0], req.Shards, &CreateGenesisBlock{
+			Version:       CurrentVersion,
+			Roster:        *r,
+			GenesisDarc:   req.GenesisDarc,
+			BlockInterval: req.BlockInterval,
+			RewardAccount: req.RewardAccount,
+			Identity:      id,
+			Shard:         i,
+			Limits:        req.Limits,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't create shard %d: %s", i, err)
+		}
+		shards.Shards = append(shards.Shards, Shard{ID: sb.SkipChainID(), Roster: r})
+	}
+
+	shardsBuf, err := protobuf.Encode(&shards)
+	if err != nil {
+		return nil, err
+	}
+	// The leader records the shards, so the transaction is not signed.
+	_, err = s.createNewBlock(id, nil, nil, ClientTransaction{
+		Instructions: []Instruction{{
+			ObjectID: ObjectID{DarcID: req.GenesisDarc.GetID(), InstanceID: OneNonce},
+			Index:    0,
+			Length:   1,
+			Invoke: &Invoke{
+				Command: CmdConfigShards,
+				Args:    Arguments{{Name: "shards", Value: shardsBuf}},
+			},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreateShardedLedgerResponse{
+		Version:  CurrentVersion,
+		Identity: identity.Skipblock,
+		Shards:   shards,
+	}, nil
+}
+
+func (s *Service) handleShardGenesisRequest(env *network.Envelope) {
+	req, ok := env.Msg.(*shardGenesisRequest)
+	if !ok {
+		return
+	}
+	reply := &shardGenesisReply{Nonce: req.Nonce}
+	var resp *CreateGenesisBlockResponse
+	err := s.verifyShardGenesis(req)
+	if err == nil {
+		resp, err = s.CreateGenesisBlock(&req.Genesis)
+	}
+	if err != nil {
+		log.Error(s.ServerIdentity(), "couldn't create shard:", err)
+		reply.Error = err.Error()
+	} else {
+		reply.Skipblock = resp.Skipblock
+	}
+	s.sendSyncReply(env.ServerIdentity, reply)
+}
+
+// shardGenesisDigest returns the hash of the request that is signed by the
+// leader of the identity chain. The rules of the darc are a map, so the darc
+// is hashed by its ID instead of its encoding.
+func shardGenesisDigest(req *shardGenesisRequest) ([]byte, error) {
+	genesis := req.Genesis
+	genesis.GenesisDarc = darc.Darc{}
+	buf, err := protobuf.Encode(&genesis)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(req.Nonce[:])
+	h.Write(req.Genesis.GenesisDarc.GetID())
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(req.Shards))
+	h.Write(b)
+	h.Write(buf)
+	return h.Sum(nil), nil
+}
+
+// verifyShardGenesis checks that the request has been signed by the leader of
+// the identity chain, and that the nodes of the shard, led by this node, have
+// been assigned with the seed of the genesis block of the identity chain.
+func (s *Service) verifyShardGenesis(req *shardGenesisRequest) error {
+	identity := s.db().GetByID(req.Genesis.Identity)
+	if identity == nil || identity.Index != 0 {
+		return errors.New("unknown identity chain")
+	}
+	digest, err := shardGenesisDigest(req)
+	if err != nil {
+		return err
+	}
+	err = schnorr.Verify(cothority.Suite, identity.Roster.List[0].Public, digest, req.Signature)
+	if err != nil {
+		return errors.New("request is not signed by the leader of the identity chain")
+	}
+	rosters, err := assignShards(identity.Roster, nil, s.epochSeed(identity), req.Shards)
+	if err != nil {
+		return err
+	}
+	if req.Genesis.Shard < 0 || req.Genesis.Shard >= len(rosters) {
+		return fmt.Errorf("shard %d doesn't exist", req.Genesis.Shard)
+	}
+	roster := rosters[req.Genesis.Shard]
+	if !rosterEqual(&req.Genesis.Roster, roster) || !roster.List[0].Equal(s.ServerIdentity()) {
+		return fmt.Errorf("shard %d has the wrong roster", req.Genesis.Shard)
+	}
+	return nil
+}
+
+// requestShardGenesis lets si create the skipchain of one of the shards.
+func (s *Service) requestShardGenesis(si *network.ServerIdentity, shards int, genesis *CreateGenesisBlock) (*skipchain.SkipBlock, error) {
+	if si.Equal(s.ServerIdentity()) {
+		resp, err := s.CreateGenesisBlock(genesis)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Skipblock, nil
+	}
+	nonce := GenNonce()
+	req := &shardGenesisRequest{Nonce: nonce, Genesis: *genesis, Shards: shards}
+	digest, err := shardGenesisDigest(req)
+	if err != nil {
+		return nil, err
+	}
+	req.Signature, err = schnorr.Sign(cothority.Suite, s.ServerIdentity().GetPrivate(), digest)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := s.syncRequest(si, nonce, req)
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := msg.(*shardGenesisReply)
+	if !ok {
+		return nil, errors.New("wrong type of reply")
+	}
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return reply.Skipblock, nil
+}
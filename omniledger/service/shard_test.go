@@ -0,0 +1,290 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/kyber.v2/sign/schnorr"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/network"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+func TestAssignShards(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, roster, _ := local.GenTree(7, false)
+
+	rosters, err := assignShards(roster, nil, []byte("seed"), 3)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(rosters))
+	seen := map[network.ServerIdentityID]bool{}
+	for _, r := range rosters {
+		require.True(t, len(r.List) == 2 || len(r.List) == 3)
+		for _, si := range r.List {
+			require.False(t, seen[si.ID])
+			seen[si.ID] = true
+		}
+	}
+	require.Equal(t, 7, len(seen))
+
+	// The assignment depends on the seed only.
+	again, err := assignShards(roster, nil, []byte("seed"), 3)
+	require.Nil(t, err)
+	for i := range rosters {
+		require.Equal(t, rosters[i].ID, again[i].ID)
+	}
+
+	// The leaders stay at the head of their shards.
+	leaders := []*network.ServerIdentity{rosters[0].List[0], rosters[1].List[0], rosters[2].List[0]}
+	other, err := assignShards(roster, leaders, []byte("other seed"), 3)
+	require.Nil(t, err)
+	for i := range other {
+		require.True(t, other[i].List[0].Equal(leaders[i]))
+	}
+
+	_, err = assignShards(roster, nil, []byte("seed"), 8)
+	require.NotNil(t, err)
+	_, err = assignShards(roster, leaders[:2], []byte("seed"), 3)
+	require.NotNil(t, err)
+}
+
+func TestShardConfig_TransactionShard(t *testing.T) {
+	sc := ShardConfig{Shards: make([]Shard, 4)}
+	darcID := darc.ID(ZeroNonce[:])
+	newOID := func(shard int) ObjectID {
+		for {
+			oid := ObjectID{DarcID: darcID, InstanceID: GenNonce()}
+			if sc.ShardOf(oid.Slice()) == shard {
+				return oid
+			}
+		}
+	}
+
+	a, b := newOID(1), newOID(1)
+	tx := ClientTransaction{Instructions: []Instruction{
+		{ObjectID: a},
+		{ObjectID: b, Coins: []CoinInput{{Account: newOID(1)}}},
+	}}
+	shard, err := sc.TransactionShard(tx)
+	require.Nil(t, err)
+	require.Equal(t, 1, shard)
+
+	tx.Instructions[1].Coins[0].Account = newOID(2)
+	_, err = sc.TransactionShard(tx)
+	require.NotNil(t, err)
+
+	_, err = sc.TransactionShard(ClientTransaction{})
+	require.NotNil(t, err)
+}
+
+func TestService_ShardedLedger(t *testing.T) {
+	sl := newShardedLedger(t, nil, EpochConfig{Length: 2}, "Spawn_dummy")
+	defer sl.local.CloseAll()
+	defer closeQueues(sl.local)
+	id := sl.identity
+	require.Equal(t, 2, len(sl.shards.Shards))
+
+	// The shards are recorded in the identity chain.
+	config, err := sl.services[0].loadConfig(id)
+	require.Nil(t, err)
+	require.NotNil(t, config.Shards)
+	require.Nil(t, config.Shards.verify())
+	for i, shard := range config.Shards.Shards {
+		require.True(t, shard.ID.Equal(sl.shards.Shards[i].ID))
+		shardConfig, err := sl.leader(i).loadConfig(shard.ID)
+		require.Nil(t, err)
+		require.True(t, shardConfig.Identity.Equal(id))
+		require.Equal(t, i, shardConfig.Shard)
+	}
+
+	// A transaction is stored in the shard of its key only.
+	tx, err := createOneClientTx(sl.darcID, dummyKind, []byte("value"), sl.signer)
+	require.Nil(t, err)
+	i, err := config.Shards.TransactionShard(tx)
+	require.Nil(t, err)
+	sl.send(t, i, tx)
+	key := tx.Instructions[0].ObjectID
+	proof := sl.proof(t, i, key)
+	require.True(t, proof.InclusionProof.Match())
+	proof = sl.proof(t, 1-i, key)
+	require.False(t, proof.InclusionProof.Match())
+
+	// The block of the shard records the block of the identity chain whose
+	// shards it uses.
+	db := sl.leader(i).db()
+	latest, err := db.GetLatest(db.GetByID(config.Shards.Shards[i].ID))
+	require.Nil(t, err)
+	header, err := decodeHeader(latest)
+	require.Nil(t, err)
+	require.True(t, db.GetByID(header.IdentityBlock).SkipChainID().Equal(id))
+	identity, err := sl.leader(i).identityConfig(id, header.IdentityBlock)
+	require.Nil(t, err)
+	require.NotNil(t, identity.Shards)
+	_, err = sl.leader(i).identityConfig(id, latest.Hash)
+	require.NotNil(t, err)
+	// Without skipchain, the identity chain cannot be loaded.
+	_, err = (&Service{}).identityConfig(id, header.IdentityBlock)
+	require.NotNil(t, err)
+
+	// The second block of the identity chain starts a new epoch, which
+	// assigns the nodes anew, keeping the leaders.
+	tx, err = createOneClientTx(sl.darcID, dummyKind, []byte("identity"), sl.signer)
+	require.Nil(t, err)
+	_, err = sl.services[0].AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: id,
+		Transaction: tx,
+	})
+	require.Nil(t, err)
+	for j := 0; j < 20; j++ {
+		time.Sleep(2 * testInterval)
+		if _, index := sl.services[0].getCollection(id).latestBlock(); index >= 2 {
+			break
+		}
+	}
+	config, err = sl.services[0].loadConfig(id)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), config.Shards.Epoch)
+	for j, s := range config.Shards.Shards {
+		require.True(t, s.Roster.List[0].Equal(sl.shards.Shards[j].Roster.List[0]))
+	}
+}
+
+func TestService_ShardGenesisRequest(t *testing.T) {
+	sl := newShardedLedger(t, nil, EpochConfig{}, "Spawn_dummy")
+	defer sl.local.CloseAll()
+	defer closeQueues(sl.local)
+
+	shard := 0
+	if sl.leader(shard) == sl.services[0] {
+		shard = 1
+	}
+	req := &shardGenesisRequest{
+		Nonce: GenNonce(),
+		Genesis: CreateGenesisBlock{
+			Version:  CurrentVersion,
+			Roster:   *sl.shards.Shards[shard].Roster,
+			Identity: sl.identity,
+			Shard:    shard,
+		},
+		Shards: 2,
+	}
+	sign := func(h *onet.Server) {
+		digest, err := shardGenesisDigest(req)
+		require.Nil(t, err)
+		req.Signature, err = schnorr.Sign(tSuite, sl.local.GetPrivate(h), digest)
+		require.Nil(t, err)
+	}
+	leader := sl.leader(shard)
+
+	// Only the leader of the identity chain can request a shard.
+	sign(sl.hosts[0])
+	require.Nil(t, leader.verifyShardGenesis(req))
+	for _, h := range sl.hosts[1:] {
+		sign(h)
+		require.NotNil(t, leader.verifyShardGenesis(req))
+	}
+
+	// The shard must be led by the node, with the roster it was assigned.
+	sign(sl.hosts[0])
+	require.NotNil(t, sl.leader(1-shard).verifyShardGenesis(req))
+	req.Genesis.Shard = 1 - shard
+	sign(sl.hosts[0])
+	require.NotNil(t, leader.verifyShardGenesis(req))
+	req.Genesis.Shard, req.Shards = shard, 3
+	sign(sl.hosts[0])
+	require.NotNil(t, leader.verifyShardGenesis(req))
+}
+
+// shardedLedger is a sharded ledger of four nodes and two shards.
+type shardedLedger struct {
+	local    *onet.LocalTest
+	hosts    []*onet.Server
+	services []*Service
+	signer   *darc.Signer
+	darcID   darc.ID
+	identity skipchain.SkipBlockID
+	shards   ShardConfig
+}
+
+func newShardedLedger(t *testing.T, reward *ObjectID, epochs EpochConfig, rules ...string) *shardedLedger {
+	sl := &shardedLedger{
+		local:  onet.NewTCPTest(tSuite),
+		signer: darc.NewSignerEd25519(nil, nil),
+	}
+	hosts, roster, _ := sl.local.GenTree(4, true)
+	sl.hosts = hosts
+	for _, sv := range sl.local.GetServices(hosts, omniledgerID) {
+		sl.services = append(sl.services, sv.(*Service))
+	}
+	registerDummy(sl.services)
+
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, roster, rules, sl.signer.Identity())
+	require.Nil(t, err)
+	sl.darcID = genesisMsg.GenesisDarc.GetBaseID()
+	resp, err := sl.services[0].CreateShardedLedger(&CreateShardedLedger{
+		Version:       CurrentVersion,
+		Roster:        *roster,
+		GenesisDarc:   genesisMsg.GenesisDarc,
+		BlockInterval: testInterval,
+		RewardAccount: reward,
+		Shards:        2,
+		Epochs:        epochs,
+	})
+	require.Nil(t, err)
+	sl.identity = resp.Identity.SkipChainID()
+	sl.shards = resp.Shards
+	return sl
+}
+
+// leader returns the service of the leader of the shard.
+func (sl *shardedLedger) leader(shard int) *Service {
+	for i, h := range sl.hosts {
+		if h.ServerIdentity.Equal(sl.shards.Shards[shard].Roster.List[0]) {
+			return sl.services[i]
+		}
+	}
+	return nil
+}
+
+// newOID returns a new object stored on the shard.
+func (sl *shardedLedger) newOID(shard int) ObjectID {
+	for {
+		oid := ObjectID{DarcID: sl.darcID, InstanceID: GenNonce()}
+		if sl.shards.ShardOf(oid.Slice()) == shard {
+			return oid
+		}
+	}
+}
+
+// send adds the transaction to the shard and waits for the next block.
+func (sl *shardedLedger) send(t *testing.T, shard int, ct ClientTransaction) {
+	id := sl.shards.Shards[shard].ID
+	leader := sl.leader(shard)
+	_, index := leader.getCollection(id).latestBlock()
+	_, err := leader.AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: id,
+		Transaction: ct,
+	})
+	require.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		time.Sleep(2 * testInterval)
+		if _, latest := leader.getCollection(id).latestBlock(); latest > index {
+			return
+		}
+	}
+	require.Fail(t, "no new block")
+}
+
+// proof returns the verified proof of the object from the shard.
+func (sl *shardedLedger) proof(t *testing.T, shard int, oid ObjectID) Proof {
+	id := sl.shards.Shards[shard].ID
+	resp, err := sl.leader(shard).GetProof(&GetProof{Version: CurrentVersion, ID: id, Key: oid.Slice()})
+	require.Nil(t, err)
+	require.Nil(t, resp.Proof.Verify(id))
+	return resp.Proof
+}
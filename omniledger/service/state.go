@@ -0,0 +1,154 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/dedis/protobuf"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+// chainState holds what the service keeps for one skipchain: its collection,
+// the queue of the transactions for the next block and its configuration.
+//
+// All changes to the collection - creating a new block, applying a block and
+// synchronising with other nodes - hold writeMu. Everybody else reads the
+// collection through a view of the latest applied block, which needs no lock
+// and never sees the changes of a block that is being created.
+type chainState struct {
+	id  skipchain.SkipBlockID
+	cdb *collectionDB
+	// ready is closed once cdb is loaded and corresponds to the latest
+	// block.
+	ready chan struct{}
+
+	// writeMu serialises all changes to cdb.
+	writeMu sync.Mutex
+
+	// mu protects queue, config and proposal
+	mu sync.Mutex
+	// queue receives the transactions for the next block. It is nil as
+	// long as no queue worker is running for this skipchain.
+	queue chan ClientTransaction
+	// config is the configuration as of the block configBlock.
+	config      *Config
+	configBlock skipchain.SkipBlockID
+	// proposal is the last body proposed by the leader, which is executed
+	// before the block is signed.
+	proposal *proposeBlock
+}
+
+func newChainState(id skipchain.SkipBlockID) *chainState {
+	return &chainState{
+		id:    id,
+		ready: make(chan struct{}),
+	}
+}
+
+// getQueue returns the queue of the skipchain, or nil if there is none.
+func (cs *chainState) getQueue() chan ClientTransaction {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.queue
+}
+
+// setQueue sets the queue of the skipchain.
+func (cs *chainState) setQueue(queue chan ClientTransaction) {
+	cs.mu.Lock()
+	cs.queue = queue
+	cs.mu.Unlock()
+}
+
+// setProposal keeps the body proposed for the next block.
+func (cs *chainState) setProposal(pb *proposeBlock) {
+	cs.mu.Lock()
+	cs.proposal = pb
+	cs.mu.Unlock()
+}
+
+// getProposal returns the body proposed for the block whose Data has the
+// given hash, or nil if there is none.
+func (cs *chainState) getProposal(dataHash []byte) *proposeBlock {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.proposal == nil || !bytes.Equal(cs.proposal.DataHash, dataHash) {
+		return nil
+	}
+	return cs.proposal
+}
+
+// getConfig returns the configuration of the skipchain as of the latest
+// applied block. It is only read from the collection if a new block has been
+// applied since the last call.
+func (cs *chainState) getConfig() (*Config, error) {
+	id, index := cs.cdb.latestBlock()
+	cs.mu.Lock()
+	if cs.config != nil && index >= 0 && cs.configBlock.Equal(id) {
+		config := cs.config
+		cs.mu.Unlock()
+		return config, nil
+	}
+	cs.mu.Unlock()
+
+	coll, id, index, err := cs.cdb.view()
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadConfig(coll)
+	if err != nil {
+		return nil, err
+	}
+	if index >= 0 {
+		cs.mu.Lock()
+		cs.config, cs.configBlock = config, id
+		cs.mu.Unlock()
+	}
+	return config, nil
+}
+
+// loadConfigID returns the ObjectID of the configuration stored in the
+// collection.
+func loadConfigID(coll collection.Collection) (ObjectID, error) {
+	// Find the genesis-darc ID.
+	val, contract, err := getValueContract(coll, GenesisReferenceID.Slice())
+	if err != nil {
+		return ObjectID{}, err
+	}
+	if string(contract) != ContractConfigID {
+		return ObjectID{}, errors.New("did not get " + ContractConfigID)
+	}
+	if len(val) != 32 {
+		return ObjectID{}, errors.New("value has a invalid length")
+	}
+	// Use the genesis-darc ID to create the config key.
+	return ObjectID{
+		DarcID:     darc.ID(val),
+		InstanceID: OneNonce,
+	}, nil
+}
+
+// loadConfig reads the configuration stored in the collection.
+func loadConfig(coll collection.Collection) (*Config, error) {
+	configID, err := loadConfigID(coll)
+	if err != nil {
+		return nil, err
+	}
+	val, contract, err := getValueContract(coll, configID.Slice())
+	if err != nil {
+		return nil, err
+	}
+	if string(contract) != ContractConfigID {
+		return nil, errors.New("did not get " + ContractConfigID)
+	}
+	config := Config{}
+	err = protobuf.DecodeWithConstructors(val, &config, network.DefaultConstructors(cothority.Suite))
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
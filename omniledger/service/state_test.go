@@ -0,0 +1,96 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+func TestService_ConcurrentClients(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	// A second skipchain with another leader, so that the queues of both
+	// chains create blocks at the same time.
+	roster := onet.NewRoster([]*network.ServerIdentity{s.roster.List[1], s.roster.List[0]})
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, roster, []string{"Spawn_dummy"}, s.signer.Identity())
+	require.Nil(t, err)
+	genesisMsg.BlockInterval = s.interval
+	resp, err := s.services[1].CreateGenesisBlock(genesisMsg)
+	require.Nil(t, err)
+	chains := []skipchain.SkipBlockID{s.sb.SkipChainID(), resp.Skipblock.SkipChainID()}
+
+	clients := 20
+	errs := make(chan error, clients)
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			errs <- concurrentClient(s, chains[c%2], genesisMsg, c)
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+}
+
+// concurrentClient adds one transaction to the skipchain, whose leader is
+// the node c%2, and asks all nodes for proofs until the key is stored.
+func concurrentClient(s *ser, id skipchain.SkipBlockID, genesisMsg *CreateGenesisBlock, c int) error {
+	darcID := s.darc.GetBaseID()
+	if !id.Equal(s.sb.SkipChainID()) {
+		darcID = genesisMsg.GenesisDarc.GetBaseID()
+	}
+	value := []byte(fmt.Sprintf("value%d", c))
+	tx, err := createOneClientTx(darcID, dummyKind, value, s.signer)
+	if err != nil {
+		return err
+	}
+	// Only the leader of the skipchain accepts transactions.
+	_, err = s.services[c%2].AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: id,
+		Transaction: tx,
+	})
+	if err != nil {
+		return err
+	}
+
+	key := tx.Instructions[0].ObjectID.Slice()
+	for i := 0; i < 200; i++ {
+		rep, err := s.services[i%len(s.services)].GetProof(&GetProof{
+			Version: CurrentVersion,
+			ID:      id,
+			Key:     key,
+		})
+		if err != nil {
+			return err
+		}
+		if err = rep.Proof.Verify(id); err != nil {
+			return err
+		}
+		if rep.Proof.InclusionProof.Match() {
+			_, values, err := rep.Proof.KeyValue()
+			if err != nil {
+				return err
+			}
+			if string(values[0]) != string(value) {
+				return errors.New("wrong value in proof")
+			}
+			return nil
+		}
+		time.Sleep(s.interval / 2)
+	}
+	return fmt.Errorf("client %d didn't get its proof in time", c)
+}
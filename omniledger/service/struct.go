@@ -1,15 +1,21 @@
 package service
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/dedis/protobuf"
 	"student_18_byzcoin/omniledger/collection"
 	"student_18_byzcoin/omniledger/darc"
 	// "github.com/dedis/student_18_omniledger/omniledger/collection"
 	// "github.com/dedis/student_18_omniledger/omniledger/darc"
+	"gopkg.in/dedis/cothority.v2"
 	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2/log"
 	"gopkg.in/dedis/onet.v2/network"
 )
 
@@ -18,10 +24,54 @@ func init() {
 		DataHeader{}, DataBody{})
 }
 
+// collectionDB holds the collection of one skipchain. It uses the following
+// buckets:
+//   - bucketName: every key of the collection, with its value and contract
+//   - bucketName_nodes: the nodes of the collection, loaded when needed
+//   - bucketName_meta: the version of the layout, the root of the collection,
+//   the roots kept in the store and the latest block applied to it
+//   - bucketName_bodies: the DataBody of every block, needed to replay the
+//   skipchain
+//   - bucketName_index: the indexes of the transactions, see index.go
+// Only the bodies and the indexes are kept if the state is reset.
+//
+// coll is changed while blocks are created and applied, so all other reads go
+// through view, which only sees the state of the latest applied block. The
+// nodes replaced by coll are removed from the store, except for the nodes of
+// the last keptRoots stored states, so views of these states can still be
+// read.
 type collectionDB struct {
 	db         *bolt.DB
 	bucketName []byte
 	coll       collection.Collection
+	store      *collection.BoltStore
+}
+
+// collectionDBVersion is the version of the on-disk layout of collectionDB.
+// Version 0 stored the contract of a key under key+"kind" in bucketName.
+// Version 1 didn't count the references to the nodes, so they were never
+// removed.
+const collectionDBVersion = 2
+
+// keptRoots is the number of the latest stored states whose nodes are kept in
+// the store. It bounds the size of the store, and lets views and snapshots of
+// a state be read while the next blocks are applied.
+var keptRoots = 16
+
+// Keys used in the meta bucket.
+var (
+	metaVersion = []byte("version")
+	metaRoot    = []byte("root")
+	metaRoots   = []byte("roots")
+	metaBlock   = []byte("block")
+	metaIndex   = []byte("index")
+	metaIndexed = []byte("indexed")
+)
+
+// storedValue is how a key of the collection is stored in bucketName.
+type storedValue struct {
+	Value      []byte
+	ContractID []byte
 }
 
 // OmniLedgerContract is the type signature of the class functions
@@ -30,45 +80,405 @@ type collectionDB struct {
 // which is to be modified, we pass it as a pointer here.
 type OmniLedgerContract func(cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error)
 
-// newCollectionDB initialises a structure and reads all key/value pairs to store
-// it in the collection.
+// ContractWithContext is the type signature of contracts that also need to
+// know where they are executed. The Context is given by value, so a contract
+// cannot change it for the following instructions.
+type ContractWithContext func(ctx Context, cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error)
+
+// WithContext adapts the contract to the ContractWithContext signature, the
+// Context is ignored.
+func (f OmniLedgerContract) WithContext() ContractWithContext {
+	return func(ctx Context, cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		return f(cdb, tx, c)
+	}
+}
+
+// Context describes the block an instruction is executed in and who signed
+// the instruction. Everything in it is the same on all nodes executing the
+// block, so contracts can rely on it and stay deterministic.
+type Context struct {
+	// SkipchainID is the ID of the skipchain, it is nil while the genesis
+	// block is created.
+	SkipchainID skipchain.SkipBlockID
+	// Index is the index of the block.
+	Index int
+	// Timestamp is the timestamp of the block as stored in its header,
+	// not the time of the node executing the instruction.
+	Timestamp int64
+	// Signers holds the identities whose signatures on the instruction are
+	// valid. Whether they are allowed to sign is checked by the darcs
+	// before the block is created.
+	Signers []darc.Identity
+
+	// depth is the number of calls that led to the current contract.
+	depth int
+	// leader is set while the leader creates a block.
+	leader bool
+	// call executes a cross-contract call, it is set by the service.
+	call func(ctx Context, instr Instruction, coins []Coin) ([]StateChange, []Coin, error)
+	// emit records an event of the running contract, it is set by the
+	// service.
+	emit func(ev Event) error
+	// epochSeed is the seed of an epoch starting with the block, it is
+	// derived from the previous block by the service.
+	epochSeed []byte
+	// identityBlock is the block of the identity chain stored in the
+	// header, if the skipchain is a shard.
+	identityBlock skipchain.SkipBlockID
+	// shards are the shards as of identityBlock, and shard is the index of
+	// the skipchain in them. They are only loaded if the block holds
+	// cross-shard transactions.
+	shards *ShardConfig
+	shard  int
+}
+
+// MaxCallDepth is the maximum number of nested calls from one contract to
+// another.
+const MaxCallDepth = 8
+
+// Call lets a contract invoke another contract within the same
+// ClientTransaction. The instruction is executed by the contract of its
+// object, after its darc has been checked against the Signers of the calling
+// instruction, so a contract can only do what its signers may do. The coins
+// are handed to the callee, which returns what is left of them.
+//
+// The StateChanges of the callee are applied at once, so the caller sees them
+// in the collection, and they are part of the ClientTransaction: if the
+// caller or any later instruction fails, they are reverted together. If the
+// call itself fails, its StateChanges and those of the calls it made are
+// reverted at once, so the caller can go on without it. The StateChanges
+// returned by the caller are applied after those of its callees.
+func (ctx Context) Call(instr Instruction, coins []Coin) ([]StateChange, []Coin, error) {
+	if ctx.call == nil {
+		return nil, nil, errors.New("calls are only possible while executing a transaction")
+	}
+	if ctx.depth >= MaxCallDepth {
+		return nil, nil, fmt.Errorf("calls are nested more than %d times", MaxCallDepth)
+	}
+	if len(instr.Coins) > 0 {
+		return nil, nil, errors.New("a call cannot take coins from accounts")
+	}
+	return ctx.call(ctx, instr, coins)
+}
+
+// Emit records an event with the given topic and data. The event is stored in
+// the Receipt of the ClientTransaction if it is accepted. The bytes of the
+// topic and data count against the limits of the instruction.
+func (ctx Context) Emit(topic string, data []byte) error {
+	if ctx.emit == nil {
+		return errors.New("events can only be emitted while executing a transaction")
+	}
+	return ctx.emit(Event{Topic: topic, Data: data})
+}
+
+// newCollectionDB initialises a structure and loads the root of the stored
+// collection. The other nodes are only loaded when they are needed. If the
+// layout on disk is from an older version, the collection is recreated from
+// all key/value pairs.
 func newCollectionDB(db *bolt.DB, name []byte) *collectionDB {
 	c := &collectionDB{
 		db:         db,
 		bucketName: name,
-		coll:       collection.New(collection.Data{}, collection.Data{}),
 	}
-	c.db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucket(name)
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for _, n := range [][]byte{name, c.nodesBucket(), c.metaBucket(),
+			c.bodiesBucket(), c.indexBucket()} {
+			if _, err := tx.CreateBucketIfNotExists(n); err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
 		}
 		return nil
 	})
-	c.loadAll()
-	// TODO: Check the merkle tree root.
+	if err != nil {
+		log.Error(err)
+	}
+	if err = c.load(); err != nil {
+		log.Error("couldn't load collection, recreating it:", err)
+		if err = c.reset(); err != nil {
+			log.Error("couldn't reset collection:", err)
+		}
+	}
 	return c
 }
 
-func (c *collectionDB) loadAll() {
+func (c *collectionDB) nodesBucket() []byte {
+	return append(append([]byte{}, c.bucketName...), []byte("_nodes")...)
+}
+
+func (c *collectionDB) metaBucket() []byte {
+	return append(append([]byte{}, c.bucketName...), []byte("_meta")...)
+}
+
+func (c *collectionDB) bodiesBucket() []byte {
+	return append(append([]byte{}, c.bucketName...), []byte("_bodies")...)
+}
+
+// load reads the stored collection. A collection with an older layout is
+// migrated.
+func (c *collectionDB) load() error {
+	var version int64
+	var root []byte
 	c.db.View(func(tx *bolt.Tx) error {
-		// Assume bucket exists and has keys
-		b := tx.Bucket([]byte(c.bucketName))
-		cur := b.Cursor()
+		meta := tx.Bucket(c.metaBucket())
+		if v := meta.Get(metaVersion); v != nil {
+			version, _ = binary.Varint(v)
+		}
+		if r := meta.Get(metaRoot); r != nil {
+			root = append([]byte{}, r...)
+		}
+		return nil
+	})
+	switch version {
+	case collectionDBVersion:
+		store, err := collection.NewBoltStore(c.db, c.nodesBucket())
+		if err != nil {
+			return err
+		}
+		c.store = store
+		c.coll, err = collection.NewFromStore(store, root,
+			collection.Data{}, collection.Data{})
+		return err
+	case 0, 1:
+		return c.migrate(version, root)
+	default:
+		return fmt.Errorf("unknown version %d of collection", version)
+	}
+}
 
+// migrate converts an older layout to the current version, by storing all
+// key/value pairs anew. In version 0, the contract of key k was stored under
+// k+"kind". In version 1, the keys were stored like now, but the nodes have
+// to be written again to count their references. The latest block applied
+// and the indexed blocks are kept, so the collection must have the same root
+// as before.
+func (c *collectionDB) migrate(version int64, root []byte) error {
+	var scs []StateChange
+	meta := make(map[string][]byte)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(c.bucketName)
+		cur := b.Cursor()
 		for k, v := cur.First(); k != nil; k, v = cur.Next() {
-			sig := b.Get(append(k, []byte("sig")...))
-			ck := make([]byte, len(k))
-			vk := make([]byte, len(v))
-			csig := make([]byte, len(sig))
-			copy(ck, k)
-			copy(vk, v)
-			copy(csig, sig)
-			c.coll.Add(ck, vk, csig)
+			if version == 1 {
+				var stored storedValue
+				if err := protobuf.Decode(append([]byte{}, v...), &stored); err != nil {
+					return err
+				}
+				scs = append(scs, StateChange{
+					StateAction: Create,
+					ObjectID:    append([]byte{}, k...),
+					Value:       stored.Value,
+					ContractID:  stored.ContractID,
+				})
+				continue
+			}
+			kind := b.Get(append(append([]byte{}, k...), []byte("kind")...))
+			if kind == nil {
+				// This is either a contract or a value without
+				// a contract, which cannot be used anyway.
+				continue
+			}
+			scs = append(scs, StateChange{
+				StateAction: Create,
+				ObjectID:    append([]byte{}, k...),
+				Value:       append([]byte{}, v...),
+				ContractID:  append([]byte{}, kind...),
+			})
+		}
+		if version == 1 {
+			m := tx.Bucket(c.metaBucket())
+			for _, k := range [][]byte{metaBlock, metaIndex, metaIndexed} {
+				if v := m.Get(k); v != nil {
+					meta[string(k)] = append([]byte{}, v...)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = c.reset(); err != nil {
+		return err
+	}
+	if len(scs) > 0 {
+		log.Lvlf1("Migrating %d keys of %s to version %d", len(scs),
+			c.bucketName, collectionDBVersion)
+	}
+	if err = c.StoreAll(scs, nil); err != nil {
+		return err
+	}
+	if version == 0 {
+		return nil
+	}
+	if !bytes.Equal(c.coll.GetRoot(), root) {
+		return errors.New("migrated collection has another root")
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		m := tx.Bucket(c.metaBucket())
+		for k, v := range meta {
+			if err := m.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// reset removes all keys and nodes of the collection, but keeps the stored
+// bodies and indexes.
+func (c *collectionDB) reset() error {
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		for _, n := range [][]byte{c.bucketName, c.nodesBucket(), c.metaBucket()} {
+			if tx.Bucket(n) != nil {
+				if err := tx.DeleteBucket(n); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.CreateBucket(n); err != nil {
+				return err
+			}
+		}
+		version := make([]byte, 8)
+		binary.PutVarint(version, collectionDBVersion)
+		return tx.Bucket(c.metaBucket()).Put(metaVersion, version)
+	})
+	if err != nil {
+		return err
+	}
+	store, err := collection.NewBoltStore(c.db, c.nodesBucket())
+	if err != nil {
+		return err
+	}
+	c.store = store
+	c.coll, err = collection.NewFromStore(store, nil, collection.Data{}, collection.Data{})
+	if err != nil {
+		return err
+	}
+	root := c.coll.GetRoot()
+	if err = c.store.Pin(root); err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(c.metaBucket())
+		if err := meta.Put(metaRoot, root); err != nil {
+			return err
+		}
+		_, err := keepRoot(meta, root)
+		return err
+	})
+}
+
+// keepRoot adds root to the roots whose nodes are kept in the store, which
+// must already be pinned. It returns the roots that are not kept anymore and
+// must be unpinned.
+func keepRoot(meta *bolt.Bucket, root []byte) ([][]byte, error) {
+	roots := append(append([]byte{}, meta.Get(metaRoots)...), root...)
+	var dropped [][]byte
+	for len(roots) > keptRoots*sha256.Size {
+		dropped = append(dropped, roots[:sha256.Size])
+		roots = roots[sha256.Size:]
+	}
+	return dropped, meta.Put(metaRoots, roots)
+}
+
+// snapshot returns a collection with the given root that is independent of
+// the collection of c. Only the roots of the last keptRoots stored states can
+// be loaded.
+func (c *collectionDB) snapshot(root []byte) (collection.Collection, error) {
+	store, err := collection.NewBoltStore(c.db, c.nodesBucket())
+	if err != nil {
+		return collection.Collection{}, err
+	}
+	return collection.NewFromStore(store, root, collection.Data{}, collection.Data{})
+}
+
+// pin keeps the nodes of the state with the given root in the store until it
+// is unpinned, even once it is not one of the last keptRoots stored states
+// anymore.
+func (c *collectionDB) pin(root []byte) error {
+	store, err := collection.NewBoltStore(c.db, c.nodesBucket())
+	if err != nil {
+		return err
+	}
+	return store.Pin(root)
+}
+
+// unpin removes a pin added by pin.
+func (c *collectionDB) unpin(root []byte) error {
+	store, err := collection.NewBoltStore(c.db, c.nodesBucket())
+	if err != nil {
+		return err
+	}
+	return store.Unpin(root)
+}
+
+// latestBlock returns the ID and the index of the latest block applied to
+// the collection. If no block has been applied yet, the index is -1.
+func (c *collectionDB) latestBlock() (id skipchain.SkipBlockID, index int) {
+	_, id, index = c.latestState()
+	return
+}
+
+// latestState returns the root of the collection as it was last stored,
+// together with the latest block applied to it.
+func (c *collectionDB) latestState() (root []byte, id skipchain.SkipBlockID, index int) {
+	index = -1
+	c.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(c.metaBucket())
+		root = append([]byte{}, meta.Get(metaRoot)...)
+		if b := meta.Get(metaBlock); b != nil {
+			id = append(skipchain.SkipBlockID{}, b...)
+			i, _ := binary.Varint(meta.Get(metaIndex))
+			index = int(i)
 		}
+		return nil
+	})
+	return
+}
 
+// view returns the collection as it was last stored, together with the
+// latest block applied to it. The view is loaded from the store and doesn't
+// share any node with coll, so it can be read while coll is being changed.
+func (c *collectionDB) view() (coll collection.Collection, id skipchain.SkipBlockID, index int, err error) {
+	var root []byte
+	root, id, index = c.latestState()
+	coll, err = c.snapshot(root)
+	return
+}
+
+// storeBody stores the body of the block with the given ID.
+func (c *collectionDB) storeBody(id skipchain.SkipBlockID, body *DataBody) error {
+	buf, err := network.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.bodiesBucket()).Put(id, buf)
+	})
+}
+
+// getBody returns the body of the block with the given ID, or nil if it is
+// not stored.
+func (c *collectionDB) getBody(id skipchain.SkipBlockID) (*DataBody, error) {
+	var buf []byte
+	c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(c.bodiesBucket()).Get(id); b != nil {
+			buf = append([]byte{}, b...)
+		}
 		return nil
 	})
+	if buf == nil {
+		return nil, nil
+	}
+	_, bodyI, err := network.Unmarshal(buf, cothority.Suite)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := bodyI.(*DataBody)
+	if !ok {
+		return nil, errors.New("stored body is of wrong type")
+	}
+	return body, nil
 }
 
 func storeInColl(coll collection.Collection, t *StateChange) error {
@@ -84,36 +494,135 @@ func storeInColl(coll collection.Collection, t *StateChange) error {
 	}
 }
 
+// undoStateChange returns the StateChange that reverts t, given the current
+// content of the collection. It must be called before t is applied.
+func undoStateChange(coll collection.Collection, t *StateChange) (StateChange, error) {
+	undo := StateChange{ObjectID: t.ObjectID}
+	rec, err := coll.Get(t.ObjectID).Record()
+	if err != nil {
+		return undo, err
+	}
+	if !rec.Match() {
+		undo.StateAction = Remove
+		return undo, nil
+	}
+	vals, err := rec.Values()
+	if err != nil {
+		return undo, err
+	}
+	undo.Value = append([]byte{}, vals[0].([]byte)...)
+	undo.ContractID = append([]byte{}, vals[1].([]byte)...)
+	switch t.StateAction {
+	case Create, Update:
+		undo.StateAction = Update
+	case Remove:
+		undo.StateAction = Create
+	default:
+		return undo, errors.New("invalid state action")
+	}
+	return undo, nil
+}
+
+// Store applies the StateChange to the collection and writes it to disk.
 func (c *collectionDB) Store(t *StateChange) error {
-	if err := storeInColl(c.coll, t); err != nil {
+	return c.StoreAll([]StateChange{*t}, nil)
+}
+
+// StoreAll applies all StateChanges to the collection and writes them to disk.
+// If sb is not nil, it is recorded as the latest block applied to the
+// collection. Either all StateChanges are applied or none.
+func (c *collectionDB) StoreAll(scs StateChanges, sb *skipchain.SkipBlock) error {
+	c.coll.Begin()
+	for i := range scs {
+		if err := storeInColl(c.coll, &scs[i]); err != nil {
+			c.coll.Rollback()
+			return err
+		}
+	}
+	c.coll.End()
+	// The nodes are only removed from memory if they could be written
+	// to the store.
+	if err := c.coll.Collect(); err != nil {
+		return err
+	}
+
+	// The new root is pinned before it is recorded, and the roots that
+	// are not kept anymore are only unpinned once it is recorded, so the
+	// stored root can always be loaded.
+	root := c.coll.GetRoot()
+	if err := c.store.Pin(root); err != nil {
 		return err
 	}
+	var dropped [][]byte
 	err := c.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(c.bucketName))
-		keykind := make([]byte, len(t.ObjectID)+4)
-		copy(keykind, t.ObjectID)
-		keykind = append(keykind, []byte("kind")...)
-
-		switch t.StateAction {
-		case Create, Update:
-			if err := bucket.Put(t.ObjectID, t.Value); err != nil {
+		meta := tx.Bucket(c.metaBucket())
+		if err := meta.Put(metaRoot, root); err != nil {
+			return err
+		}
+		var err error
+		if dropped, err = keepRoot(meta, root); err != nil {
+			return err
+		}
+		if sb != nil {
+			index := make([]byte, 8)
+			binary.PutVarint(index, int64(sb.Index))
+			if err := meta.Put(metaIndex, index); err != nil {
 				return err
 			}
-			return bucket.Put(keykind, t.ContractID)
-		case Remove:
-			if err := bucket.Delete(t.ObjectID); err != nil {
+			if err := meta.Put(metaBlock, sb.Hash); err != nil {
 				return err
 			}
-			return bucket.Delete(keykind)
-		default:
-			return errors.New("invalid state action")
 		}
+
+		bucket := tx.Bucket(c.bucketName)
+		for _, sc := range scs {
+			switch sc.StateAction {
+			case Create, Update:
+				buf, err := protobuf.Encode(&storedValue{
+					Value:      sc.Value,
+					ContractID: sc.ContractID,
+				})
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put(sc.ObjectID, buf); err != nil {
+					return err
+				}
+			case Remove:
+				if err := bucket.Delete(sc.ObjectID); err != nil {
+					return err
+				}
+			default:
+				return errors.New("invalid state action")
+			}
+		}
+		return nil
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	for _, r := range dropped {
+		if err = c.store.Unpin(r); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// GetValueContract returns the value and the contract stored under key in the
+// latest stored state.
 func (c *collectionDB) GetValueContract(key []byte) (value, contract []byte, err error) {
-	proof, err := c.coll.Get(key).Record()
+	coll, _, _, err := c.view()
+	if err != nil {
+		return
+	}
+	return getValueContract(coll, key)
+}
+
+// getValueContract returns the value and the contract stored under key in
+// coll.
+func getValueContract(coll collection.Collection, key []byte) (value, contract []byte, err error) {
+	proof, err := coll.Get(key).Record()
 	if err != nil {
 		return
 	}
@@ -138,31 +647,11 @@ func (c *collectionDB) GetValueContract(key []byte) (value, contract []byte, err
 	return
 }
 
-// RootHash returns the hash of the root node in the merkle tree.
+// RootHash returns the hash of the root node in the merkle tree, as it was
+// last stored.
 func (c *collectionDB) RootHash() []byte {
-	return c.coll.GetRoot()
-}
-
-// tryHash returns the merkle root of the collection as if the key value pairs
-// in the transactions had been added, without actually adding it.
-func (c *collectionDB) tryHash(ts []StateChange) (mr []byte, rerr error) {
-	for _, sc := range ts {
-		err := c.coll.Add(sc.ObjectID, sc.Value, sc.ContractID)
-		if err != nil {
-			rerr = err
-			return
-		}
-		// remove the pair after we got the merkle root.
-		defer func(k []byte) {
-			err = c.coll.Remove(k)
-			if err != nil {
-				rerr = err
-				mr = nil
-			}
-		}(sc.ObjectID)
-	}
-	mr = c.coll.GetRoot()
-	return
+	root, _, _ := c.latestState()
+	return root
 }
 
 // RegisterContract stores the contract in a map and will
@@ -177,6 +666,39 @@ func RegisterContract(s skipchain.GetService, kind string, f OmniLedgerContract)
 	return scs.(*Service).registerContract(kind, f)
 }
 
+// RegisterContractWithContext is like RegisterContract, but the contract also
+// receives the Context of every instruction.
+func RegisterContractWithContext(s skipchain.GetService, kind string, f ContractWithContext) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerContractWithContext(kind, f)
+}
+
+// RegisterContractVersion stores a version of a contract. Which version runs
+// in a block is decided by the config of the skipchain, see versions.go.
+// RegisterContract and RegisterContractWithContext register
+// DefaultContractVersion.
+func RegisterContractVersion(s skipchain.GetService, kind string, version int, f ContractWithContext) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerContractVersion(kind, version, f)
+}
+
+// RegisterSchema stores the argument schema of a version of a contract. The
+// instructions for that version are checked against it before they are given
+// to the contract, see schema.go.
+func RegisterSchema(s skipchain.GetService, kind string, version int, commands ...CommandSchema) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerSchema(kind, version, commands...)
+}
+
 // DataHeader is the data passed to the Skipchain
 type DataHeader struct {
 	// CollectionRoot is the root of the merkle tree of the colleciton after
@@ -189,10 +711,25 @@ type DataHeader struct {
 	StateChangesHash []byte
 	// Timestamp is a unix timestamp in nanoseconds.
 	Timestamp int64
+	// ReceiptsRoot is the root of the merkle tree over the receipts in the
+	// body, see events.go.
+	ReceiptsRoot []byte
+	// Contracts holds the sorted IDs of the contracts called by the
+	// transactions in the body, so that a node can refuse to sign a block
+	// using contracts it doesn't have.
+	Contracts []string
+	// IdentityBlock is the block of the identity chain whose shards are
+	// used by the transactions, if the skipchain is a shard. So all nodes
+	// execute the block with the same shards, however far they followed
+	// the identity chain.
+	IdentityBlock skipchain.SkipBlockID
 }
 
 // DataBody is stored in the body of the skipblock but is not hashed. This reduces
 // the proof needed for a key/value pair.
 type DataBody struct {
 	Transactions ClientTransactions
+	// Receipts holds the receipts of all transactions the leader tried,
+	// including the refused ones.
+	Receipts []Receipt
 }
@@ -8,6 +8,7 @@ import (
 
 	bolt "github.com/coreos/bbolt"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/cothority.v2/skipchain"
 )
 
 var testName = []byte("coll1")
@@ -120,8 +121,7 @@ func TestCollectionDB(t *testing.T) {
 	}
 }
 
-// TODO: Test good case, bad add case, bad remove case
-func TestCollectionDBtryHash(t *testing.T) {
+func TestCollectionDBRoot(t *testing.T) {
 	tmpDB, err := ioutil.TempFile("", "tmpDB")
 	require.Nil(t, err)
 	tmpDB.Close()
@@ -131,27 +131,99 @@ func TestCollectionDBtryHash(t *testing.T) {
 	require.Nil(t, err)
 
 	cdb := newCollectionDB(db, testName)
-	scs := []StateChange{{
-		StateAction: Create,
-		ObjectID:    []byte("key1"),
-		ContractID:  []byte("kind1"),
-		Value:       []byte("value1"),
-	},
-		{
+	empty := cdb.RootHash()
+	for i := 0; i < 16; i++ {
+		require.Nil(t, cdb.Store(&StateChange{
 			StateAction: Create,
-			ObjectID:    []byte("key2"),
-			ContractID:  []byte("kind2"),
-			Value:       []byte("value2"),
-		},
+			ObjectID:    []byte(fmt.Sprintf("Key%d", i)),
+			Value:       []byte(fmt.Sprintf("value%d", i)),
+			ContractID:  []byte("myContract"),
+		}))
 	}
-	mrTrial, err := cdb.tryHash(scs)
+	require.NotEqual(t, empty, cdb.RootHash())
+
+	// The root is loaded from the stored nodes, not recomputed from the
+	// key/value pairs.
+	cdb2 := newCollectionDB(db, testName)
+	require.Equal(t, cdb.RootHash(), cdb2.RootHash())
+
+	// A block stored together with its StateChanges is recorded as the
+	// latest block.
+	_, index := cdb2.latestBlock()
+	require.Equal(t, -1, index)
+	sb := skipchain.NewSkipBlock()
+	sb.Index = 3
+	sb.Hash = []byte("block")
+	require.Nil(t, cdb2.StoreAll(StateChanges{{
+		StateAction: Remove,
+		ObjectID:    []byte("Key0"),
+	}}, sb))
+	id, index := newCollectionDB(db, testName).latestBlock()
+	require.Equal(t, 3, index)
+	require.Equal(t, sb.Hash, id)
+
+	// Failing StateChanges are not applied at all.
+	root := cdb2.RootHash()
+	require.NotNil(t, cdb2.StoreAll(StateChanges{{
+		StateAction: Remove,
+		ObjectID:    []byte("Key1"),
+	}, {
+		StateAction: Remove,
+		ObjectID:    []byte("Key0"),
+	}}, nil))
+	require.Equal(t, root, cdb2.RootHash())
+	_, _, err = cdb2.GetValueContract([]byte("Key1"))
 	require.Nil(t, err)
-	_, _, err = cdb.GetValueContract([]byte("key1"))
-	require.EqualError(t, err, "no match found")
-	_, _, err = cdb.GetValueContract([]byte("key2"))
-	require.EqualError(t, err, "no match found")
-	cdb.Store(&scs[0])
-	cdb.Store(&scs[1])
-	mrReal := cdb.RootHash()
-	require.Equal(t, mrTrial, mrReal)
+
+	// The bodies are kept when the state is reset.
+	body := &DataBody{Transactions: ClientTransactions{{
+		Instructions: Instructions{{Index: 0, Length: 1, Delete: &Delete{}}},
+	}}}
+	require.Nil(t, cdb2.storeBody(sb.Hash, body))
+	require.Nil(t, cdb2.reset())
+	require.Equal(t, empty, cdb2.RootHash())
+	_, index = cdb2.latestBlock()
+	require.Equal(t, -1, index)
+	stored, err := cdb2.getBody(sb.Hash)
+	require.Nil(t, err)
+	require.Equal(t, body.Transactions.Hash(), stored.Transactions.Hash())
+}
+
+func TestCollectionDBMigrate(t *testing.T) {
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+
+	// Write the keys in the layout of version 0.
+	require.Nil(t, db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(testName)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 16; i++ {
+			k := []byte(fmt.Sprintf("Key%d", i))
+			if err := b.Put(k, []byte(fmt.Sprintf("value%d", i))); err != nil {
+				return err
+			}
+			if err := b.Put(append(k, []byte("kind")...), []byte("myContract")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	cdb := newCollectionDB(db, testName)
+	for i := 0; i < 16; i++ {
+		v, c, err := cdb.GetValueContract([]byte(fmt.Sprintf("Key%d", i)))
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("value%d", i), string(v))
+		require.Equal(t, "myContract", string(c))
+		_, _, err = cdb.GetValueContract([]byte(fmt.Sprintf("Key%dkind", i)))
+		require.NotNil(t, err)
+	}
+	require.Equal(t, cdb.RootHash(), newCollectionDB(db, testName).RootHash())
 }
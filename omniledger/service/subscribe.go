@@ -0,0 +1,378 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/dedis/cothority.v2"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
+	"student_18_byzcoin/omniledger/collection"
+)
+
+// Instead of polling GetProof, a client can follow a skipchain with
+// Subscribe:
+//   1. for every block applied to its collection, the node streams a
+//   SubscribeResponse with the block, the links proving that it is part of
+//   the skipchain and all receipts of its body. The receipts hold the hashes
+//   of the accepted ClientTransactions and their events, and are proven by
+//   the receipts root in the header
+//   2. if a watched object changed in the block, the response holds its
+//   proof against the block
+//   3. a subscription can start at an earlier block, then the blocks up to
+//   the latest one are sent first. Otherwise it starts with the latest
+//   block. As the nodes only keep the latest state, the response of the
+//   latest replayed block holds the proofs of all watched objects
+// A subscriber that doesn't read fast enough is dropped. Client.Subscribe
+// then reconnects and resumes after the last block it got.
+
+// subscribeBuffer is the number of responses kept for a subscriber before it
+// is dropped.
+const subscribeBuffer = 100
+
+// subscribeReplayDepth is the number of earlier blocks a subscription can
+// start at.
+const subscribeReplayDepth = 1000
+
+// subscriber is the stream of a client.
+type subscriber struct {
+	keys [][]byte
+	out  chan *SubscribeResponse
+	// closed is set once out is closed, it is protected by
+	// Service.subscribeMu.
+	closed bool
+}
+
+// changed returns the watched keys that are changed by the StateChanges.
+func (sub *subscriber) changed(scs StateChanges) [][]byte {
+	var keys [][]byte
+	for _, key := range sub.keys {
+		for _, sc := range scs {
+			if bytes.Equal(sc.ObjectID, key) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// Subscribe streams the blocks of a skipchain to the client, starting at the
+// block req.From, or at the latest block if req.From is negative or after
+// it. The stream stops when the client disconnects and closes the
+// returned channel.
+func (s *Service) Subscribe(req *Subscribe) (chan *SubscribeResponse, chan bool, error) {
+	if req.Version != CurrentVersion {
+		return nil, nil, errors.New("version mismatch")
+	}
+	sb := s.db().GetByID(req.ID)
+	if sb == nil {
+		return nil, nil, errors.New("unknown skipchain")
+	}
+	id := sb.SkipChainID()
+	cs := s.getChain(id)
+	sub := &subscriber{}
+	for _, oid := range req.ObjectIDs {
+		sub.keys = append(sub.keys, oid.Slice())
+	}
+
+	// The earlier blocks are read from a view, without stopping the
+	// blocks from being applied. The blocks applied since then are read
+	// while the subscriber is added, so it gets every block exactly once.
+	coll, latest, index, err := cs.cdb.view()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Without earlier blocks to send, the subscription starts with the
+	// latest block, so that the client gets the watched objects.
+	from := req.From
+	if from < 0 || from > index {
+		from = index
+	}
+	if index-from >= subscribeReplayDepth {
+		return nil, nil, fmt.Errorf("block %d is too old, only the last %d blocks are replayed",
+			from, subscribeReplayDepth)
+	}
+	replay, err := s.replayBlocks(cs.cdb, coll, latest, from, index, sub.keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	cs.writeMu.Lock()
+	next := index + 1
+	latest, index = cs.cdb.latestBlock()
+	gap, err := s.replayBlocks(cs.cdb, cs.cdb.coll, latest, next, index, sub.keys)
+	if err != nil {
+		cs.writeMu.Unlock()
+		return nil, nil, err
+	}
+	replay = append(replay, gap...)
+	sub.out = make(chan *SubscribeResponse, len(replay)+subscribeBuffer)
+	for _, resp := range replay {
+		sub.out <- resp
+	}
+	s.subscribeMu.Lock()
+	s.subscribers[string(id)] = append(s.subscribers[string(id)], sub)
+	s.subscribeMu.Unlock()
+	cs.writeMu.Unlock()
+
+	stop := make(chan bool)
+	go func() {
+		<-stop
+		s.unsubscribe(id, sub)
+	}()
+	return sub.out, stop, nil
+}
+
+// replayBlocks returns the responses for the blocks from the given index up to
+// the block latest, whose index is to and whose state is coll. As the nodes
+// only keep the latest state, the response of the block latest holds the
+// proofs of all keys.
+func (s *Service) replayBlocks(cdb *collectionDB, coll collection.Collection, latest skipchain.SkipBlockID,
+	from, to int, keys [][]byte) ([]*SubscribeResponse, error) {
+	if from < 0 || from > to {
+		return nil, nil
+	}
+	blocks := make([]*skipchain.SkipBlock, to-from+1)
+	sb := s.db().GetByID(latest)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if sb == nil {
+			return nil, fmt.Errorf("missing block %d", from+i)
+		}
+		blocks[i] = sb
+		if i > 0 {
+			sb = s.db().GetByID(sb.BackLinkIDs[0])
+		}
+	}
+	var replay []*SubscribeResponse
+	for _, sb := range blocks {
+		body, err := cdb.getBody(sb.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			return nil, fmt.Errorf("missing body of block %d", sb.Index)
+		}
+		resp, err := s.blockResponse(sb, body)
+		if err != nil {
+			return nil, err
+		}
+		replay = append(replay, resp)
+	}
+	var err error
+	replay[len(replay)-1].Objects, err = s.objectProofs(coll, to, blocks[0].SkipChainID(), keys)
+	if err != nil {
+		return nil, err
+	}
+	return replay, nil
+}
+
+// objectProofs returns the proofs of the keys in coll, which must be the state
+// after the block with the given index.
+func (s *Service) objectProofs(coll collection.Collection, index int, id skipchain.SkipBlockID, keys [][]byte) ([]Proof, error) {
+	var proofs []Proof
+	for _, key := range keys {
+		p, err := newProof(coll, index, s.db(), id, key)
+		if err != nil {
+			return nil, err
+		}
+		proofs = append(proofs, *p)
+	}
+	return proofs, nil
+}
+
+// blockResponse returns the response for the block, without the proofs of the
+// watched objects.
+func (s *Service) blockResponse(sb *skipchain.SkipBlock, body *DataBody) (*SubscribeResponse, error) {
+	links, block, err := chainLinks(s.db(), sb.SkipChainID(), sb.Index)
+	if err != nil {
+		return nil, err
+	}
+	if !block.Hash.Equal(sb.Hash) {
+		return nil, fmt.Errorf("couldn't find the links to block %d", sb.Index)
+	}
+	return &SubscribeResponse{
+		Version:  CurrentVersion,
+		Block:    *block,
+		Links:    links,
+		Receipts: body.Receipts,
+	}, nil
+}
+
+// notifySubscribers sends the block to the subscribers of its skipchain. It
+// is called once the StateChanges of the block are stored in the collection.
+func (s *Service) notifySubscribers(cdb *collectionDB, sb *skipchain.SkipBlock, body *DataBody, scs StateChanges) {
+	id := sb.SkipChainID()
+	s.subscribeMu.Lock()
+	subs := append([]*subscriber{}, s.subscribers[string(id)]...)
+	s.subscribeMu.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+	base, err := s.blockResponse(sb, body)
+	if err != nil {
+		// The subscribers see that the block is missing and resume
+		// from it.
+		log.Error(s.ServerIdentity(), "couldn't notify subscribers:", err)
+		return
+	}
+	for _, sub := range subs {
+		resp := *base
+		resp.Objects, err = s.objectProofs(cdb.coll, sb.Index, id, sub.changed(scs))
+		if err != nil {
+			log.Error(s.ServerIdentity(), "couldn't notify subscriber:", err)
+			continue
+		}
+		s.subscribeMu.Lock()
+		if !sub.closed {
+			select {
+			case sub.out <- &resp:
+			default:
+				log.Lvl2(s.ServerIdentity(), "dropping a subscriber that is too slow")
+				s.removeSubscriber(id, sub)
+			}
+		}
+		s.subscribeMu.Unlock()
+	}
+}
+
+// unsubscribe removes the subscriber and closes its stream.
+func (s *Service) unsubscribe(id skipchain.SkipBlockID, sub *subscriber) {
+	s.subscribeMu.Lock()
+	defer s.subscribeMu.Unlock()
+	s.removeSubscriber(id, sub)
+}
+
+// removeSubscriber must be called with subscribeMu held.
+func (s *Service) removeSubscriber(id skipchain.SkipBlockID, sub *subscriber) {
+	if sub.closed {
+		return
+	}
+	subs := s.subscribers[string(id)]
+	for i := range subs {
+		if subs[i] == sub {
+			s.subscribers[string(id)] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	sub.closed = true
+	close(sub.out)
+}
+
+// Verify checks that the block is part of the skipchain, and that the
+// receipts and the proofs of the objects correspond to the block.
+func (resp SubscribeResponse) Verify(id skipchain.SkipBlockID) error {
+	if err := verifyLinks(id, resp.Links, resp.Block); err != nil {
+		return err
+	}
+	_, d, err := network.Unmarshal(resp.Block.Data, cothority.Suite)
+	if err != nil {
+		return err
+	}
+	header, ok := d.(*DataHeader)
+	if !ok {
+		return errors.New("block holds no header")
+	}
+	if !bytes.Equal(receiptsRoot(resp.Receipts), header.ReceiptsRoot) {
+		return ErrorVerifyReceiptsRoot
+	}
+	for _, p := range resp.Objects {
+		if !p.Latest.Hash.Equal(resp.Block.Hash) {
+			return errors.New("proof of object is not from the block")
+		}
+		if err := p.Verify(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TxHashes returns the hashes of the ClientTransactions accepted in the block.
+func (resp SubscribeResponse) TxHashes() [][]byte {
+	var hashes [][]byte
+	for _, r := range resp.Receipts {
+		if r.Error == "" {
+			hashes = append(hashes, r.TxHash)
+		}
+	}
+	return hashes
+}
+
+// Events returns the events emitted in the block, in order.
+func (resp SubscribeResponse) Events() []Event {
+	var events []Event
+	for _, r := range resp.Receipts {
+		events = append(events, r.Events...)
+	}
+	return events
+}
+
+// subscribeRetries is the number of times in a row Client.Subscribe tries to
+// connect without getting a block, before it gives up.
+const subscribeRetries = 5
+
+// subscribeRetryDelay is the time Client.Subscribe waits before it
+// reconnects.
+var subscribeRetryDelay = time.Second
+
+// streamOpener sends the request to the node and returns a function reading
+// the next response from the stream, and one closing the stream.
+type streamOpener func(si *network.ServerIdentity, req *Subscribe) (read func(*SubscribeResponse) error, close func(), err error)
+
+// subscribeLoop implements Client.Subscribe, with open connecting to the
+// nodes.
+func subscribeLoop(r *onet.Roster, id skipchain.SkipBlockID, from int, objects []ObjectID,
+	f func(*SubscribeResponse) bool, open streamOpener) error {
+	if len(r.List) == 0 {
+		return errors.New("empty roster")
+	}
+	next := from
+	var err error
+	for failures, node := 0, 0; failures < subscribeRetries; node++ {
+		if failures > 0 {
+			time.Sleep(subscribeRetryDelay)
+		}
+		var read func(*SubscribeResponse) error
+		var closeStream func()
+		read, closeStream, err = open(r.List[node%len(r.List)], &Subscribe{
+			Version:   CurrentVersion,
+			ID:        id,
+			From:      next,
+			ObjectIDs: objects,
+		})
+		if err != nil {
+			failures++
+			continue
+		}
+		for {
+			resp := &SubscribeResponse{}
+			if err = read(resp); err != nil {
+				break
+			}
+			if err = resp.Verify(id); err != nil {
+				break
+			}
+			if next >= 0 && resp.Block.Index < next {
+				// A stream resuming after the latest block
+				// starts with it, it is not given again.
+				continue
+			}
+			if next >= 0 && resp.Block.Index != next {
+				err = fmt.Errorf("expected block %d but got %d", next, resp.Block.Index)
+				break
+			}
+			failures = 0
+			next = resp.Block.Index + 1
+			if !f(resp) {
+				closeStream()
+				return nil
+			}
+		}
+		closeStream()
+		failures++
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+// readResponse returns the next response of the stream, or nil if it has been
+// closed.
+func readResponse(t *testing.T, s *ser, ch chan *SubscribeResponse) *SubscribeResponse {
+	select {
+	case resp := <-ch:
+		return resp
+	case <-time.After(20 * s.interval):
+		require.Fail(t, "no response in time")
+	}
+	return nil
+}
+
+func TestService_Subscribe(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	id := s.sb.SkipChainID()
+	_, latest := s.service().getCollection(id).latestBlock()
+
+	// The latest block is sent first, with the proofs of the watched
+	// objects, then the new blocks.
+	tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+	require.Nil(t, err)
+	oid := tx.Instructions[0].ObjectID
+	ch, stop, err := s.service().Subscribe(&Subscribe{
+		Version:   CurrentVersion,
+		ID:        id,
+		From:      -1,
+		ObjectIDs: []ObjectID{oid},
+	})
+	require.Nil(t, err)
+	resp := readResponse(t, s, ch)
+	require.Nil(t, resp.Verify(id))
+	require.Equal(t, latest, resp.Block.Index)
+	require.Equal(t, 1, len(resp.Objects))
+	require.False(t, resp.Objects[0].InclusionProof.Match())
+	_, err = s.service().AddTransaction(&AddTxRequest{
+		Version:     CurrentVersion,
+		SkipchainID: id,
+		Transaction: tx,
+	})
+	require.Nil(t, err)
+	resp = readResponse(t, s, ch)
+	require.Nil(t, resp.Verify(id))
+	require.Equal(t, latest+1, resp.Block.Index)
+	require.Equal(t, [][]byte{tx.Hash()}, resp.TxHashes())
+	require.Equal(t, 1, len(resp.Objects))
+	require.True(t, resp.Objects[0].InclusionProof.Match())
+	require.Equal(t, oid.Slice(), resp.Objects[0].InclusionProof.Key)
+
+	// A changed receipt doesn't verify.
+	forged := *resp
+	forged.Receipts = []Receipt{{TxHash: []byte("forged")}}
+	require.Equal(t, ErrorVerifyReceiptsRoot, forged.Verify(id))
+
+	close(stop)
+	for resp = range ch {
+	}
+
+	// The earlier blocks are sent first, the last one with the proofs of
+	// the watched objects.
+	ch, stop, err = s.service().Subscribe(&Subscribe{
+		Version:   CurrentVersion,
+		ID:        id,
+		From:      0,
+		ObjectIDs: []ObjectID{oid},
+	})
+	require.Nil(t, err)
+	for i := 0; i <= latest+1; i++ {
+		resp = readResponse(t, s, ch)
+		require.Nil(t, resp.Verify(id))
+		require.Equal(t, i, resp.Block.Index)
+	}
+	require.Equal(t, 1, len(resp.Objects))
+	require.True(t, resp.Objects[0].InclusionProof.Match())
+	close(stop)
+
+	// So does a subscription starting after the latest block.
+	ch, stop, err = s.service().Subscribe(&Subscribe{
+		Version:   CurrentVersion,
+		ID:        id,
+		From:      latest + 10,
+		ObjectIDs: []ObjectID{oid},
+	})
+	require.Nil(t, err)
+	resp = readResponse(t, s, ch)
+	require.Nil(t, resp.Verify(id))
+	require.Equal(t, latest+1, resp.Block.Index)
+	require.Equal(t, 1, len(resp.Objects))
+	require.True(t, resp.Objects[0].InclusionProof.Match())
+	close(stop)
+
+	// The blocks applied while the earlier blocks are read are replayed
+	// on their own, with the proofs of the state they lead to.
+	cdb := s.service().getCollection(id)
+	coll, latestID, index, err := cdb.view()
+	require.Nil(t, err)
+	replay, err := s.service().replayBlocks(cdb, coll, latestID, index+1, index, [][]byte{oid.Slice()})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(replay))
+	replay, err = s.service().replayBlocks(cdb, coll, latestID, 1, index, [][]byte{oid.Slice()})
+	require.Nil(t, err)
+	require.Equal(t, index, len(replay))
+	for i, resp := range replay {
+		require.Nil(t, resp.Verify(id))
+		require.Equal(t, i+1, resp.Block.Index)
+		if i < index-1 {
+			require.Equal(t, 0, len(resp.Objects))
+		}
+	}
+	require.Equal(t, 1, len(replay[index-1].Objects))
+
+	_, _, err = s.service().Subscribe(&Subscribe{Version: CurrentVersion, ID: []byte("unknown")})
+	require.NotNil(t, err)
+}
+
+func TestSubscribeLoop(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	id := s.sb.SkipChainID()
+	defer func(d time.Duration) { subscribeRetryDelay = d }(subscribeRetryDelay)
+	subscribeRetryDelay = 10 * time.Millisecond
+
+	// The first stream breaks after the genesis block, the second one
+	// resumes at the next block.
+	var requests []int
+	open := func(si *network.ServerIdentity, req *Subscribe) (func(*SubscribeResponse) error, func(), error) {
+		requests = append(requests, req.From)
+		ch, stop, err := s.services[len(requests)%2].Subscribe(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		read := 0
+		return func(resp *SubscribeResponse) error {
+			if len(requests) == 1 && read == 1 {
+				return errors.New("connection lost")
+			}
+			read++
+			r := readResponse(t, s, ch)
+			if r == nil {
+				return errors.New("stream closed")
+			}
+			*resp = *r
+			return nil
+		}, func() { close(stop) }, nil
+	}
+
+	var indexes []int
+	err := subscribeLoop(s.roster, id, 0, nil, func(resp *SubscribeResponse) bool {
+		indexes = append(indexes, resp.Block.Index)
+		if resp.Block.Index == 0 {
+			tx, err := createOneClientTx(s.darc.GetBaseID(), dummyKind, s.value, s.signer)
+			require.Nil(t, err)
+			_, err = s.service().AddTransaction(&AddTxRequest{
+				Version:     CurrentVersion,
+				SkipchainID: id,
+				Transaction: tx,
+			})
+			require.Nil(t, err)
+		}
+		return resp.Block.Index < 1
+	}, open)
+	require.Nil(t, err)
+	require.Equal(t, []int{0, 1}, indexes)
+	require.Equal(t, []int{0, 1}, requests)
+}
@@ -0,0 +1,644 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"student_18_byzcoin/omniledger/collection"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2"
+	"gopkg.in/dedis/onet.v2/log"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+// A node that is missing blocks or bodies synchronises the state of a
+// skipchain with another node of the roster:
+//   1. the latest block is fetched using skipchain's GetUpdateChain and
+//   verified through the forward links
+//   2. if the node is too far behind, the collection of a recent block is
+//   downloaded in chunks, every key with a proof against the CollectionRoot
+//   of that block. The other node keeps this collection while it is being
+//   downloaded
+//   3. the remaining blocks are fetched with their bodies and replayed
+
+// syncReplayDistance is the number of missing blocks up to which a node
+// replays the blocks instead of downloading the collection.
+var syncReplayDistance = 100
+
+// syncChunkBits is the number of bits of the path of the keys that are sent
+// in the same chunk, so the collection is sent in 2^syncChunkBits chunks. It
+// must not be bigger than 16.
+var syncChunkBits = 8
+
+// syncMaxProofs is the maximum number of proofs sent in one reply. A bigger
+// chunk is sent in several parts.
+var syncMaxProofs = 1000
+
+// snapshotPinTime is how long the state of a block is kept after the last
+// request for one of its chunks.
+var snapshotPinTime = time.Minute
+
+// syncTimeout is how long a node waits for the reply of another node.
+var syncTimeout = 10 * time.Second
+
+var (
+	updateChainRequestID = network.RegisterMessage(&updateChainRequest{})
+	updateChainReplyID   = network.RegisterMessage(&updateChainReply{})
+	blocksRequestID      = network.RegisterMessage(&blocksRequest{})
+	blocksReplyID        = network.RegisterMessage(&blocksReply{})
+	snapshotRequestID    = network.RegisterMessage(&snapshotRequest{})
+	snapshotReplyID      = network.RegisterMessage(&snapshotReply{})
+)
+
+// updateChainRequest asks a node for the blocks GetUpdateChain returns when
+// starting at Latest.
+type updateChainRequest struct {
+	Nonce  Nonce
+	Latest skipchain.SkipBlockID
+}
+
+// updateChainReply holds the blocks returned by GetUpdateChain and the latest
+// block applied to the collection of the node.
+type updateChainReply struct {
+	Nonce        Nonce
+	Update       []*skipchain.SkipBlock
+	Applied      skipchain.SkipBlockID
+	AppliedIndex int
+	Error        string
+}
+
+// blocksRequest asks a node for all blocks from the block with the given
+// Index up to the block with the given ID.
+type blocksRequest struct {
+	Nonce Nonce
+	ID    skipchain.SkipBlockID
+	Index int
+}
+
+// blocksReply holds the requested blocks and the bodies of all blocks but the
+// first one, which is already applied or whose collection is downloaded.
+type blocksReply struct {
+	Nonce  Nonce
+	Blocks []*skipchain.SkipBlock
+	Bodies []DataBody
+	Error  string
+}
+
+// snapshotRequest asks a node for the keys in the collection of the block ID
+// whose path starts with the first Bits of Prefix, starting with the key at
+// Offset.
+type snapshotRequest struct {
+	Nonce  Nonce
+	ID     skipchain.SkipBlockID
+	Prefix []byte
+	Bits   int
+	Offset int
+}
+
+// snapshotReply holds the proofs of at most syncMaxProofs keys of the
+// requested chunk. More tells whether the chunk holds more keys.
+type snapshotReply struct {
+	Nonce  Nonce
+	Proofs []collection.Proof
+	More   bool
+	Error  string
+}
+
+// snapshotPin keeps a state in the store while other nodes download it.
+type snapshotPin struct {
+	timer *time.Timer
+	last  time.Time
+}
+
+// registerSync registers the handlers of the messages used to synchronise
+// the state of a skipchain.
+func (s *Service) registerSync() {
+	s.RegisterProcessorFunc(updateChainRequestID, s.handleUpdateChainRequest)
+	s.RegisterProcessorFunc(blocksRequestID, s.handleBlocksRequest)
+	s.RegisterProcessorFunc(snapshotRequestID, s.handleSnapshotRequest)
+	for _, id := range []network.MessageTypeID{updateChainReplyID,
+		blocksReplyID, snapshotReplyID} {
+		s.RegisterProcessorFunc(id, s.handleSyncReply)
+	}
+}
+
+// syncState brings the collection of the skipchain up to date with the
+// latest block known to the nodes of the roster. The nodes are asked one
+// after the other until the synchronisation succeeds.
+func (s *Service) syncState(roster *onet.Roster, id skipchain.SkipBlockID) error {
+	s.syncMu.Lock()
+	if s.syncing[string(id)] {
+		s.syncMu.Unlock()
+		return errors.New("skipchain is already being synchronised")
+	}
+	s.syncing[string(id)] = true
+	s.syncMu.Unlock()
+	defer func() {
+		s.syncMu.Lock()
+		delete(s.syncing, string(id))
+		s.syncMu.Unlock()
+	}()
+
+	cs := s.getChain(id)
+	cs.writeMu.Lock()
+	defer cs.writeMu.Unlock()
+	for _, si := range roster.List {
+		if si.Equal(s.ServerIdentity()) {
+			continue
+		}
+		err := s.syncFrom(si, id, cs.cdb)
+		if err == nil {
+			return nil
+		}
+		log.Lvl2(s.ServerIdentity(), "couldn't synchronise with", si, err)
+	}
+	return fmt.Errorf("couldn't synchronise %x with any node", id)
+}
+
+// syncFrom synchronises the collection with the node si.
+func (s *Service) syncFrom(si *network.ServerIdentity, id skipchain.SkipBlockID, cdb *collectionDB) error {
+	// Start at the latest block we know, or at the genesis block, which we
+	// trust as its hash is the ID of the skipchain.
+	start := id
+	if sb := s.db().GetByID(id); sb != nil {
+		latest, err := s.db().GetLatest(sb)
+		if err != nil {
+			return err
+		}
+		start = latest.Hash
+	}
+	uc, err := s.requestUpdateChain(si, start)
+	if err != nil {
+		return err
+	}
+	latest, err := verifyUpdateChain(start, uc.Update)
+	if err != nil {
+		return err
+	}
+	for _, sb := range uc.Update {
+		if s.db().Store(sb) == nil {
+			return fmt.Errorf("couldn't store block %d", sb.Index)
+		}
+	}
+
+	base, index := cdb.latestBlock()
+	if index >= latest.Index {
+		return nil
+	}
+	snapshot := index < 0 || uc.AppliedIndex-index > syncReplayDistance
+	if snapshot {
+		if uc.AppliedIndex < 0 || uc.AppliedIndex > latest.Index {
+			return errors.New("node has no collection to send")
+		}
+		base, index = uc.Applied, uc.AppliedIndex
+	}
+
+	blocks, bodies, err := s.requestBlocks(si, latest.Hash, index)
+	if err != nil {
+		return err
+	}
+	if err = verifyBlocks(latest, base, index, blocks, bodies); err != nil {
+		return err
+	}
+	for i, sb := range blocks {
+		if s.db().Store(sb) == nil {
+			return fmt.Errorf("couldn't store block %d", sb.Index)
+		}
+		if i > 0 {
+			if err = cdb.storeBody(sb.Hash, &bodies[i-1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if snapshot {
+		log.Lvlf2("%s: Downloading collection of block %d of %x from %s",
+			s.ServerIdentity(), blocks[0].Index, id, si)
+		if err = s.installSnapshot(si, cdb, blocks[0]); err != nil {
+			return err
+		}
+	}
+	log.Lvlf2("%s: Replaying %d blocks of %x", s.ServerIdentity(),
+		len(blocks)-1, id)
+	return s.catchUp(cdb, latest, nil)
+}
+
+// installSnapshot downloads the collection of the block sb from si and
+// replaces the collection of cdb with it. Every key must come with a proof
+// against the CollectionRoot of sb. The collection is emptied first and every
+// part of a chunk is written to the store once it is verified, so the whole
+// state is never held in memory. Only once the collection has the same root
+// as sb is sb recorded as its latest block, so an incomplete download is
+// started again by the next synchronisation.
+func (s *Service) installSnapshot(si *network.ServerIdentity, cdb *collectionDB, sb *skipchain.SkipBlock) error {
+	header, err := decodeHeader(sb)
+	if err != nil {
+		return err
+	}
+	if err = cdb.reset(); err != nil {
+		return err
+	}
+	chunk, offset := 0, 0
+	for chunk < 1<<uint(syncChunkBits) {
+		prefix := make([]byte, 2)
+		binary.BigEndian.PutUint16(prefix, uint16(chunk<<uint(16-syncChunkBits)))
+		proofs, more, err := s.requestSnapshot(si, sb.Hash, prefix, syncChunkBits, offset)
+		if err != nil {
+			return err
+		}
+		var scs StateChanges
+		for _, p := range proofs {
+			if !p.Consistent() || !p.Match() ||
+				!bytes.Equal(p.TreeRootHash(), header.CollectionRoot) {
+				return fmt.Errorf("invalid proof in chunk %d", chunk)
+			}
+			if !hasPrefix(p.Key, prefix, syncChunkBits) {
+				return fmt.Errorf("key outside of chunk %d", chunk)
+			}
+			values, err := p.RawValues()
+			if err != nil {
+				return err
+			}
+			if len(values) != 2 {
+				return errors.New("wrong number of values in proof")
+			}
+			scs = append(scs, StateChange{
+				StateAction: Create,
+				ObjectID:    p.Key,
+				Value:       values[0],
+				ContractID:  values[1],
+			})
+		}
+		if err = cdb.StoreAll(scs, nil); err != nil {
+			return err
+		}
+		if more {
+			offset += len(proofs)
+		} else {
+			chunk, offset = chunk+1, 0
+		}
+	}
+	if !bytes.Equal(cdb.coll.GetRoot(), header.CollectionRoot) {
+		return errors.New("downloaded collection is incomplete")
+	}
+	return cdb.StoreAll(nil, sb)
+}
+
+// verifyUpdateChain checks that the blocks start at the trusted block start
+// and that every block is linked to the previous one by a valid forward link.
+// It returns the latest block.
+func verifyUpdateChain(start skipchain.SkipBlockID, update []*skipchain.SkipBlock) (*skipchain.SkipBlock, error) {
+	if len(update) == 0 {
+		return nil, errors.New("got no blocks")
+	}
+	if !update[0].Hash.Equal(start) {
+		return nil, errors.New("blocks don't start at the requested block")
+	}
+	for i, sb := range update {
+		if !sb.Hash.Equal(sb.CalculateHash()) {
+			return nil, fmt.Errorf("wrong hash of block %d", sb.Index)
+		}
+		if err := sb.VerifyForwardSignatures(); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			continue
+		}
+		linked := false
+		for _, fl := range update[i-1].ForwardLink {
+			if fl.To.Equal(sb.Hash) {
+				linked = true
+			}
+		}
+		if !linked {
+			return nil, fmt.Errorf("block %d is not linked", sb.Index)
+		}
+	}
+	return update[len(update)-1], nil
+}
+
+// verifyBlocks checks that the blocks go from the block base with the given
+// index to the verified block latest, following the backlinks, and that the
+// bodies correspond to the blocks.
+func verifyBlocks(latest *skipchain.SkipBlock, base skipchain.SkipBlockID, index int,
+	blocks []*skipchain.SkipBlock, bodies []DataBody) error {
+	if len(blocks) != latest.Index-index+1 || len(bodies) != len(blocks)-1 {
+		return errors.New("wrong number of blocks")
+	}
+	if !blocks[len(blocks)-1].Hash.Equal(latest.Hash) ||
+		!blocks[0].Hash.Equal(base) {
+		return errors.New("blocks don't correspond to the request")
+	}
+	for i, sb := range blocks {
+		if sb.Index != index+i || !sb.Hash.Equal(sb.CalculateHash()) {
+			return fmt.Errorf("wrong block %d", index+i)
+		}
+		if err := sb.VerifyForwardSignatures(); err != nil {
+			return err
+		}
+		if i == 0 {
+			continue
+		}
+		if len(sb.BackLinkIDs) == 0 || !sb.BackLinkIDs[0].Equal(blocks[i-1].Hash) {
+			return fmt.Errorf("block %d is not linked", sb.Index)
+		}
+		header, err := decodeHeader(sb)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(header.ClientTransactionHash, bodies[i-1].Transactions.Hash()) {
+			return fmt.Errorf("body of block %d doesn't correspond to its header", sb.Index)
+		}
+	}
+	return nil
+}
+
+// hasPrefix returns whether the path of the key in a collection starts with
+// the first bits of prefix.
+func hasPrefix(key, prefix []byte, bits int) bool {
+	path := sha256.Sum256(key)
+	for i := 0; i < bits; i++ {
+		mask := byte(0x80) >> uint(i%8)
+		if path[i/8]&mask != prefix[i/8]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Service) handleUpdateChainRequest(env *network.Envelope) {
+	req, ok := env.Msg.(*updateChainRequest)
+	if !ok {
+		return
+	}
+	reply := &updateChainReply{Nonce: req.Nonce, AppliedIndex: -1}
+	guc, err := s.skService().GetUpdateChain(&skipchain.GetUpdateChain{LatestID: req.Latest})
+	if err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Update = guc.(*skipchain.GetUpdateChainReply).Update
+		if len(reply.Update) == 0 {
+			reply.Error = "unknown block"
+		} else {
+			cdb := s.getCollection(reply.Update[0].SkipChainID())
+			reply.Applied, reply.AppliedIndex = cdb.latestBlock()
+		}
+	}
+	s.sendSyncReply(env.ServerIdentity, reply)
+}
+
+func (s *Service) handleBlocksRequest(env *network.Envelope) {
+	req, ok := env.Msg.(*blocksRequest)
+	if !ok {
+		return
+	}
+	reply := &blocksReply{Nonce: req.Nonce}
+	blocks, bodies, err := s.getBlocks(req.ID, req.Index)
+	if err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Blocks, reply.Bodies = blocks, bodies
+	}
+	s.sendSyncReply(env.ServerIdentity, reply)
+}
+
+func (s *Service) handleSnapshotRequest(env *network.Envelope) {
+	req, ok := env.Msg.(*snapshotRequest)
+	if !ok {
+		return
+	}
+	reply := &snapshotReply{Nonce: req.Nonce}
+	proofs, more, err := s.getSnapshot(req.ID, req.Prefix, req.Bits, req.Offset)
+	if err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Proofs, reply.More = proofs, more
+	}
+	s.sendSyncReply(env.ServerIdentity, reply)
+}
+
+// getBlocks returns the blocks from the given index up to the block id, and
+// the bodies of all blocks but the first one.
+func (s *Service) getBlocks(id skipchain.SkipBlockID, index int) ([]*skipchain.SkipBlock, []DataBody, error) {
+	sb := s.db().GetByID(id)
+	if sb == nil {
+		return nil, nil, errors.New("unknown block")
+	}
+	if index < 0 || index > sb.Index {
+		return nil, nil, errors.New("invalid index")
+	}
+	cdb := s.getCollection(sb.SkipChainID())
+	blocks := make([]*skipchain.SkipBlock, sb.Index-index+1)
+	bodies := make([]DataBody, len(blocks)-1)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if sb == nil {
+			return nil, nil, fmt.Errorf("missing block %d", index+i)
+		}
+		blocks[i] = sb
+		if i == 0 {
+			break
+		}
+		body, err := cdb.getBody(sb.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if body == nil {
+			return nil, nil, fmt.Errorf("missing body of block %d", sb.Index)
+		}
+		bodies[i-1] = *body
+		sb = s.db().GetByID(sb.BackLinkIDs[0])
+	}
+	return blocks, bodies, nil
+}
+
+// getSnapshot returns the proofs of at most syncMaxProofs keys in the given
+// chunk of the collection of block id, starting with the key at offset, and
+// whether the chunk holds more keys. Only the chunks downloaded by
+// installSnapshot can be requested.
+func (s *Service) getSnapshot(id skipchain.SkipBlockID, prefix []byte, bits, offset int) ([]collection.Proof, bool, error) {
+	if bits != syncChunkBits || len(prefix)*8 < bits {
+		return nil, false, errors.New("invalid chunk")
+	}
+	if offset < 0 {
+		return nil, false, errors.New("invalid offset")
+	}
+	sb := s.db().GetByID(id)
+	if sb == nil {
+		return nil, false, errors.New("unknown block")
+	}
+	header, err := decodeHeader(sb)
+	if err != nil {
+		return nil, false, err
+	}
+	cdb := s.getCollection(sb.SkipChainID())
+	if err = s.pinSnapshot(cdb, id, header.CollectionRoot); err != nil {
+		return nil, false, err
+	}
+	coll, err := cdb.snapshot(header.CollectionRoot)
+	if err != nil {
+		return nil, false, err
+	}
+	keys, err := coll.Keys(prefix, bits)
+	if err != nil {
+		return nil, false, err
+	}
+	if offset > len(keys) {
+		return nil, false, errors.New("invalid offset")
+	}
+	keys = keys[offset:]
+	more := len(keys) > syncMaxProofs
+	if more {
+		keys = keys[:syncMaxProofs]
+	}
+	proofs := make([]collection.Proof, len(keys))
+	for i, key := range keys {
+		proofs[i], err = coll.Get(key).Proof()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return proofs, more, nil
+}
+
+// pinSnapshot keeps the state of block id, with the given root, in the store
+// until none of its chunks has been requested for snapshotPinTime. So a node
+// can download it even if more than keptRoots blocks are applied meanwhile.
+func (s *Service) pinSnapshot(cdb *collectionDB, id skipchain.SkipBlockID, root []byte) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	if pin, ok := s.snapshots[string(id)]; ok {
+		pin.last = time.Now()
+		pin.timer.Reset(snapshotPinTime)
+		return nil
+	}
+	if err := cdb.pin(root); err != nil {
+		return err
+	}
+	pin := &snapshotPin{last: time.Now()}
+	pin.timer = time.AfterFunc(snapshotPinTime, func() {
+		s.syncMu.Lock()
+		if time.Since(pin.last) < snapshotPinTime {
+			// The timer has been reset meanwhile.
+			s.syncMu.Unlock()
+			return
+		}
+		delete(s.snapshots, string(id))
+		s.syncMu.Unlock()
+		if err := cdb.unpin(root); err != nil {
+			log.Error(s.ServerIdentity(), "couldn't unpin snapshot:", err)
+		}
+	})
+	s.snapshots[string(id)] = pin
+	return nil
+}
+
+func (s *Service) sendSyncReply(si *network.ServerIdentity, reply network.Message) {
+	if err := s.SendRaw(si, reply); err != nil {
+		log.Error(s.ServerIdentity(), "couldn't reply to", si, err)
+	}
+}
+
+// handleSyncReply passes the reply to the request waiting for it.
+func (s *Service) handleSyncReply(env *network.Envelope) {
+	var nonce Nonce
+	switch reply := env.Msg.(type) {
+	case *updateChainReply:
+		nonce = reply.Nonce
+	case *blocksReply:
+		nonce = reply.Nonce
+	case *snapshotReply:
+		nonce = reply.Nonce
+	case *shardGenesisReply:
+		nonce = reply.Nonce
+	default:
+		return
+	}
+	s.syncMu.Lock()
+	waiting, ok := s.syncReplies[nonce]
+	s.syncMu.Unlock()
+	if ok {
+		select {
+		case waiting <- env.Msg:
+		default:
+		}
+	}
+}
+
+// syncRequest sends the request to si and waits for the reply with the same
+// nonce.
+func (s *Service) syncRequest(si *network.ServerIdentity, nonce Nonce, req network.Message) (network.Message, error) {
+	reply := make(chan network.Message, 1)
+	s.syncMu.Lock()
+	s.syncReplies[nonce] = reply
+	s.syncMu.Unlock()
+	defer func() {
+		s.syncMu.Lock()
+		delete(s.syncReplies, nonce)
+		s.syncMu.Unlock()
+	}()
+
+	if err := s.SendRaw(si, req); err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-time.After(syncTimeout):
+		return nil, fmt.Errorf("%s didn't reply in time", si)
+	}
+}
+
+func (s *Service) requestUpdateChain(si *network.ServerIdentity, latest skipchain.SkipBlockID) (*updateChainReply, error) {
+	nonce := GenNonce()
+	msg, err := s.syncRequest(si, nonce, &updateChainRequest{nonce, latest})
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := msg.(*updateChainReply)
+	if !ok {
+		return nil, errors.New("wrong type of reply")
+	}
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return reply, nil
+}
+
+func (s *Service) requestBlocks(si *network.ServerIdentity, id skipchain.SkipBlockID, index int) ([]*skipchain.SkipBlock, []DataBody, error) {
+	nonce := GenNonce()
+	msg, err := s.syncRequest(si, nonce, &blocksRequest{nonce, id, index})
+	if err != nil {
+		return nil, nil, err
+	}
+	reply, ok := msg.(*blocksReply)
+	if !ok {
+		return nil, nil, errors.New("wrong type of reply")
+	}
+	if reply.Error != "" {
+		return nil, nil, errors.New(reply.Error)
+	}
+	return reply.Blocks, reply.Bodies, nil
+}
+
+func (s *Service) requestSnapshot(si *network.ServerIdentity, id skipchain.SkipBlockID, prefix []byte, bits, offset int) ([]collection.Proof, bool, error) {
+	nonce := GenNonce()
+	msg, err := s.syncRequest(si, nonce, &snapshotRequest{nonce, id, prefix, bits, offset})
+	if err != nil {
+		return nil, false, err
+	}
+	reply, ok := msg.(*snapshotReply)
+	if !ok {
+		return nil, false, errors.New("wrong type of reply")
+	}
+	if reply.Error != "" {
+		return nil, false, errors.New(reply.Error)
+	}
+	if reply.More && len(reply.Proofs) == 0 {
+		return nil, false, errors.New("got an empty part of a chunk")
+	}
+	return reply.Proofs, reply.More, nil
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"gopkg.in/dedis/onet.v2/network"
+)
+
+func TestService_SyncSnapshot(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	defer func(bits, proofs int) {
+		syncChunkBits, syncMaxProofs = bits, proofs
+	}(syncChunkBits, syncMaxProofs)
+	syncChunkBits, syncMaxProofs = 2, 1
+
+	id := s.sb.SkipChainID()
+	root := s.services[0].getCollection(id).RootHash()
+
+	// The second node lost its collection and all bodies, like a node
+	// joining the roster.
+	cdb := s.services[1].getCollection(id)
+	require.Nil(t, cdb.reset())
+	removeBodies(t, cdb)
+	_, index := cdb.latestBlock()
+	require.Equal(t, -1, index)
+
+	require.Nil(t, s.services[1].syncState(s.roster, id))
+	require.Equal(t, root, cdb.RootHash())
+	_, index = cdb.latestBlock()
+	require.Equal(t, 1, index)
+	v, _, err := cdb.GetValueContract(s.tx.Instructions[0].ObjectID.Slice())
+	require.Nil(t, err)
+	require.Equal(t, s.value, v)
+
+	// A download that fails doesn't record a block, so it is started
+	// again.
+	latest, err := s.services[1].db().GetLatest(s.services[1].db().GetByID(id))
+	require.Nil(t, err)
+	sb := latest.Copy()
+	header, err := decodeHeader(sb)
+	require.Nil(t, err)
+	header.CollectionRoot = make([]byte, len(root))
+	sb.Data, err = network.Marshal(header)
+	require.Nil(t, err)
+	require.NotNil(t, s.services[1].installSnapshot(s.service().ServerIdentity(), cdb, sb))
+	_, index = cdb.latestBlock()
+	require.Equal(t, -1, index)
+}
+
+func TestService_SnapshotPin(t *testing.T) {
+	defer func(kept int, pinTime time.Duration) {
+		keptRoots, snapshotPinTime = kept, pinTime
+	}(keptRoots, snapshotPinTime)
+	keptRoots, snapshotPinTime = 1, 100*time.Millisecond
+
+	tmpDB, err := ioutil.TempFile("", "tmpDB")
+	require.Nil(t, err)
+	tmpDB.Close()
+	defer os.Remove(tmpDB.Name())
+	db, err := bolt.Open(tmpDB.Name(), 0600, nil)
+	require.Nil(t, err)
+	cdb := newCollectionDB(db, testName)
+	store := func(i int) {
+		require.Nil(t, cdb.Store(&StateChange{
+			StateAction: Create,
+			ObjectID:    []byte(fmt.Sprintf("Key%d", i)),
+			Value:       []byte(fmt.Sprintf("value%d", i)),
+			ContractID:  []byte("myContract"),
+		}))
+	}
+	store(0)
+	root := cdb.RootHash()
+
+	// The state is kept while it is downloaded, even if newer states
+	// are stored.
+	s := &Service{snapshots: make(map[string]*snapshotPin)}
+	require.Nil(t, s.pinSnapshot(cdb, []byte("block"), root))
+	for i := 1; i < 4; i++ {
+		store(i)
+	}
+	_, err = cdb.snapshot(root)
+	require.Nil(t, err)
+
+	// Once nobody downloads it anymore, it is removed.
+	time.Sleep(3 * snapshotPinTime)
+	_, err = cdb.snapshot(root)
+	require.NotNil(t, err)
+}
+
+func TestService_SyncReplay(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	id := s.sb.SkipChainID()
+	root := s.services[0].getCollection(id).RootHash()
+
+	// The second node only applied the genesis block and lost the bodies
+	// of the following ones.
+	genesis := s.services[1].db().GetByID(id)
+	cdb := s.services[1].getCollection(id)
+	body, err := cdb.getBody(genesis.Hash)
+	require.Nil(t, err)
+	require.NotNil(t, body)
+	require.Nil(t, cdb.reset())
+	removeBodies(t, cdb)
+	require.Nil(t, s.services[1].applyBlock(cdb, genesis, body))
+	latest, err := s.services[1].db().GetLatest(genesis)
+	require.Nil(t, err)
+	require.NotNil(t, s.services[1].catchUp(cdb, latest, nil))
+
+	require.Nil(t, s.services[1].syncState(s.roster, id))
+	require.Equal(t, root, cdb.RootHash())
+	_, index := cdb.latestBlock()
+	require.Equal(t, 1, index)
+	body, err = cdb.getBody(latest.Hash)
+	require.Nil(t, err)
+	require.NotNil(t, body)
+}
+
+func TestService_SyncVerify(t *testing.T) {
+	s := newSer(t, 2, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	id := s.sb.SkipChainID()
+	latest, err := s.service().db().GetLatest(s.service().db().GetByID(id))
+	require.Nil(t, err)
+	blocks, bodies, err := s.service().getBlocks(latest.Hash, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(blocks))
+	require.Nil(t, verifyBlocks(latest, id, 0, blocks, bodies))
+	_, err = verifyUpdateChain(id, blocks)
+	require.Nil(t, err)
+
+	// The update chain must start at the trusted block.
+	_, err = verifyUpdateChain(latest.Hash, blocks)
+	require.NotNil(t, err)
+
+	// A body that doesn't correspond to its block is refused.
+	require.NotNil(t, verifyBlocks(latest, id, 0, blocks,
+		[]DataBody{{Transactions: ClientTransactions{s.tx, s.tx}}}))
+
+	// Blocks that are not linked are refused.
+	require.NotNil(t, verifyBlocks(latest, id, 0,
+		[]*skipchain.SkipBlock{blocks[0], blocks[0]}, bodies))
+
+	// Only the chunks of a snapshot can be requested.
+	_, _, err = s.service().getSnapshot(latest.Hash, []byte{0}, syncChunkBits, 0)
+	require.Nil(t, err)
+	_, _, err = s.service().getSnapshot(latest.Hash, []byte{0}, 0, 0)
+	require.NotNil(t, err)
+	_, _, err = s.service().getSnapshot(latest.Hash, nil, syncChunkBits, 0)
+	require.NotNil(t, err)
+	_, _, err = s.service().getSnapshot(latest.Hash, []byte{0}, syncChunkBits, -1)
+	require.NotNil(t, err)
+
+	// A node asked for the update chain of an unknown block replies with an
+	// error.
+	_, err = s.services[1].requestUpdateChain(s.service().ServerIdentity(), skipchain.SkipBlockID("unknown"))
+	require.NotNil(t, err)
+}
+
+// removeBodies deletes all bodies stored in the collectionDB.
+func removeBodies(t *testing.T, cdb *collectionDB) {
+	require.Nil(t, cdb.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(cdb.bodiesBucket()); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(cdb.bodiesBucket())
+		return err
+	}))
+}
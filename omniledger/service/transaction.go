@@ -48,6 +48,20 @@ type Instruction struct {
 	Delete *Delete
 	// Signatures that can be verified using the darc defined by the objectID.
 	Signatures []darc.Signature
+	// Coins are taken from accounts before the contract is called and handed
+	// to it together with the coins left over by the previous instructions.
+	Coins []CoinInput
+}
+
+// CoinInput takes coins from an account object for an instruction.
+type CoinInput struct {
+	// Account is the object holding the coins.
+	Account ObjectID
+	// Coin is the type and the number of coins taken from the account.
+	Coin Coin
+	// Signatures that can be verified using the darc of the account, for the
+	// action "Invoke_fetch".
+	Signatures []darc.Signature
 }
 
 // ObjectID points to an object that holds the state of a contract.
@@ -64,6 +78,22 @@ func (oid ObjectID) Slice() []byte {
 	return append(oid.DarcID[:], oid.InstanceID[:]...)
 }
 
+// NewObjectIDFromSlice is the inverse of ObjectID.Slice.
+func NewObjectIDFromSlice(buf []byte) (ObjectID, error) {
+	var oid ObjectID
+	if len(buf) != 64 {
+		return oid, errors.New("object ID has a invalid length")
+	}
+	oid.DarcID = darc.ID(append([]byte{}, buf[:32]...))
+	copy(oid.InstanceID[:], buf[32:])
+	return oid, nil
+}
+
+// Equal returns true if both ObjectIDs point to the same object.
+func (oid ObjectID) Equal(other ObjectID) bool {
+	return oid.DarcID.Equal(other.DarcID) && oid.InstanceID == other.InstanceID
+}
+
 // Nonce is used to prevent replay attacks in instructions.
 type Nonce [32]byte
 
@@ -100,16 +130,46 @@ type Argument struct {
 type Arguments []Argument
 
 // Search returns the value of a given argument. If it is not found, nil
-// is returned.
-// TODO: An argument with nil value cannot be distinguished from
-// a missing argument!
+// is returned. Use Lookup to distinguish an empty argument from a missing
+// one.
 func (args Arguments) Search(name string) []byte {
+	value, _ := args.Lookup(name)
+	return value
+}
+
+// Lookup returns the value of a given argument and whether it is given.
+func (args Arguments) Lookup(name string) ([]byte, bool) {
 	for _, arg := range args {
 		if arg.Name == name {
-			return arg.Value
+			return arg.Value, true
 		}
 	}
-	return nil
+	return nil, false
+}
+
+// Uint64 returns the value of an argument of type ArgUint64.
+func (args Arguments) Uint64(name string) (uint64, error) {
+	value, ok := args.Lookup(name)
+	if !ok {
+		return 0, fmt.Errorf("missing argument %q", name)
+	}
+	if err := ArgUint64.verify(value); err != nil {
+		return 0, fmt.Errorf("argument %q: %s", name, err)
+	}
+	return binary.LittleEndian.Uint64(value), nil
+}
+
+// Varint returns the value of an argument of type ArgVarint.
+func (args Arguments) Varint(name string) (int64, error) {
+	value, ok := args.Lookup(name)
+	if !ok {
+		return 0, fmt.Errorf("missing argument %q", name)
+	}
+	if err := ArgVarint.verify(value); err != nil {
+		return 0, fmt.Errorf("argument %q: %s", name, err)
+	}
+	i, _ := binary.Varint(value)
+	return i, nil
 }
 
 // Hash computes the digest of the hash function
@@ -139,6 +199,15 @@ func (instr Instruction) Hash() []byte {
 		h.Write([]byte(a.Name))
 		h.Write(a.Value)
 	}
+	b = make([]byte, 8)
+	for _, in := range instr.Coins {
+		h.Write(in.Account.DarcID)
+		h.Write(in.Account.InstanceID[:])
+		h.Write(in.Coin.Name.DarcID)
+		h.Write(in.Coin.Name.InstanceID[:])
+		binary.LittleEndian.PutUint64(b, in.Coin.Value)
+		h.Write(b)
+	}
 	return h.Sum(nil)
 }
 
@@ -199,46 +268,96 @@ func (instr Instruction) String() string {
 
 // SignBy gets signers to sign the (receiver) transaction.
 func (instr *Instruction) SignBy(signers ...*darc.Signer) error {
-	// Create the request and populate it with the right identities.  We
-	// need to do this prior to signing because identities are a part of
-	// the digest.
 	req, err := instr.ToDarcRequest()
 	if err != nil {
 		return err
 	}
+	instr.Signatures, err = signRequest(req, signers)
+	return err
+}
+
+// SignCoinInput gets signers to sign the i-th coin input of the (receiver)
+// transaction. As the signature covers the whole instruction, it must be
+// called once all coin inputs have been added.
+func (instr *Instruction) SignCoinInput(i int, signers ...*darc.Signer) error {
+	if i < 0 || i >= len(instr.Coins) {
+		return errors.New("no such coin input")
+	}
+	req, err := instr.CoinInputRequest(i)
+	if err != nil {
+		return err
+	}
+	instr.Coins[i].Signatures, err = signRequest(req, signers)
+	return err
+}
+
+// signRequest populates the request with the identities of the signers and
+// returns their signatures on it.
+func signRequest(req *darc.Request, signers []*darc.Signer) ([]darc.Signature, error) {
+	// We need to set the identities prior to signing because they are a
+	// part of the digest.
 	req.Identities = make([]*darc.Identity, len(signers))
 	for i := range signers {
 		req.Identities[i] = signers[i].Identity()
 	}
 
-	// Sign the instruction and write the signatures to it.
 	digest := req.Hash()
-	instr.Signatures = make([]darc.Signature, len(signers))
+	sigs := make([]darc.Signature, len(signers))
 	for i := range signers {
 		sig, err := signers[i].Sign(digest)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		instr.Signatures[i] = darc.Signature{
+		sigs[i] = darc.Signature{
 			Signature: sig,
 			Signer:    *signers[i].Identity(),
 		}
 	}
-	return nil
+	return sigs, nil
 }
 
 // ToDarcRequest converts the Instruction content into a darc.Request.
 func (instr Instruction) ToDarcRequest() (*darc.Request, error) {
-	baseID := instr.ObjectID.DarcID
-	action := instr.Action()
-	ids := make([]*darc.Identity, len(instr.Signatures))
-	sigs := make([][]byte, len(instr.Signatures))
-	for i, sig := range instr.Signatures {
-		ids[i] = &sig.Signer
+	return newDarcRequest(instr.ObjectID.DarcID, instr.Action(), instr.Hash(), instr.Signatures), nil
+}
+
+// VerifiedSigners returns the identities whose signatures on the instruction
+// are valid. The signatures of identities that cannot be verified, or that
+// don't verify, are skipped.
+func (instr Instruction) VerifiedSigners() []darc.Identity {
+	req, err := instr.ToDarcRequest()
+	if err != nil {
+		return nil
+	}
+	digest := req.Hash()
+	var ids []darc.Identity
+	for _, sig := range instr.Signatures {
+		if sig.Signer.Verify(digest, sig.Signature) == nil {
+			ids = append(ids, sig.Signer)
+		}
+	}
+	return ids
+}
+
+// CoinInputRequest returns the darc.Request that allows the i-th coin input
+// to take coins from its account.
+func (instr Instruction) CoinInputRequest(i int) (*darc.Request, error) {
+	if i < 0 || i >= len(instr.Coins) {
+		return nil, errors.New("no such coin input")
+	}
+	in := instr.Coins[i]
+	return newDarcRequest(in.Account.DarcID, "Invoke_"+CmdCoinFetch, instr.Hash(), in.Signatures), nil
+}
+
+func newDarcRequest(baseID darc.ID, action string, msg []byte, signatures []darc.Signature) *darc.Request {
+	ids := make([]*darc.Identity, len(signatures))
+	sigs := make([][]byte, len(signatures))
+	for i, sig := range signatures {
+		ids[i] = &signatures[i].Signer
 		sigs[i] = sig.Signature // TODO shallow copy is ok?
 	}
-	req := darc.InitRequest(baseID, darc.Action(action), instr.Hash(), ids, sigs)
-	return &req, nil
+	req := darc.InitRequest(baseID, darc.Action(action), msg, ids, sigs)
+	return &req
 }
 
 // Instructions is a slice of Instruction
@@ -257,6 +376,14 @@ func (instrs Instructions) Hash() []byte {
 // If any of the instructions fails, none of them will be applied.
 type ClientTransaction struct {
 	Instructions Instructions
+	// Atomix is set if the ClientTransaction is a step of a cross-shard
+	// transaction.
+	Atomix *AtomixStep
+}
+
+// Hash returns the sha256 hash of the client transaction.
+func (ct ClientTransaction) Hash() []byte {
+	return ClientTransactions{ct}.Hash()
 }
 
 // ClientTransactions is a slice of ClientTransaction
@@ -267,6 +394,9 @@ func (cts ClientTransactions) Hash() []byte {
 	h := sha256.New()
 	for _, ct := range cts {
 		h.Write(ct.Instructions.Hash())
+		if ct.Atomix != nil {
+			h.Write(ct.Atomix.Hash())
+		}
 	}
 	return h.Sum(nil)
 }
@@ -113,6 +113,12 @@ func TestTransaction_Signing(t *testing.T) {
 	req, err := instr.ToDarcRequest()
 	require.Nil(t, err)
 	require.Nil(t, req.Verify(d))
+
+	signers := instr.VerifiedSigners()
+	require.Equal(t, 1, len(signers))
+	require.True(t, signers[0].Equal(signer.Identity()))
+	instr.Signatures[0].Signature[0] ^= 1
+	require.Equal(t, 0, len(instr.VerifiedSigners()))
 }
 
 func createOneClientTx(dID darc.ID, kind string, value []byte, signer *darc.Signer) (ClientTransaction, error) {
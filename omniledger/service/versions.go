@@ -0,0 +1,163 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/protobuf"
+	"student_18_byzcoin/omniledger/collection"
+)
+
+// Contracts are registered with a version, and a node can run several
+// versions of the same contract. Which version is run is decided by the
+// config of the skipchain, and not by the nodes:
+//   1. without upgrade, the version enabled by Config.Contracts is run, or
+//   DefaultContractVersion if the skipchain has no whitelist
+//   2. the "upgrade" command of the config records that a new version is
+//   active from a later block on. It is allowed by the rule "Invoke_upgrade"
+//   of the genesis darc
+//   3. a block runs the version active at its index, according to the config
+//   before the block
+// So an upgrade is coordinated by deploying the new version on all nodes and
+// scheduling it, and a replayed block runs the version it ran the first
+// time.
+
+// ContractUpgrade records that a version of a contract is active from a block
+// on.
+type ContractUpgrade struct {
+	// ContractID is the ID of the upgraded contract.
+	ContractID string
+	// Version is the version run from the block on.
+	Version int
+	// Index is the index of the first block running the version.
+	Index int
+}
+
+// contractVersion returns the version of the contract that is active at the
+// block with the given index, or 0 if the contract is not enabled.
+func (c *Config) contractVersion(contractID string, index int) int {
+	version := c.Contracts.version(contractID)
+	if version == 0 {
+		return 0
+	}
+	from := -1
+	for _, u := range c.Upgrades {
+		if u.ContractID == contractID && u.Index <= index && u.Index >= from {
+			version, from = u.Version, u.Index
+		}
+	}
+	return version
+}
+
+// pendingUpgrades returns the upgrades that are not active at the block with
+// the given index.
+func pendingUpgrades(upgrades []ContractUpgrade, index int) []ContractUpgrade {
+	var pending []ContractUpgrade
+	for _, u := range upgrades {
+		if u.Index > index {
+			pending = append(pending, u)
+		}
+	}
+	return pending
+}
+
+// registerContractVersion stores a version of a contract. Registering the
+// same version again replaces it.
+func (s *Service) registerContractVersion(contractID string, version int, c ContractWithContext) error {
+	if version <= 0 {
+		return fmt.Errorf("invalid version %d of contract %s", version, contractID)
+	}
+	if s.contracts[contractID] == nil {
+		s.contracts[contractID] = make(map[int]ContractWithContext)
+	}
+	s.contracts[contractID][version] = c
+	return nil
+}
+
+// hasContract returns whether the contract is registered with the version.
+func (s *Service) hasContract(contractID string, version int) bool {
+	_, ok := s.contracts[contractID][version]
+	return ok
+}
+
+// activeContract returns the version of the contract that is active at the
+// block with the given index, and its number. It returns an error if the contract is not
+// enabled by the config, or if this node doesn't have the active version. A
+// nil config, before the genesis block is applied, enables
+// DefaultContractVersion of all contracts.
+func (s *Service) activeContract(config *Config, contractID string, index int) (ContractWithContext, int, error) {
+	version := DefaultContractVersion
+	if config != nil {
+		version = config.contractVersion(contractID, index)
+	}
+	if version == 0 {
+		return nil, 0, errors.New("contract is not enabled: " + contractID)
+	}
+	f, ok := s.contracts[contractID][version]
+	if !ok {
+		return nil, 0, fmt.Errorf("contract %s has no version %d", contractID, version)
+	}
+	return f, version, nil
+}
+
+// contractConfig is the config contract as it is registered. The commands that
+// depend on the block they are executed in get the Context, the others are
+// handled by ContractConfig.
+func (s *Service) contractConfig(ctx Context, cdb collection.Collection, tx Instruction, coins []Coin) ([]StateChange, []Coin, error) {
+	if tx.Invoke != nil {
+		switch tx.Invoke.Command {
+		case CmdConfigContracts:
+			return s.contractConfigContracts(ctx, cdb, tx, coins)
+		case CmdConfigUpgrade:
+			return s.contractConfigUpgrade(ctx, cdb, tx, coins)
+		case CmdConfigEpoch:
+			return s.contractConfigEpoch(ctx, cdb, tx, coins)
+		}
+	}
+	return s.ContractConfig(cdb, tx, coins)
+}
+
+// contractConfigUpgrade schedules the version of the "version" argument of the
+// contract of the "contract" argument, starting at the block of the "index"
+// argument. The block must come after the current
+// one, and the contract must be enabled. The nodes don't need to have the
+// version yet, only once it is active.
+func (s *Service) contractConfigUpgrade(ctx Context, cdb collection.Collection, tx Instruction, coins []Coin) ([]StateChange, []Coin, error) {
+	if tx.ObjectID.InstanceID != OneNonce {
+		return nil, nil, errors.New("upgrades are recorded in the config")
+	}
+	config, err := loadConfig(cdb)
+	if err != nil {
+		return nil, nil, err
+	}
+	version, err := tx.Invoke.Args.Varint("version")
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := tx.Invoke.Args.Varint("index")
+	if err != nil {
+		return nil, nil, err
+	}
+	u := ContractUpgrade{
+		ContractID: string(tx.Invoke.Args.Search("contract")),
+		Version:    int(version),
+		Index:      int(index),
+	}
+	if u.Version <= 0 {
+		return nil, nil, fmt.Errorf("invalid version %d", u.Version)
+	}
+	if u.Index <= ctx.Index {
+		return nil, nil, fmt.Errorf("upgrade must start after block %d", ctx.Index)
+	}
+	if u.ContractID == ContractConfigID || config.Contracts.version(u.ContractID) == 0 {
+		return nil, nil, errors.New("contract cannot be upgraded: " + u.ContractID)
+	}
+	config.Upgrades = append(config.Upgrades, u)
+	configBuf, err := protobuf.Encode(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []StateChange{
+		NewStateChange(Update, tx.ObjectID, ContractConfigID, configBuf),
+	}, coins, nil
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v2"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+// versionKind is a contract whose versions store their version.
+var versionKind = "version"
+
+func contractVersion(version string) ContractWithContext {
+	return func(ctx Context, cdb collection.Collection, tx Instruction, c []Coin) ([]StateChange, []Coin, error) {
+		return []StateChange{NewStateChange(Create, tx.ObjectID, versionKind, []byte(version))}, c, nil
+	}
+}
+
+func TestService_ContractUpgrade(t *testing.T) {
+	signer := darc.NewSignerEd25519(nil, nil)
+	genesisMsg, err := DefaultGenesisMsg(CurrentVersion, &onet.Roster{},
+		[]string{"Spawn_" + versionKind, "Invoke_" + CmdConfigUpgrade}, signer.Identity())
+	require.Nil(t, err)
+	e, err := NewExecutor(genesisMsg)
+	require.Nil(t, err)
+	require.Nil(t, e.RegisterContractWithContext(versionKind, contractVersion("v1")))
+	require.Nil(t, e.RegisterContractVersion(versionKind, 2, contractVersion("v2")))
+	require.NotNil(t, e.RegisterContractVersion(versionKind, 0, contractVersion("v0")))
+	dID := genesisMsg.GenesisDarc.GetBaseID()
+
+	apply := func(instr Instruction) string {
+		require.Nil(t, instr.SignBy(signer))
+		receipts, err := e.Apply(ClientTransaction{Instructions: []Instruction{instr}})
+		require.Nil(t, err)
+		return receipts[0].Error
+	}
+	// spawn returns the version that ran, or the error.
+	spawn := func() string {
+		oid := ObjectID{DarcID: dID, InstanceID: GenNonce()}
+		if err := apply(Instruction{ObjectID: oid, Spawn: &Spawn{ContractID: versionKind}}); err != "" {
+			return err
+		}
+		value, _, err := e.Get(oid.Slice())
+		require.Nil(t, err)
+		return string(value)
+	}
+	upgrade := func(contractID string, version, index int) string {
+		varint := func(i int) []byte {
+			buf := make([]byte, binary.MaxVarintLen64)
+			return buf[:binary.PutVarint(buf, int64(i))]
+		}
+		return apply(Instruction{
+			ObjectID: ObjectID{DarcID: dID, InstanceID: OneNonce},
+			Nonce:    GenNonce(),
+			Invoke: &Invoke{
+				Command: CmdConfigUpgrade,
+				Args: Arguments{
+					{Name: "contract", Value: []byte(contractID)},
+					{Name: "version", Value: varint(version)},
+					{Name: "index", Value: varint(index)},
+				},
+			},
+		})
+	}
+
+	require.Equal(t, "v1", spawn())
+	// Version 2 is active from the second block after the upgrade on.
+	require.Equal(t, "", upgrade(versionKind, 2, e.Index()+3))
+	require.Equal(t, "v1", spawn())
+	require.Equal(t, "v2", spawn())
+	require.Equal(t, "v2", spawn())
+
+	require.NotEqual(t, "", upgrade(versionKind, 3, e.Index()))
+	require.NotEqual(t, "", upgrade(versionKind, 0, e.Index()+2))
+	require.NotEqual(t, "", upgrade(ContractConfigID, 2, e.Index()+2))
+
+	// A version that the node doesn't have cannot be run.
+	require.Equal(t, "", upgrade(versionKind, 3, e.Index()+2))
+	require.Contains(t, spawn(), "has no version 3")
+}
+
+func TestConfig_ContractVersion(t *testing.T) {
+	config := &Config{Upgrades: []ContractUpgrade{
+		{ContractID: "a", Version: 3, Index: 10},
+		{ContractID: "a", Version: 2, Index: 5},
+		{ContractID: "b", Version: 4, Index: 5},
+	}}
+	require.Equal(t, 1, config.contractVersion("a", 4))
+	require.Equal(t, 2, config.contractVersion("a", 5))
+	require.Equal(t, 3, config.contractVersion("a", 10))
+	require.Equal(t, 1, config.contractVersion("c", 10))
+
+	config.Contracts = &ContractWhitelist{Contracts: []EnabledContract{{ID: "a", Version: 5}}}
+	require.Equal(t, 5, config.contractVersion("a", 4))
+	require.Equal(t, 3, config.contractVersion("a", 10))
+	require.Equal(t, 0, config.contractVersion("b", 10))
+	require.Equal(t, []ContractUpgrade{{ContractID: "a", Version: 3, Index: 10}},
+		pendingUpgrades(config.Upgrades, 5))
+}
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"gopkg.in/dedis/cothority.v2/skipchain"
+	"student_18_byzcoin/omniledger/collection"
+	"student_18_byzcoin/omniledger/darc"
+)
+
+// A view is a read-only method of a contract. It is called through CallView
+// without creating a block:
+//   1. the node runs the view on the latest state of its collection, and
+//   records every key the view reads
+//   2. the result is returned together with the proofs of these keys, all
+//   from the same block
+//   3. the client verifies the proofs and runs the view again on the proven
+//   values, so it doesn't need to trust the node
+
+// ViewCoinBalance returns the balance of the "account" argument, in coins of
+// the "coin" argument, as a little-endian uint64.
+var ViewCoinBalance = "balance"
+
+// ViewDarcRules returns the expression of the "action" argument in the darc
+// given by the "darc" argument.
+var ViewDarcRules = "rules"
+
+// ContractView is the type signature of view methods. The result must only
+// depend on the arguments and on what is read through the ViewReader.
+type ContractView func(r *ViewReader, args Arguments) ([]byte, error)
+
+// ViewReader gives a view read access to the state and records the keys it
+// reads.
+type ViewReader struct {
+	get  func(key []byte) (value []byte, contractID string, err error)
+	keys [][]byte
+}
+
+// Get returns the value and the contract stored under the key. If nothing is
+// stored under the key, value is nil and contractID is empty.
+func (r *ViewReader) Get(key []byte) (value []byte, contractID string, err error) {
+	found := false
+	for _, k := range r.keys {
+		if bytes.Equal(k, key) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		r.keys = append(r.keys, append([]byte{}, key...))
+	}
+	return r.get(key)
+}
+
+// newCollectionReader reads from the collection.
+func newCollectionReader(coll collection.Collection) *ViewReader {
+	return &ViewReader{get: func(key []byte) ([]byte, string, error) {
+		rec, err := coll.Get(key).Record()
+		if err != nil {
+			return nil, "", err
+		}
+		if !rec.Match() {
+			return nil, "", nil
+		}
+		value, contract, err := getValueContract(coll, key)
+		return value, string(contract), err
+	}}
+}
+
+// newProofReader reads from the proofs, which must have been verified. Reading
+// a key without a proof is an error.
+func newProofReader(proofs []Proof) *ViewReader {
+	return &ViewReader{get: func(key []byte) ([]byte, string, error) {
+		for _, p := range proofs {
+			if !bytes.Equal(p.InclusionProof.Key, key) {
+				continue
+			}
+			if !p.InclusionProof.Match() {
+				return nil, "", nil
+			}
+			_, values, err := p.KeyValue()
+			if err != nil {
+				return nil, "", err
+			}
+			if len(values) < 2 {
+				return nil, "", errors.New("proof holds no value")
+			}
+			return values[0], string(values[1]), nil
+		}
+		return nil, "", fmt.Errorf("no proof for key %x", key)
+	}}
+}
+
+// RegisterView stores the view method of a contract, so it can be called with
+// CallView.
+func RegisterView(s skipchain.GetService, contractID, method string, f ContractView) error {
+	scs := s.Service(ServiceName)
+	if scs == nil {
+		return errors.New("Didn't find our service: " + ServiceName)
+	}
+	return scs.(*Service).registerView(contractID, method, f)
+}
+
+func (s *Service) registerView(contractID, method string, f ContractView) error {
+	if s.views[contractID] == nil {
+		s.views[contractID] = make(map[string]ContractView)
+	}
+	s.views[contractID][method] = f
+	return nil
+}
+
+// CallView runs a view method on the latest state of the collection and
+// returns its result with the proofs of all keys it read.
+func (s *Service) CallView(req *CallView) (*CallViewResponse, error) {
+	if req.Version != CurrentVersion {
+		return nil, errors.New("version mismatch")
+	}
+	if s.db().GetByID(req.ID) == nil {
+		return nil, errors.New("unknown skipchain")
+	}
+	f, ok := s.views[req.ContractID][req.Method]
+	if !ok {
+		return nil, fmt.Errorf("contract %s has no view %s", req.ContractID, req.Method)
+	}
+	// All keys are read and proven from the same view.
+	coll, _, index, err := s.getCollection(req.ID).view()
+	if err != nil {
+		return nil, err
+	}
+	r := newCollectionReader(coll)
+	result, err := f(r, req.Args)
+	if err != nil {
+		return nil, err
+	}
+	resp := &CallViewResponse{Version: CurrentVersion, Result: result}
+	for _, key := range r.keys {
+		p, err := newProof(coll, index, s.db(), req.ID, key)
+		if err != nil {
+			return nil, err
+		}
+		resp.Proofs = append(resp.Proofs, *p)
+	}
+	return resp, nil
+}
+
+// Verify checks that the result of the view has been computed from the state
+// of the skipchain: the proofs must be valid and come from the same block, and
+// running the view on the proven values must give the same result.
+func (resp CallViewResponse) Verify(id skipchain.SkipBlockID, f ContractView, args Arguments) error {
+	for i, p := range resp.Proofs {
+		if err := p.Verify(id); err != nil {
+			return err
+		}
+		if !p.Latest.Hash.Equal(resp.Proofs[0].Latest.Hash) {
+			return fmt.Errorf("proof %d comes from another block", i)
+		}
+	}
+	result, err := f(newProofReader(resp.Proofs), args)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(result, resp.Result) {
+		return errors.New("result doesn't correspond to the proofs")
+	}
+	return nil
+}
+
+// viewCoinBalance implements ViewCoinBalance.
+func viewCoinBalance(r *ViewReader, args Arguments) ([]byte, error) {
+	account, err := NewObjectIDFromSlice(args.Search("account"))
+	if err != nil {
+		return nil, err
+	}
+	coin, err := NewObjectIDFromSlice(args.Search("coin"))
+	if err != nil {
+		return nil, err
+	}
+	value, contract, err := r.Get(account.Slice())
+	if err != nil {
+		return nil, err
+	}
+	balance := uint64(0)
+	if value != nil {
+		ca, err := decodeCoinAccount(value, []byte(contract))
+		if err != nil {
+			return nil, err
+		}
+		balance = ca.Balance(coin)
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, balance)
+	return buf, nil
+}
+
+// viewDarcRules implements ViewDarcRules.
+func viewDarcRules(r *ViewReader, args Arguments) ([]byte, error) {
+	value, contract, err := r.Get(toObjectID(darc.ID(args.Search("darc"))).Slice())
+	if err != nil {
+		return nil, err
+	}
+	if contract != ContractDarcID {
+		return nil, errors.New("no such darc")
+	}
+	d, err := darc.NewDarcFromProto(value)
+	if err != nil {
+		return nil, err
+	}
+	action := darc.Action(args.Search("action"))
+	if !d.Rules.Contains(action) {
+		return nil, fmt.Errorf("darc has no rule for %s", action)
+	}
+	return []byte(d.Rules[action]), nil
+}
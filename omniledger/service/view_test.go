@@ -0,0 +1,99 @@
+package service
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/dedis/protobuf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestViewCoinBalance(t *testing.T) {
+	s := newSer(t, 0, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+
+	coinType := ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}
+	account := ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}
+	coll := newConfigColl(t, s, nil)
+	ca := CoinAccount{Coins: []Coin{{Name: coinType, Value: 100}}}
+	buf, err := protobuf.Encode(&ca)
+	require.Nil(t, err)
+	require.Nil(t, coll.Add(account.Slice(), buf, []byte(ContractCoinID)))
+
+	balance := func(account ObjectID) uint64 {
+		r := newCollectionReader(coll)
+		result, err := viewCoinBalance(r, Arguments{
+			{Name: "account", Value: account.Slice()},
+			{Name: "coin", Value: coinType.Slice()},
+		})
+		require.Nil(t, err)
+		require.Equal(t, [][]byte{account.Slice()}, r.keys)
+		return binary.LittleEndian.Uint64(result)
+	}
+	require.Equal(t, uint64(100), balance(account))
+	require.Equal(t, uint64(0), balance(ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}))
+
+	// Only coin accounts have a balance.
+	_, err = viewCoinBalance(newCollectionReader(coll), Arguments{
+		{Name: "account", Value: toObjectID(s.darc.GetBaseID()).Slice()},
+		{Name: "coin", Value: coinType.Slice()},
+	})
+	require.NotNil(t, err)
+}
+
+func TestService_CallView(t *testing.T) {
+	s := newSer(t, 1, testInterval)
+	defer s.local.CloseAll()
+	defer closeQueues(s.local)
+	id := s.sb.SkipChainID()
+
+	args := Arguments{
+		{Name: "darc", Value: s.darc.GetBaseID()},
+		{Name: "action", Value: []byte("Spawn_dummy")},
+	}
+	resp, err := s.service().CallView(&CallView{
+		Version:    CurrentVersion,
+		ID:         id,
+		ContractID: ContractDarcID,
+		Method:     ViewDarcRules,
+		Args:       args,
+	})
+	require.Nil(t, err)
+	require.Equal(t, []byte(s.darc.Rules.GetSignExpr()), resp.Result)
+	require.Equal(t, 1, len(resp.Proofs))
+	require.Nil(t, resp.Verify(id, viewDarcRules, args))
+
+	// The result must correspond to the proofs.
+	wrong := *resp
+	wrong.Result = []byte("wrong")
+	require.NotNil(t, wrong.Verify(id, viewDarcRules, args))
+	wrong = *resp
+	wrong.Proofs = nil
+	require.NotNil(t, wrong.Verify(id, viewDarcRules, args))
+
+	// The absence of an account is proven, too.
+	args = Arguments{
+		{Name: "account", Value: ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}.Slice()},
+		{Name: "coin", Value: ObjectID{DarcID: s.darc.GetBaseID(), InstanceID: GenNonce()}.Slice()},
+	}
+	resp, err = s.service().CallView(&CallView{
+		Version:    CurrentVersion,
+		ID:         id,
+		ContractID: ContractCoinID,
+		Method:     ViewCoinBalance,
+		Args:       args,
+	})
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), binary.LittleEndian.Uint64(resp.Result))
+	require.False(t, resp.Proofs[0].InclusionProof.Match())
+	require.Nil(t, resp.Verify(id, viewCoinBalance, args))
+
+	_, err = s.service().CallView(&CallView{
+		Version:    CurrentVersion,
+		ID:         id,
+		ContractID: ContractCoinID,
+		Method:     "unknown",
+	})
+	require.NotNil(t, err)
+}